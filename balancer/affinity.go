@@ -0,0 +1,166 @@
+package balancer
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/proxy"
+)
+
+// Affinity is the mode to keep the flows with the same key on the
+// same proxy.
+type Affinity uint8
+
+const (
+	AffinityNone Affinity = iota
+	AffinitySource
+	AffinityDestination
+	AffinitySourceDestination
+)
+
+func (a Affinity) String() string {
+	switch a {
+	case AffinityNone:
+		return "none"
+	case AffinitySource:
+		return "source"
+	case AffinityDestination:
+		return "destination"
+	case AffinitySourceDestination:
+		return "source-destination"
+	default:
+		return fmt.Sprintf("Affinity(%d)", a)
+	}
+}
+
+// ParseAffinity parses Affinity from its string form, where empty
+// string means AffinityNone.
+func ParseAffinity(s string) (Affinity, error) {
+	for _, a := range []Affinity{AffinityNone, AffinitySource, AffinityDestination, AffinitySourceDestination} {
+		if s == a.String() {
+			return a, nil
+		}
+	}
+	if s == "" {
+		return AffinityNone, nil
+	}
+	return AffinityNone, fmt.Errorf("unsupported affinity: %s", s)
+}
+
+// key returns the affinity key of metadata. The destination is the
+// hostname if known, so that flows to the same site stick together
+// even if it resolves to different IPs.
+func (a Affinity) key(metadata *M.Metadata) string {
+	dst := metadata.Host
+	if dst == "" {
+		dst = metadata.DstIP.String()
+	}
+	switch a {
+	case AffinitySource:
+		return metadata.SrcIP.String()
+	case AffinityDestination:
+		return dst
+	case AffinitySourceDestination:
+		return metadata.SrcIP.String() + "|" + dst
+	default:
+		return ""
+	}
+}
+
+// Namer is implemented by proxies with a name, which is used as their
+// identity in consistent hashing instead of the address.
+type Namer interface {
+	Name() string
+}
+
+func identityOf(p proxy.Proxy) string {
+	if n, ok := p.(Namer); ok {
+		return n.Name()
+	}
+	return p.Proto().String() + "://" + p.Addr()
+}
+
+// consistentPick picks from candidates by weighted rendezvous hashing
+// of key, so that removing a candidate only remaps the keys that were
+// on it.
+func consistentPick(candidates []proxy.Proxy, key string) proxy.Proxy {
+	var (
+		best  proxy.Proxy
+		score float64
+	)
+	for _, p := range candidates {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(identityOf(p)))
+
+		// Map the hash to (0, 1), then weight it as in
+		// "Weighted Distributed Hash Tables" (Schindelhauer et al.).
+		u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+		s := float64(weightOf(p)) / -math.Log(u)
+		if best == nil || s > score {
+			best, score = p, s
+		}
+	}
+	return best
+}
+
+// stickyTable remembers the proxy picked for each affinity key until
+// it has been idle for ttl.
+type stickyTable struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	entries   map[string]*stickyEntry
+	lastSweep time.Time
+}
+
+type stickyEntry struct {
+	proxy  proxy.Proxy
+	expire time.Time
+}
+
+func newStickyTable(ttl time.Duration) *stickyTable {
+	return &stickyTable{
+		ttl:     ttl,
+		entries: make(map[string]*stickyEntry),
+	}
+}
+
+// pick returns the proxy remembered for key if it is still one of
+// candidates, or picks a new one by pick and remembers it.
+func (t *stickyTable) pick(candidates []proxy.Proxy, key string, pick func() proxy.Proxy) proxy.Proxy {
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if e, ok := t.entries[key]; ok && now.Before(e.expire) && slices.Contains(candidates, e.proxy) {
+		e.expire = now.Add(t.ttl)
+		return e.proxy
+	}
+
+	p := pick()
+	t.entries[key] = &stickyEntry{proxy: p, expire: now.Add(t.ttl)}
+
+	if now.Sub(t.lastSweep) > t.ttl {
+		for k, e := range t.entries {
+			if !now.Before(e.expire) {
+				delete(t.entries, k)
+			}
+		}
+		t.lastSweep = now
+	}
+	return p
+}
+
+func (t *stickyTable) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.entries)
+}
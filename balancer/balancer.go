@@ -0,0 +1,80 @@
+// Package balancer provides proxy groups which balance flows across
+// their member proxies with pluggable strategies.
+package balancer
+
+import (
+	"fmt"
+	"time"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/proxy"
+)
+
+// Names of the built-in strategies.
+const (
+	RoundRobin         = "round-robin"
+	WeightedRoundRobin = "weighted-round-robin"
+	LeastActive        = "least-active"
+	Random             = "random"
+	LowestLatency      = "lowest-latency"
+	Failover           = "failover"
+)
+
+// Strategy picks a proxy from the non-empty candidates for the flow
+// described by metadata.
+type Strategy interface {
+	Name() string
+	Pick(candidates []proxy.Proxy, metadata *M.Metadata) proxy.Proxy
+}
+
+// Weighter is implemented by proxies with a configured weight, which
+// defaults to 1 otherwise.
+type Weighter interface {
+	Weight() int
+}
+
+// ActiveCounter is implemented by proxies which count their active
+// connections.
+type ActiveCounter interface {
+	Active() int64
+}
+
+// LatencyReporter is implemented by proxies which measure their
+// latency. It reports false if no measurement is available.
+type LatencyReporter interface {
+	Latency() (time.Duration, bool)
+}
+
+// New returns a new Strategy by name.
+func New(name string) (Strategy, error) {
+	switch name {
+	case RoundRobin, "":
+		return &roundRobin{}, nil
+	case WeightedRoundRobin:
+		return &weightedRoundRobin{current: make(map[proxy.Proxy]int)}, nil
+	case LeastActive:
+		return &leastActive{}, nil
+	case Random:
+		return random{}, nil
+	case LowestLatency:
+		return lowestLatency{}, nil
+	case Failover:
+		return failover{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported strategy: %s", name)
+	}
+}
+
+func weightOf(p proxy.Proxy) int {
+	if w, ok := p.(Weighter); ok && w.Weight() > 0 {
+		return w.Weight()
+	}
+	return 1
+}
+
+func activeOf(p proxy.Proxy) int64 {
+	if c, ok := p.(ActiveCounter); ok {
+		return c.Active()
+	}
+	return 0
+}
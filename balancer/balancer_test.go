@@ -0,0 +1,368 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/proxy"
+	"github.com/xjasonlyu/tun2socks/v2/proxy/proto"
+)
+
+// fakeProxy is a proxy.Proxy reporting the given weight, active
+// connections and latency.
+type fakeProxy struct {
+	name     string
+	weight   int
+	active   int64
+	latency  time.Duration
+	measured bool
+
+	// err is returned by dials, which are counted by dials.
+	err   error
+	dials int
+}
+
+func (p *fakeProxy) DialContext(context.Context, *M.Metadata) (net.Conn, error) {
+	p.dials++
+	if p.err != nil {
+		return nil, p.err
+	}
+	return &net.TCPConn{}, nil
+}
+
+func (p *fakeProxy) DialUDP(*M.Metadata) (net.PacketConn, error) {
+	p.dials++
+	if p.err != nil {
+		return nil, p.err
+	}
+	return &net.UDPConn{}, nil
+}
+
+func (p *fakeProxy) Addr() string                   { return p.name }
+func (p *fakeProxy) Proto() proto.Proto             { return proto.Direct }
+func (p *fakeProxy) Weight() int                    { return p.weight }
+func (p *fakeProxy) Active() int64                  { return p.active }
+func (p *fakeProxy) Latency() (time.Duration, bool) { return p.latency, p.measured }
+
+func pickN(t *testing.T, s Strategy, candidates []proxy.Proxy, n int) map[string]int {
+	t.Helper()
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		counts[s.Pick(candidates, &M.Metadata{}).Addr()]++
+	}
+	return counts
+}
+
+func TestNew(t *testing.T) {
+	for _, name := range []string{RoundRobin, WeightedRoundRobin, LeastActive, Random, LowestLatency, Failover} {
+		s, err := New(name)
+		require.NoError(t, err)
+		assert.Equal(t, name, s.Name())
+	}
+
+	s, err := New("")
+	require.NoError(t, err)
+	assert.Equal(t, RoundRobin, s.Name())
+
+	_, err = New("fastest")
+	assert.Error(t, err)
+}
+
+func TestRoundRobin(t *testing.T) {
+	a, b := &fakeProxy{name: "a"}, &fakeProxy{name: "b"}
+	s, _ := New(RoundRobin)
+	assert.Equal(t, map[string]int{"a": 3, "b": 3}, pickN(t, s, []proxy.Proxy{a, b}, 6))
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	a := &fakeProxy{name: "a", weight: 5}
+	b := &fakeProxy{name: "b", weight: 1}
+	c := &fakeProxy{name: "c"} // default weight 1
+	s, _ := New(WeightedRoundRobin)
+
+	var seq []string
+	for i := 0; i < 7; i++ {
+		seq = append(seq, s.Pick([]proxy.Proxy{a, b, c}, nil).Addr())
+	}
+	// Smooth: the heavy proxy is interleaved with the others.
+	assert.Equal(t, []string{"a", "a", "b", "a", "c", "a", "a"}, seq)
+
+	// Removed candidates are forgotten.
+	assert.Equal(t, map[string]int{"b": 2, "c": 2}, pickN(t, s, []proxy.Proxy{b, c}, 4))
+}
+
+func TestLeastActive(t *testing.T) {
+	a := &fakeProxy{name: "a", active: 3}
+	b := &fakeProxy{name: "b", active: 1}
+	c := &fakeProxy{name: "c", active: 1}
+	s, _ := New(LeastActive)
+
+	// Ties are broken in turn.
+	assert.Equal(t, map[string]int{"b": 2, "c": 2}, pickN(t, s, []proxy.Proxy{a, b, c}, 4))
+
+	b.active = 0
+	assert.Equal(t, map[string]int{"b": 3}, pickN(t, s, []proxy.Proxy{a, b, c}, 3))
+}
+
+func TestRandom(t *testing.T) {
+	a, b := &fakeProxy{name: "a"}, &fakeProxy{name: "b"}
+	s, _ := New(Random)
+	counts := pickN(t, s, []proxy.Proxy{a, b}, 1000)
+	assert.Equal(t, 1000, counts["a"]+counts["b"])
+	assert.Greater(t, counts["a"], 0)
+	assert.Greater(t, counts["b"], 0)
+}
+
+func TestLowestLatency(t *testing.T) {
+	a := &fakeProxy{name: "a", latency: 300 * time.Millisecond, measured: true}
+	b := &fakeProxy{name: "b", latency: 100 * time.Millisecond, measured: true}
+	c := &fakeProxy{name: "c"}
+	s, _ := New(LowestLatency)
+
+	assert.Equal(t, "b", s.Pick([]proxy.Proxy{a, b, c}, nil).Addr())
+	// Unmeasured proxies are picked only if none is measured.
+	assert.Equal(t, "a", s.Pick([]proxy.Proxy{c, a}, nil).Addr())
+	assert.Equal(t, "c", s.Pick([]proxy.Proxy{c}, nil).Addr())
+}
+
+func TestGroup(t *testing.T) {
+	a, b := &fakeProxy{name: "a"}, &fakeProxy{name: "b"}
+	s, _ := New(RoundRobin)
+	g := NewGroup("group", s, []proxy.Proxy{a, b})
+
+	assert.Equal(t, "group", g.Name())
+	assert.Len(t, g.Available(), 2)
+
+	g.Update([]proxy.Proxy{b})
+	assert.Equal(t, proxy.Proxy(b), g.Pick(nil))
+
+	g.RemoveMember(b)
+	assert.Equal(t, []proxy.Proxy{a}, g.Members())
+	assert.Nil(t, g.Pick(nil))
+
+	_, err := g.DialContext(context.Background(), &M.Metadata{})
+	assert.ErrorIs(t, err, ErrNoAvailable)
+}
+
+func TestGroupUDP(t *testing.T) {
+	a, b := &fakeProxy{name: "a"}, &fakeProxy{name: "b"}
+	s, _ := New(RoundRobin)
+	g := NewGroup("group", s, []proxy.Proxy{a, b})
+
+	g.UpdateUDP([]proxy.Proxy{b})
+	for range 4 {
+		assert.Equal(t, proxy.Proxy(b), g.Pick(&M.Metadata{Network: M.UDP}))
+	}
+	assert.Len(t, g.Available(), 2)
+
+	g.UpdateUDP(nil)
+	_, err := g.DialUDP(&M.Metadata{Network: M.UDP})
+	assert.ErrorIs(t, err, ErrNoAvailable)
+	metadata := &M.Metadata{Network: M.TCP}
+	_, err = g.DialContext(context.Background(), metadata)
+	assert.NoError(t, err)
+	assert.Equal(t, "group", metadata.Group)
+
+	g.Update([]proxy.Proxy{a})
+	assert.Equal(t, []proxy.Proxy{a}, g.AvailableUDP())
+}
+
+func TestParseAffinity(t *testing.T) {
+	for _, s := range []string{"none", "source", "destination", "source-destination"} {
+		a, err := ParseAffinity(s)
+		require.NoError(t, err)
+		assert.Equal(t, s, a.String())
+	}
+
+	a, err := ParseAffinity("")
+	require.NoError(t, err)
+	assert.Equal(t, AffinityNone, a)
+
+	_, err = ParseAffinity("src")
+	assert.Error(t, err)
+}
+
+func TestAffinityKey(t *testing.T) {
+	m := &M.Metadata{
+		SrcIP: netip.MustParseAddr("10.0.0.1"),
+		DstIP: netip.MustParseAddr("198.18.0.1"),
+	}
+	assert.Equal(t, "10.0.0.1", AffinitySource.key(m))
+	assert.Equal(t, "198.18.0.1", AffinityDestination.key(m))
+
+	m.Host = "example.com"
+	assert.Equal(t, "example.com", AffinityDestination.key(m))
+	assert.Equal(t, "10.0.0.1|example.com", AffinitySourceDestination.key(m))
+}
+
+func TestConsistentPick(t *testing.T) {
+	var candidates []proxy.Proxy
+	for _, name := range []string{"a", "b", "c", "d"} {
+		candidates = append(candidates, &fakeProxy{name: name})
+	}
+
+	before := make(map[string]proxy.Proxy)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		before[key] = consistentPick(candidates, key)
+	}
+
+	// Keys are spread over all candidates.
+	counts := make(map[proxy.Proxy]int)
+	for _, p := range before {
+		counts[p]++
+	}
+	assert.Len(t, counts, 4)
+
+	// Removing a candidate only remaps the keys on it.
+	removed := candidates[1]
+	remaining := []proxy.Proxy{candidates[0], candidates[2], candidates[3]}
+	for key, p := range before {
+		after := consistentPick(remaining, key)
+		if p == removed {
+			assert.NotEqual(t, removed, after)
+		} else {
+			assert.Equal(t, p, after, key)
+		}
+	}
+}
+
+func TestGroupAffinity(t *testing.T) {
+	a, b := &fakeProxy{name: "a"}, &fakeProxy{name: "b"}
+	m1 := &M.Metadata{SrcIP: netip.MustParseAddr("10.0.0.1")}
+	m2 := &M.Metadata{SrcIP: netip.MustParseAddr("10.0.0.2")}
+
+	s, _ := New(RoundRobin)
+	g := NewGroup("hash", s, []proxy.Proxy{a, b}, WithAffinity(AffinitySource, 0))
+	p := g.Pick(m1)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, p, g.Pick(m1))
+	}
+
+	s, _ = New(RoundRobin)
+	g = NewGroup("sticky", s, []proxy.Proxy{a, b}, WithAffinity(AffinitySource, time.Minute))
+	assert.Equal(t, proxy.Proxy(a), g.Pick(m1))
+	assert.Equal(t, proxy.Proxy(b), g.Pick(m2))
+	assert.Equal(t, proxy.Proxy(a), g.Pick(m1))
+	assert.Equal(t, proxy.Proxy(b), g.Pick(m2))
+	assert.Equal(t, 2, g.sticky.len())
+
+	// The remembered proxy is replaced once unavailable.
+	g.Update([]proxy.Proxy{b})
+	assert.Equal(t, proxy.Proxy(b), g.Pick(m1))
+	g.Update([]proxy.Proxy{a, b})
+	assert.Equal(t, proxy.Proxy(b), g.Pick(m1))
+}
+
+func TestStickyTableExpire(t *testing.T) {
+	a, b := &fakeProxy{name: "a"}, &fakeProxy{name: "b"}
+	table := newStickyTable(10 * time.Millisecond)
+	candidates := []proxy.Proxy{a, b}
+
+	assert.Equal(t, proxy.Proxy(a), table.pick(candidates, "k", func() proxy.Proxy { return a }))
+	assert.Equal(t, proxy.Proxy(a), table.pick(candidates, "k", func() proxy.Proxy { return b }))
+
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, proxy.Proxy(b), table.pick(candidates, "k", func() proxy.Proxy { return b }))
+	assert.Equal(t, 1, table.len())
+}
+
+func TestGroupFailover(t *testing.T) {
+	a := &fakeProxy{name: "a", err: errors.New("refused")}
+	b := &fakeProxy{name: "b", err: errors.New("timeout")}
+	c := &fakeProxy{name: "c"}
+
+	s, _ := New(Failover)
+	g := NewGroup("failover", s, []proxy.Proxy{a, b, c}, WithRetry())
+
+	m := &M.Metadata{}
+	_, err := g.DialContext(context.Background(), m)
+	require.NoError(t, err)
+	assert.Equal(t, 3, m.Attempts)
+	assert.Equal(t, []int{1, 1, 1}, []int{a.dials, b.dials, c.dials})
+
+	// Proxies just failed are tried last.
+	assert.Equal(t, []proxy.Proxy{c, a, b}, g.attempts(m))
+	m = &M.Metadata{}
+	_, err = g.DialUDP(m)
+	require.NoError(t, err)
+	assert.Equal(t, 1, m.Attempts)
+	assert.Equal(t, []int{1, 1, 2}, []int{a.dials, b.dials, c.dials})
+
+	// All errors are returned if every attempt fails.
+	c.err = errors.New("reset")
+	_, err = g.DialContext(context.Background(), &M.Metadata{})
+	assert.ErrorContains(t, err, "refused")
+	assert.ErrorContains(t, err, "reset")
+}
+
+func TestGroupDestinationError(t *testing.T) {
+	a := &fakeProxy{name: "a", err: &proxy.DestinationError{Err: errors.New("host unreachable")}}
+	b := &fakeProxy{name: "b"}
+
+	s, _ := New(Failover)
+	g := NewGroup("failover", s, []proxy.Proxy{a, b}, WithRetry())
+
+	// The destination is not retried via other proxies, nor is the
+	// proxy marked failed.
+	_, err := g.DialContext(context.Background(), &M.Metadata{})
+	assert.ErrorContains(t, err, "host unreachable")
+	_, err = g.DialUDP(&M.Metadata{})
+	assert.ErrorContains(t, err, "host unreachable")
+	assert.Equal(t, 0, b.dials)
+	assert.Equal(t, []proxy.Proxy{a, b}, g.attempts(&M.Metadata{}))
+}
+
+func TestGroupWithoutRetry(t *testing.T) {
+	a := &fakeProxy{name: "a", err: errors.New("refused")}
+	b := &fakeProxy{name: "b"}
+
+	s, _ := New(Failover)
+	g := NewGroup("single", s, []proxy.Proxy{a, b})
+	_, err := g.DialContext(context.Background(), &M.Metadata{})
+	assert.Error(t, err)
+	assert.Equal(t, 0, b.dials)
+}
+
+// slowProxy blocks until the dial context is done.
+type slowProxy struct {
+	fakeProxy
+	deadline  time.Time
+	shortened bool
+}
+
+func (p *slowProxy) DialContext(ctx context.Context, _ *M.Metadata) (net.Conn, error) {
+	p.deadline, _ = ctx.Deadline()
+	p.shortened = Shortened(ctx)
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestGroupRetryDeadline(t *testing.T) {
+	a := &slowProxy{fakeProxy: fakeProxy{name: "a"}}
+	b := &fakeProxy{name: "b"}
+
+	s, _ := New(Failover)
+	g := NewGroup("failover", s, []proxy.Proxy{a, b}, WithRetry())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+
+	_, err := g.DialContext(ctx, &M.Metadata{})
+	require.NoError(t, err)
+	// The first attempt gets about half of the remaining time.
+	assert.True(t, a.deadline.Before(deadline.Add(-40*time.Millisecond)))
+	assert.True(t, a.shortened)
+	assert.False(t, Shortened(ctx))
+	assert.Equal(t, 1, b.dials)
+}
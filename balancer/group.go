@@ -0,0 +1,343 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/xjasonlyu/tun2socks/v2/log"
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/proxy"
+	"github.com/xjasonlyu/tun2socks/v2/proxy/proto"
+)
+
+var _ proxy.Proxy = (*Group)(nil)
+
+// ErrNoAvailable is returned when a Group has no available proxy.
+var ErrNoAvailable = errors.New("no healthy proxy available")
+
+// failureCooldown is the duration for which a proxy failed to dial is
+// tried after the others by groups with retry.
+const failureCooldown = 10 * time.Second
+
+type shortenedKey struct{}
+
+// Shortened reports whether ctx is an attempt of a Group with retry,
+// of which the deadline is a share of the dial's. Its expiry doesn't
+// imply the proxy failing.
+func Shortened(ctx context.Context) bool {
+	v, _ := ctx.Value(shortenedKey{}).(bool)
+	return v
+}
+
+// Group is a proxy group which dials through one of its available
+// proxies picked by Strategy.
+type Group struct {
+	name     string
+	strategy Strategy
+
+	affinity Affinity
+	sticky   *stickyTable
+
+	// retry enables dialing the other available proxies in turn
+	// if the picked one fails.
+	retry    bool
+	failMu   sync.Mutex
+	failures map[proxy.Proxy]time.Time
+
+	mu sync.RWMutex
+	// members holds all configured proxies regardless of health.
+	members []proxy.Proxy
+	// available holds the proxies currently in rotation.
+	available []proxy.Proxy
+	// availableUDP holds the proxies in rotation for UDP, which may
+	// differ from available if UDP is checked separately.
+	availableUDP []proxy.Proxy
+}
+
+// Option configures a Group.
+type Option func(*Group)
+
+// WithAffinity keeps the flows with the same affinity key on the same
+// proxy. If ttl is zero, the proxy is picked by consistent hashing of
+// the key regardless of Strategy. Otherwise, it is picked by Strategy
+// and remembered for the key until idle for ttl.
+func WithAffinity(affinity Affinity, ttl time.Duration) Option {
+	return func(g *Group) {
+		g.affinity = affinity
+		if affinity != AffinityNone && ttl > 0 {
+			g.sticky = newStickyTable(ttl)
+		}
+	}
+}
+
+// WithRetry makes Group dial the other available proxies in order if
+// the picked one fails, within the deadline of the dial. Proxies which
+// failed within failureCooldown are tried last.
+func WithRetry() Option {
+	return func(g *Group) {
+		g.retry = true
+		g.failures = make(map[proxy.Proxy]time.Time)
+	}
+}
+
+// NewGroup creates a Group with all members available.
+func NewGroup(name string, strategy Strategy, members []proxy.Proxy, opts ...Option) *Group {
+	g := &Group{
+		name:         name,
+		strategy:     strategy,
+		members:      members,
+		available:    members,
+		availableUDP: members,
+	}
+	for _, opt := range opts {
+		opt(g)
+	}
+	return g
+}
+
+// Name returns the name of Group.
+func (g *Group) Name() string {
+	return g.name
+}
+
+// Strategy returns the Strategy of Group.
+func (g *Group) Strategy() Strategy {
+	return g.strategy
+}
+
+// Members returns all configured proxies regardless of their health.
+func (g *Group) Members() []proxy.Proxy {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.members
+}
+
+// Available returns the proxies currently in rotation.
+func (g *Group) Available() []proxy.Proxy {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.available
+}
+
+// AvailableUDP returns the proxies currently in rotation for UDP.
+func (g *Group) AvailableUDP() []proxy.Proxy {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.availableUDP
+}
+
+// AddMember adds p to the configured proxies, which takes effect on
+// the next Update.
+func (g *Group) AddMember(p proxy.Proxy) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.members = append(slices.Clip(g.members), p)
+}
+
+// RemoveMember removes p from the configured proxies and the proxies
+// in rotation.
+func (g *Group) RemoveMember(p proxy.Proxy) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	del := func(x proxy.Proxy) bool { return x == p }
+	g.members = slices.DeleteFunc(slices.Clone(g.members), del)
+	g.available = slices.DeleteFunc(slices.Clone(g.available), del)
+	g.availableUDP = slices.DeleteFunc(slices.Clone(g.availableUDP), del)
+}
+
+// Update replaces the proxies in rotation for both TCP and UDP.
+func (g *Group) Update(available []proxy.Proxy) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.available = slices.Clone(available)
+	g.availableUDP = g.available
+}
+
+// UpdateUDP replaces the proxies in rotation for UDP only.
+func (g *Group) UpdateUDP(available []proxy.Proxy) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.availableUDP = slices.Clone(available)
+}
+
+// candidates returns the proxies in rotation for the network of
+// metadata.
+func (g *Group) candidates(metadata *M.Metadata) []proxy.Proxy {
+	if metadata != nil && metadata.Network == M.UDP {
+		return g.AvailableUDP()
+	}
+	return g.Available()
+}
+
+// Pick returns the proxy picked for metadata, or nil if none is
+// available for its network.
+func (g *Group) Pick(metadata *M.Metadata) proxy.Proxy {
+	available := g.candidates(metadata)
+
+	if len(available) == 0 {
+		return nil
+	}
+	if g.affinity == AffinityNone || metadata == nil {
+		return g.strategy.Pick(available, metadata)
+	}
+
+	key := g.affinity.key(metadata)
+	if g.sticky != nil {
+		return g.sticky.pick(available, key, func() proxy.Proxy {
+			return g.strategy.Pick(available, metadata)
+		})
+	}
+	return consistentPick(available, key)
+}
+
+// Affinity returns the affinity mode of Group.
+func (g *Group) Affinity() Affinity {
+	return g.affinity
+}
+
+// Retry reports whether Group retries on dial failure.
+func (g *Group) Retry() bool {
+	return g.retry
+}
+
+// attempts returns the proxies to dial in order, starting with the
+// picked one, or only the picked one if retry is disabled.
+func (g *Group) attempts(metadata *M.Metadata) []proxy.Proxy {
+	p := g.Pick(metadata)
+	if p == nil {
+		return nil
+	}
+	if !g.retry {
+		return []proxy.Proxy{p}
+	}
+
+	list := []proxy.Proxy{p}
+	for _, x := range g.candidates(metadata) {
+		if x != p {
+			list = append(list, x)
+		}
+	}
+
+	// Move the ones just failed to the end, keeping the order.
+	now := time.Now()
+	g.failMu.Lock()
+	var fresh, failed []proxy.Proxy
+	for _, x := range list {
+		if t, ok := g.failures[x]; ok && now.Sub(t) < failureCooldown {
+			failed = append(failed, x)
+		} else {
+			delete(g.failures, x)
+			fresh = append(fresh, x)
+		}
+	}
+	g.failMu.Unlock()
+	return append(fresh, failed...)
+}
+
+func (g *Group) markFailure(p proxy.Proxy, err error) {
+	if !g.retry {
+		return
+	}
+	g.failMu.Lock()
+	g.failures[p] = time.Now()
+	g.failMu.Unlock()
+	log.Debugf("[BALANCER] %s: dial via %s: %v", g.name, identityOf(p), err)
+}
+
+// destinationError reports whether err is of the destination rather
+// than the proxy, which the other proxies are not retried for, as they
+// would fail to reach it as well.
+func destinationError(err error) bool {
+	var de *proxy.DestinationError
+	return errors.As(err, &de)
+}
+
+func (g *Group) markSuccess(p proxy.Proxy, metadata *M.Metadata, attempt int) {
+	if !g.retry {
+		return
+	}
+	g.failMu.Lock()
+	delete(g.failures, p)
+	g.failMu.Unlock()
+	metadata.Attempts = attempt
+	if attempt > 1 {
+		log.Infof("[BALANCER] %s: dial via %s succeeded at attempt %d", g.name, identityOf(p), attempt)
+	}
+}
+
+func (g *Group) DialContext(ctx context.Context, metadata *M.Metadata) (net.Conn, error) {
+	list := g.attempts(metadata)
+	if len(list) == 0 {
+		return nil, ErrNoAvailable
+	}
+
+	var errs []error
+	for i, p := range list {
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, err)
+			break
+		}
+
+		// Share the remaining time among the remaining attempts, so
+		// that a hanging proxy doesn't use up the whole deadline.
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if deadline, ok := ctx.Deadline(); ok && i < len(list)-1 {
+			share := time.Until(deadline) / time.Duration(len(list)-i)
+			attemptCtx, cancel = context.WithTimeout(context.WithValue(ctx, shortenedKey{}, true), share)
+		}
+		c, err := p.DialContext(attemptCtx, metadata)
+		cancel()
+		if err == nil {
+			metadata.Group = g.name
+			g.markSuccess(p, metadata, i+1)
+			return c, nil
+		} else if destinationError(err) {
+			return nil, errors.Join(append(errs, err)...)
+		}
+		g.markFailure(p, err)
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (g *Group) DialUDP(metadata *M.Metadata) (net.PacketConn, error) {
+	list := g.attempts(metadata)
+	if len(list) == 0 {
+		return nil, ErrNoAvailable
+	}
+
+	var errs []error
+	for i, p := range list {
+		pc, err := p.DialUDP(metadata)
+		if err == nil {
+			metadata.Group = g.name
+			g.markSuccess(p, metadata, i+1)
+			return pc, nil
+		} else if destinationError(err) {
+			return nil, errors.Join(append(errs, err)...)
+		}
+		g.markFailure(p, err)
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// Addr returns the address of the first available proxy for logging.
+func (g *Group) Addr() string {
+	if available := g.Available(); len(available) > 0 {
+		return available[0].Addr()
+	}
+	return ""
+}
+
+// Proto returns the protocol of the first available proxy for logging.
+func (g *Group) Proto() proto.Proto {
+	if available := g.Available(); len(available) > 0 {
+		return available[0].Proto()
+	}
+	return proto.Direct
+}
@@ -0,0 +1,125 @@
+package balancer
+
+import (
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/proxy"
+)
+
+// roundRobin picks candidates in turn.
+type roundRobin struct {
+	counter atomic.Uint64
+}
+
+func (*roundRobin) Name() string { return RoundRobin }
+
+func (s *roundRobin) Pick(candidates []proxy.Proxy, _ *M.Metadata) proxy.Proxy {
+	n := s.counter.Add(1)
+	return candidates[(n-1)%uint64(len(candidates))]
+}
+
+// weightedRoundRobin implements the smooth weighted round-robin of
+// nginx, which spreads picks of heavier proxies evenly instead of in
+// bursts.
+type weightedRoundRobin struct {
+	mu      sync.Mutex
+	current map[proxy.Proxy]int
+}
+
+func (*weightedRoundRobin) Name() string { return WeightedRoundRobin }
+
+func (s *weightedRoundRobin) Pick(candidates []proxy.Proxy, _ *M.Metadata) proxy.Proxy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var (
+		best  proxy.Proxy
+		total int
+	)
+	current := make(map[proxy.Proxy]int, len(candidates))
+	for _, p := range candidates {
+		w := weightOf(p)
+		total += w
+		current[p] = s.current[p] + w
+		if best == nil || current[p] > current[best] {
+			best = p
+		}
+	}
+	current[best] -= total
+	// Drop the states of proxies which are no longer candidates.
+	s.current = current
+	return best
+}
+
+// leastActive picks the candidate with the fewest active connections,
+// and breaks ties in turn.
+type leastActive struct {
+	counter atomic.Uint64
+}
+
+func (*leastActive) Name() string { return LeastActive }
+
+func (s *leastActive) Pick(candidates []proxy.Proxy, _ *M.Metadata) proxy.Proxy {
+	var (
+		fewest int64
+		tied   []proxy.Proxy
+	)
+	for _, p := range candidates {
+		switch n := activeOf(p); {
+		case tied == nil || n < fewest:
+			fewest, tied = n, []proxy.Proxy{p}
+		case n == fewest:
+			tied = append(tied, p)
+		}
+	}
+	n := s.counter.Add(1)
+	return tied[(n-1)%uint64(len(tied))]
+}
+
+// random picks candidates uniformly at random.
+type random struct{}
+
+func (random) Name() string { return Random }
+
+func (random) Pick(candidates []proxy.Proxy, _ *M.Metadata) proxy.Proxy {
+	return candidates[rand.IntN(len(candidates))]
+}
+
+// lowestLatency picks the candidate with the lowest measured latency,
+// or the first one if none is measured.
+type lowestLatency struct{}
+
+func (lowestLatency) Name() string { return LowestLatency }
+
+func (lowestLatency) Pick(candidates []proxy.Proxy, _ *M.Metadata) proxy.Proxy {
+	best := candidates[0]
+	var bestMeasured bool
+	var bestLatency int64
+	for _, p := range candidates {
+		r, ok := p.(LatencyReporter)
+		if !ok {
+			continue
+		}
+		latency, measured := r.Latency()
+		if !measured {
+			continue
+		}
+		if !bestMeasured || int64(latency) < bestLatency {
+			best, bestMeasured, bestLatency = p, true, int64(latency)
+		}
+	}
+	return best
+}
+
+// failover picks the first candidate, which is in priority order. It
+// is meant for groups with retry, trying the rest on failure.
+type failover struct{}
+
+func (failover) Name() string { return Failover }
+
+func (failover) Pick(candidates []proxy.Proxy, _ *M.Metadata) proxy.Proxy {
+	return candidates[0]
+}
@@ -2,6 +2,7 @@ package adapter
 
 import (
 	"net"
+	"net/netip"
 
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 )
@@ -14,6 +15,20 @@ type TCPConn interface {
 	ID() *stack.TransportEndpointID
 }
 
+// PendingTCPConn is a TCPConn of which the handshake is deferred by
+// ActionDefer. It must be either accepted or rejected before any use
+// other than ID, and closing it before that rejects it with ActionReset.
+type PendingTCPConn interface {
+	TCPConn
+
+	// Accept completes the handshake.
+	Accept() error
+
+	// Reject refuses the connection with ActionReset, ActionUnreachable
+	// or ActionDrop.
+	Reject(Action)
+}
+
 // UDPConn implements net.Conn and net.PacketConn.
 type UDPConn interface {
 	net.Conn
@@ -22,3 +37,35 @@ type UDPConn interface {
 	// ID returns the transport endpoint id of UDPConn.
 	ID() *stack.TransportEndpointID
 }
+
+// ConeUDPConn is a UDPConn which can open sessions to its source from
+// other addresses, as cone NATs pass the replies from remotes which the
+// source hasn't sent to.
+type ConeUDPConn interface {
+	UDPConn
+
+	// DialFrom returns a new UDPConn from the address to the source of
+	// ConeUDPConn, of which the ID has the address as the local one.
+	DialFrom(netip.AddrPort) (UDPConn, error)
+}
+
+// EchoRequest is an ICMP echo request received by the stack.
+type EchoRequest interface {
+	// ID returns the addresses of EchoRequest, of which the local
+	// address is the destination pinged. Ports are zero.
+	ID() *stack.TransportEndpointID
+
+	// Ident and Seq return the identifier and sequence number.
+	Ident() uint16
+	Seq() uint16
+
+	// Payload returns the data to be echoed.
+	Payload() []byte
+
+	// Reply sends the echo reply from the destination pinged.
+	Reply() error
+
+	// Unreachable sends the ICMP error of communication administratively
+	// prohibited from the destination pinged.
+	Unreachable() error
+}
@@ -1,8 +1,47 @@
 package adapter
 
+import (
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
 // TransportHandler is a TCP/UDP connection handler that implements
 // HandleTCP and HandleUDP methods.
 type TransportHandler interface {
 	HandleTCP(TCPConn)
 	HandleUDP(UDPConn)
 }
+
+// Action is what the stack does with a new TCP connection or UDP
+// session before it's established.
+type Action uint8
+
+const (
+	// ActionAccept establishes the flow and passes it to TransportHandler.
+	ActionAccept Action = iota
+	// ActionReset replies TCP RST, or ICMP port unreachable for UDP.
+	ActionReset
+	// ActionUnreachable replies ICMP destination unreachable, with the
+	// code of communication administratively prohibited.
+	ActionUnreachable
+	// ActionDrop silently drops the packet.
+	ActionDrop
+	// ActionDefer holds the TCP SYN segment, and passes the connection
+	// to TransportHandler as PendingTCPConn to decide on later. It's
+	// the same as ActionAccept for UDP.
+	ActionDefer
+)
+
+// TransportFilter is optionally implemented by TransportHandler to
+// decide on new flows by their first packets, i.e. TCP SYN segments
+// and UDP datagrams of unknown sessions, before they're established.
+type TransportFilter interface {
+	FilterTCP(*stack.TransportEndpointID) Action
+	FilterUDP(*stack.TransportEndpointID) Action
+}
+
+// EchoHandler is optionally implemented by TransportHandler to handle
+// ICMP echo requests to any destination. A request is passed on to the
+// stack as usual unless HandleEcho returns true, which must not block.
+type EchoHandler interface {
+	HandleEcho(EchoRequest) bool
+}
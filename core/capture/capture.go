@@ -0,0 +1,338 @@
+// Package capture records the packets passing through a link endpoint
+// in pcapng format, for debugging devices tcpdump can't reach, such as
+// file descriptors handed in by another process.
+package capture
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/link/nested"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+const (
+	// DefaultSnapLen is the default number of bytes captured from
+	// each packet.
+	DefaultSnapLen = 65535
+
+	// queueSize is the number of packets buffered for writing,
+	// beyond which they are dropped.
+	queueSize = 1024
+)
+
+var _ stack.LinkEndpoint = (*Endpoint)(nil)
+
+// Endpoint wraps a stack.LinkEndpoint, passing a copy of each packet,
+// inbound (delivered to the stack) or outbound (written by the stack),
+// to the running capture sessions.
+type Endpoint struct {
+	nested.Endpoint
+
+	name string
+
+	mu       sync.Mutex
+	sessions atomic.Pointer[[]*Session]
+}
+
+// New creates an Endpoint wrapping lower, with the interface name
+// written to captures.
+func New(lower stack.LinkEndpoint, name string) *Endpoint {
+	e := &Endpoint{name: name}
+	e.Endpoint.Init(lower, e)
+	return e
+}
+
+// DeliverNetworkPacket implements stack.NetworkDispatcher.
+func (e *Endpoint) DeliverNetworkPacket(protocol tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer) {
+	e.capture(true, pkt)
+	e.Endpoint.DeliverNetworkPacket(protocol, pkt)
+}
+
+// WritePackets implements stack.LinkEndpoint.
+func (e *Endpoint) WritePackets(pkts stack.PacketBufferList) (int, tcpip.Error) {
+	if e.active() {
+		for _, pkt := range pkts.AsSlice() {
+			e.capture(false, pkt)
+		}
+	}
+	return e.Endpoint.WritePackets(pkts)
+}
+
+func (e *Endpoint) active() bool {
+	sessions := e.sessions.Load()
+	return sessions != nil && len(*sessions) > 0
+}
+
+func (e *Endpoint) capture(inbound bool, pkt *stack.PacketBuffer) {
+	sessions := e.sessions.Load()
+	if sessions == nil || len(*sessions) == 0 {
+		return
+	}
+
+	buf := pkt.ToBuffer()
+	defer buf.Release()
+	buf.TrimFront(int64(len(pkt.VirtioNetHeader().Slice()) + len(pkt.LinkHeader().Slice())))
+	data := buf.Flatten()
+
+	now := time.Now()
+	for _, s := range *sessions {
+		s.capture(now, inbound, data)
+	}
+}
+
+// Sessions returns the running capture sessions.
+func (e *Endpoint) Sessions() []*Session {
+	if sessions := e.sessions.Load(); sessions != nil {
+		return *sessions
+	}
+	return nil
+}
+
+// Start starts a capture session writing pcapng to w, until stopped
+// or a limit of opts is reached.
+func (e *Endpoint) Start(w io.Writer, opts Options) (*Session, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	s := newSession(e, w, opts)
+	if err := s.p.writeHeader(e.name, s.opts.SnapLen); err != nil {
+		return nil, err
+	}
+	if err := s.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	e.mu.Lock()
+	var sessions []*Session
+	if old := e.sessions.Load(); old != nil {
+		sessions = append(sessions, *old...)
+	}
+	sessions = append(sessions, s)
+	e.sessions.Store(&sessions)
+	e.mu.Unlock()
+
+	go s.run()
+	return s, nil
+}
+
+func (e *Endpoint) remove(s *Session) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	old := e.sessions.Load()
+	if old == nil {
+		return
+	}
+	sessions := make([]*Session, 0, len(*old))
+	for _, v := range *old {
+		if v != s {
+			sessions = append(sessions, v)
+		}
+	}
+	e.sessions.Store(&sessions)
+}
+
+// Options are the options of a capture session.
+type Options struct {
+	// SnapLen is the maximum number of bytes captured from each
+	// packet, DefaultSnapLen if zero.
+	SnapLen int `json:"snaplen"`
+	// Count stops the session after capturing as many packets,
+	// unlimited if zero.
+	Count int64 `json:"count"`
+	// Duration stops the session after the duration, unlimited if
+	// zero.
+	Duration time.Duration `json:"duration"`
+	// Filter selects the packets to capture.
+	Filter Filter `json:"-"`
+}
+
+func (o *Options) validate() error {
+	if o.SnapLen == 0 {
+		o.SnapLen = DefaultSnapLen
+	}
+	if o.SnapLen < 0 || o.Count < 0 || o.Duration < 0 {
+		return errors.New("negative capture limit")
+	}
+	return o.Filter.validate()
+}
+
+// packet is a captured packet pending write.
+type packet struct {
+	ts      time.Time
+	inbound bool
+	data    []byte
+	size    int
+}
+
+// Stats are the statistics of a capture session.
+type Stats struct {
+	Start   time.Time `json:"start"`
+	Packets int64     `json:"packets"`
+	Bytes   int64     `json:"bytes"`
+	Dropped int64     `json:"dropped"`
+}
+
+// Session is a running capture, writing the captured packets in a
+// background goroutine so that the datapath never blocks on it.
+type Session struct {
+	e    *Endpoint
+	opts Options
+
+	w *bufio.Writer
+	p *pcapngWriter
+
+	queue   chan packet
+	start   time.Time
+	packets atomic.Int64
+	bytes   atomic.Int64
+	dropped atomic.Int64
+
+	stopOnce sync.Once
+	stopCh   chan struct{}
+	done     chan struct{}
+	err      error
+}
+
+func newSession(e *Endpoint, w io.Writer, opts Options) *Session {
+	bw := bufio.NewWriter(&flushWriter{w})
+	return &Session{
+		e:      e,
+		opts:   opts,
+		w:      bw,
+		p:      newPCAPNGWriter(bw),
+		queue:  make(chan packet, queueSize),
+		start:  time.Now(),
+		stopCh: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// Options returns the options of s.
+func (s *Session) Options() Options {
+	return s.opts
+}
+
+// Stats returns the statistics of s.
+func (s *Session) Stats() Stats {
+	return Stats{
+		Start:   s.start,
+		Packets: min(s.packets.Load(), s.limit()),
+		Bytes:   s.bytes.Load(),
+		Dropped: s.dropped.Load(),
+	}
+}
+
+func (s *Session) limit() int64 {
+	if s.opts.Count > 0 {
+		return s.opts.Count
+	}
+	return 1<<63 - 1
+}
+
+// Stop stops s without waiting for the queued packets to be written.
+func (s *Session) Stop() {
+	s.stopOnce.Do(func() {
+		s.e.remove(s)
+		close(s.stopCh)
+	})
+}
+
+// Done returns a channel closed once s has stopped and written all
+// the captured packets.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Wait waits for s to finish, returning the error of writing if any.
+func (s *Session) Wait() error {
+	<-s.done
+	return s.err
+}
+
+func (s *Session) capture(ts time.Time, inbound bool, data []byte) {
+	if !s.opts.Filter.Match(data) {
+		return
+	}
+	n := s.packets.Add(1)
+	if n > s.limit() {
+		return
+	}
+
+	pkt := packet{ts: ts, inbound: inbound, size: len(data)}
+	pkt.data = data[:min(len(data), s.opts.SnapLen)]
+	select {
+	case s.queue <- pkt:
+		s.bytes.Add(int64(len(pkt.data)))
+	default:
+		s.dropped.Add(1)
+	}
+	if n == s.limit() {
+		s.Stop()
+	}
+}
+
+func (s *Session) run() {
+	defer close(s.done)
+	defer s.Stop()
+
+	var deadline <-chan time.Time
+	if s.opts.Duration > 0 {
+		timer := time.NewTimer(s.opts.Duration)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	for {
+		select {
+		case <-deadline:
+			s.Stop()
+		case pkt := <-s.queue:
+			if s.err = s.write(pkt); s.err != nil {
+				return
+			}
+		case <-s.stopCh:
+			for {
+				select {
+				case pkt := <-s.queue:
+					if s.err = s.write(pkt); s.err != nil {
+						return
+					}
+				default:
+					s.err = s.w.Flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *Session) write(pkt packet) error {
+	if err := s.p.writePacket(pkt.ts, pkt.inbound, pkt.data, pkt.size); err != nil {
+		return err
+	}
+	// Flush once idle, so that streams are kept up to date.
+	if len(s.queue) == 0 {
+		return s.w.Flush()
+	}
+	return nil
+}
+
+// flushWriter flushes the underlying writer after each write if it
+// buffers, as http.ResponseWriter does.
+type flushWriter struct {
+	w io.Writer
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if fl, ok := f.w.(interface{ Flush() }); ok && err == nil {
+		fl.Flush()
+	}
+	return n, err
+}
@@ -0,0 +1,168 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+func udpPacket(src, dst string, srcPort, dstPort uint16, payload []byte) []byte {
+	b := make([]byte, header.IPv4MinimumSize+header.UDPMinimumSize+len(payload))
+	header.IPv4(b).Encode(&header.IPv4Fields{
+		TotalLength: uint16(len(b)),
+		TTL:         64,
+		Protocol:    uint8(header.UDPProtocolNumber),
+		SrcAddr:     tcpip.AddrFrom4(netip.MustParseAddr(src).As4()),
+		DstAddr:     tcpip.AddrFrom4(netip.MustParseAddr(dst).As4()),
+	})
+	header.UDP(b[header.IPv4MinimumSize:]).Encode(&header.UDPFields{
+		SrcPort: srcPort,
+		DstPort: dstPort,
+		Length:  uint16(header.UDPMinimumSize + len(payload)),
+	})
+	copy(b[header.IPv4MinimumSize+header.UDPMinimumSize:], payload)
+	return b
+}
+
+func newPacketBuffer(b []byte) *stack.PacketBuffer {
+	return stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload: buffer.MakeWithData(b),
+	})
+}
+
+type block struct {
+	typ  uint32
+	body []byte
+}
+
+func readBlocks(t *testing.T, b []byte) []block {
+	var blocks []block
+	for len(b) > 0 {
+		require.GreaterOrEqual(t, len(b), 12)
+		n := int(le.Uint32(b[4:]))
+		require.LessOrEqual(t, n, len(b))
+		require.Equal(t, uint32(n), le.Uint32(b[n-4:]))
+		blocks = append(blocks, block{typ: le.Uint32(b), body: b[8 : n-4]})
+		b = b[n:]
+	}
+	return blocks
+}
+
+func TestCapture(t *testing.T) {
+	lower := channel.New(16, 1500, "")
+	e := New(lower, "tun0")
+
+	var out bytes.Buffer
+	s, err := e.Start(&out, Options{
+		SnapLen: 32,
+		Count:   2,
+		Filter:  Filter{Port: 53, Protocol: "udp"},
+	})
+	require.NoError(t, err)
+	assert.Len(t, e.Sessions(), 1)
+
+	query := udpPacket("10.0.0.1", "8.8.8.8", 40000, 53, make([]byte, 64))
+	e.DeliverNetworkPacket(header.IPv4ProtocolNumber, newPacketBuffer(udpPacket("10.0.0.1", "1.1.1.1", 40000, 80, nil)))
+	e.DeliverNetworkPacket(header.IPv4ProtocolNumber, newPacketBuffer(query))
+
+	var pkts stack.PacketBufferList
+	pkts.PushBack(newPacketBuffer(udpPacket("8.8.8.8", "10.0.0.1", 53, 40000, nil)))
+	_, werr := e.WritePackets(pkts)
+	require.Nil(t, werr)
+	assert.Equal(t, 1, lower.NumQueued())
+
+	// Beyond count.
+	e.DeliverNetworkPacket(header.IPv4ProtocolNumber, newPacketBuffer(query))
+
+	select {
+	case <-s.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("session not stopped after count")
+	}
+	require.NoError(t, s.Wait())
+	assert.Empty(t, e.Sessions())
+	assert.Equal(t, int64(2), s.Stats().Packets)
+
+	blocks := readBlocks(t, out.Bytes())
+	require.Len(t, blocks, 4)
+	assert.Equal(t, uint32(blockSectionHeader), blocks[0].typ)
+	assert.Equal(t, uint32(byteOrderMagic), le.Uint32(blocks[0].body))
+
+	assert.Equal(t, uint32(blockInterfaceDescriptor), blocks[1].typ)
+	assert.Equal(t, uint16(linkTypeRaw), le.Uint16(blocks[1].body))
+	assert.Equal(t, uint32(32), le.Uint32(blocks[1].body[4:]))
+	assert.Equal(t, []byte("tun0"), blocks[1].body[12:16])
+
+	for i, want := range []struct {
+		data  []byte
+		size  int
+		flags uint32
+	}{
+		{query[:32], len(query), flagInbound},
+		{udpPacket("8.8.8.8", "10.0.0.1", 53, 40000, nil), 28, flagOutbound},
+	} {
+		b := blocks[2+i]
+		assert.Equal(t, uint32(blockEnhancedPacket), b.typ)
+		capLen := int(le.Uint32(b.body[12:]))
+		assert.Equal(t, len(want.data), capLen)
+		assert.Equal(t, uint32(want.size), le.Uint32(b.body[16:]))
+		assert.Equal(t, want.data, b.body[20:20+capLen])
+
+		opts := b.body[20+capLen+(-capLen&3):]
+		assert.Equal(t, uint16(optEPBFlags), le.Uint16(opts))
+		assert.Equal(t, want.flags, le.Uint32(opts[4:]))
+	}
+}
+
+func TestCaptureDuration(t *testing.T) {
+	e := New(channel.New(16, 1500, ""), "")
+	s, err := e.Start(&bytes.Buffer{}, Options{Duration: 10 * time.Millisecond})
+	require.NoError(t, err)
+
+	select {
+	case <-s.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("session not stopped after duration")
+	}
+	assert.Empty(t, e.Sessions())
+
+	_, err = e.Start(&bytes.Buffer{}, Options{Filter: Filter{Protocol: "sctp"}})
+	assert.Error(t, err)
+}
+
+func TestFilter(t *testing.T) {
+	udp := udpPacket("10.0.0.1", "8.8.8.8", 40000, 53, nil)
+	fragment := udpPacket("10.0.0.1", "8.8.8.8", 40000, 53, nil)
+	binary.BigEndian.PutUint16(fragment[6:], 100) // fragment offset
+
+	for _, tt := range []struct {
+		filter Filter
+		pkt    []byte
+		want   bool
+	}{
+		{Filter{}, udp, true},
+		{Filter{}, []byte{0x45}, true},
+		{Filter{Port: 53}, []byte{0x45}, false},
+		{Filter{Host: netip.MustParsePrefix("8.8.0.0/16")}, udp, true},
+		{Filter{Host: netip.MustParsePrefix("10.0.0.1/32")}, udp, true},
+		{Filter{Host: netip.MustParsePrefix("1.1.1.1/32")}, udp, false},
+		{Filter{Port: 40000}, udp, true},
+		{Filter{Port: 443}, udp, false},
+		{Filter{Protocol: "udp"}, udp, true},
+		{Filter{Protocol: "tcp"}, udp, false},
+		{Filter{Port: 53}, fragment, false},
+		{Filter{Protocol: "udp"}, fragment, true},
+	} {
+		assert.Equal(t, tt.want, tt.filter.Match(tt.pkt), "%+v", tt.filter)
+	}
+}
@@ -0,0 +1,105 @@
+package capture
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// Filter selects packets to capture, where the zero value of each
+// field matches any.
+type Filter struct {
+	// Host matches the source or destination address.
+	Host netip.Prefix
+	// Port matches the source or destination port of TCP and UDP.
+	Port uint16
+	// Protocol matches the transport protocol: tcp, udp or icmp
+	// (which includes ICMPv6). IPv6 extension headers are not
+	// followed, so packets carrying them match by Host only.
+	Protocol string
+}
+
+func (f *Filter) validate() error {
+	switch f.Protocol {
+	case "", "tcp", "udp", "icmp":
+		return nil
+	default:
+		return fmt.Errorf("unsupported protocol: %s", f.Protocol)
+	}
+}
+
+// Match reports whether the raw IP packet b is selected by f.
+func (f *Filter) Match(b []byte) bool {
+	src, dst, proto, transport, ok := parseIP(b)
+	if !ok {
+		// Keep malformed packets unless filtered, they might be
+		// exactly what is being debugged.
+		return !f.Host.IsValid() && f.Port == 0 && f.Protocol == ""
+	}
+	if f.Host.IsValid() && !f.Host.Contains(src) && !f.Host.Contains(dst) {
+		return false
+	}
+	if f.Protocol != "" && f.Protocol != protocolName(proto) {
+		return false
+	}
+	if f.Port != 0 {
+		if proto != uint8(header.TCPProtocolNumber) && proto != uint8(header.UDPProtocolNumber) {
+			return false
+		}
+		if len(transport) < 4 {
+			return false
+		}
+		srcPort, dstPort := binary.BigEndian.Uint16(transport[0:]), binary.BigEndian.Uint16(transport[2:])
+		if srcPort != f.Port && dstPort != f.Port {
+			return false
+		}
+	}
+	return true
+}
+
+// parseIP returns the addresses, transport protocol and payload of
+// the raw IP packet b, where the payload is empty for fragments other
+// than the first one.
+func parseIP(b []byte) (src, dst netip.Addr, proto uint8, transport []byte, ok bool) {
+	if len(b) == 0 {
+		return
+	}
+	switch header.IPVersion(b) {
+	case header.IPv4Version:
+		ip := header.IPv4(b)
+		if len(b) < header.IPv4MinimumSize || int(ip.HeaderLength()) > len(b) {
+			return
+		}
+		src = netip.AddrFrom4([4]byte(b[12:16]))
+		dst = netip.AddrFrom4([4]byte(b[16:20]))
+		proto = ip.Protocol()
+		if ip.FragmentOffset() == 0 {
+			transport = b[ip.HeaderLength():]
+		}
+		return src, dst, proto, transport, true
+	case header.IPv6Version:
+		if len(b) < header.IPv6MinimumSize {
+			return
+		}
+		ip := header.IPv6(b)
+		src = netip.AddrFrom16([16]byte(b[8:24]))
+		dst = netip.AddrFrom16([16]byte(b[24:40]))
+		return src, dst, ip.NextHeader(), b[header.IPv6MinimumSize:], true
+	}
+	return
+}
+
+func protocolName(proto uint8) string {
+	switch proto {
+	case uint8(header.TCPProtocolNumber):
+		return "tcp"
+	case uint8(header.UDPProtocolNumber):
+		return "udp"
+	case uint8(header.ICMPv4ProtocolNumber), uint8(header.ICMPv6ProtocolNumber):
+		return "icmp"
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,121 @@
+package capture
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// pcapng (draft-ietf-opsawg-pcapng) constants.
+const (
+	blockSectionHeader       = 0x0a0d0d0a
+	blockInterfaceDescriptor = 0x00000001
+	blockEnhancedPacket      = 0x00000006
+
+	byteOrderMagic = 0x1a2b3c4d
+
+	// linkTypeRaw is LINKTYPE_RAW, i.e. raw IPv4 or IPv6 packets
+	// without link layer header, as read from TUN devices.
+	linkTypeRaw = 101
+
+	optEndOfOpt = 0
+	optIfName   = 2
+	optIfTSRes  = 9
+	optEPBFlags = 2
+
+	// Direction bits of epb_flags.
+	flagInbound  = 1
+	flagOutbound = 2
+)
+
+var le = binary.LittleEndian
+
+// pcapngWriter writes a section with a single interface of raw IP
+// packets, timestamped in nanoseconds.
+type pcapngWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+func newPCAPNGWriter(w io.Writer) *pcapngWriter {
+	return &pcapngWriter{w: w}
+}
+
+// writeHeader writes the section header and interface description.
+func (p *pcapngWriter) writeHeader(name string, snapLen int) error {
+	b, start := beginBlock(p.buf[:0], blockSectionHeader)
+	b = le.AppendUint32(b, byteOrderMagic)
+	b = le.AppendUint16(b, 1)          // major version
+	b = le.AppendUint16(b, 0)          // minor version
+	b = le.AppendUint64(b, ^uint64(0)) // section length unspecified
+	b = endBlock(b, start)
+
+	b, start = beginBlock(b, blockInterfaceDescriptor)
+	b = le.AppendUint16(b, linkTypeRaw)
+	b = le.AppendUint16(b, 0) // reserved
+	b = le.AppendUint32(b, uint32(snapLen))
+	if name != "" {
+		b = appendOption(b, optIfName, []byte(name))
+	}
+	b = appendOption(b, optIfTSRes, []byte{9}) // 10^-9 seconds
+	b = appendOption(b, optEndOfOpt, nil)
+	b = endBlock(b, start)
+
+	return p.write(b)
+}
+
+// writePacket writes data captured from a packet of length size.
+func (p *pcapngWriter) writePacket(ts time.Time, inbound bool, data []byte, size int) error {
+	b, start := beginBlock(p.buf[:0], blockEnhancedPacket)
+	ns := uint64(ts.UnixNano())
+	b = le.AppendUint32(b, 0) // interface ID
+	b = le.AppendUint32(b, uint32(ns>>32))
+	b = le.AppendUint32(b, uint32(ns))
+	b = le.AppendUint32(b, uint32(len(data)))
+	b = le.AppendUint32(b, uint32(size))
+	b = appendPadded(b, data)
+
+	flags := uint32(flagOutbound)
+	if inbound {
+		flags = flagInbound
+	}
+	b = appendOption(b, optEPBFlags, le.AppendUint32(nil, flags))
+	b = appendOption(b, optEndOfOpt, nil)
+	b = endBlock(b, start)
+
+	return p.write(b)
+}
+
+func (p *pcapngWriter) write(b []byte) error {
+	p.buf = b[:0]
+	_, err := p.w.Write(b)
+	return err
+}
+
+// beginBlock appends the header of a block of type t to b, returning
+// the offset of the block.
+func beginBlock(b []byte, t uint32) ([]byte, int) {
+	start := len(b)
+	b = le.AppendUint32(b, t)
+	return le.AppendUint32(b, 0), start // length, filled by endBlock
+}
+
+// endBlock fills the length of the block at start and appends the
+// trailing length.
+func endBlock(b []byte, start int) []byte {
+	n := uint32(len(b) - start + 4)
+	le.PutUint32(b[start+4:], n)
+	return le.AppendUint32(b, n)
+}
+
+func appendOption(b []byte, code uint16, value []byte) []byte {
+	b = le.AppendUint16(b, code)
+	b = le.AppendUint16(b, uint16(len(value)))
+	return appendPadded(b, value)
+}
+
+// appendPadded appends v padded to 32 bits.
+func appendPadded(b, v []byte) []byte {
+	b = append(b, v...)
+	return append(b, make([]byte, -len(v)&3)...)
+}
@@ -0,0 +1,174 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/nested"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+
+	"github.com/xjasonlyu/tun2socks/v2/core/adapter"
+)
+
+var _ stack.LinkEndpoint = (*echoEndpoint)(nil)
+
+// echoEndpoint wraps a link endpoint, passing the inbound ICMP echo
+// requests to handle before the stack, which replies those to foreign
+// addresses only for IPv6.
+type echoEndpoint struct {
+	nested.Endpoint
+
+	s      *stack.Stack
+	nicID  tcpip.NICID
+	handle func(adapter.EchoRequest) bool
+}
+
+func newEchoEndpoint(lower stack.LinkEndpoint, s *stack.Stack, nicID tcpip.NICID, handle func(adapter.EchoRequest) bool) *echoEndpoint {
+	e := &echoEndpoint{s: s, nicID: nicID, handle: handle}
+	e.Endpoint.Init(lower, e)
+	return e
+}
+
+// DeliverNetworkPacket implements stack.NetworkDispatcher.
+func (e *echoEndpoint) DeliverNetworkPacket(protocol tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer) {
+	if r := e.parseEcho(pkt); r != nil && e.handle(r) {
+		return
+	}
+	e.Endpoint.DeliverNetworkPacket(protocol, pkt)
+}
+
+// parseEcho returns the echo request in pkt, or nil if it's not one.
+// Only the headers are pulled up for the other packets.
+func (e *echoEndpoint) parseEcho(pkt *stack.PacketBuffer) *echoRequest {
+	b, ok := pkt.Data().PullUp(1)
+	if !ok {
+		return nil
+	}
+
+	switch header.IPVersion(b) {
+	case header.IPv4Version:
+		if b, ok = pkt.Data().PullUp(header.IPv4MinimumSize); !ok {
+			return nil
+		}
+		if ip := header.IPv4(b); ip.TransportProtocol() != header.ICMPv4ProtocolNumber || ip.More() || ip.FragmentOffset() != 0 {
+			return nil
+		}
+
+		ip := header.IPv4(pkt.Data().AsRange().ToSlice())
+		if !ip.IsValid(len(ip)) || !ip.IsChecksumValid() {
+			return nil
+		}
+		icmp := header.ICMPv4(ip.Payload())
+		if len(icmp) < header.ICMPv4MinimumSize || icmp.Type() != header.ICMPv4Echo ||
+			checksum.Checksum(icmp, 0) != 0xffff {
+			return nil
+		}
+		dst := ip.DestinationAddress()
+		if header.IsV4MulticastAddress(dst) || dst == header.IPv4Broadcast {
+			return nil
+		}
+		return &echoRequest{
+			e:     e,
+			proto: header.IPv4ProtocolNumber,
+			id:    stack.TransportEndpointID{LocalAddress: dst, RemoteAddress: ip.SourceAddress()},
+			ident: icmp.Ident(),
+			seq:   icmp.Sequence(),
+			data:  icmp.Payload(),
+			pkt:   ip,
+		}
+	case header.IPv6Version:
+		if b, ok = pkt.Data().PullUp(header.IPv6MinimumSize); !ok {
+			return nil
+		}
+		if header.IPv6(b).TransportProtocol() != header.ICMPv6ProtocolNumber {
+			return nil
+		}
+
+		ip := header.IPv6(pkt.Data().AsRange().ToSlice())
+		if !ip.IsValid(len(ip)) {
+			return nil
+		}
+		icmp := header.ICMPv6(ip.Payload())
+		if len(icmp) < header.ICMPv6EchoMinimumSize || icmp.Type() != header.ICMPv6EchoRequest {
+			return nil
+		}
+		src, dst := ip.SourceAddress(), ip.DestinationAddress()
+		if icmp.Checksum() != header.ICMPv6Checksum(header.ICMPv6ChecksumParams{Header: icmp, Src: src, Dst: dst}) ||
+			header.IsV6MulticastAddress(dst) {
+			return nil
+		}
+		return &echoRequest{
+			e:     e,
+			proto: header.IPv6ProtocolNumber,
+			id:    stack.TransportEndpointID{LocalAddress: dst, RemoteAddress: src},
+			ident: icmp.Ident(),
+			seq:   icmp.Sequence(),
+			data:  icmp.Payload(),
+			pkt:   ip,
+		}
+	default:
+		return nil
+	}
+}
+
+var _ adapter.EchoRequest = (*echoRequest)(nil)
+
+type echoRequest struct {
+	e     *echoEndpoint
+	proto tcpip.NetworkProtocolNumber
+	id    stack.TransportEndpointID
+	ident uint16
+	seq   uint16
+	data  []byte
+	// pkt is the whole packet, quoted in ICMP errors.
+	pkt []byte
+}
+
+func (r *echoRequest) ID() *stack.TransportEndpointID {
+	return &r.id
+}
+
+func (r *echoRequest) Ident() uint16 {
+	return r.ident
+}
+
+func (r *echoRequest) Seq() uint16 {
+	return r.seq
+}
+
+func (r *echoRequest) Payload() []byte {
+	return r.data
+}
+
+func (r *echoRequest) Reply() error {
+	msg := &icmpMessage{data: r.data}
+	binary.BigEndian.PutUint16(msg.rest[:2], r.ident)
+	binary.BigEndian.PutUint16(msg.rest[2:], r.seq)
+	if r.proto == header.IPv4ProtocolNumber {
+		msg.typ = uint8(header.ICMPv4EchoReply)
+	} else {
+		msg.typ = uint8(header.ICMPv6EchoReply)
+	}
+
+	if err := writeICMP(r.e.s, r.e.nicID, r.proto, r.id.LocalAddress, r.id.RemoteAddress, msg); err != nil {
+		return errors.New(err.String())
+	}
+	return nil
+}
+
+func (r *echoRequest) Unreachable() error {
+	q := &quotedPacket{
+		nicID: r.e.nicID,
+		proto: r.proto,
+		src:   r.id.RemoteAddress,
+		dst:   r.id.LocalAddress,
+		data:  quote(r.proto, r.pkt),
+	}
+	if err := q.replyUnreachable(r.e.s); err != nil {
+		return errors.New(err.String())
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+
+	"github.com/xjasonlyu/tun2socks/v2/core/adapter"
+)
+
+type echoHandler struct {
+	filterHandler
+	// answer answers the requests, which are left to the stack if nil.
+	answer func(adapter.EchoRequest) error
+	reqs   chan adapter.EchoRequest
+}
+
+func (h *echoHandler) HandleEcho(req adapter.EchoRequest) bool {
+	h.reqs <- req
+	if h.answer != nil {
+		return h.answer(req) == nil
+	}
+	return false
+}
+
+// newEcho returns an IPv4 ICMP echo request from testSrc to testDst.
+func newEcho(payload []byte) []byte {
+	b := make([]byte, header.IPv4MinimumSize+header.ICMPv4MinimumSize+len(payload))
+	ip := header.IPv4(b)
+	ip.Encode(&header.IPv4Fields{
+		TotalLength: uint16(len(b)),
+		TTL:         64,
+		Protocol:    uint8(header.ICMPv4ProtocolNumber),
+		SrcAddr:     testSrc,
+		DstAddr:     testDst,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+
+	icmp := header.ICMPv4(b[header.IPv4MinimumSize:])
+	icmp.SetType(header.ICMPv4Echo)
+	icmp.SetIdent(7)
+	icmp.SetSequence(42)
+	copy(icmp.Payload(), payload)
+	icmp.SetChecksum(^checksum.Checksum(icmp, 0))
+	return b
+}
+
+func testEcho(t *testing.T, answer func(adapter.EchoRequest) error) (*echoHandler, header.IPv4, bool) {
+	ep := channel.New(16, 1500, "")
+	h := &echoHandler{answer: answer, reqs: make(chan adapter.EchoRequest, 1)}
+	s, err := CreateStack(&Config{LinkEndpoint: ep, TransportHandler: h})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		s.Close()
+		ep.Close()
+	})
+
+	ep.InjectInbound(header.IPv4ProtocolNumber, stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload: buffer.MakeWithData(newEcho([]byte("ping"))),
+	}))
+	ip, ok := readPacket(ep)
+	return h, ip, ok
+}
+
+func TestEcho(t *testing.T) {
+	h, ip, ok := testEcho(t, adapter.EchoRequest.Reply)
+	req := <-h.reqs
+	assert.Equal(t, testDst, req.ID().LocalAddress)
+	assert.Equal(t, testSrc, req.ID().RemoteAddress)
+	assert.Equal(t, uint16(7), req.Ident())
+	assert.Equal(t, uint16(42), req.Seq())
+	assert.Equal(t, []byte("ping"), req.Payload())
+
+	require.True(t, ok)
+	assert.True(t, ip.IsChecksumValid())
+	assert.Equal(t, testDst, ip.SourceAddress())
+	assert.Equal(t, testSrc, ip.DestinationAddress())
+	icmp := header.ICMPv4(ip.Payload())
+	assert.Equal(t, header.ICMPv4EchoReply, icmp.Type())
+	assert.Equal(t, uint16(7), icmp.Ident())
+	assert.Equal(t, uint16(42), icmp.Sequence())
+	assert.Equal(t, uint16(0xffff), checksum.Checksum(icmp, 0))
+	assert.Equal(t, []byte("ping"), []byte(icmp.Payload()))
+
+	// Unhandled requests to foreign addresses are not replied by the
+	// stack for IPv4.
+	h, _, ok = testEcho(t, nil)
+	<-h.reqs
+	assert.False(t, ok)
+}
+
+func TestEchoUnreachable(t *testing.T) {
+	h, ip, ok := testEcho(t, adapter.EchoRequest.Unreachable)
+	<-h.reqs
+
+	require.True(t, ok)
+	assert.True(t, ip.IsChecksumValid())
+	assert.Equal(t, testDst, ip.SourceAddress())
+	assert.Equal(t, testSrc, ip.DestinationAddress())
+	icmp := header.ICMPv4(ip.Payload())
+	assert.Equal(t, header.ICMPv4DstUnreachable, icmp.Type())
+	assert.Equal(t, header.ICMPv4AdminProhibited, icmp.Code())
+	assert.Equal(t, uint16(0xffff), checksum.Checksum(icmp, 0))
+	assert.Equal(t, newEcho([]byte("ping")), []byte(icmp.Payload()))
+}
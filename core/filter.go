@@ -0,0 +1,184 @@
+package core
+
+import (
+	"sync"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+
+	"github.com/xjasonlyu/tun2socks/v2/core/adapter"
+)
+
+type packetHandler func(stack.TransportEndpointID, *stack.PacketBuffer) bool
+
+// withFilter returns the transport protocol handler which decides on
+// packets with filter before passing them to next. The packets of
+// established flows are delivered to their endpoints by the stack,
+// so only those of new flows reach the handler.
+func withFilter(s *stack.Stack, filter func(*stack.TransportEndpointID) adapter.Action, next packetHandler) packetHandler {
+	return func(id stack.TransportEndpointID, pkt *stack.PacketBuffer) bool {
+		return apply(s, filter(&id), id, pkt, next)
+	}
+}
+
+// withTCPFilter is withFilter for TCP, which filters SYN segments only,
+// as the others without endpoints are refused by the forwarder anyway.
+// The SYN segments of deferred handshakes are kept in syns for their
+// forwarder requests, and their retransmits are passed on as decided.
+func withTCPFilter(s *stack.Stack, filter func(*stack.TransportEndpointID) adapter.Action, syns *synStore, next packetHandler) packetHandler {
+	return func(id stack.TransportEndpointID, pkt *stack.PacketBuffer) bool {
+		flags := header.TCP(pkt.TransportHeader().Slice()).Flags()
+		if flags&(header.TCPFlagSyn|header.TCPFlagAck) != header.TCPFlagSyn || syns.has(id) {
+			return next(id, pkt)
+		}
+		action := filter(&id)
+		if action == adapter.ActionDefer {
+			syns.put(id, newQuotedPacket(pkt))
+		}
+		return apply(s, action, id, pkt, next)
+	}
+}
+
+func apply(s *stack.Stack, action adapter.Action, id stack.TransportEndpointID, pkt *stack.PacketBuffer, next packetHandler) bool {
+	switch action {
+	case adapter.ActionReset:
+		// Unhandled packets are replied by the stack with TCP RST,
+		// or ICMP port unreachable for UDP.
+		return false
+	case adapter.ActionUnreachable:
+		newQuotedPacket(pkt).replyUnreachable(s)
+		return true
+	case adapter.ActionDrop:
+		return true
+	default:
+		return next(id, pkt)
+	}
+}
+
+// synTimeout is how long the SYN segments are kept in synStore if
+// their forwarder requests are not handled, e.g. dropped by the
+// forwarder beyond its in-flight limit.
+const synTimeout = time.Minute
+
+// synStore holds the SYN segments of deferred handshakes until their
+// forwarder requests are completed.
+type synStore struct {
+	mu    sync.Mutex
+	m     map[stack.TransportEndpointID]*synEntry
+	swept time.Time
+}
+
+type synEntry struct {
+	q     *quotedPacket
+	added time.Time
+	taken bool
+}
+
+func newSYNStore() *synStore {
+	return &synStore{
+		m:     make(map[stack.TransportEndpointID]*synEntry),
+		swept: time.Now(),
+	}
+}
+
+// has reports whether the handshake of id is deferred and pending.
+func (st *synStore) has(id stack.TransportEndpointID) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	_, ok := st.m[id]
+	return ok
+}
+
+func (st *synStore) put(id stack.TransportEndpointID, q *quotedPacket) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	now := time.Now()
+	if now.Sub(st.swept) >= synTimeout {
+		st.sweep(now)
+	}
+	st.m[id] = &synEntry{q: q, added: now}
+}
+
+// sweep removes the segments not taken within synTimeout.
+func (st *synStore) sweep(now time.Time) {
+	st.swept = now
+	for id, e := range st.m {
+		if !e.taken && now.Sub(e.added) >= synTimeout {
+			delete(st.m, id)
+		}
+	}
+}
+
+// take returns the segment of id for its forwarder request, which is
+// kept until the request is completed.
+func (st *synStore) take(id stack.TransportEndpointID) *quotedPacket {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	e, ok := st.m[id]
+	if !ok {
+		return nil
+	}
+	e.taken = true
+	return e.q
+}
+
+func (st *synStore) remove(id stack.TransportEndpointID) {
+	st.mu.Lock()
+	delete(st.m, id)
+	st.mu.Unlock()
+}
+
+// quotedPacket is the copy of a received packet, kept to reply ICMP
+// errors to it. Data is truncated to what fits in ICMP errors.
+type quotedPacket struct {
+	nicID    tcpip.NICID
+	proto    tcpip.NetworkProtocolNumber
+	src, dst tcpip.Address
+	data     []byte
+}
+
+func newQuotedPacket(pkt *stack.PacketBuffer) *quotedPacket {
+	v := stack.PayloadSince(pkt.NetworkHeader())
+	defer v.Release()
+
+	return &quotedPacket{
+		nicID: pkt.NICID,
+		proto: pkt.NetworkProtocolNumber,
+		src:   pkt.Network().SourceAddress(),
+		dst:   pkt.Network().DestinationAddress(),
+		data:  quote(pkt.NetworkProtocolNumber, v.AsSlice()),
+	}
+}
+
+// quote returns a copy of the leading bytes of the packet b to quote in
+// ICMP errors, as many as fit in the minimum MTU.
+func quote(proto tcpip.NetworkProtocolNumber, b []byte) []byte {
+	n := len(b)
+	switch proto {
+	case header.IPv4ProtocolNumber:
+		n = min(n, header.IPv4MinimumProcessableDatagramSize-header.IPv4MinimumSize-header.ICMPv4MinimumSize)
+	case header.IPv6ProtocolNumber:
+		n = min(n, header.IPv6MinimumMTU-header.IPv6MinimumSize-header.ICMPv6DstUnreachableMinimumSize)
+	}
+	return append([]byte(nil), b[:n]...)
+}
+
+// replyUnreachable sends the ICMP error of communication administratively
+// prohibited back to the source of q.
+func (q *quotedPacket) replyUnreachable(s *stack.Stack) tcpip.Error {
+	src, dst := q.dst, q.src
+	if header.IsV4MulticastAddress(src) || header.IsV6MulticastAddress(src) || src == header.IPv4Broadcast {
+		return nil
+	}
+
+	msg := &icmpMessage{data: q.data}
+	switch q.proto {
+	case header.IPv4ProtocolNumber:
+		msg.typ, msg.code = uint8(header.ICMPv4DstUnreachable), uint8(header.ICMPv4AdminProhibited)
+	case header.IPv6ProtocolNumber:
+		msg.typ, msg.code = uint8(header.ICMPv6DstUnreachable), uint8(header.ICMPv6Prohibited)
+	}
+	return writeICMP(s, q.nicID, q.proto, src, dst, msg)
+}
@@ -0,0 +1,206 @@
+package core
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+
+	"github.com/xjasonlyu/tun2socks/v2/core/adapter"
+)
+
+type filterHandler struct {
+	action   adapter.Action
+	tcp      chan adapter.TCPConn
+	filtered atomic.Int32
+}
+
+func (h *filterHandler) HandleTCP(conn adapter.TCPConn) { h.tcp <- conn }
+func (h *filterHandler) HandleUDP(conn adapter.UDPConn) { conn.Close() }
+
+func (h *filterHandler) FilterTCP(*stack.TransportEndpointID) adapter.Action {
+	h.filtered.Add(1)
+	return h.action
+}
+func (h *filterHandler) FilterUDP(*stack.TransportEndpointID) adapter.Action { return h.action }
+
+var (
+	testSrc = tcpip.AddrFrom4([4]byte{10, 0, 0, 1})
+	testDst = tcpip.AddrFrom4([4]byte{169, 254, 169, 254})
+)
+
+// newSYN returns an IPv4 TCP SYN segment from testSrc to testDst:80.
+func newSYN() []byte {
+	b := make([]byte, header.IPv4MinimumSize+header.TCPMinimumSize)
+	ip := header.IPv4(b)
+	ip.Encode(&header.IPv4Fields{
+		TotalLength: uint16(len(b)),
+		TTL:         64,
+		Protocol:    uint8(header.TCPProtocolNumber),
+		SrcAddr:     testSrc,
+		DstAddr:     testDst,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+
+	tcp := header.TCP(b[header.IPv4MinimumSize:])
+	tcp.Encode(&header.TCPFields{
+		SrcPort:    12345,
+		DstPort:    80,
+		SeqNum:     1000,
+		DataOffset: header.TCPMinimumSize,
+		Flags:      header.TCPFlagSyn,
+		WindowSize: 65535,
+	})
+	xsum := header.PseudoHeaderChecksum(header.TCPProtocolNumber, testSrc, testDst, uint16(len(tcp)))
+	tcp.SetChecksum(^checksum.Checksum(tcp, xsum))
+	return b
+}
+
+func newFilterStack(t *testing.T, action adapter.Action) (*channel.Endpoint, *filterHandler) {
+	ep := channel.New(16, 1500, "")
+	h := &filterHandler{action: action, tcp: make(chan adapter.TCPConn, 1)}
+	s, err := CreateStack(&Config{LinkEndpoint: ep, TransportHandler: h})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		s.Close()
+		ep.Close()
+	})
+
+	injectSYN(ep)
+	return ep, h
+}
+
+func injectSYN(ep *channel.Endpoint) {
+	ep.InjectInbound(header.IPv4ProtocolNumber, stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload: buffer.MakeWithData(newSYN()),
+	}))
+}
+
+func readPacket(ep *channel.Endpoint) (header.IPv4, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	pkt := ep.ReadContext(ctx)
+	if pkt == nil {
+		return nil, false
+	}
+	defer pkt.DecRef()
+	return header.IPv4(pkt.ToView().AsSlice()), true
+}
+
+func testFilter(t *testing.T, action adapter.Action) (header.IPv4, bool) {
+	ep, _ := newFilterStack(t, action)
+	return readPacket(ep)
+}
+
+func assertUnreachable(t *testing.T, ip header.IPv4) {
+	assert.True(t, ip.IsChecksumValid())
+	assert.Equal(t, testDst, ip.SourceAddress())
+	assert.Equal(t, testSrc, ip.DestinationAddress())
+	icmp := header.ICMPv4(ip.Payload())
+	assert.Equal(t, header.ICMPv4DstUnreachable, icmp.Type())
+	assert.Equal(t, header.ICMPv4AdminProhibited, icmp.Code())
+	assert.Equal(t, uint16(0xffff), checksum.Checksum(icmp, 0))
+	assert.Equal(t, newSYN(), []byte(icmp.Payload()))
+}
+
+func assertTCPFlags(t *testing.T, ip header.IPv4, flags header.TCPFlags) {
+	assert.Equal(t, uint8(header.TCPProtocolNumber), ip.Protocol())
+	assert.Equal(t, flags, header.TCP(ip.Payload()).Flags()&flags)
+}
+
+func TestFilterTCP(t *testing.T) {
+	// Accepted SYN is replied with SYN-ACK.
+	ip, ok := testFilter(t, adapter.ActionAccept)
+	require.True(t, ok)
+	assertTCPFlags(t, ip, header.TCPFlagSyn|header.TCPFlagAck)
+
+	ip, ok = testFilter(t, adapter.ActionReset)
+	require.True(t, ok)
+	assertTCPFlags(t, ip, header.TCPFlagRst)
+
+	ip, ok = testFilter(t, adapter.ActionUnreachable)
+	require.True(t, ok)
+	assertUnreachable(t, ip)
+
+	_, ok = testFilter(t, adapter.ActionDrop)
+	assert.False(t, ok)
+}
+
+func TestDeferredTCP(t *testing.T) {
+	pending := func(t *testing.T) (*channel.Endpoint, adapter.PendingTCPConn) {
+		ep, h := newFilterStack(t, adapter.ActionDefer)
+		conn := (<-h.tcp).(adapter.PendingTCPConn)
+		assert.Equal(t, uint16(80), conn.ID().LocalPort)
+
+		// The SYN is held until decided, and its retransmits are not
+		// filtered again.
+		_, ok := readPacket(ep)
+		assert.False(t, ok)
+		injectSYN(ep)
+		assert.EqualValues(t, 1, h.filtered.Load())
+		return ep, conn
+	}
+
+	t.Run("Accept", func(t *testing.T) {
+		ep, conn := pending(t)
+		go conn.Accept()
+		ip, ok := readPacket(ep)
+		require.True(t, ok)
+		assertTCPFlags(t, ip, header.TCPFlagSyn|header.TCPFlagAck)
+	})
+
+	t.Run("Unreachable", func(t *testing.T) {
+		ep, conn := pending(t)
+		conn.Reject(adapter.ActionUnreachable)
+		ip, ok := readPacket(ep)
+		require.True(t, ok)
+		assertUnreachable(t, ip)
+
+		// Completed only once.
+		assert.Error(t, conn.Accept())
+		assert.NoError(t, conn.Close())
+		_, ok = readPacket(ep)
+		assert.False(t, ok)
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		ep, conn := pending(t)
+		assert.NoError(t, conn.Close())
+		ip, ok := readPacket(ep)
+		require.True(t, ok)
+		assertTCPFlags(t, ip, header.TCPFlagRst)
+	})
+}
+
+func TestSYNStore(t *testing.T) {
+	id := stack.TransportEndpointID{LocalPort: 80, RemotePort: 12345}
+	q := &quotedPacket{}
+
+	st := newSYNStore()
+	st.put(id, q)
+	assert.True(t, st.has(id))
+	assert.Same(t, q, st.take(id))
+
+	// Taken ones are kept until completed.
+	st.sweep(time.Now().Add(synTimeout))
+	assert.True(t, st.has(id))
+	st.remove(id)
+	assert.False(t, st.has(id))
+	assert.Nil(t, st.take(id))
+
+	// Those never taken are removed once timed out.
+	st.put(id, q)
+	st.sweep(time.Now().Add(synTimeout / 2))
+	assert.True(t, st.has(id))
+	st.sweep(time.Now().Add(synTimeout))
+	assert.False(t, st.has(id))
+}
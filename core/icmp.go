@@ -0,0 +1,75 @@
+package core
+
+import (
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// defaultTTL is the TTL or hop limit of ICMP messages sent by core.
+const defaultTTL = 64
+
+// icmpMessage is an ICMPv4 or ICMPv6 message, of which the header is
+// type, code, checksum and the 4 bytes of rest.
+type icmpMessage struct {
+	typ, code uint8
+	rest      [4]byte
+	data      []byte
+}
+
+// writeICMP sends msg from src to dst through the NIC of nicID, without
+// going through the stack, which only sends ICMP messages from its own
+// addresses.
+func writeICMP(s *stack.Stack, nicID tcpip.NICID, proto tcpip.NetworkProtocolNumber, src, dst tcpip.Address, msg *icmpMessage) tcpip.Error {
+	var b []byte
+	switch proto {
+	case header.IPv4ProtocolNumber:
+		const offset = header.IPv4MinimumSize + header.ICMPv4MinimumSize
+		b = make([]byte, offset+len(msg.data))
+
+		ip := header.IPv4(b)
+		ip.Encode(&header.IPv4Fields{
+			TotalLength: uint16(len(b)),
+			TTL:         defaultTTL,
+			Protocol:    uint8(header.ICMPv4ProtocolNumber),
+			SrcAddr:     src,
+			DstAddr:     dst,
+		})
+		ip.SetChecksum(^ip.CalculateChecksum())
+
+		icmp := header.ICMPv4(b[header.IPv4MinimumSize:])
+		icmp.SetType(header.ICMPv4Type(msg.typ))
+		icmp.SetCode(header.ICMPv4Code(msg.code))
+		copy(icmp[4:], msg.rest[:])
+		copy(icmp[header.ICMPv4MinimumSize:], msg.data)
+		icmp.SetChecksum(^checksum.Checksum(icmp, 0))
+	case header.IPv6ProtocolNumber:
+		const offset = header.IPv6MinimumSize + header.ICMPv6MinimumSize
+		b = make([]byte, offset+len(msg.data))
+
+		ip := header.IPv6(b)
+		ip.Encode(&header.IPv6Fields{
+			PayloadLength:     uint16(len(b) - header.IPv6MinimumSize),
+			TransportProtocol: header.ICMPv6ProtocolNumber,
+			HopLimit:          defaultTTL,
+			SrcAddr:           src,
+			DstAddr:           dst,
+		})
+
+		icmp := header.ICMPv6(b[header.IPv6MinimumSize:])
+		icmp.SetType(header.ICMPv6Type(msg.typ))
+		icmp.SetCode(header.ICMPv6Code(msg.code))
+		copy(icmp[4:], msg.rest[:])
+		copy(icmp[header.ICMPv6MinimumSize:], msg.data)
+		icmp.SetChecksum(header.ICMPv6Checksum(header.ICMPv6ChecksumParams{
+			Header: icmp,
+			Src:    src,
+			Dst:    dst,
+		}))
+	default:
+		return &tcpip.ErrUnknownProtocol{}
+	}
+	return s.WriteRawPacket(nicID, proto, buffer.MakeWithData(b))
+}
@@ -53,19 +53,31 @@ func CreateStack(cfg *Config) (*stack.Stack, error) {
 		},
 	})
 
+	// Decide on new flows before they're established, if supported.
+	var filterTCP, filterUDP func(*stack.TransportEndpointID) adapter.Action
+	if f, ok := cfg.TransportHandler.(adapter.TransportFilter); ok {
+		filterTCP, filterUDP = f.FilterTCP, f.FilterUDP
+	}
+
 	// Generate unique NIC id.
 	nicID := s.NextNICID()
 
+	// Intercept ICMP echo requests before the stack, if supported.
+	ep := cfg.LinkEndpoint
+	if h, ok := cfg.TransportHandler.(adapter.EchoHandler); ok {
+		ep = newEchoEndpoint(ep, s, nicID, h.HandleEcho)
+	}
+
 	opts = append(opts,
 		// Important: We must initiate transport protocol handlers
 		// before creating NIC, otherwise NIC would dispatch packets
 		// to stack and cause race condition.
 		// Initiate transport protocol (TCP/UDP) with given handler.
-		withTCPHandler(cfg.TransportHandler.HandleTCP),
-		withUDPHandler(cfg.TransportHandler.HandleUDP),
+		withTCPHandler(cfg.TransportHandler.HandleTCP, filterTCP),
+		withUDPHandler(cfg.TransportHandler.HandleUDP, filterUDP),
 
 		// Create stack NIC and then bind link endpoint to it.
-		withCreatingNIC(nicID, cfg.LinkEndpoint),
+		withCreatingNIC(nicID, ep),
 
 		// In the past we did s.AddAddressRange to assign 0.0.0.0/0
 		// onto the interface. We need that to be able to terminate
@@ -1,6 +1,8 @@
 package core
 
 import (
+	"errors"
+	"sync"
 	"time"
 
 	glog "gvisor.dev/gvisor/pkg/log"
@@ -41,45 +43,71 @@ const (
 	tcpKeepaliveInterval = 30 * time.Second
 )
 
-func withTCPHandler(handle func(adapter.TCPConn)) option.Option {
+func withTCPHandler(handle func(adapter.TCPConn), filter func(*stack.TransportEndpointID) adapter.Action) option.Option {
 	return func(s *stack.Stack) error {
+		syns := newSYNStore()
 		tcpForwarder := tcp.NewForwarder(s, defaultWndSize, maxConnAttempts, func(r *tcp.ForwarderRequest) {
-			var (
-				wq  waiter.Queue
-				ep  tcpip.Endpoint
-				err tcpip.Error
-				id  = r.ID()
-			)
-
-			defer func() {
-				if err != nil {
-					glog.Debugf("forward tcp request: %s:%d->%s:%d: %s",
-						id.RemoteAddress, id.RemotePort, id.LocalAddress, id.LocalPort, err)
-				}
-			}()
-
-			// Perform a TCP three-way handshake.
-			ep, err = r.CreateEndpoint(&wq)
-			if err != nil {
-				// RST: prevent potential half-open TCP connection leak.
-				r.Complete(true)
+			// The handshake is deferred by filter, until the
+			// handler decides on the pending connection.
+			id := r.ID()
+			if syn := syns.take(id); syn != nil {
+				handle(&pendingTCPConn{
+					tcpConn: tcpConn{id: id},
+					s:       s,
+					r:       r,
+					syn:     syn,
+					syns:    syns,
+				})
 				return
 			}
-			defer r.Complete(false)
 
-			err = setSocketOptions(s, ep)
-
-			conn := &tcpConn{
-				TCPConn: gonet.NewTCPConn(&wq, ep),
-				id:      id,
+			if conn, _ := createTCPConn(s, r); conn != nil {
+				handle(conn)
 			}
-			handle(conn)
 		})
-		s.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpForwarder.HandlePacket)
+		handler := tcpForwarder.HandlePacket
+		if filter != nil {
+			handler = withTCPFilter(s, filter, syns, handler)
+		}
+		s.SetTransportProtocolHandler(tcp.ProtocolNumber, handler)
 		return nil
 	}
 }
 
+// createTCPConn performs the TCP three-way handshake of r, and returns
+// nil conn if it fails. The error of setting socket options is returned
+// along with conn.
+func createTCPConn(s *stack.Stack, r *tcp.ForwarderRequest) (conn *tcpConn, err tcpip.Error) {
+	var (
+		wq waiter.Queue
+		ep tcpip.Endpoint
+		id = r.ID()
+	)
+
+	defer func() {
+		if err != nil {
+			glog.Debugf("forward tcp request: %s:%d->%s:%d: %s",
+				id.RemoteAddress, id.RemotePort, id.LocalAddress, id.LocalPort, err)
+		}
+	}()
+
+	// Perform a TCP three-way handshake.
+	ep, err = r.CreateEndpoint(&wq)
+	if err != nil {
+		// RST: prevent potential half-open TCP connection leak.
+		r.Complete(true)
+		return nil, err
+	}
+	defer r.Complete(false)
+
+	err = setSocketOptions(s, ep)
+
+	return &tcpConn{
+		TCPConn: gonet.NewTCPConn(&wq, ep),
+		id:      id,
+	}, err
+}
+
 func setSocketOptions(s *stack.Stack, ep tcpip.Endpoint) tcpip.Error {
 	{ /* TCP keepalive options */
 		ep.SocketOptions().SetKeepAlive(true)
@@ -120,3 +148,69 @@ type tcpConn struct {
 func (c *tcpConn) ID() *stack.TransportEndpointID {
 	return &c.id
 }
+
+// pendingTCPConn is a tcpConn of which the handshake is deferred.
+type pendingTCPConn struct {
+	tcpConn
+
+	s    *stack.Stack
+	r    *tcp.ForwarderRequest
+	syn  *quotedPacket
+	syns *synStore
+
+	mu   sync.Mutex
+	done bool
+}
+
+func (c *pendingTCPConn) Accept() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.done {
+		return errors.New("already completed")
+	}
+	c.done = true
+	defer c.syns.remove(c.id)
+
+	conn, err := createTCPConn(c.s, c.r)
+	if conn == nil {
+		return errors.New(err.String())
+	}
+	c.TCPConn = conn.TCPConn
+	return nil
+}
+
+func (c *pendingTCPConn) Reject(action adapter.Action) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rejectLocked(action)
+}
+
+func (c *pendingTCPConn) rejectLocked(action adapter.Action) {
+	if c.done {
+		return
+	}
+	c.done = true
+	defer c.syns.remove(c.id)
+
+	switch action {
+	case adapter.ActionUnreachable:
+		c.r.Complete(false)
+		c.syn.replyUnreachable(c.s)
+	case adapter.ActionDrop:
+		c.r.Complete(false)
+	default:
+		c.r.Complete(true)
+	}
+}
+
+func (c *pendingTCPConn) Close() error {
+	c.mu.Lock()
+	c.rejectLocked(adapter.ActionReset)
+	conn := c.TCPConn
+	c.mu.Unlock()
+
+	if conn == nil {
+		return nil
+	}
+	return conn.Close()
+}
@@ -1,8 +1,13 @@
 package core
 
 import (
+	"fmt"
+	"net/netip"
+
 	glog "gvisor.dev/gvisor/pkg/log"
+	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
 	"gvisor.dev/gvisor/pkg/waiter"
@@ -11,7 +16,7 @@ import (
 	"github.com/xjasonlyu/tun2socks/v2/core/option"
 )
 
-func withUDPHandler(handle func(adapter.UDPConn)) option.Option {
+func withUDPHandler(handle func(adapter.UDPConn), filter func(*stack.TransportEndpointID) adapter.Action) option.Option {
 	return func(s *stack.Stack) error {
 		udpForwarder := udp.NewForwarder(s, func(r *udp.ForwarderRequest) {
 			var (
@@ -28,19 +33,62 @@ func withUDPHandler(handle func(adapter.UDPConn)) option.Option {
 			conn := &udpConn{
 				UDPConn: gonet.NewUDPConn(&wq, ep),
 				id:      id,
+				s:       s,
 			}
 			handle(conn)
 		})
-		s.SetTransportProtocolHandler(udp.ProtocolNumber, udpForwarder.HandlePacket)
+		handler := udpForwarder.HandlePacket
+		if filter != nil {
+			handler = withFilter(s, filter, handler)
+		}
+		s.SetTransportProtocolHandler(udp.ProtocolNumber, handler)
 		return nil
 	}
 }
 
+var _ adapter.ConeUDPConn = (*udpConn)(nil)
+
 type udpConn struct {
 	*gonet.UDPConn
 	id stack.TransportEndpointID
+	s  *stack.Stack
 }
 
 func (c *udpConn) ID() *stack.TransportEndpointID {
 	return &c.id
 }
+
+// DialFrom binds a new endpoint to from, which is allowed for foreign
+// addresses by spoofing, and connects it to the source of c. The stack
+// then delivers the datagrams between them to the endpoint rather than
+// the forwarder.
+func (c *udpConn) DialFrom(from netip.AddrPort) (adapter.UDPConn, error) {
+	var (
+		addr  = tcpip.AddrFromSlice(from.Addr().Unmap().AsSlice())
+		proto = header.IPv4ProtocolNumber
+	)
+	if addr.Len() == header.IPv6AddressSize {
+		proto = header.IPv6ProtocolNumber
+	}
+	if addr.Len() != c.id.RemoteAddress.Len() {
+		return nil, fmt.Errorf("dial udp from %s: address family mismatch", from)
+	}
+
+	pc, err := gonet.DialUDP(c.s,
+		&tcpip.FullAddress{Addr: addr, Port: from.Port()},
+		&tcpip.FullAddress{Addr: c.id.RemoteAddress, Port: c.id.RemotePort},
+		proto)
+	if err != nil {
+		return nil, err
+	}
+	return &udpConn{
+		UDPConn: pc,
+		id: stack.TransportEndpointID{
+			LocalPort:     from.Port(),
+			LocalAddress:  addr,
+			RemotePort:    c.id.RemotePort,
+			RemoteAddress: c.id.RemoteAddress,
+		},
+		s: c.s,
+	}, nil
+}
@@ -0,0 +1,100 @@
+package core
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+
+	"github.com/xjasonlyu/tun2socks/v2/core/adapter"
+)
+
+type udpHandler struct {
+	filterHandler
+	udp chan adapter.UDPConn
+}
+
+func (h *udpHandler) HandleUDP(conn adapter.UDPConn) { h.udp <- conn }
+
+// newUDP returns an IPv4 UDP datagram from testSrc:12345 to dst:port.
+func newUDP(dst tcpip.Address, port uint16, payload []byte) []byte {
+	b := make([]byte, header.IPv4MinimumSize+header.UDPMinimumSize+len(payload))
+	ip := header.IPv4(b)
+	ip.Encode(&header.IPv4Fields{
+		TotalLength: uint16(len(b)),
+		TTL:         64,
+		Protocol:    uint8(header.UDPProtocolNumber),
+		SrcAddr:     testSrc,
+		DstAddr:     dst,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+
+	udp := header.UDP(b[header.IPv4MinimumSize:])
+	udp.Encode(&header.UDPFields{
+		SrcPort: 12345,
+		DstPort: port,
+		Length:  uint16(len(udp)),
+	})
+	copy(udp.Payload(), payload)
+	xsum := header.PseudoHeaderChecksum(header.UDPProtocolNumber, testSrc, dst, uint16(len(udp)))
+	udp.SetChecksum(^checksum.Checksum(udp, xsum))
+	return b
+}
+
+func TestUDPDialFrom(t *testing.T) {
+	ep := channel.New(16, 1500, "")
+	h := &udpHandler{udp: make(chan adapter.UDPConn, 1)}
+	s, err := CreateStack(&Config{LinkEndpoint: ep, TransportHandler: h})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		s.Close()
+		ep.Close()
+	})
+
+	inject := func(b []byte) {
+		ep.InjectInbound(header.IPv4ProtocolNumber, stack.NewPacketBuffer(stack.PacketBufferOptions{
+			Payload: buffer.MakeWithData(b),
+		}))
+	}
+	inject(newUDP(testDst, 53, []byte("first")))
+	conn := (<-h.udp).(adapter.ConeUDPConn)
+
+	other := tcpip.AddrFrom4([4]byte{192, 0, 2, 1})
+	oc, err := conn.DialFrom(netip.MustParseAddrPort("192.0.2.1:5000"))
+	require.NoError(t, err)
+	defer oc.Close()
+	assert.Equal(t, other, oc.ID().LocalAddress)
+	assert.Equal(t, testSrc, oc.ID().RemoteAddress)
+
+	// Sent to the source from the other address.
+	_, err = oc.Write([]byte("reply"))
+	require.NoError(t, err)
+	ip, ok := readPacket(ep)
+	require.True(t, ok)
+	assert.Equal(t, other, ip.SourceAddress())
+	assert.Equal(t, testSrc, ip.DestinationAddress())
+	udp := header.UDP(ip.Payload())
+	assert.Equal(t, uint16(5000), udp.SourcePort())
+	assert.Equal(t, uint16(12345), udp.DestinationPort())
+	assert.Equal(t, []byte("reply"), []byte(udp.Payload()))
+
+	// The replies of the source are delivered to the new conn.
+	inject(newUDP(other, 5000, []byte("again")))
+	b := make([]byte, 16)
+	oc.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := oc.Read(b)
+	require.NoError(t, err)
+	assert.Equal(t, "again", string(b[:n]))
+	assert.Len(t, h.udp, 0)
+
+	_, err = conn.DialFrom(netip.MustParseAddrPort("[2001:db8::1]:5000"))
+	assert.Error(t, err)
+}
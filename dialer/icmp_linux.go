@@ -0,0 +1,62 @@
+package dialer
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ListenICMP opens an unprivileged ICMP datagram socket, also known as
+// ping socket, with the options of d. Network is "udp4" for ICMPv4 or
+// "udp6" for ICMPv6. The identifier of sent echo requests is replaced
+// by the kernel, which only delivers the replies of the socket to it.
+//
+// It's permitted by the net.ipv4.ping_group_range sysctl.
+func (d *Dialer) ListenICMP(network string) (net.PacketConn, error) {
+	var (
+		family int
+		proto  int
+		sa     unix.Sockaddr
+	)
+	switch network {
+	case "udp4":
+		family, proto, sa = unix.AF_INET, unix.IPPROTO_ICMP, &unix.SockaddrInet4{}
+	case "udp6":
+		family, proto, sa = unix.AF_INET6, unix.IPPROTO_ICMPV6, &unix.SockaddrInet6{}
+	default:
+		return nil, fmt.Errorf("unsupported network: %s", network)
+	}
+
+	fd, err := unix.Socket(family, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if err = unix.Bind(fd, sa); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+
+	f := os.NewFile(uintptr(fd), "icmp")
+	pc, err := net.FilePacketConn(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := pc.(syscall.Conn).SyscallConn()
+	if err == nil {
+		err = setSocketOptions(network, "", rc, &Options{
+			InterfaceName:  d.InterfaceName.Load(),
+			InterfaceIndex: int(d.InterfaceIndex.Load()),
+			RoutingMark:    int(d.RoutingMark.Load()),
+		})
+	}
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	return pc, nil
+}
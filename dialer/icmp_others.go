@@ -0,0 +1,13 @@
+//go:build !linux
+
+package dialer
+
+import (
+	"errors"
+	"net"
+)
+
+// ListenICMP is only supported on Linux.
+func (d *Dialer) ListenICMP(string) (net.PacketConn, error) {
+	return nil, errors.ErrUnsupported
+}
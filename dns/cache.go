@@ -0,0 +1,137 @@
+package dns
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// negativeTTL is the TTL of cached responses without answers.
+	negativeTTL = 30 * time.Second
+
+	// maxTTL caps the TTL of cached responses.
+	maxTTL = time.Hour
+)
+
+type cacheKey struct {
+	name  string
+	typ   dnsmessage.Type
+	class dnsmessage.Class
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	msg     dnsmessage.Message
+	expires time.Time
+}
+
+// cache is an LRU cache of DNS responses which respects TTLs.
+type cache struct {
+	mu      sync.Mutex
+	size    int
+	lru     *list.List
+	entries map[cacheKey]*list.Element
+}
+
+func newCache(size int) *cache {
+	return &cache{
+		size:    size,
+		lru:     list.New(),
+		entries: make(map[cacheKey]*list.Element),
+	}
+}
+
+// get returns the cached response of key with TTLs decreased by the
+// time elapsed since it was cached.
+func (c *cache) get(key cacheKey, now time.Time) (dnsmessage.Message, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return dnsmessage.Message{}, false
+	}
+	e := elem.Value.(*cacheEntry)
+	if !now.Before(e.expires) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		return dnsmessage.Message{}, false
+	}
+	c.lru.MoveToFront(elem)
+
+	msg := e.msg
+	ttl := uint32(e.expires.Sub(now).Seconds())
+	msg.Answers = withTTL(msg.Answers, ttl)
+	msg.Authorities = withTTL(msg.Authorities, ttl)
+	msg.Additionals = withTTL(msg.Additionals, ttl)
+	return msg, true
+}
+
+// put caches msg as the response of key, if it is cacheable.
+func (c *cache) put(key cacheKey, msg dnsmessage.Message, now time.Time) {
+	if c.size <= 0 || msg.Truncated ||
+		(msg.RCode != dnsmessage.RCodeSuccess && msg.RCode != dnsmessage.RCodeNameError) {
+		return
+	}
+
+	ttl := negativeTTL
+	if len(msg.Answers) > 0 {
+		ttl = maxTTL
+		for _, rr := range msg.Answers {
+			ttl = min(ttl, time.Duration(rr.Header.TTL)*time.Second)
+		}
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := &cacheEntry{key: key, msg: msg, expires: now.Add(ttl)}
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = e
+		c.lru.MoveToFront(elem)
+		return
+	}
+	if c.lru.Len() >= c.size {
+		elem := c.lru.Back()
+		c.lru.Remove(elem)
+		delete(c.entries, elem.Value.(*cacheEntry).key)
+	}
+	c.entries[key] = c.lru.PushFront(e)
+}
+
+// len returns the number of cached responses.
+func (c *cache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// flush removes all cached responses.
+func (c *cache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Init()
+	c.entries = make(map[cacheKey]*list.Element)
+}
+
+// withTTL returns a copy of rrs with TTLs capped to ttl.
+func withTTL(rrs []dnsmessage.Resource, ttl uint32) []dnsmessage.Resource {
+	if len(rrs) == 0 {
+		return nil
+	}
+	out := make([]dnsmessage.Resource, len(rrs))
+	copy(out, rrs)
+	for i := range out {
+		if out[i].Header.Type == dnsmessage.TypeOPT {
+			continue
+		}
+		out[i].Header.TTL = min(out[i].Header.TTL, ttl)
+	}
+	return out
+}
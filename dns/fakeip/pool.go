@@ -0,0 +1,223 @@
+// Package fakeip provides fake IP allocation for hostnames.
+package fakeip
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"strings"
+	"sync"
+)
+
+// reservedAddrs is the number of leading addresses skipped in each
+// range, i.e. the network address and the gateway address.
+const reservedAddrs = 2
+
+// Mapping is a hostname to fake IP mapping.
+type Mapping struct {
+	Host string     `json:"host"`
+	IP   netip.Addr `json:"ip"`
+}
+
+// Pool allocates fake IPs for hostnames from IPv4 and optional IPv6
+// ranges, and keeps a bounded LRU reverse map of them.
+type Pool struct {
+	mu sync.Mutex
+	v4 *table
+	v6 *table
+}
+
+// New creates a Pool. The v6 prefix is optional and may be invalid,
+// and size limits the number of mappings kept for each range.
+func New(v4, v6 netip.Prefix, size int) (*Pool, error) {
+	if size <= 0 {
+		return nil, errors.New("invalid fake IP pool size")
+	}
+	if !v4.IsValid() || !v4.Addr().Is4() {
+		return nil, fmt.Errorf("invalid fake IPv4 range: %s", v4)
+	}
+
+	p := &Pool{}
+	var err error
+	if p.v4, err = newTable(v4, size); err != nil {
+		return nil, err
+	}
+	if v6.IsValid() {
+		if !v6.Addr().Is6() || v6.Addr().Is4In6() {
+			return nil, fmt.Errorf("invalid fake IPv6 range: %s", v6)
+		}
+		if p.v6, err = newTable(v6, size); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// IPv4 returns the fake IPv4 address of host, allocating one if needed.
+func (p *Pool) IPv4(host string) netip.Addr {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.v4.lookupIP(normalize(host))
+}
+
+// IPv6 returns the fake IPv6 address of host, allocating one if needed.
+// It returns an invalid address if no IPv6 range is configured.
+func (p *Pool) IPv6(host string) netip.Addr {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.v6 == nil {
+		return netip.Addr{}
+	}
+	return p.v6.lookupIP(normalize(host))
+}
+
+// Contains reports whether ip is in the fake IP ranges.
+func (p *Pool) Contains(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return p.v4.prefix.Contains(ip) || (p.v6 != nil && p.v6.prefix.Contains(ip))
+}
+
+// LookupHost returns the host that ip is mapped to.
+func (p *Pool) LookupHost(ip netip.Addr) (string, bool) {
+	ip = ip.Unmap()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.v4.prefix.Contains(ip) {
+		return p.v4.lookupHost(ip)
+	}
+	if p.v6 != nil && p.v6.prefix.Contains(ip) {
+		return p.v6.lookupHost(ip)
+	}
+	return "", false
+}
+
+// Mappings returns all mappings, most recently used first.
+func (p *Pool) Mappings() []Mapping {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	mappings := p.v4.mappings()
+	if p.v6 != nil {
+		mappings = append(mappings, p.v6.mappings()...)
+	}
+	return mappings
+}
+
+// Flush removes all mappings.
+func (p *Pool) Flush() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.v4.flush()
+	if p.v6 != nil {
+		p.v6.flush()
+	}
+}
+
+// table is an LRU of mappings within a single IP range.
+type table struct {
+	prefix   netip.Prefix
+	first    netip.Addr
+	capacity uint64
+	offset   uint64
+
+	lru   *list.List
+	hosts map[string]*list.Element
+	ips   map[netip.Addr]*list.Element
+}
+
+func newTable(prefix netip.Prefix, size int) (*table, error) {
+	prefix = prefix.Masked()
+
+	hostBits := prefix.Addr().BitLen() - prefix.Bits()
+	available := uint64(math.MaxUint64)
+	if hostBits < 64 {
+		available = 1 << hostBits
+	}
+	if prefix.Addr().Is4() {
+		available-- /* broadcast address */
+	}
+	if available <= reservedAddrs {
+		return nil, fmt.Errorf("fake IP range %s is too small", prefix)
+	}
+	available -= reservedAddrs
+
+	t := &table{
+		prefix:   prefix,
+		first:    addOffset(prefix.Addr(), reservedAddrs),
+		capacity: min(available, uint64(size)),
+	}
+	t.flush()
+	return t, nil
+}
+
+func (t *table) lookupIP(host string) netip.Addr {
+	if elem, ok := t.hosts[host]; ok {
+		t.lru.MoveToFront(elem)
+		return elem.Value.(*Mapping).IP
+	}
+
+	var m *Mapping
+	if t.offset < t.capacity {
+		m = &Mapping{IP: addOffset(t.first, t.offset)}
+		t.offset++
+	} else {
+		// Evict the least recently used mapping and reuse its IP.
+		elem := t.lru.Back()
+		m = t.lru.Remove(elem).(*Mapping)
+		delete(t.hosts, m.Host)
+		delete(t.ips, m.IP)
+	}
+	m.Host = host
+
+	elem := t.lru.PushFront(m)
+	t.hosts[host] = elem
+	t.ips[m.IP] = elem
+	return m.IP
+}
+
+func (t *table) lookupHost(ip netip.Addr) (string, bool) {
+	elem, ok := t.ips[ip]
+	if !ok {
+		return "", false
+	}
+	t.lru.MoveToFront(elem)
+	return elem.Value.(*Mapping).Host, true
+}
+
+func (t *table) mappings() []Mapping {
+	mappings := make([]Mapping, 0, t.lru.Len())
+	for elem := t.lru.Front(); elem != nil; elem = elem.Next() {
+		mappings = append(mappings, *elem.Value.(*Mapping))
+	}
+	return mappings
+}
+
+func (t *table) flush() {
+	t.offset = 0
+	t.lru = list.New()
+	t.hosts = make(map[string]*list.Element)
+	t.ips = make(map[netip.Addr]*list.Element)
+}
+
+// addOffset returns the address n after addr.
+func addOffset(addr netip.Addr, n uint64) netip.Addr {
+	b := addr.As16()
+	for i := len(b) - 1; i >= 0 && n > 0; i-- {
+		sum := uint64(b[i]) + n&0xff
+		b[i] = byte(sum)
+		n = n>>8 + sum>>8
+	}
+	ip := netip.AddrFrom16(b)
+	if addr.Is4() {
+		return ip.Unmap()
+	}
+	return ip
+}
+
+func normalize(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
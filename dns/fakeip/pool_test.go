@@ -0,0 +1,66 @@
+package fakeip
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPool(t *testing.T) {
+	p, err := New(netip.MustParsePrefix("198.18.0.0/15"), netip.MustParsePrefix("fc00::/18"), 16)
+	require.NoError(t, err)
+
+	ip := p.IPv4("Example.COM.")
+	assert.Equal(t, netip.MustParseAddr("198.18.0.2"), ip)
+	assert.Equal(t, ip, p.IPv4("example.com"))
+	assert.True(t, p.Contains(ip))
+	assert.False(t, p.Contains(netip.MustParseAddr("1.1.1.1")))
+
+	host, ok := p.LookupHost(ip)
+	assert.True(t, ok)
+	assert.Equal(t, "example.com", host)
+
+	ip6 := p.IPv6("example.com")
+	assert.Equal(t, netip.MustParseAddr("fc00::2"), ip6)
+	host, ok = p.LookupHost(ip6)
+	assert.True(t, ok)
+	assert.Equal(t, "example.com", host)
+
+	assert.Len(t, p.Mappings(), 2)
+	p.Flush()
+	assert.Empty(t, p.Mappings())
+	_, ok = p.LookupHost(ip)
+	assert.False(t, ok)
+}
+
+func TestPoolEviction(t *testing.T) {
+	p, err := New(netip.MustParsePrefix("10.0.0.0/29"), netip.Prefix{}, 100)
+	require.NoError(t, err)
+
+	// 8 addresses minus network, gateway and broadcast.
+	hosts := []string{"a", "b", "c", "d", "e"}
+	for _, h := range hosts {
+		p.IPv4(h)
+	}
+	assert.Len(t, p.Mappings(), 5)
+	assert.False(t, p.IPv6("a").IsValid())
+
+	// Touch "a" so that "b" becomes the least recently used one.
+	ipA := p.IPv4("a")
+
+	ipF := p.IPv4("f")
+	assert.Equal(t, netip.MustParseAddr("10.0.0.3"), ipF)
+	assert.Equal(t, ipA, p.IPv4("a"))
+
+	host, ok := p.LookupHost(ipF)
+	assert.True(t, ok)
+	assert.Equal(t, "f", host)
+	assert.Len(t, p.Mappings(), 5)
+}
+
+func TestAddOffset(t *testing.T) {
+	assert.Equal(t, netip.MustParseAddr("10.0.1.4"), addOffset(netip.MustParseAddr("10.0.0.250"), 10))
+	assert.Equal(t, netip.MustParseAddr("fc00::1:0"), addOffset(netip.MustParseAddr("fc00::ffff"), 1))
+}
@@ -0,0 +1,247 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/xjasonlyu/tun2socks/v2/dns/fakeip"
+	"github.com/xjasonlyu/tun2socks/v2/log"
+)
+
+const (
+	// fakeIPTTL is the TTL of fake IP records, which is kept short so
+	// that clients re-query often and keep their mappings fresh.
+	fakeIPTTL = 1
+
+	// hostsTTL is the TTL of records answered from the hosts table.
+	hostsTTL = 60
+)
+
+// Config is the configuration of Server.
+type Config struct {
+	// FakeIP enables fake-IP mode if set, in which A and AAAA
+	// queries are answered with fake IPs allocated from it.
+	FakeIP *fakeip.Pool
+
+	// Hosts is the static hosts table keyed by lower-case hostname,
+	// which takes precedence over fake IPs and upstream.
+	Hosts map[string][]netip.Addr
+
+	// Upstream resolves queries which are not answered locally.
+	Upstream Upstream
+
+	// CacheSize is the maximum number of cached upstream responses,
+	// or zero to disable cache.
+	CacheSize int
+}
+
+// Server answers DNS queries hijacked from the netstack.
+type Server struct {
+	fakeIP   *fakeip.Pool
+	hosts    map[string][]netip.Addr
+	upstream Upstream
+	cache    *cache
+}
+
+// NewServer creates a Server with the given config.
+func NewServer(cfg *Config) (*Server, error) {
+	if cfg.FakeIP == nil && cfg.Upstream == nil {
+		return nil, errors.New("upstream is required without fake IP")
+	}
+	return &Server{
+		fakeIP:   cfg.FakeIP,
+		hosts:    cfg.Hosts,
+		upstream: cfg.Upstream,
+		cache:    newCache(cfg.CacheSize),
+	}, nil
+}
+
+// ServeDNS answers the DNS query message b.
+func (s *Server) ServeDNS(b []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(b)
+	if err != nil {
+		return nil, fmt.Errorf("parse header: %w", err)
+	}
+	if h.Response {
+		return nil, fmt.Errorf("unexpected response message: %d", h.ID)
+	}
+
+	q, err := p.Question()
+	if err != nil {
+		return reply(h, nil, dnsmessage.RCodeFormatError, nil)
+	}
+
+	if answers, ok := s.answer(q); ok {
+		return reply(h, &q, dnsmessage.RCodeSuccess, answers)
+	}
+	if s.upstream == nil {
+		// Other record types are answered with an empty NOERROR response.
+		return reply(h, &q, dnsmessage.RCodeSuccess, nil)
+	}
+
+	key := cacheKey{name: strings.ToLower(q.Name.String()), typ: q.Type, class: q.Class}
+	if msg, ok := s.cache.get(key, time.Now()); ok {
+		msg.ID = h.ID
+		return msg.Pack()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), upstreamTimeout)
+	defer cancel()
+
+	resp, err := s.upstream.Exchange(ctx, b)
+	if err != nil {
+		log.Debugf("[DNS] exchange %s %s: %v", q.Name, q.Type, err)
+		return reply(h, &q, dnsmessage.RCodeServerFailure, nil)
+	}
+
+	var msg dnsmessage.Message
+	if err = msg.Unpack(resp); err != nil || msg.ID != h.ID {
+		log.Debugf("[DNS] invalid response of %s %s: %v", q.Name, q.Type, err)
+		return reply(h, &q, dnsmessage.RCodeServerFailure, nil)
+	}
+	s.cache.put(key, msg, time.Now())
+	return resp, nil
+}
+
+// FlushCache removes all cached upstream responses.
+func (s *Server) FlushCache() {
+	s.cache.flush()
+}
+
+// CacheLen returns the number of cached upstream responses.
+func (s *Server) CacheLen() int {
+	return s.cache.len()
+}
+
+// answer builds the answer records of question q locally, from the
+// hosts table or fake IPs. It reports false if q should be resolved
+// by upstream.
+func (s *Server) answer(q dnsmessage.Question) ([]dnsmessage.Resource, bool) {
+	host := strings.ToLower(strings.TrimSuffix(q.Name.String(), "."))
+	rh := dnsmessage.ResourceHeader{
+		Name:  q.Name,
+		Type:  q.Type,
+		Class: q.Class,
+	}
+
+	if ips, ok := s.hosts[host]; ok && (q.Type == dnsmessage.TypeA || q.Type == dnsmessage.TypeAAAA) {
+		rh.TTL = hostsTTL
+		var answers []dnsmessage.Resource
+		for _, ip := range ips {
+			switch {
+			case q.Type == dnsmessage.TypeA && ip.Unmap().Is4():
+				answers = append(answers, dnsmessage.Resource{Header: rh, Body: &dnsmessage.AResource{A: ip.Unmap().As4()}})
+			case q.Type == dnsmessage.TypeAAAA && ip.Is6() && !ip.Is4In6():
+				answers = append(answers, dnsmessage.Resource{Header: rh, Body: &dnsmessage.AAAAResource{AAAA: ip.As16()}})
+			}
+		}
+		return answers, true
+	}
+
+	if s.fakeIP == nil {
+		return nil, false
+	}
+
+	rh.TTL = fakeIPTTL
+	switch q.Type {
+	case dnsmessage.TypeA:
+		ip := s.fakeIP.IPv4(host)
+		return []dnsmessage.Resource{{Header: rh, Body: &dnsmessage.AResource{A: ip.As4()}}}, true
+	case dnsmessage.TypeAAAA:
+		if ip := s.fakeIP.IPv6(host); ip.IsValid() {
+			return []dnsmessage.Resource{{Header: rh, Body: &dnsmessage.AAAAResource{AAAA: ip.As16()}}}, true
+		}
+		return nil, true
+	case dnsmessage.TypePTR:
+		ip, ok := parsePTR(host)
+		if !ok || !s.fakeIP.Contains(ip) {
+			return nil, false
+		}
+		if name, ok := s.fakeIP.LookupHost(ip); ok {
+			ptr, err := dnsmessage.NewName(name + ".")
+			if err == nil {
+				return []dnsmessage.Resource{{Header: rh, Body: &dnsmessage.PTRResource{PTR: ptr}}}, true
+			}
+		}
+		return nil, true
+	}
+	return nil, false
+}
+
+// LookupHost returns the hostname that ip is mapped to. It returns an
+// empty hostname if ip is not a fake IP, or an error if ip is a fake
+// IP without mapping, e.g. evicted or flushed.
+func (s *Server) LookupHost(ip netip.Addr) (string, error) {
+	if s.fakeIP == nil || !s.fakeIP.Contains(ip) {
+		return "", nil
+	}
+	host, ok := s.fakeIP.LookupHost(ip)
+	if !ok {
+		return "", fmt.Errorf("fake IP %s has no mapping", ip)
+	}
+	return host, nil
+}
+
+// FakeIP returns the fake IP pool of Server, which is nil if
+// fake-IP mode is disabled.
+func (s *Server) FakeIP() *fakeip.Pool {
+	return s.fakeIP
+}
+
+// reply builds a response message of query header h.
+func reply(h dnsmessage.Header, q *dnsmessage.Question, rcode dnsmessage.RCode, answers []dnsmessage.Resource) ([]byte, error) {
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 h.ID,
+			Response:           true,
+			OpCode:             h.OpCode,
+			RecursionDesired:   h.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              rcode,
+		},
+		Answers: answers,
+	}
+	if q != nil {
+		msg.Questions = []dnsmessage.Question{*q}
+	}
+	return msg.Pack()
+}
+
+// parsePTR parses the IP address from the name of a PTR query.
+func parsePTR(name string) (netip.Addr, bool) {
+	name = strings.ToLower(name)
+	if s, ok := strings.CutSuffix(name, ".in-addr.arpa"); ok {
+		labels := strings.Split(s, ".")
+		if len(labels) != 4 {
+			return netip.Addr{}, false
+		}
+		for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+			labels[i], labels[j] = labels[j], labels[i]
+		}
+		ip, err := netip.ParseAddr(strings.Join(labels, "."))
+		return ip, err == nil
+	}
+	if s, ok := strings.CutSuffix(name, ".ip6.arpa"); ok {
+		nibbles := strings.Split(s, ".")
+		if len(nibbles) != 32 {
+			return netip.Addr{}, false
+		}
+		var b strings.Builder
+		for i := len(nibbles) - 1; i >= 0; i-- {
+			b.WriteString(nibbles[i])
+			if i%4 == 0 && i > 0 {
+				b.WriteByte(':')
+			}
+		}
+		ip, err := netip.ParseAddr(b.String())
+		return ip, err == nil
+	}
+	return netip.Addr{}, false
+}
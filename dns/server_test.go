@@ -0,0 +1,146 @@
+package dns
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/xjasonlyu/tun2socks/v2/dns/fakeip"
+)
+
+func buildQuery(t *testing.T, name string, typ dnsmessage.Type) []byte {
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 0x1234, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  typ,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	b, err := msg.Pack()
+	require.NoError(t, err)
+	return b
+}
+
+func TestServerFakeIP(t *testing.T) {
+	pool, err := fakeip.New(netip.MustParsePrefix("198.18.0.0/15"), netip.Prefix{}, 100)
+	require.NoError(t, err)
+	s, err := NewServer(&Config{FakeIP: pool})
+	require.NoError(t, err)
+
+	b, err := s.ServeDNS(buildQuery(t, "example.com.", dnsmessage.TypeA))
+	require.NoError(t, err)
+
+	var msg dnsmessage.Message
+	require.NoError(t, msg.Unpack(b))
+	assert.Equal(t, uint16(0x1234), msg.ID)
+	assert.True(t, msg.Response)
+	require.Len(t, msg.Answers, 1)
+	ip := netip.AddrFrom4(msg.Answers[0].Body.(*dnsmessage.AResource).A)
+
+	host, err := s.LookupHost(ip)
+	require.NoError(t, err)
+	assert.Equal(t, "example.com", host)
+
+	// No IPv6 range configured.
+	b, err = s.ServeDNS(buildQuery(t, "example.com.", dnsmessage.TypeAAAA))
+	require.NoError(t, err)
+	require.NoError(t, msg.Unpack(b))
+	assert.Equal(t, dnsmessage.RCodeSuccess, msg.RCode)
+	assert.Empty(t, msg.Answers)
+
+	// PTR of fake IP.
+	b, err = s.ServeDNS(buildQuery(t, "2.0.18.198.in-addr.arpa.", dnsmessage.TypePTR))
+	require.NoError(t, err)
+	require.NoError(t, msg.Unpack(b))
+	require.Len(t, msg.Answers, 1)
+	assert.Equal(t, "example.com.", msg.Answers[0].Body.(*dnsmessage.PTRResource).PTR.String())
+
+	pool.Flush()
+	_, err = s.LookupHost(ip)
+	assert.Error(t, err)
+
+	host, err = s.LookupHost(netip.MustParseAddr("1.1.1.1"))
+	assert.NoError(t, err)
+	assert.Empty(t, host)
+}
+
+func TestParsePTR(t *testing.T) {
+	ip, ok := parsePTR("4.3.2.1.in-addr.arpa")
+	assert.True(t, ok)
+	assert.Equal(t, netip.MustParseAddr("1.2.3.4"), ip)
+
+	ip, ok = parsePTR("1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.c.f.ip6.arpa")
+	assert.True(t, ok)
+	assert.Equal(t, netip.MustParseAddr("fc00::1"), ip)
+
+	_, ok = parsePTR("example.com")
+	assert.False(t, ok)
+}
+
+type fakeUpstream struct {
+	count int
+}
+
+func (u *fakeUpstream) Exchange(_ context.Context, query []byte) ([]byte, error) {
+	u.count++
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil {
+		return nil, err
+	}
+	msg.Response = true
+	msg.Answers = []dnsmessage.Resource{{
+		Header: dnsmessage.ResourceHeader{
+			Name:  msg.Questions[0].Name,
+			Type:  dnsmessage.TypeTXT,
+			Class: dnsmessage.ClassINET,
+			TTL:   300,
+		},
+		Body: &dnsmessage.TXTResource{TXT: []string{"hello"}},
+	}}
+	return msg.Pack()
+}
+
+func TestServerUpstream(t *testing.T) {
+	_, err := NewServer(&Config{})
+	assert.Error(t, err)
+
+	upstream := &fakeUpstream{}
+	s, err := NewServer(&Config{
+		Hosts: map[string][]netip.Addr{
+			"router.lan": {netip.MustParseAddr("192.168.1.1"), netip.MustParseAddr("fd00::1")},
+		},
+		Upstream:  upstream,
+		CacheSize: 16,
+	})
+	require.NoError(t, err)
+
+	var msg dnsmessage.Message
+	b, err := s.ServeDNS(buildQuery(t, "Router.LAN.", dnsmessage.TypeAAAA))
+	require.NoError(t, err)
+	require.NoError(t, msg.Unpack(b))
+	require.Len(t, msg.Answers, 1)
+	assert.Equal(t, netip.MustParseAddr("fd00::1").As16(), msg.Answers[0].Body.(*dnsmessage.AAAAResource).AAAA)
+	assert.Equal(t, 0, upstream.count)
+
+	for i := 0; i < 3; i++ {
+		b, err = s.ServeDNS(buildQuery(t, "example.com.", dnsmessage.TypeTXT))
+		require.NoError(t, err)
+		require.NoError(t, msg.Unpack(b))
+		require.Len(t, msg.Answers, 1)
+		assert.LessOrEqual(t, msg.Answers[0].Header.TTL, uint32(300))
+	}
+	assert.Equal(t, 1, upstream.count)
+	assert.Equal(t, 1, s.CacheLen())
+
+	s.FlushCache()
+	assert.Equal(t, 0, s.CacheLen())
+	_, err = s.ServeDNS(buildQuery(t, "example.com.", dnsmessage.TypeTXT))
+	require.NoError(t, err)
+	assert.Equal(t, 2, upstream.count)
+}
@@ -0,0 +1,167 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/proxy"
+)
+
+const (
+	// upstreamTimeout is the timeout of each upstream exchange.
+	upstreamTimeout = 5 * time.Second
+
+	// dohMediaType is the media type of DNS-over-HTTPS messages.
+	dohMediaType = "application/dns-message"
+)
+
+// Upstream exchanges DNS messages with an upstream server.
+type Upstream interface {
+	Exchange(ctx context.Context, query []byte) ([]byte, error)
+}
+
+// DialerFunc returns the proxy.Dialer used to reach upstream servers,
+// which is looked up for every exchange so that it follows changes
+// of the tunnel dialer.
+type DialerFunc func() proxy.Dialer
+
+// NewUpstream creates Upstream from URL s, which is either
+// "tcp://host[:port]" for DNS-over-TCP or "https://host[:port]/path"
+// for DNS-over-HTTPS. Upstream servers are reached through dialer.
+func NewUpstream(s string, dialer DialerFunc) (Upstream, error) {
+	if !strings.Contains(s, "://") {
+		s = "tcp://" + s
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "tcp":
+		addr := u.Host
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), "53")
+		}
+		return &tcpUpstream{addr: addr, dialer: dialer}, nil
+	case "https":
+		return newDoHUpstream(u, dialer), nil
+	default:
+		return nil, fmt.Errorf("unsupported upstream scheme: %s", u.Scheme)
+	}
+}
+
+// tcpUpstream implements DNS-over-TCP as defined in RFC 7766.
+type tcpUpstream struct {
+	addr   string
+	dialer DialerFunc
+}
+
+func (u *tcpUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	c, err := dialContext(ctx, u.dialer(), u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+
+	if len(query) > 0xffff {
+		return nil, errors.New("query too large")
+	}
+	req := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(req, uint16(len(query)))
+	copy(req[2:], query)
+	if _, err = c.Write(req); err != nil {
+		return nil, err
+	}
+
+	var length [2]byte
+	if _, err = io.ReadFull(c, length[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err = io.ReadFull(c, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// dohUpstream implements DNS-over-HTTPS as defined in RFC 8484.
+type dohUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func newDoHUpstream(u *url.URL, dialer DialerFunc) *dohUpstream {
+	return &dohUpstream{
+		url: u.String(),
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+					return dialContext(ctx, dialer(), addr)
+				},
+				ForceAttemptHTTP2: true,
+				IdleConnTimeout:   90 * time.Second,
+			},
+		},
+	}
+}
+
+func (u *dohUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dohMediaType)
+	req.Header.Set("Accept", dohMediaType)
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH status: %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 0xffff))
+}
+
+// dialContext dials TCP address through d.
+func dialContext(ctx context.Context, d proxy.Dialer, address string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := &M.Metadata{
+		Network: M.TCP,
+		DstPort: uint16(port),
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		metadata.DstIP = ip
+	} else {
+		metadata.Host = host
+	}
+	return d.DialContext(ctx, metadata)
+}
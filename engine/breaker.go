@@ -0,0 +1,194 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/xjasonlyu/tun2socks/v2/balancer"
+	"github.com/xjasonlyu/tun2socks/v2/log"
+	"github.com/xjasonlyu/tun2socks/v2/proxy"
+)
+
+const (
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 30 * time.Second
+)
+
+// breakerState is the state of a circuit breaker.
+type breakerState int
+
+const (
+	// breakerClosed lets the proxy serve traffic as usual.
+	breakerClosed breakerState = iota
+	// breakerOpen takes the proxy out of rotation until cooldown.
+	breakerOpen
+	// breakerHalfOpen puts the proxy back on trial, where the next
+	// dial either closes the breaker or opens it again.
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// breaker is a circuit breaker driven by the dials of real traffic,
+// which ejects a proxy after consecutive dial failures without
+// waiting for the next health check.
+type breaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+
+	mu sync.Mutex
+	// onChange is called on every state change, outside of the lock.
+	onChange func()
+	state    breakerState
+	failures int
+	timer    *time.Timer
+	stopped  bool
+}
+
+func newBreaker(name string, c CircuitBreakerConfig, onChange func()) *breaker {
+	b := &breaker{
+		name:      name,
+		threshold: c.Threshold,
+		cooldown:  c.Cooldown,
+		onChange:  onChange,
+	}
+	if b.threshold <= 0 {
+		b.threshold = defaultBreakerThreshold
+	}
+	if b.cooldown <= 0 {
+		b.cooldown = defaultBreakerCooldown
+	}
+	return b
+}
+
+// State returns the current state of breaker.
+func (b *breaker) State() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Allow reports whether the proxy should be kept in the proxy groups.
+// It's consulted only when the groups are refreshed, so the proxy open
+// is still dialed by the rules referencing it directly, and by the
+// groups keeping all of their proxies under fail policy open.
+func (b *breaker) Allow() bool {
+	return b.State() != breakerOpen
+}
+
+// report records the result of a dial with ctx. Only the failures to
+// reach or handshake with the proxy server are counted, but not those
+// of the destination or caused by the caller.
+func (b *breaker) report(ctx context.Context, err error) {
+	if err != nil && !proxyFailure(ctx, err) {
+		return
+	}
+
+	b.mu.Lock()
+	from := b.state
+	if err == nil {
+		b.failures = 0
+		b.state = breakerClosed
+	} else {
+		b.failures++
+		if from == breakerHalfOpen || (from == breakerClosed && b.failures >= b.threshold) {
+			b.open()
+		}
+	}
+	to, failures := b.state, b.failures
+	b.mu.Unlock()
+
+	if from != to {
+		b.changed(from, to, failures, err)
+	}
+}
+
+// proxyFailure reports whether err of a dial with ctx is a failure of
+// the proxy itself.
+func proxyFailure(ctx context.Context, err error) bool {
+	var de *proxy.DestinationError
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, errProxyDisabled), errors.As(err, &de):
+		return false
+	case errors.Is(err, context.DeadlineExceeded):
+		// A share of the deadline given by a proxy group may be too
+		// short for a healthy proxy.
+		return !balancer.Shortened(ctx)
+	default:
+		return true
+	}
+}
+
+// open opens breaker and schedules the transition to half-open. It
+// must be called with b.mu held.
+func (b *breaker) open() {
+	b.state = breakerOpen
+	if b.stopped {
+		return
+	}
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	b.timer = time.AfterFunc(b.cooldown, b.halfOpen)
+}
+
+func (b *breaker) halfOpen() {
+	b.mu.Lock()
+	if b.state != breakerOpen || b.stopped {
+		b.mu.Unlock()
+		return
+	}
+	b.state = breakerHalfOpen
+	b.mu.Unlock()
+
+	b.changed(breakerOpen, breakerHalfOpen, 0, nil)
+}
+
+// setOnChange replaces the function called on state changes, e.g.
+// for the proxy set carrying over the proxy on reload.
+func (b *breaker) setOnChange(f func()) {
+	b.mu.Lock()
+	b.onChange = f
+	b.mu.Unlock()
+}
+
+func (b *breaker) changed(from, to breakerState, failures int, err error) {
+	switch to {
+	case breakerOpen:
+		log.Warnf("[CIRCUIT_BREAKER] %s: %s -> %s after %d consecutive failures: %v",
+			b.name, from, to, failures, err)
+	default:
+		log.Infof("[CIRCUIT_BREAKER] %s: %s -> %s", b.name, from, to)
+	}
+	b.mu.Lock()
+	onChange := b.onChange
+	b.mu.Unlock()
+	if onChange != nil {
+		onChange()
+	}
+}
+
+// stop cancels the pending transition of breaker, which is no longer
+// in use.
+func (b *breaker) stop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.stopped = true
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+}
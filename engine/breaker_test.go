@@ -0,0 +1,115 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/xjasonlyu/tun2socks/v2/balancer"
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/proxy"
+	"github.com/xjasonlyu/tun2socks/v2/proxy/proto"
+	"github.com/xjasonlyu/tun2socks/v2/transport/socks5"
+)
+
+func TestBreaker(t *testing.T) {
+	var changes atomic.Int32
+	b := newBreaker("test", CircuitBreakerConfig{Threshold: 2, Cooldown: 20 * time.Millisecond},
+		func() { changes.Add(1) })
+	defer b.stop()
+
+	ctx := context.Background()
+	b.report(ctx, assert.AnError)
+	b.report(ctx, nil)
+	b.report(ctx, assert.AnError)
+	b.report(ctx, context.Canceled)
+	assert.Equal(t, breakerClosed, b.State(), "a success resets the failure count")
+
+	b.report(ctx, assert.AnError)
+	assert.Equal(t, breakerOpen, b.State())
+	assert.False(t, b.Allow())
+	assert.Equal(t, int32(1), changes.Load())
+
+	require.Eventually(t, b.Allow, time.Second, 5*time.Millisecond)
+	assert.Equal(t, breakerHalfOpen, b.State())
+
+	// A single failure on trial opens it again.
+	b.report(ctx, assert.AnError)
+	assert.Equal(t, breakerOpen, b.State())
+
+	require.Eventually(t, b.Allow, time.Second, 5*time.Millisecond)
+	b.report(ctx, nil)
+	assert.Equal(t, breakerClosed, b.State())
+	assert.Equal(t, int32(5), changes.Load())
+}
+
+func TestProxyFailure(t *testing.T) {
+	ctx := context.Background()
+	assert.True(t, proxyFailure(ctx, assert.AnError))
+	assert.True(t, proxyFailure(ctx, fmt.Errorf("connect to proxy: %w", context.DeadlineExceeded)))
+	assert.False(t, proxyFailure(ctx, context.Canceled))
+	assert.False(t, proxyFailure(ctx, errProxyDisabled))
+	assert.False(t, proxyFailure(ctx, &proxy.DestinationError{Err: socks5.Reply(0x05)}))
+
+	// The dial through a proxy group with retry times out with a share
+	// of the deadline.
+	a, b := &ctxProxy{}, &ctxProxy{}
+	s, _ := balancer.New(balancer.Failover)
+	g := balancer.NewGroup("group", s, []proxy.Proxy{a, b}, balancer.WithRetry())
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	g.DialContext(ctx, &M.Metadata{Network: M.TCP})
+	assert.False(t, proxyFailure(a.ctx, context.DeadlineExceeded))
+	assert.True(t, proxyFailure(b.ctx, context.DeadlineExceeded))
+}
+
+// ctxProxy records the context of the last dial, which always fails.
+type ctxProxy struct {
+	ctx context.Context
+}
+
+func (p *ctxProxy) DialContext(ctx context.Context, _ *M.Metadata) (net.Conn, error) {
+	p.ctx = ctx
+	return nil, assert.AnError
+}
+
+func (p *ctxProxy) DialUDP(*M.Metadata) (net.PacketConn, error) { return nil, assert.AnError }
+func (p *ctxProxy) Addr() string                                { return "" }
+func (p *ctxProxy) Proto() proto.Proto                          { return proto.Direct }
+
+func TestProxySetBreaker(t *testing.T) {
+	k := &Key{
+		Proxies: []ProxyEntry{
+			// Nothing listens on port 1, so dials fail at once.
+			{Name: "a", URL: "socks5://127.0.0.1:1"},
+			{Name: "b", URL: "socks5://127.0.0.1:1081"},
+		},
+		ProxyGroups: []ProxyGroupConfig{
+			{Name: "group", Proxies: []string{"a", "b"}},
+		},
+		CircuitBreaker: CircuitBreakerConfig{Enable: true, Threshold: 1, Cooldown: time.Hour},
+		Rules:          []string{"MATCH,group"},
+	}
+	ps, err := buildProxySet(k)
+	require.NoError(t, err)
+	defer ps.stopBreakers(nil)
+
+	// Probe dials aren't reported.
+	_, err = ps.named["a"].DialContext(context.Background(), &M.Metadata{Network: M.TCP, Probe: true})
+	require.Error(t, err)
+	_, err = ps.named["a"].DialUDP(&M.Metadata{Network: M.UDP, Probe: true})
+	require.Error(t, err)
+	assert.Equal(t, "closed", ps.Proxies()[0].Circuit)
+
+	_, err = ps.named["a"].DialContext(context.Background(), &M.Metadata{Network: M.TCP})
+	require.Error(t, err)
+	assert.Equal(t, []string{"b"}, ps.ProxyGroups()[0].Available)
+	assert.Equal(t, "open", ps.Proxies()[0].Circuit)
+	assert.Equal(t, "closed", ps.Proxies()[1].Circuit)
+}
@@ -1,13 +1,13 @@
 package engine
 
 import (
-	"context"
+	"cmp"
 	"errors"
+	"fmt"
 	"net"
 	"net/netip"
 	"os/exec"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/docker/go-units"
@@ -16,15 +16,21 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 
 	"github.com/xjasonlyu/tun2socks/v2/core"
+	"github.com/xjasonlyu/tun2socks/v2/core/capture"
 	"github.com/xjasonlyu/tun2socks/v2/core/device"
 	"github.com/xjasonlyu/tun2socks/v2/core/option"
 	"github.com/xjasonlyu/tun2socks/v2/dialer"
+	"github.com/xjasonlyu/tun2socks/v2/dns"
+	"github.com/xjasonlyu/tun2socks/v2/dns/fakeip"
+	"github.com/xjasonlyu/tun2socks/v2/flowlog"
 	"github.com/xjasonlyu/tun2socks/v2/log"
-	M "github.com/xjasonlyu/tun2socks/v2/metadata"
 	"github.com/xjasonlyu/tun2socks/v2/proxy"
-	"github.com/xjasonlyu/tun2socks/v2/proxy/proto"
 	"github.com/xjasonlyu/tun2socks/v2/restapi"
+	"github.com/xjasonlyu/tun2socks/v2/rule"
 	"github.com/xjasonlyu/tun2socks/v2/tunnel"
+	"github.com/xjasonlyu/tun2socks/v2/tunnel/admission"
+	"github.com/xjasonlyu/tun2socks/v2/tunnel/ping"
+	"github.com/xjasonlyu/tun2socks/v2/tunnel/statistic"
 )
 
 var (
@@ -44,6 +50,15 @@ var (
 
 	// _healthChecker holds the health checker instance.
 	_healthChecker *HealthChecker
+
+	// _proxySet holds the proxies in use, replaced on reload.
+	_proxySet *proxySet
+
+	// _dnsServer holds the DNS server in use, if DNS hijacking is enabled.
+	_dnsServer *dns.Server
+
+	// _exporters holds the flow exporters of closed connections.
+	_exporters []*flowlog.Exporter
 )
 
 // Start starts the default engine up.
@@ -78,6 +93,9 @@ func start() error {
 	for _, f := range []func(*Key) error{
 		general,
 		restAPI,
+		flowLog,
+		dnsHijack,
+		proxies,
 		netstack,
 	} {
 		if err := f(_defaultKey); err != nil {
@@ -94,6 +112,11 @@ func stop() (err error) {
 		_healthChecker.Stop()
 		_healthChecker = nil
 	}
+	if _proxySet != nil {
+		_proxySet.stopBreakers(nil)
+		_proxySet = nil
+	}
+	applyExporters(nil)
 	if _defaultDevice != nil {
 		_defaultDevice.Close()
 	}
@@ -122,33 +145,142 @@ func general(k *Key) error {
 	if err != nil {
 		return err
 	}
-	log.SetLogger(log.Must(log.NewLeveled(level)))
-
+	if k.UDPTimeout > 0 && k.UDPTimeout < time.Second {
+		return errors.New("invalid udp timeout value")
+	}
+	udpNAT, err := tunnel.ParseUDPNAT(k.UDPNAT)
+	if err != nil {
+		return err
+	}
+	var iface *net.Interface
 	if k.Interface != "" {
-		iface, err := net.InterfaceByName(k.Interface)
-		if err != nil {
+		if iface, err = net.InterfaceByName(k.Interface); err != nil {
 			return err
 		}
+	}
+	rateLimit, err := parseRateLimit(k.RateLimit)
+	if err != nil {
+		return err
+	}
+	if err = rateLimit.Validate(); err != nil {
+		return err
+	}
+	deferReject, err := parseReject(k.TCPDeferHandshake.Reject)
+	if err != nil {
+		return err
+	}
+	aclConfig, err := parseACL(k.ACL)
+	if err != nil {
+		return err
+	}
+	if err = aclConfig.Validate(); err != nil {
+		return err
+	}
+	pingMode, err := ping.ParseMode(k.ICMP.Mode)
+	if err != nil {
+		return err
+	}
+	if k.ICMP.Timeout < 0 {
+		return errors.New("invalid icmp timeout value")
+	}
+	if c := k.ConnectionLimit; c.MaxTCP < 0 || c.MaxUDP < 0 || c.MaxTCPPerSource < 0 || c.MaxUDPPerSource < 0 {
+		return errors.New("invalid connection limit value")
+	}
+
+	// All options below are applied unconditionally, so that general
+	// can be re-run by Reload to reset the removed ones as well. They
+	// are all validated above, so that none is applied if any fails.
+	log.SetLogger(log.Must(log.NewLeveled(level)))
+
+	if iface != nil {
 		dialer.DefaultDialer.InterfaceName.Store(iface.Name)
 		dialer.DefaultDialer.InterfaceIndex.Store(int32(iface.Index))
 		log.Infof("[DIALER] bind to interface: %s", k.Interface)
+	} else {
+		dialer.DefaultDialer.InterfaceName.Store("")
+		dialer.DefaultDialer.InterfaceIndex.Store(0)
 	}
 
+	dialer.DefaultDialer.RoutingMark.Store(int32(k.Mark))
 	if k.Mark != 0 {
-		dialer.DefaultDialer.RoutingMark.Store(int32(k.Mark))
 		log.Infof("[DIALER] set fwmark: %#x", k.Mark)
 	}
 
-	if k.UDPTimeout > 0 {
-		if k.UDPTimeout < time.Second {
-			return errors.New("invalid udp timeout value")
+	tunnel.T().SetUDPTimeout(k.UDPTimeout)
+	tunnel.T().SetUDPNAT(udpNAT)
+	if udpNAT != tunnel.NATSymmetric {
+		log.Infof("[UDP] NAT behavior: %s", udpNAT)
+	}
+
+	var sniffTimeout time.Duration
+	if k.Sniffing.Enable {
+		sniffTimeout = k.Sniffing.Timeout
+		if sniffTimeout <= 0 {
+			sniffTimeout = 300 * time.Millisecond
 		}
-		tunnel.T().SetUDPTimeout(k.UDPTimeout)
+		log.Infof("[SNIFF] enabled with timeout: %v", sniffTimeout)
 	}
-	return nil
+	tunnel.T().SetSniffTimeout(sniffTimeout)
+
+	tunnel.T().SetDeferredHandshake(k.TCPDeferHandshake.Enable, deferReject)
+	if k.TCPDeferHandshake.Enable {
+		if k.Sniffing.Enable {
+			log.Warnf("[TCP] handshakes are not deferred while sniffing is enabled")
+		} else {
+			log.Infof("[TCP] defer handshakes until dialed, reject: %s", cmp.Or(k.TCPDeferHandshake.Reject, "reset"))
+		}
+	}
+
+	historySize := k.ConnectionHistory
+	if historySize == 0 {
+		historySize = statistic.DefaultHistorySize
+	}
+	statistic.DefaultManager.SetHistorySize(historySize)
+
+	tunnel.T().Admission().SetConfig(admission.Config{
+		MaxTCP:          k.ConnectionLimit.MaxTCP,
+		MaxUDP:          k.ConnectionLimit.MaxUDP,
+		MaxTCPPerSource: k.ConnectionLimit.MaxTCPPerSource,
+		MaxUDPPerSource: k.ConnectionLimit.MaxUDPPerSource,
+	})
+
+	if err = tunnel.T().ACL().SetConfig(aclConfig); err != nil {
+		return err
+	}
+	if n := len(aclConfig.Rules); n > 0 || aclConfig.DefaultDeny {
+		policy := "allow"
+		if aclConfig.DefaultDeny {
+			policy = "deny"
+		}
+		log.Infof("[ACL] %d rules, default %s, action: %s", n, policy, tunnel.T().ACL().Config().Action)
+	}
+
+	tunnel.T().Ping().SetConfig(ping.Config{
+		Mode:       pingMode,
+		Timeout:    k.ICMP.Timeout,
+		ProbePorts: k.ICMP.ProbePorts,
+	})
+	if pingMode != ping.Off {
+		log.Infof("[ICMP] echo mode: %s", pingMode)
+	}
+
+	return tunnel.T().RateLimiter().Update(rateLimit)
 }
 
 func restAPI(k *Key) error {
+	restapi.SetStatsFunc(func() tcpip.Stats {
+		_engineMu.Lock()
+		defer _engineMu.Unlock()
+
+		// default stack is not initialized.
+		if _defaultStack == nil {
+			return tcpip.Stats{}
+		}
+		return _defaultStack.Stats()
+	})
+	restapi.SetRateLimiter(tunnel.T().RateLimiter())
+	restapi.SetPinger(tunnel.T().Ping())
+
 	if k.RestAPI != "" {
 		u, err := parseRestAPI(k.RestAPI)
 		if err != nil {
@@ -156,17 +288,6 @@ func restAPI(k *Key) error {
 		}
 		host, token := u.Host, u.User.String()
 
-		restapi.SetStatsFunc(func() tcpip.Stats {
-			_engineMu.Lock()
-			defer _engineMu.Unlock()
-
-			// default stack is not initialized.
-			if _defaultStack == nil {
-				return tcpip.Stats{}
-			}
-			return _defaultStack.Stats()
-		})
-
 		go func() {
 			if err := restapi.Start(host, token); err != nil {
 				log.Errorf("[RESTAPI] failed to start: %v", err)
@@ -174,13 +295,200 @@ func restAPI(k *Key) error {
 		}()
 		log.Infof("[RESTAPI] serve at: %s", u)
 	}
+
+	if k.Metrics != "" {
+		go func() {
+			if err := restapi.StartMetrics(k.Metrics); err != nil {
+				log.Errorf("[METRICS] failed to start: %v", err)
+			}
+		}()
+		log.Infof("[METRICS] serve at: http://%s/metrics", k.Metrics)
+	}
 	return nil
 }
 
-func netstack(k *Key) (err error) {
-	if k.Proxy.IsEmpty() {
-		return errors.New("empty proxy")
+func flowLog(k *Key) error {
+	exporters, err := buildExporters(k)
+	if err != nil {
+		return err
+	}
+	applyExporters(exporters)
+	return nil
+}
+
+// buildExporters creates the flow exporters configured in k.
+func buildExporters(k *Key) ([]*flowlog.Exporter, error) {
+	var exporters []*flowlog.Exporter
+	if c := k.AccessLog; c.Path != "" {
+		x, err := flowlog.NewAccessLog(c.Path, int64(c.MaxSize)<<20, c.MaxBackups)
+		if err != nil {
+			return nil, fmt.Errorf("access log: %w", err)
+		}
+		exporters = append(exporters, x)
+		log.Infof("[ACCESS_LOG] write to: %s", c.Path)
+	}
+	if c := k.IPFIX; c.Collector != "" {
+		x, err := flowlog.NewIPFIX(c.Collector, c.ObservationDomain)
+		if err != nil {
+			closeExporters(exporters)
+			return nil, fmt.Errorf("ipfix: %w", err)
+		}
+		exporters = append(exporters, x)
+		log.Infof("[IPFIX] export to: %s", c.Collector)
+	}
+	return exporters, nil
+}
+
+// applyExporters replaces the running flow exporters with exporters.
+func applyExporters(exporters []*flowlog.Exporter) {
+	sinks := make([]statistic.Sink, 0, len(exporters))
+	for _, x := range exporters {
+		sinks = append(sinks, x)
+	}
+	statistic.DefaultManager.SetSinks(sinks...)
+	closeExporters(_exporters)
+	_exporters = exporters
+}
+
+func closeExporters(exporters []*flowlog.Exporter) {
+	for _, x := range exporters {
+		_ = x.Close()
+	}
+}
+
+func dnsHijack(k *Key) error {
+	server, err := buildDNSServer(k, nil)
+	if err != nil {
+		return err
+	}
+	applyDNSServer(k, server)
+	return nil
+}
+
+// buildDNSServer creates the DNS server from k, which is nil if DNS
+// hijacking is disabled. The fake IP pool is reused if not nil.
+func buildDNSServer(k *Key, pool *fakeip.Pool) (*dns.Server, error) {
+	if !k.DNS.Enable {
+		return nil, nil
+	}
+
+	c := dnsDefaults(k.DNS)
+	cfg := &dns.Config{CacheSize: c.CacheSize}
+	switch c.Mode {
+	case "fake-ip":
+		if pool == nil {
+			var err error
+			if pool, err = parseFakeIPPool(c); err != nil {
+				return nil, err
+			}
+		}
+		cfg.FakeIP = pool
+	case "normal":
+	default:
+		return nil, fmt.Errorf("unsupported dns mode: %s", c.Mode)
+	}
+
+	hosts, err := parseHosts(c.Hosts)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Hosts = hosts
+
+	if c.Upstream != "" {
+		if cfg.Upstream, err = dns.NewUpstream(c.Upstream, tunnel.T().Dialer); err != nil {
+			return nil, err
+		}
+	}
+	return dns.NewServer(cfg)
+}
+
+// dnsDefaults returns c with the defaults filled in.
+func dnsDefaults(c DNSConfig) DNSConfig {
+	if c.Mode == "" {
+		c.Mode = "fake-ip"
+	}
+	if c.FakeIPRange == "" {
+		c.FakeIPRange = "198.18.0.0/15"
 	}
+	if c.FakeIPSize == 0 {
+		c.FakeIPSize = 65535
+	}
+	if c.CacheSize == 0 {
+		c.CacheSize = 4096
+	}
+	return c
+}
+
+// applyDNSServer installs server to tunnel and REST API, or disables
+// DNS hijacking if server is nil.
+func applyDNSServer(k *Key, server *dns.Server) {
+	_dnsServer = server
+	if server == nil {
+		tunnel.T().SetDNSHandler(nil)
+		restapi.SetDNSServer(nil)
+		return
+	}
+	tunnel.T().SetDNSHandler(server)
+	restapi.SetDNSServer(server)
+
+	mode := "normal"
+	if server.FakeIP() != nil {
+		mode = "fake-ip"
+	}
+	log.Infof("[DNS] hijack udp/53 in %s mode, upstream: %s", mode, k.DNS.Upstream)
+}
+
+func proxies(k *Key) error {
+	ps, err := buildProxySet(k)
+	if err != nil {
+		return err
+	}
+	d, err := ps.dialer(k)
+	if err != nil {
+		return err
+	}
+	applyProxySet(k, ps, d)
+	return nil
+}
+
+// applyProxySet swaps the dialer of tunnel to d built from ps, and
+// restarts the health checker for the proxy groups of ps. The members
+// carried over from the running proxySet keep their state.
+func applyProxySet(k *Key, ps *proxySet, d proxy.Dialer) {
+	_defaultProxy = ps.defaultProxy
+	tunnel.T().SetDialer(d)
+
+	if _healthChecker != nil {
+		_healthChecker.Stop()
+		_healthChecker = nil
+	}
+	if _proxySet != nil {
+		_proxySet.stopBreakers(ps)
+	}
+	_proxySet = ps
+	ps.acl = tunnel.T().ACL()
+	ps.updateServers()
+	ps.retainTraffic()
+
+	checked := k.HealthCheck.Enable && len(ps.groups) > 0
+	for _, m := range ps.members {
+		if m.breaker != nil {
+			m.breaker.setOnChange(func() { ps.updateHealthy(nil) })
+		}
+		// 仅保留仍在进行的检查的结果
+		m.resetHealth(!checked, !checked || k.HealthCheck.UDPCheck == "")
+	}
+	// 启动健康检查器（仅在存在代理组时）
+	if checked {
+		_healthChecker = NewHealthChecker(k.HealthCheck, ps.leaves(), ps.updateHealthy)
+		ps.hc = _healthChecker
+		_healthChecker.Start()
+	}
+	ps.updateHealthy(nil)
+	restapi.SetProxyManager(ps)
+}
+
+func netstack(k *Key) (err error) {
 	if k.Device == "" {
 		return errors.New("empty device")
 	}
@@ -202,39 +510,6 @@ func netstack(k *Key) (err error) {
 		}
 	}()
 
-	proxies := k.Proxy.GetProxies()
-	if len(proxies) == 1 {
-		// Single proxy mode
-		if _defaultProxy, err = parseProxy(proxies[0]); err != nil {
-			return
-		}
-		tunnel.T().SetDialer(_defaultProxy)
-	} else {
-		// Multiple proxy mode - use round-robin proxy
-		var proxyList []proxy.Proxy
-		for _, proxyStr := range proxies {
-			p, parseErr := parseProxy(proxyStr)
-			if parseErr != nil {
-				return parseErr
-			}
-			proxyList = append(proxyList, p)
-		}
-		roundRobinProxy := NewRoundRobinProxy(proxyList)
-		_defaultProxy = roundRobinProxy
-		tunnel.T().SetDialer(roundRobinProxy)
-
-		// 启动健康检查器（仅在多代理模式下）
-		if k.HealthCheck.Enable {
-			_healthChecker = NewHealthChecker(k.HealthCheck, proxyList, func(healthyProxies []proxy.Proxy) {
-				if rrProxy, ok := _defaultProxy.(*RoundRobinProxy); ok {
-					rrProxy.UpdateProxies(healthyProxies)
-					log.Infof("[ENGINE] 更新健康代理列表，当前健康代理数量: %d", len(healthyProxies))
-				}
-			})
-			_healthChecker.Start()
-		}
-	}
-
 	if _defaultDevice, err = parseDevice(k.Device, uint32(k.MTU)); err != nil {
 		return
 	}
@@ -265,8 +540,12 @@ func netstack(k *Key) (err error) {
 		opts = append(opts, option.WithTCPReceiveBufferSize(int(size)))
 	}
 
+	// Wrap the device to capture packets on demand by REST API.
+	ep := capture.New(_defaultDevice, _defaultDevice.Name())
+	restapi.SetCaptureEndpoint(ep)
+
 	if _defaultStack, err = core.CreateStack(&core.Config{
-		LinkEndpoint:     _defaultDevice,
+		LinkEndpoint:     ep,
 		TransportHandler: tunnel.T(),
 		MulticastGroups:  multicastGroups,
 		Options:          opts,
@@ -274,6 +553,14 @@ func netstack(k *Key) (err error) {
 		return
 	}
 
+	if r, ok := tunnel.T().Dialer().(*rule.Router); ok {
+		log.Infof(
+			"[STACK] %s://%s <-> rules(%d)",
+			_defaultDevice.Type(), _defaultDevice.Name(), len(r.Rules()),
+		)
+		return nil
+	}
+
 	log.Infof(
 		"[STACK] %s://%s <-> %s://%s",
 		_defaultDevice.Type(), _defaultDevice.Name(),
@@ -281,73 +568,3 @@ func netstack(k *Key) (err error) {
 	)
 	return nil
 }
-
-// RoundRobinProxy implements round-robin load balancing across multiple proxies
-type RoundRobinProxy struct {
-	proxies []proxy.Proxy
-	counter uint64
-	mu      sync.RWMutex
-}
-
-// NewRoundRobinProxy creates a new round-robin proxy with the given proxy list
-func NewRoundRobinProxy(proxies []proxy.Proxy) *RoundRobinProxy {
-	return &RoundRobinProxy{
-		proxies: proxies,
-		counter: 0,
-	}
-}
-
-// UpdateProxies updates the proxy list dynamically
-func (rr *RoundRobinProxy) UpdateProxies(proxies []proxy.Proxy) {
-	rr.mu.Lock()
-	defer rr.mu.Unlock()
-	rr.proxies = make([]proxy.Proxy, len(proxies))
-	copy(rr.proxies, proxies)
-}
-
-// nextProxy returns the next proxy in round-robin fashion
-func (rr *RoundRobinProxy) nextProxy() proxy.Proxy {
-	rr.mu.RLock()
-	defer rr.mu.RUnlock()
-
-	if len(rr.proxies) == 0 {
-		return nil
-	}
-
-	n := atomic.AddUint64(&rr.counter, 1)
-	return rr.proxies[(n-1)%uint64(len(rr.proxies))]
-}
-
-// DialContext implements proxy.Dialer interface
-func (rr *RoundRobinProxy) DialContext(ctx context.Context, metadata *M.Metadata) (net.Conn, error) {
-	proxy := rr.nextProxy()
-	if proxy == nil {
-		return nil, errors.New("no healthy proxy available")
-	}
-	return proxy.DialContext(ctx, metadata)
-}
-
-// DialUDP implements proxy.Dialer interface
-func (rr *RoundRobinProxy) DialUDP(metadata *M.Metadata) (net.PacketConn, error) {
-	proxy := rr.nextProxy()
-	if proxy == nil {
-		return nil, errors.New("no healthy proxy available")
-	}
-	return proxy.DialUDP(metadata)
-}
-
-// Addr implements proxy.Proxy interface - returns first proxy's address for logging
-func (rr *RoundRobinProxy) Addr() string {
-	if len(rr.proxies) > 0 {
-		return rr.proxies[0].Addr()
-	}
-	return ""
-}
-
-// Proto implements proxy.Proxy interface - returns first proxy's protocol for logging
-func (rr *RoundRobinProxy) Proto() proto.Proto {
-	if len(rr.proxies) > 0 {
-		return rr.proxies[0].Proto()
-	}
-	return proto.Direct
-}
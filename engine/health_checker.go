@@ -1,37 +1,112 @@
 package engine
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
 	"fmt"
+	"math/rand/v2"
 	"net"
+	"net/http"
 	"net/netip"
 	"net/url"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/xjasonlyu/tun2socks/v2/balancer"
 	"github.com/xjasonlyu/tun2socks/v2/log"
-	"github.com/xjasonlyu/tun2socks/v2/metadata"
 	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/metrics"
 	"github.com/xjasonlyu/tun2socks/v2/proxy"
 )
 
+const (
+	// 默认的健康状态阈值：连续成功 rise 次恢复，连续失败 fall 次剔除
+	defaultRise = 2
+	defaultFall = 3
+
+	// 默认的探测间隔抖动比例
+	defaultJitter = 0.1
+
+	// UDP 检查默认查询的域名
+	defaultUDPCheckDomain = "www.google.com"
+
+	// 故障策略：所有代理都不健康时保留全部代理（open）或全部剔除（closed）
+	failPolicyOpen   = "open"
+	failPolicyClosed = "closed"
+)
+
 // HealthChecker 健康检查器
 type HealthChecker struct {
 	config         HealthCheckConfig
-	healthyProxies map[string]proxy.Proxy // 健康的代理列表
-	allProxies     map[string]proxy.Proxy // 所有代理列表
+	states         map[proxy.Proxy]*healthState // 各代理的健康状态
 	mu             sync.RWMutex
+	started        bool
 	stopCh         chan struct{}
+	stopOnce       sync.Once
 	updateCallback func([]proxy.Proxy) // 更新回调函数
+
+	target               *url.URL       // 检查的目标URL
+	statusMin, statusMax int            // 期望的状态码范围
+	udpServer            netip.AddrPort // UDP 检查的DNS服务器，无效时不检查UDP
+}
+
+// healthState 单个代理的健康状态，TCP 与 UDP 分别统计
+type healthState struct {
+	proxy  proxy.Proxy
+	dialer proxy.Proxy // 检查时拨号的代理，即解除包装后的 proxy
+	tcp    healthCounter
+	udp    healthCounter
+	stopCh chan struct{}
+}
+
+// proxyUnwrapper 包装了其他代理的代理，检查时直接经内层代理拨号，
+// 以免探测计入外层的连接数、流量及熔断统计，或因外层被禁用而失败
+type proxyUnwrapper interface {
+	Unwrap() proxy.Proxy
+}
+
+// healthReporter 记录了健康状态的代理，如重载配置时保留的代理，检查从该状态开始
+type healthReporter interface {
+	Healthy() bool
+	HealthyUDP() bool
+}
+
+func newHealthState(p proxy.Proxy) *healthState {
+	dialer := p
+	if u, ok := p.(proxyUnwrapper); ok {
+		dialer = u.Unwrap()
+	}
+	st := &healthState{
+		proxy:  p,
+		dialer: dialer,
+		tcp:    healthCounter{healthy: true},
+		udp:    healthCounter{healthy: true},
+		stopCh: make(chan struct{}),
+	}
+	if r, ok := p.(healthReporter); ok {
+		st.tcp.healthy = r.Healthy()
+		st.udp.healthy = r.HealthyUDP()
+	}
+	return st
+}
+
+// healthCounter 单项检查的健康状态及连续成功、失败次数
+type healthCounter struct {
+	healthy   bool
+	successes int // 连续成功次数
+	failures  int // 连续失败次数
 }
 
 // NewHealthChecker 创建新的健康检查器
 func NewHealthChecker(config HealthCheckConfig, proxies []proxy.Proxy, updateCallback func([]proxy.Proxy)) *HealthChecker {
 	hc := &HealthChecker{
 		config:         config,
-		healthyProxies: make(map[string]proxy.Proxy),
-		allProxies:     make(map[string]proxy.Proxy),
+		states:         make(map[proxy.Proxy]*healthState),
 		stopCh:         make(chan struct{}),
 		updateCallback: updateCallback,
 	}
@@ -46,12 +121,31 @@ func NewHealthChecker(config HealthCheckConfig, proxies []proxy.Proxy, updateCal
 	if hc.config.URL == "" {
 		hc.config.URL = "http://www.google.com"
 	}
+	if hc.config.Rise <= 0 {
+		hc.config.Rise = defaultRise
+	}
+	if hc.config.Fall <= 0 {
+		hc.config.Fall = defaultFall
+	}
+	if hc.config.MaxBackoff == 0 {
+		hc.config.MaxBackoff = 8 * hc.config.Interval
+	}
+	if hc.config.Jitter == 0 {
+		hc.config.Jitter = defaultJitter
+	}
+	if hc.config.UDPCheckDomain == "" {
+		hc.config.UDPCheckDomain = defaultUDPCheckDomain
+	}
+	// 配置已由 validateHealthCheck 校验
+	hc.target, _ = url.Parse(hc.config.URL)
+	hc.statusMin, hc.statusMax, _ = parseStatusRange(hc.config.ExpectedStatus)
+	if hc.config.UDPCheck != "" {
+		hc.udpServer, _ = parseDNSServer(hc.config.UDPCheck)
+	}
 
-	// 初始化代理列表
+	// 初始化代理列表，初始时假设所有代理都是健康的
 	for _, p := range proxies {
-		key := fmt.Sprintf("%s://%s", p.Proto(), p.Addr())
-		hc.allProxies[key] = p
-		hc.healthyProxies[key] = p // 初始时假设所有代理都是健康的
+		hc.states[p] = newHealthState(p)
 	}
 
 	return hc
@@ -64,112 +158,212 @@ func (hc *HealthChecker) Start() {
 		return
 	}
 
-	log.Infof("[HEALTH_CHECKER] 启动健康检查器，检查间隔: %v, 超时: %v, 目标URL: %s",
-		hc.config.Interval, hc.config.Timeout, hc.config.URL)
+	log.Infof("[HEALTH_CHECKER] 启动健康检查器，检查间隔: %v, 超时: %v, 目标URL: %s, rise/fall: %d/%d",
+		hc.config.Interval, hc.config.Timeout, hc.config.URL, hc.config.Rise, hc.config.Fall)
+	if hc.udpServer.IsValid() {
+		log.Infof("[HEALTH_CHECKER] 启用UDP检查，DNS服务器: %s, 查询域名: %s", hc.udpServer, hc.config.UDPCheckDomain)
+	}
 
-	go hc.run()
+	hc.mu.Lock()
+	hc.started = true
+	for _, st := range hc.states {
+		go hc.run(st)
+	}
+	hc.mu.Unlock()
 }
 
 // Stop 停止健康检查器
 func (hc *HealthChecker) Stop() {
-	if hc.stopCh != nil {
+	hc.stopOnce.Do(func() {
 		close(hc.stopCh)
-	}
+	})
 }
 
-// GetHealthyProxies 获取健康的代理列表
+// GetHealthyProxies 获取TCP健康的代理列表
 func (hc *HealthChecker) GetHealthyProxies() []proxy.Proxy {
 	hc.mu.RLock()
 	defer hc.mu.RUnlock()
 
 	var proxies []proxy.Proxy
-	for _, p := range hc.healthyProxies {
-		proxies = append(proxies, p)
+	for p, st := range hc.states {
+		if st.tcp.healthy {
+			proxies = append(proxies, p)
+		}
 	}
 	return proxies
 }
 
-// run 执行健康检查循环
-func (hc *HealthChecker) run() {
-	ticker := time.NewTicker(hc.config.Interval)
-	defer ticker.Stop()
+// GetUDPHealthyProxies 获取UDP健康的代理列表，未启用UDP检查时所有代理均视为健康
+func (hc *HealthChecker) GetUDPHealthyProxies() []proxy.Proxy {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
 
-	// 立即执行一次检查
-	hc.checkAllProxies()
+	var proxies []proxy.Proxy
+	for p, st := range hc.states {
+		if st.udp.healthy {
+			proxies = append(proxies, p)
+		}
+	}
+	return proxies
+}
+
+// AddProxy 添加待检查的代理
+func (hc *HealthChecker) AddProxy(p proxy.Proxy) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	if _, ok := hc.states[p]; ok {
+		return
+	}
+	st := newHealthState(p)
+	hc.states[p] = st
+	if hc.started {
+		go hc.run(st)
+	}
+}
+
+// RemoveProxy 移除待检查的代理
+func (hc *HealthChecker) RemoveProxy(p proxy.Proxy) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	if st, ok := hc.states[p]; ok {
+		close(st.stopCh)
+		delete(hc.states, p)
+	}
+}
+
+// checkRecorder 记录单个代理的检查结果
+type checkRecorder interface {
+	recordCheck(healthy bool, delay time.Duration, err error)
+	recordUDPCheck(healthy bool, delay time.Duration, err error)
+}
+
+// run 按各自的间隔循环检查单个代理，首次检查在抖动范围内随机延后，
+// 以免所有代理在同一时刻被探测
+func (hc *HealthChecker) run(st *healthState) {
+	timer := time.NewTimer(hc.jitter(0))
+	defer timer.Stop()
 
 	for {
 		select {
-		case <-ticker.C:
-			hc.checkAllProxies()
+		case <-timer.C:
+			timer.Reset(hc.checkOnce(st))
+		case <-st.stopCh:
+			return
 		case <-hc.stopCh:
 			return
 		}
 	}
 }
 
-// checkAllProxies 检查所有代理的健康状态
-func (hc *HealthChecker) checkAllProxies() {
-	log.Debugf("[HEALTH_CHECKER] 开始检查 %d 个代理服务器", len(hc.allProxies))
-
-	var wg sync.WaitGroup
-	newHealthyProxies := make(map[string]proxy.Proxy)
-	var mu sync.Mutex
-
-	for key, p := range hc.allProxies {
-		wg.Add(1)
-		go func(key string, proxy proxy.Proxy) {
-			defer wg.Done()
-
-			if hc.checkProxy(proxy) {
-				mu.Lock()
-				newHealthyProxies[key] = proxy
-				mu.Unlock()
-				log.Debugf("[HEALTH_CHECKER] 代理 %s 健康检查通过", key)
-			} else {
-				log.Warnf("[HEALTH_CHECKER] 代理 %s 健康检查失败", key)
-			}
-		}(key, p)
+// checkOnce 检查单个代理并按阈值更新健康状态，返回距下次检查的间隔
+func (hc *HealthChecker) checkOnce(st *healthState) time.Duration {
+	key := fmt.Sprintf("%s://%s", st.proxy.Proto(), st.proxy.Addr())
+	r, _ := st.proxy.(checkRecorder)
+	name := key
+	if n, ok := st.proxy.(balancer.Namer); ok {
+		name = n.Name()
 	}
 
-	wg.Wait()
-
-	// 更新健康代理列表
+	delay, err := hc.checkProxy(st.dialer)
+	metrics.ObserveHealthCheck(name, "tcp", delay, err)
 	hc.mu.Lock()
-	oldCount := len(hc.healthyProxies)
-	hc.healthyProxies = newHealthyProxies
-	newCount := len(hc.healthyProxies)
+	changed := hc.update(&st.tcp, err == nil)
+	tcp := st.tcp
 	hc.mu.Unlock()
 
-	if oldCount != newCount {
-		log.Infof("[HEALTH_CHECKER] 健康代理数量变化: %d -> %d", oldCount, newCount)
+	if r != nil {
+		r.recordCheck(tcp.healthy, delay, err)
 	}
+	hc.logCheck(key, "", delay, err, changed, tcp.healthy)
 
-	// 如果没有健康的代理，警告用户但保留所有代理以防止完全断线
-	if newCount == 0 {
-		log.Errorf("[HEALTH_CHECKER] 警告：所有代理都不健康，保留原有代理列表以防止断线")
+	if hc.udpServer.IsValid() {
+		udpDelay, udpErr := hc.checkUDP(st.dialer)
+		metrics.ObserveHealthCheck(name, "udp", udpDelay, udpErr)
 		hc.mu.Lock()
-		for key, p := range hc.allProxies {
-			hc.healthyProxies[key] = p
-		}
+		udpChanged := hc.update(&st.udp, udpErr == nil)
+		udp := st.udp
 		hc.mu.Unlock()
+
+		if r != nil {
+			r.recordUDPCheck(udp.healthy, udpDelay, udpErr)
+		}
+		hc.logCheck(key, "UDP", udpDelay, udpErr, udpChanged, udp.healthy)
+		changed = changed || udpChanged
 	}
 
 	// 调用更新回调
-	if hc.updateCallback != nil {
+	if changed && hc.updateCallback != nil {
 		hc.updateCallback(hc.GetHealthyProxies())
 	}
+	// 两路检查一同调度，仅按 TCP 的状态退避，以免 UDP 的失败拖慢 TCP 的恢复
+	return hc.jitter(hc.backoff(tcp.healthy, tcp.failures))
 }
 
-// checkProxy 检查单个代理的健康状态
-func (hc *HealthChecker) checkProxy(proxy proxy.Proxy) bool {
-	// 解析目标URL
-	targetURL, err := url.Parse(hc.config.URL)
-	if err != nil {
-		log.Errorf("[HEALTH_CHECKER] 无法解析目标URL %s: %v", hc.config.URL, err)
+// logCheck 记录一次检查的结果及健康状态的变化
+func (hc *HealthChecker) logCheck(key, kind string, delay time.Duration, err error, changed, healthy bool) {
+	if err == nil {
+		log.Debugf("[HEALTH_CHECKER] 代理 %s %s健康检查通过，延迟: %v", key, kind, delay)
+	} else {
+		log.Warnf("[HEALTH_CHECKER] 代理 %s %s健康检查失败: %v", key, kind, err)
+	}
+
+	if changed {
+		if healthy {
+			log.Infof("[HEALTH_CHECKER] 代理 %s %s恢复健康", key, kind)
+		} else {
+			log.Warnf("[HEALTH_CHECKER] 代理 %s %s被标记为不健康", key, kind)
+		}
+	}
+}
+
+// update 记录一次检查结果，连续成功 Rise 次或连续失败 Fall 次时切换
+// 健康状态，返回状态是否变化
+func (hc *HealthChecker) update(st *healthCounter, ok bool) bool {
+	if ok {
+		st.successes++
+		st.failures = 0
+		if !st.healthy && st.successes >= hc.config.Rise {
+			st.healthy = true
+			return true
+		}
 		return false
 	}
 
-	// 获取目标主机和端口
+	st.failures++
+	st.successes = 0
+	if st.healthy && st.failures >= hc.config.Fall {
+		st.healthy = false
+		return true
+	}
+	return false
+}
+
+// backoff 返回下次检查的间隔：健康的代理按固定间隔检查，不健康的代理
+// 按连续失败次数指数退避，最长为 MaxBackoff
+func (hc *HealthChecker) backoff(healthy bool, failures int) time.Duration {
+	interval := hc.config.Interval
+	if healthy || hc.config.MaxBackoff <= interval {
+		return interval
+	}
+	for n := failures - hc.config.Fall; n > 0 && interval < hc.config.MaxBackoff; n-- {
+		interval *= 2
+	}
+	return min(interval, hc.config.MaxBackoff)
+}
+
+// jitter 为间隔 d 加上 [0, Jitter*Interval) 的随机抖动
+func (hc *HealthChecker) jitter(d time.Duration) time.Duration {
+	if hc.config.Jitter <= 0 {
+		return d
+	}
+	return d + time.Duration(rand.Float64()*hc.config.Jitter*float64(hc.config.Interval))
+}
+
+// checkProxy 检查单个代理的健康状态，返回从拨号到收到响应头的往返延迟
+func (hc *HealthChecker) checkProxy(proxy proxy.Proxy) (time.Duration, error) {
+	targetURL := hc.target
 	host := targetURL.Hostname()
 	port := targetURL.Port()
 	if port == "" {
@@ -179,111 +373,182 @@ func (hc *HealthChecker) checkProxy(proxy proxy.Proxy) bool {
 			port = "80"
 		}
 	}
-
-	// 解析IP地址
-	ips, err := net.LookupIP(host)
-	if err != nil {
-		log.Debugf("[HEALTH_CHECKER] 无法解析域名 %s: %v", host, err)
-		return false
-	}
-	if len(ips) == 0 {
-		log.Debugf("[HEALTH_CHECKER] 域名 %s 没有解析到IP地址", host)
-		return false
-	}
-
-	// 转换端口为uint16
 	portNum, err := strconv.ParseUint(port, 10, 16)
 	if err != nil {
-		log.Debugf("[HEALTH_CHECKER] 无效的端口号 %s: %v", port, err)
-		return false
-	}
-
-	// 创建元数据
-	var dstIP netip.Addr
-	if ip4 := ips[0].To4(); ip4 != nil {
-		dstIP = netip.AddrFrom4([4]byte{ip4[0], ip4[1], ip4[2], ip4[3]})
-	} else if ip6 := ips[0].To16(); ip6 != nil {
-		var ip6Array [16]byte
-		copy(ip6Array[:], ip6)
-		dstIP = netip.AddrFrom16(ip6Array)
-	} else {
-		log.Debugf("[HEALTH_CHECKER] 无法处理IP地址格式: %v", ips[0])
-		return false
+		return 0, fmt.Errorf("无效的端口号 %s: %w", port, err)
 	}
 
+	// 域名交由代理解析，不在本地查询
 	metadata := &M.Metadata{
-		Network: metadata.TCP,
-		DstIP:   dstIP,
+		Network: M.TCP,
 		DstPort: uint16(portNum),
 	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		metadata.DstIP = ip
+	} else {
+		metadata.Host = host
+	}
 
-	// 设置超时上下文
 	ctx, cancel := context.WithTimeout(context.Background(), hc.config.Timeout)
 	defer cancel()
 
+	start := time.Now()
+
 	// 通过代理建立连接
 	conn, err := proxy.DialContext(ctx, metadata)
 	if err != nil {
-		log.Debugf("[HEALTH_CHECKER] 代理 %s://%s 连接失败: %v", proxy.Proto(), proxy.Addr(), err)
-		return false
+		return 0, fmt.Errorf("连接失败: %w", err)
 	}
 	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(hc.config.Timeout))
 
-	// 发送HTTP请求
-	if err := hc.sendHTTPRequest(conn, targetURL); err != nil {
-		log.Debugf("[HEALTH_CHECKER] 代理 %s://%s HTTP请求失败: %v", proxy.Proto(), proxy.Addr(), err)
-		return false
+	// HTTPS 需完成真实的 TLS 握手
+	if targetURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			return 0, fmt.Errorf("TLS握手失败: %w", err)
+		}
+		conn = tlsConn
 	}
 
-	return true
-}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, targetURL.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Close = true
+	req.Header.Set("User-Agent", "tun2socks-health-checker")
+	if err = req.Write(conn); err != nil {
+		return 0, fmt.Errorf("发送HTTP请求失败: %w", err)
+	}
 
-// sendHTTPRequest 发送HTTP请求
-func (hc *HealthChecker) sendHTTPRequest(conn net.Conn, targetURL *url.URL) error {
-	// 设置连接超时
-	conn.SetDeadline(time.Now().Add(hc.config.Timeout))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return 0, fmt.Errorf("读取HTTP响应失败: %w", err)
+	}
+	resp.Body.Close()
+	delay := time.Since(start)
 
-	// 构造HTTP请求
-	request := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n",
-		targetURL.Path, targetURL.Host)
-	if targetURL.Path == "" {
-		request = fmt.Sprintf("GET / HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n",
-			targetURL.Host)
+	if resp.StatusCode < hc.statusMin || resp.StatusCode > hc.statusMax {
+		return delay, fmt.Errorf("非预期的HTTP状态码: %d", resp.StatusCode)
 	}
+	return delay, nil
+}
 
-	// 发送请求
-	_, err := conn.Write([]byte(request))
+// checkUDP 通过代理的 DialUDP 向DNS服务器发送A记录查询并校验应答，返回往返延迟
+func (hc *HealthChecker) checkUDP(proxy proxy.Proxy) (time.Duration, error) {
+	name, err := dnsmessage.NewName(strings.TrimSuffix(hc.config.UDPCheckDomain, ".") + ".")
 	if err != nil {
-		return fmt.Errorf("发送HTTP请求失败: %v", err)
+		return 0, fmt.Errorf("无效的查询域名 %s: %w", hc.config.UDPCheckDomain, err)
+	}
+	id := uint16(rand.Uint32())
+	query, err := (&dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  name,
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}},
+	}).Pack()
+	if err != nil {
+		return 0, err
 	}
 
-	// 读取响应
-	buffer := make([]byte, 1024)
-	_, err = conn.Read(buffer)
+	metadata := &M.Metadata{
+		Network: M.UDP,
+		DstIP:   hc.udpServer.Addr(),
+		DstPort: hc.udpServer.Port(),
+	}
+
+	start := time.Now()
+
+	pc, err := proxy.DialUDP(metadata)
 	if err != nil {
-		return fmt.Errorf("读取HTTP响应失败: %v", err)
+		return 0, fmt.Errorf("UDP连接失败: %w", err)
 	}
+	defer pc.Close()
+	pc.SetDeadline(time.Now().Add(hc.config.Timeout))
 
-	// 简单检查是否收到HTTP响应
-	response := string(buffer)
-	if len(response) > 0 && (contains(response, "HTTP/1.1") || contains(response, "HTTP/1.0")) {
-		return nil
+	if _, err = pc.WriteTo(query, net.UDPAddrFromAddrPort(hc.udpServer)); err != nil {
+		return 0, fmt.Errorf("发送DNS查询失败: %w", err)
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			return 0, fmt.Errorf("读取DNS应答失败: %w", err)
+		}
+		var msg dnsmessage.Message
+		// 忽略无法解析或不匹配的报文，直到超时
+		if msg.Unpack(buf[:n]) != nil || !msg.Response || msg.ID != id {
+			continue
+		}
+		delay := time.Since(start)
+		if msg.RCode != dnsmessage.RCodeSuccess {
+			return delay, fmt.Errorf("非预期的DNS应答码: %v", msg.RCode)
+		}
+		return delay, nil
 	}
+}
 
-	return fmt.Errorf("无效的HTTP响应")
+// parseDNSServer 解析UDP检查的DNS服务器地址，省略端口时默认为53
+func parseDNSServer(s string) (netip.AddrPort, error) {
+	if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		return addrPort, nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid udp check server: %s", s)
+	}
+	return netip.AddrPortFrom(addr, 53), nil
 }
 
-// contains 检查字符串是否包含子字符串（简单实现避免引入strings包）
-func contains(s, substr string) bool {
-	return len(s) >= len(substr) && indexSubstring(s, substr) >= 0
+// parseStatusRange 解析期望的状态码范围，如 "204" 或 "200-399"
+func parseStatusRange(s string) (low, high int, err error) {
+	if s == "" {
+		return 200, 399, nil
+	}
+	lo, hi, found := strings.Cut(s, "-")
+	if low, err = strconv.Atoi(strings.TrimSpace(lo)); err != nil {
+		return 0, 0, fmt.Errorf("invalid expected status: %s", s)
+	}
+	high = low
+	if found {
+		if high, err = strconv.Atoi(strings.TrimSpace(hi)); err != nil {
+			return 0, 0, fmt.Errorf("invalid expected status: %s", s)
+		}
+	}
+	if low < 100 || high > 599 || low > high {
+		return 0, 0, fmt.Errorf("invalid expected status: %s", s)
+	}
+	return low, high, nil
 }
 
-// indexSubstring 查找子字符串位置
-func indexSubstring(s, substr string) int {
-	for i := 0; i <= len(s)-len(substr); i++ {
-		if s[i:i+len(substr)] == substr {
-			return i
+// validateHealthCheck 校验健康检查配置
+func validateHealthCheck(c HealthCheckConfig) error {
+	if !c.Enable {
+		return nil
+	}
+	if c.URL != "" {
+		u, err := url.Parse(c.URL)
+		if err != nil {
+			return fmt.Errorf("health check url: %w", err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("health check url: unsupported scheme: %s", u.Scheme)
+		}
+	}
+	if c.FailPolicy != "" && c.FailPolicy != failPolicyOpen && c.FailPolicy != failPolicyClosed {
+		return fmt.Errorf("health check: unsupported fail policy: %s", c.FailPolicy)
+	}
+	if c.Jitter > 1 {
+		return fmt.Errorf("health check: jitter must not exceed 1: %v", c.Jitter)
+	}
+	if c.UDPCheck != "" {
+		if _, err := parseDNSServer(c.UDPCheck); err != nil {
+			return fmt.Errorf("health check: %w", err)
 		}
 	}
-	return -1
+	_, _, err := parseStatusRange(c.ExpectedStatus)
+	return err
 }
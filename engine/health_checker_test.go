@@ -0,0 +1,163 @@
+package engine
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/xjasonlyu/tun2socks/v2/proxy"
+)
+
+func TestParseStatusRange(t *testing.T) {
+	for _, tt := range []struct {
+		s         string
+		low, high int
+		wantErr   bool
+	}{
+		{"", 200, 399, false},
+		{"204", 204, 204, false},
+		{"200-299", 200, 299, false},
+		{"300-200", 0, 0, true},
+		{"abc", 0, 0, true},
+		{"200-", 0, 0, true},
+		{"0-999", 0, 0, true},
+	} {
+		low, high, err := parseStatusRange(tt.s)
+		if tt.wantErr {
+			assert.Error(t, err, tt.s)
+			continue
+		}
+		require.NoError(t, err, tt.s)
+		assert.Equal(t, tt.low, low)
+		assert.Equal(t, tt.high, high)
+	}
+}
+
+func TestHealthCheckerCheckProxy(t *testing.T) {
+	status := http.StatusNoContent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/generate_204", r.URL.Path)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	config := HealthCheckConfig{Enable: true, URL: server.URL + "/generate_204", ExpectedStatus: "204"}
+	require.NoError(t, validateHealthCheck(config))
+	hc := NewHealthChecker(config, nil, nil)
+
+	delay, err := hc.checkProxy(proxy.NewDirect())
+	require.NoError(t, err)
+	assert.Greater(t, delay, time.Duration(0))
+
+	// Members are checked through the proxies they wrap, without
+	// their runtime state.
+	m := newMember("direct", "direct://", proxy.NewDirect())
+	m.disabled.Store(true)
+	hc = NewHealthChecker(config, []proxy.Proxy{m}, nil)
+	hc.checkOnce(hc.states[m])
+	assert.True(t, m.Healthy())
+	assert.NoError(t, m.lastError)
+	assert.Zero(t, m.Active())
+
+	status = http.StatusBadGateway
+	_, err = hc.checkProxy(proxy.NewDirect())
+	assert.ErrorContains(t, err, "502")
+
+	assert.Error(t, validateHealthCheck(HealthCheckConfig{Enable: true, URL: "ftp://example.com"}))
+}
+
+func TestHealthCheckerHysteresis(t *testing.T) {
+	hc := NewHealthChecker(HealthCheckConfig{Rise: 2, Fall: 3}, nil, nil)
+	st := &healthCounter{healthy: true}
+
+	assert.False(t, hc.update(st, false))
+	assert.False(t, hc.update(st, false))
+	assert.False(t, hc.update(st, true), "a success resets the failure count")
+	assert.False(t, hc.update(st, false))
+	assert.False(t, hc.update(st, false))
+	assert.True(t, hc.update(st, false))
+	assert.False(t, st.healthy)
+
+	assert.False(t, hc.update(st, true))
+	assert.True(t, hc.update(st, true))
+	assert.True(t, st.healthy)
+}
+
+func TestHealthCheckerBackoff(t *testing.T) {
+	hc := NewHealthChecker(HealthCheckConfig{
+		Interval:   time.Second,
+		Fall:       3,
+		MaxBackoff: 5 * time.Second,
+		Jitter:     -1,
+	}, nil, nil)
+
+	assert.Equal(t, time.Second, hc.backoff(true, 10))
+	assert.Equal(t, time.Second, hc.backoff(false, 3))
+	assert.Equal(t, 2*time.Second, hc.backoff(false, 4))
+	assert.Equal(t, 4*time.Second, hc.backoff(false, 5))
+	assert.Equal(t, 5*time.Second, hc.backoff(false, 6))
+	assert.Equal(t, 5*time.Second, hc.backoff(false, 100))
+	assert.Equal(t, time.Second, hc.jitter(time.Second))
+
+	hc = NewHealthChecker(HealthCheckConfig{Interval: time.Second, Jitter: 0.5}, nil, nil)
+	for range 100 {
+		d := hc.jitter(time.Second)
+		assert.GreaterOrEqual(t, d, time.Second)
+		assert.Less(t, d, 1500*time.Millisecond)
+	}
+
+	assert.Error(t, validateHealthCheck(HealthCheckConfig{Enable: true, FailPolicy: "maybe"}))
+	assert.Error(t, validateHealthCheck(HealthCheckConfig{Enable: true, Jitter: 2}))
+}
+
+func TestHealthCheckerCheckUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+
+	var fail atomic.Bool
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var msg dnsmessage.Message
+			if msg.Unpack(buf[:n]) != nil {
+				continue
+			}
+			msg.Response = true
+			if fail.Load() {
+				msg.RCode = dnsmessage.RCodeServerFailure
+			}
+			b, _ := msg.Pack()
+			// A stray packet with another ID must be ignored.
+			pc.WriteTo([]byte{0xff}, addr)
+			pc.WriteTo(b, addr)
+		}
+	}()
+
+	config := HealthCheckConfig{Enable: true, Timeout: time.Second, UDPCheck: pc.LocalAddr().String()}
+	require.NoError(t, validateHealthCheck(config))
+	hc := NewHealthChecker(config, nil, nil)
+
+	_, err = hc.checkUDP(proxy.NewDirect())
+	require.NoError(t, err)
+
+	fail.Store(true)
+	_, err = hc.checkUDP(proxy.NewDirect())
+	assert.Error(t, err)
+
+	server, err := parseDNSServer("8.8.8.8")
+	require.NoError(t, err)
+	assert.Equal(t, "8.8.8.8:53", server.String())
+	assert.Error(t, validateHealthCheck(HealthCheckConfig{Enable: true, UDPCheck: "dns.google"}))
+}
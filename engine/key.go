@@ -12,6 +12,7 @@ type Key struct {
 	Mark                     int           `yaml:"fwmark"`
 	Proxy                    ProxyConfig   `yaml:"proxy"`
 	RestAPI                  string        `yaml:"restapi"`
+	Metrics                  string        `yaml:"metrics"`
 	Device                   string        `yaml:"device"`
 	LogLevel                 string        `yaml:"loglevel"`
 	Interface                string        `yaml:"interface"`
@@ -22,8 +23,148 @@ type Key struct {
 	TUNPreUp                 string        `yaml:"tun-pre-up"`
 	TUNPostUp                string        `yaml:"tun-post-up"`
 	UDPTimeout               time.Duration `yaml:"udp-timeout"`
+	UDPNAT                   string        `yaml:"udp-nat"`
+	// 延迟 TCP 握手配置
+	TCPDeferHandshake TCPDeferHandshakeConfig `yaml:"tcp-defer-handshake"`
 	// 健康检查配置
 	HealthCheck HealthCheckConfig `yaml:"health-check"`
+	// 熔断配置
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuit-breaker"`
+	// 具名代理、代理组及路由规则配置
+	Proxies     []ProxyEntry       `yaml:"proxies"`
+	ProxyGroups []ProxyGroupConfig `yaml:"proxy-groups"`
+	Rules       []string           `yaml:"rules"`
+	// DNS 劫持配置
+	DNS DNSConfig `yaml:"dns"`
+	// 域名嗅探配置
+	Sniffing SniffingConfig `yaml:"sniffing"`
+	// 保留的已关闭连接记录条数，默认 1024，负数表示不保留
+	ConnectionHistory int `yaml:"connection-history"`
+	// 连接访问日志配置
+	AccessLog AccessLogConfig `yaml:"access-log"`
+	// IPFIX 流记录导出配置
+	IPFIX IPFIXConfig `yaml:"ipfix"`
+	// 带宽限速配置
+	RateLimit RateLimitConfig `yaml:"rate-limit"`
+	// 并发连接数限制
+	ConnectionLimit ConnectionLimitConfig `yaml:"connection-limit"`
+	// 目标访问控制列表
+	ACL ACLConfig `yaml:"acl"`
+	// ICMP echo（ping）处理配置
+	ICMP ICMPConfig `yaml:"icmp"`
+}
+
+// ICMPConfig ICMP echo 请求处理方式。代理无法转发 ICMP，默认交由协议栈处理，
+// 即只回复发往 TUN 网卡自身地址的请求
+type ICMPConfig struct {
+	// 处理模式：off（默认）、local（本地直接回复所有请求）、
+	// forward（经与直连出口相同的网卡及 fwmark，通过非特权 ICMP 套接字转发）
+	// 或 probe（经代理向目标发起 TCP 连接探测，成功则回复）
+	Mode       string        `yaml:"mode"`
+	Timeout    time.Duration `yaml:"timeout"`     // 转发或探测的超时时间，默认 3s
+	ProbePorts []uint16      `yaml:"probe-ports"` // probe 模式依次尝试的目标端口，默认 [443, 80]
+}
+
+// ACLConfig 目标访问控制列表，在 TCP 握手及 UDP 会话建立前按目标地址检查，
+// 规则按顺序匹配，第一条命中的规则生效
+type ACLConfig struct {
+	Default string `yaml:"default"` // 未命中任何规则时的策略：allow（默认）或 deny
+	// 拒绝方式：reset（默认，TCP 回复 RST，UDP 回复 ICMP 端口不可达）、
+	// unreachable（回复 ICMP 管理性禁止）或 drop（静默丢弃）
+	Action           string          `yaml:"action"`
+	DenyProxyServers bool            `yaml:"deny-proxy-servers"` // 是否拒绝发往代理服务器自身的连接，避免环路
+	Rules            []ACLRuleConfig `yaml:"rules"`
+}
+
+// ACLRuleConfig 访问控制规则，所有非空条件同时满足时命中
+type ACLRuleConfig struct {
+	Policy    string   `yaml:"policy"`     // allow 或 deny
+	Action    string   `yaml:"action"`     // 覆盖 acl.action 的拒绝方式，仅对 deny 规则有效
+	CIDR      []string `yaml:"cidr"`       // 目标 IP 或网段
+	Ports     []string `yaml:"ports"`      // 目标端口或端口范围，如 25、8000-9000
+	Network   string   `yaml:"network"`    // tcp、udp 或 icmp，为空表示全部
+	IPVersion int      `yaml:"ip-version"` // 4 或 6，为 0 表示两者
+}
+
+// TCPDeferHandshakeConfig 延迟 TCP 握手：暂缓应答客户端的 SYN，代理拨号成功后才完成握手，
+// 使客户端在代理或目标不可达时直接连接失败。开启域名嗅探时不生效
+type TCPDeferHandshakeConfig struct {
+	Enable bool   `yaml:"enable"` // 是否延迟握手
+	Reject string `yaml:"reject"` // 拨号失败时的拒绝方式：reset（默认，回复 RST）或 unreachable（回复 ICMP 不可达）
+}
+
+// ConnectionLimitConfig 并发连接数限制，0 表示不限制。
+// 达到上限时拒绝新的 TCP 连接；UDP 则淘汰同一范围内最久未活动的会话
+type ConnectionLimitConfig struct {
+	MaxTCP          int `yaml:"max-tcp"`            // TCP 连接总数上限
+	MaxUDP          int `yaml:"max-udp"`            // UDP 会话总数上限
+	MaxTCPPerSource int `yaml:"max-tcp-per-source"` // 每个源 IP 的 TCP 连接数上限
+	MaxUDPPerSource int `yaml:"max-udp-per-source"` // 每个源 IP 的 UDP 会话数上限
+}
+
+// RateLimitConfig 带宽限速配置，各范围的限速同时生效
+type RateLimitConfig struct {
+	Global    BandwidthConfig            `yaml:"global"`     // 所有连接共享的限速
+	PerSource BandwidthConfig            `yaml:"per-source"` // 每个源 IP 的限速
+	Sources   map[string]BandwidthConfig `yaml:"sources"`    // 按源 IP 或网段覆盖 per-source，取最长匹配，网段内每个 IP 单独计算
+	Proxies   map[string]BandwidthConfig `yaml:"proxies"`    // 按代理名称限速
+}
+
+// BandwidthConfig 上下行带宽，单位为字节每秒，支持 KB、MB 等单位（如 10MB），为空表示不限速
+type BandwidthConfig struct {
+	Up   string `yaml:"up"`
+	Down string `yaml:"down"`
+}
+
+// AccessLogConfig 连接访问日志配置，每个结束的连接写入一行 JSON
+type AccessLogConfig struct {
+	Path       string `yaml:"path"`        // 日志文件路径，为空时不记录
+	MaxSize    int    `yaml:"max-size"`    // 单个文件的最大大小（MB），超过后轮转，默认 100
+	MaxBackups int    `yaml:"max-backups"` // 保留的历史文件个数，默认 5，负数表示不保留
+}
+
+// IPFIXConfig IPFIX 流记录导出配置
+type IPFIXConfig struct {
+	Collector         string `yaml:"collector"`          // 采集器地址（host:port，UDP），为空时不导出
+	ObservationDomain uint32 `yaml:"observation-domain"` // 观测域 ID，默认 0
+}
+
+// SniffingConfig 域名嗅探配置
+type SniffingConfig struct {
+	Enable  bool          `yaml:"enable"`  // 是否从 TLS SNI、HTTP Host 及 QUIC Initial 中嗅探域名
+	Timeout time.Duration `yaml:"timeout"` // 等待客户端首包的超时时间，默认 300ms
+}
+
+// DNSConfig DNS 劫持配置
+type DNSConfig struct {
+	Enable       bool              `yaml:"enable"`         // 是否劫持 TUN 上的 UDP/53 查询
+	Mode         string            `yaml:"mode"`           // 应答模式：fake-ip 或 normal，默认 fake-ip
+	FakeIPRange  string            `yaml:"fake-ip-range"`  // Fake IPv4 地址池，默认 198.18.0.0/15
+	FakeIPRange6 string            `yaml:"fake-ip-range6"` // Fake IPv6 地址池，留空则不分配 IPv6
+	FakeIPSize   int               `yaml:"fake-ip-size"`   // 每个地址池保留的最大映射数，默认 65535
+	Hosts        map[string]string `yaml:"hosts"`          // 静态 hosts 表，多个地址以逗号分隔
+	Upstream     string            `yaml:"upstream"`       // 上游服务器，tcp://host[:port] 或 DoH URL，经代理转发
+	CacheSize    int               `yaml:"cache-size"`     // 上游应答缓存条数，默认 4096，-1 表示禁用
+}
+
+// ProxyEntry 具名代理配置
+type ProxyEntry struct {
+	Name   string `yaml:"name"`   // 代理名称，供代理组和规则引用
+	URL    string `yaml:"url"`    // 代理地址，格式同 proxy
+	Weight int    `yaml:"weight"` // 权重，仅 weighted-round-robin 策略使用，默认 1
+}
+
+// ProxyGroupConfig 代理组配置
+type ProxyGroupConfig struct {
+	Name    string   `yaml:"name"`    // 代理组名称，供规则引用
+	Type    string   `yaml:"type"`    // 负载均衡策略：round-robin（默认）、weighted-round-robin、least-active、random、lowest-latency、failover
+	Proxies []string `yaml:"proxies"` // 组内代理名称列表
+	// 拨号失败时是否依次重试组内其他代理，failover 类型默认开启
+	Retry bool `yaml:"retry"`
+	// 会话保持模式：none（默认）、source、destination、source-destination
+	Affinity string `yaml:"affinity"`
+	// 会话保持时长：为 0 时按一致性哈希选择代理；大于 0 时按策略选择并在空闲超时前保持
+	AffinityTTL time.Duration `yaml:"affinity-ttl"`
 }
 
 // HealthCheckConfig 健康检查配置
@@ -31,7 +172,28 @@ type HealthCheckConfig struct {
 	Enable   bool          `yaml:"enable"`   // 是否启用健康检查
 	Interval time.Duration `yaml:"interval"` // 检查间隔，默认30秒
 	Timeout  time.Duration `yaml:"timeout"`  // 检查超时时间，默认5秒
-	URL      string        `yaml:"url"`      // 检查的目标URL，默认http://www.google.com
+	URL      string        `yaml:"url"`      // 检查的目标URL，支持 http 及 https，默认http://www.google.com
+	// 期望的HTTP状态码范围，如 "204" 或 "200-399"，默认 200-399
+	ExpectedStatus string `yaml:"expected-status"`
+
+	Rise       int           `yaml:"rise"`        // 连续成功多少次后恢复健康，默认 2
+	Fall       int           `yaml:"fall"`        // 连续失败多少次后标记为不健康，默认 3
+	MaxBackoff time.Duration `yaml:"max-backoff"` // 不健康代理的最长探测间隔（指数退避），默认 8 倍检查间隔
+	Jitter     float64       `yaml:"jitter"`      // 探测间隔的随机抖动比例，默认 0.1，负数表示不抖动
+	// 所有代理都不健康时的策略：open（默认）保留全部代理，closed 拒绝连接
+	FailPolicy string `yaml:"fail-policy"`
+
+	// 通过 DialUDP 向该 DNS 服务器（如 8.8.8.8:53）发送查询以检查 UDP 转发，为空时不检查
+	UDPCheck       string `yaml:"udp-check"`
+	UDPCheckDomain string `yaml:"udp-check-domain"` // UDP 检查查询的域名，默认 www.google.com
+}
+
+// CircuitBreakerConfig 熔断配置，根据实际流量连接或握手代理服务器的结果将代理移出代理组，
+// 规则直接引用的代理不受影响
+type CircuitBreakerConfig struct {
+	Enable    bool          `yaml:"enable"`    // 是否启用熔断
+	Threshold int           `yaml:"threshold"` // 连续拨号失败多少次后熔断，默认 5
+	Cooldown  time.Duration `yaml:"cooldown"`  // 熔断多久后进入半开状态重新尝试，默认 30 秒
 }
 
 // ProxyConfig supports both single proxy string and multiple proxy slice
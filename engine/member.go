@@ -0,0 +1,267 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/metrics"
+	"github.com/xjasonlyu/tun2socks/v2/proxy"
+	"github.com/xjasonlyu/tun2socks/v2/proxy/proto"
+)
+
+var errProxyDisabled = errors.New("proxy disabled")
+
+// member is a leaf proxy with its runtime state, which is shared by
+// all proxy groups and rules referencing it.
+type member struct {
+	proxy.Proxy
+
+	name   string
+	url    string
+	rawURL string
+	weight int
+
+	// added marks member added at runtime, which is carried over by
+	// Reload unless its name is taken.
+	added bool
+
+	active   atomic.Int64
+	disabled atomic.Bool
+
+	// breaker ejects member on consecutive dial failures, if enabled.
+	breaker *breaker
+
+	mu        sync.RWMutex
+	healthy   bool
+	lastCheck time.Time
+	lastDelay time.Duration
+	lastError error
+
+	// UDP health, which stays healthy unless checked.
+	udpHealthy   bool
+	udpLastDelay time.Duration
+	udpLastError error
+}
+
+func newMember(name, rawURL string, p proxy.Proxy) *member {
+	return &member{
+		Proxy:      p,
+		name:       name,
+		url:        redactURL(rawURL),
+		rawURL:     rawURL,
+		healthy:    true,
+		udpHealthy: true,
+	}
+}
+
+// Name returns the name of member.
+func (m *member) Name() string {
+	return m.name
+}
+
+// Weight implements balancer.Weighter.
+func (m *member) Weight() int {
+	return m.weight
+}
+
+// Latency implements balancer.LatencyReporter with the delay of the
+// last health check if it passed.
+func (m *member) Latency() (time.Duration, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.lastDelay, m.lastError == nil && !m.lastCheck.IsZero()
+}
+
+// Active returns the number of active connections of member.
+func (m *member) Active() int64 {
+	return m.active.Load()
+}
+
+// Healthy reports whether the last health check of member passed,
+// or true if it has never been checked.
+func (m *member) Healthy() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.healthy
+}
+
+// Unwrap returns the proxy wrapped by member, which dials without the
+// runtime state of member, e.g. for health checks.
+func (m *member) Unwrap() proxy.Proxy {
+	return m.Proxy
+}
+
+// Allow reports whether member is allowed by its circuit breaker.
+func (m *member) Allow() bool {
+	return m.breaker == nil || m.breaker.Allow()
+}
+
+// HealthyUDP reports whether member is considered healthy for UDP,
+// or true if UDP has never been checked.
+func (m *member) HealthyUDP() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.udpHealthy
+}
+
+// recordCheck records the result of a health check, and the health
+// state after applying it.
+func (m *member) recordCheck(healthy bool, delay time.Duration, err error) {
+	m.mu.Lock()
+	m.healthy = healthy
+	m.lastCheck = time.Now()
+	m.lastDelay = delay
+	m.lastError = err
+	m.mu.Unlock()
+}
+
+// recordUDPCheck records the result of a UDP health check, and the
+// UDP health state after applying it.
+func (m *member) recordUDPCheck(healthy bool, delay time.Duration, err error) {
+	m.mu.Lock()
+	m.udpHealthy = healthy
+	m.udpLastDelay = delay
+	m.udpLastError = err
+	m.mu.Unlock()
+}
+
+// resetHealth forgets the results of the TCP or UDP health checks
+// of member, which are no longer run.
+func (m *member) resetHealth(tcp, udp bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if tcp {
+		m.healthy = true
+		m.lastCheck = time.Time{}
+		m.lastDelay = 0
+		m.lastError = nil
+	}
+	if udp {
+		m.udpHealthy = true
+		m.udpLastDelay = 0
+		m.udpLastError = nil
+	}
+}
+
+func (m *member) DialContext(ctx context.Context, metadata *M.Metadata) (net.Conn, error) {
+	if m.disabled.Load() {
+		return nil, errProxyDisabled
+	}
+	if metadata.Probe {
+		return m.Proxy.DialContext(ctx, metadata)
+	}
+	start := time.Now()
+	c, err := m.Proxy.DialContext(ctx, metadata)
+	m.report(ctx, err)
+	metrics.ObserveDial(m.name, M.TCP.String(), time.Since(start), err)
+	if err != nil {
+		return nil, err
+	}
+	m.annotate(metadata)
+	m.active.Add(1)
+	return &memberConn{Conn: c, m: m}, nil
+}
+
+func (m *member) DialUDP(metadata *M.Metadata) (net.PacketConn, error) {
+	if m.disabled.Load() {
+		return nil, errProxyDisabled
+	}
+	if metadata.Probe {
+		return m.Proxy.DialUDP(metadata)
+	}
+	start := time.Now()
+	pc, err := m.Proxy.DialUDP(metadata)
+	m.report(context.Background(), err)
+	metrics.ObserveDial(m.name, M.UDP.String(), time.Since(start), err)
+	if err != nil {
+		return nil, err
+	}
+	m.annotate(metadata)
+	m.active.Add(1)
+	return &memberPacketConn{PacketConn: pc, m: m}, nil
+}
+
+// report reports the result of a dial with ctx to the circuit breaker.
+func (m *member) report(ctx context.Context, err error) {
+	if m.breaker != nil {
+		m.breaker.report(ctx, err)
+	}
+}
+
+// annotate records member on metadata of a dialed flow.
+func (m *member) annotate(metadata *M.Metadata) {
+	metadata.Proxy = m.name
+	metadata.ProxyProto = m.Proto().String()
+	metadata.ProxyAddress = m.Addr()
+}
+
+func (m *member) release() {
+	m.active.Add(-1)
+}
+
+// memberConn releases member once on close to track active
+// connections.
+type memberConn struct {
+	net.Conn
+	once sync.Once
+	m    *member
+}
+
+func (c *memberConn) Close() error {
+	c.once.Do(c.m.release)
+	return c.Conn.Close()
+}
+
+func (c *memberConn) CloseRead() error {
+	if cr, ok := c.Conn.(interface{ CloseRead() error }); ok {
+		return cr.CloseRead()
+	}
+	return nil
+}
+
+func (c *memberConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// memberPacketConn releases member once on close to track active
+// sessions.
+type memberPacketConn struct {
+	net.PacketConn
+	once sync.Once
+	m    *member
+}
+
+func (pc *memberPacketConn) Close() error {
+	pc.once.Do(pc.m.release)
+	return pc.PacketConn.Close()
+}
+
+// redactURL hides the user info of proxy URL s, which may carry
+// the password or the encoded cipher key.
+func redactURL(s string) string {
+	if !strings.Contains(s, "://") {
+		s = fmt.Sprintf("%s://%s", proto.Socks5 /* default protocol */, s)
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		// Where the user info ends is unknown, so keep the scheme only.
+		scheme, _, _ := strings.Cut(s, "://")
+		return scheme + "://<redacted>"
+	}
+	if u.User == nil {
+		return s
+	}
+	u.User = url.User("xxxxx")
+	return u.String()
+}
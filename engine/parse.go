@@ -7,15 +7,22 @@ import (
 	"net/netip"
 	"net/url"
 	"runtime"
+	"slices"
 	"strings"
 
+	"github.com/docker/go-units"
 	"github.com/gorilla/schema"
 
+	"github.com/xjasonlyu/tun2socks/v2/core/adapter"
 	"github.com/xjasonlyu/tun2socks/v2/core/device"
 	"github.com/xjasonlyu/tun2socks/v2/core/device/fdbased"
 	"github.com/xjasonlyu/tun2socks/v2/core/device/tun"
+	"github.com/xjasonlyu/tun2socks/v2/dns/fakeip"
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
 	"github.com/xjasonlyu/tun2socks/v2/proxy"
 	"github.com/xjasonlyu/tun2socks/v2/proxy/proto"
+	"github.com/xjasonlyu/tun2socks/v2/tunnel/acl"
+	"github.com/xjasonlyu/tun2socks/v2/tunnel/ratelimit"
 )
 
 func parseRestAPI(s string) (*url.URL, error) {
@@ -186,6 +193,39 @@ func parseRelay(u *url.URL) (proxy.Proxy, error) {
 	return proxy.NewRelay(address, username, password, opts.NoDelay)
 }
 
+func parseFakeIPPool(c DNSConfig) (*fakeip.Pool, error) {
+	v4, err := netip.ParsePrefix(c.FakeIPRange)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fake-ip-range: %w", err)
+	}
+
+	var v6 netip.Prefix
+	if c.FakeIPRange6 != "" {
+		if v6, err = netip.ParsePrefix(c.FakeIPRange6); err != nil {
+			return nil, fmt.Errorf("invalid fake-ip-range6: %w", err)
+		}
+	}
+	return fakeip.New(v4, v6, c.FakeIPSize)
+}
+
+func parseHosts(hosts map[string]string) (map[string][]netip.Addr, error) {
+	table := make(map[string][]netip.Addr, len(hosts))
+	for host, v := range hosts {
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			ip, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid hosts entry %s: %w", host, err)
+			}
+			table[host] = append(table[host], ip)
+		}
+	}
+	return table, nil
+}
+
 func parseMulticastGroups(s string) (multicastGroups []netip.Addr, _ error) {
 	for _, ip := range strings.Split(s, ",") {
 		if ip = strings.TrimSpace(ip); ip == "" {
@@ -202,3 +242,146 @@ func parseMulticastGroups(s string) (multicastGroups []netip.Addr, _ error) {
 	}
 	return
 }
+
+func parseRateLimit(c RateLimitConfig) (cfg ratelimit.Config, err error) {
+	if cfg.Global, err = parseBandwidth(c.Global); err != nil {
+		return cfg, fmt.Errorf("invalid global rate limit: %w", err)
+	}
+	if cfg.PerSource, err = parseBandwidth(c.PerSource); err != nil {
+		return cfg, fmt.Errorf("invalid per-source rate limit: %w", err)
+	}
+	for s, b := range c.Sources {
+		source := ratelimit.SourceLimit{}
+		if source.Prefix, err = parsePrefix(s); err != nil {
+			return cfg, fmt.Errorf("invalid rate limit source %s: %w", s, err)
+		}
+		if source.Limit, err = parseBandwidth(b); err != nil {
+			return cfg, fmt.Errorf("invalid rate limit of source %s: %w", s, err)
+		}
+		cfg.Sources = append(cfg.Sources, source)
+	}
+	slices.SortFunc(cfg.Sources, func(a, b ratelimit.SourceLimit) int {
+		return strings.Compare(a.Prefix.String(), b.Prefix.String())
+	})
+	for name, b := range c.Proxies {
+		limit, err := parseBandwidth(b)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid rate limit of proxy %s: %w", name, err)
+		}
+		if cfg.Proxies == nil {
+			cfg.Proxies = make(map[string]ratelimit.Limit)
+		}
+		cfg.Proxies[name] = limit
+	}
+	return cfg, nil
+}
+
+func parseBandwidth(c BandwidthConfig) (limit ratelimit.Limit, err error) {
+	if c.Up != "" {
+		if limit.Up, err = units.RAMInBytes(c.Up); err != nil {
+			return
+		}
+	}
+	if c.Down != "" {
+		if limit.Down, err = units.RAMInBytes(c.Down); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// parsePrefix parses s as a CIDR, or an IP as a single address
+// prefix.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		return p.Masked(), err
+	}
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	ip = ip.Unmap()
+	return netip.PrefixFrom(ip, ip.BitLen()), nil
+}
+
+func parseReject(s string) (adapter.Action, error) {
+	switch s {
+	case "", "reset":
+		return adapter.ActionReset, nil
+	case "unreachable":
+		return adapter.ActionUnreachable, nil
+	default:
+		return 0, fmt.Errorf("invalid reject action: %s", s)
+	}
+}
+
+func parseACL(c ACLConfig) (cfg acl.Config, err error) {
+	switch c.Default {
+	case "", "allow":
+	case "deny":
+		cfg.DefaultDeny = true
+	default:
+		return cfg, fmt.Errorf("invalid acl default policy: %s", c.Default)
+	}
+	if c.Action != "" {
+		if cfg.Action, err = acl.ParseAction(c.Action); err != nil {
+			return cfg, err
+		}
+	}
+	for i, rc := range c.Rules {
+		r, err := parseACLRule(rc)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid acl rule %d: %w", i, err)
+		}
+		cfg.Rules = append(cfg.Rules, r)
+	}
+	return cfg, nil
+}
+
+func parseACLRule(c ACLRuleConfig) (r acl.Rule, err error) {
+	switch c.Policy {
+	case "allow":
+	case "deny":
+		r.Deny = true
+	default:
+		return r, fmt.Errorf("invalid policy: %q", c.Policy)
+	}
+	if c.Action != "" {
+		if r.Action, err = acl.ParseAction(c.Action); err != nil {
+			return r, err
+		}
+	}
+	for _, s := range c.CIDR {
+		p, err := parsePrefix(s)
+		if err != nil {
+			return r, err
+		}
+		r.Prefixes = append(r.Prefixes, p)
+	}
+	for _, s := range c.Ports {
+		pr, err := acl.ParsePortRange(s)
+		if err != nil {
+			return r, err
+		}
+		r.Ports = append(r.Ports, pr)
+	}
+	switch c.Network {
+	case "":
+	case "tcp":
+		r.Networks = []M.Network{M.TCP}
+	case "udp":
+		r.Networks = []M.Network{M.UDP}
+	case "icmp":
+		r.Networks = []M.Network{M.ICMP}
+	default:
+		return r, fmt.Errorf("invalid network: %q", c.Network)
+	}
+	switch c.IPVersion {
+	case 0, 4, 6:
+		r.IPVersion = c.IPVersion
+	default:
+		return r, fmt.Errorf("invalid ip version: %d", c.IPVersion)
+	}
+	return r, nil
+}
@@ -0,0 +1,649 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/xjasonlyu/tun2socks/v2/balancer"
+	"github.com/xjasonlyu/tun2socks/v2/log"
+	"github.com/xjasonlyu/tun2socks/v2/proxy"
+	"github.com/xjasonlyu/tun2socks/v2/restapi"
+	"github.com/xjasonlyu/tun2socks/v2/rule"
+	"github.com/xjasonlyu/tun2socks/v2/tunnel/acl"
+	"github.com/xjasonlyu/tun2socks/v2/tunnel/statistic"
+)
+
+const (
+	// defaultProxyName is the name of proxy (group) built from the
+	// "proxy" field of Key.
+	defaultProxyName = "PROXY"
+
+	// Built-in proxies which can always be referenced by rules.
+	directProxyName = "DIRECT"
+	rejectProxyName = "REJECT"
+)
+
+var _ restapi.ProxyManager = (*proxySet)(nil)
+
+// proxySet holds all proxies and proxy groups parsed from Key, and
+// manages them at runtime.
+type proxySet struct {
+	mu sync.RWMutex
+
+	// named holds proxies and proxy groups keyed by name.
+	named map[string]proxy.Proxy
+
+	// members holds all leaf proxies subject to health check,
+	// excluding the built-in ones.
+	members []*member
+
+	// groups holds all proxy groups, including the default one.
+	groups []*balancer.Group
+
+	// defaultProxy is the proxy (group) named by defaultProxyName,
+	// which may be nil if "proxy" is not configured.
+	defaultProxy proxy.Proxy
+
+	// targets holds the names referenced by rules.
+	targets map[string]struct{}
+
+	// hc is the health checker of members, if enabled.
+	hc *HealthChecker
+
+	// failClosed leaves a group without available proxies if all
+	// of its members are unhealthy, instead of keeping them all.
+	failClosed bool
+
+	// breaker configures the circuit breakers of members.
+	breaker CircuitBreakerConfig
+
+	// acl denies the proxy servers of members if denyServers, once
+	// set by applyProxySet. serversMu orders its updates.
+	acl         *acl.ACL
+	denyServers bool
+	serversMu   sync.Mutex
+
+	// prev holds the members of the previous proxySet by name, which
+	// may be carried over while rebuilding.
+	prev map[string]*member
+}
+
+func buildProxySet(k *Key) (*proxySet, error) {
+	return rebuildProxySet(k, nil)
+}
+
+// rebuildProxySet builds proxySet from k like buildProxySet, carrying
+// over the members of prev which are unchanged, with their runtime
+// state, and those added at runtime to prev, which are left untouched
+// until applied by applyProxySet.
+func rebuildProxySet(k *Key, prev *proxySet) (*proxySet, error) {
+	if err := validateHealthCheck(k.HealthCheck); err != nil {
+		return nil, err
+	}
+
+	ps := &proxySet{
+		named: map[string]proxy.Proxy{
+			directProxyName: newMember(directProxyName, "direct://", proxy.NewDirect()),
+			rejectProxyName: newMember(rejectProxyName, "reject://", proxy.NewReject()),
+		},
+		targets:     make(map[string]struct{}),
+		failClosed:  k.HealthCheck.FailPolicy == failPolicyClosed,
+		breaker:     k.CircuitBreaker,
+		denyServers: k.ACL.DenyProxyServers,
+	}
+	// Members with circuit breakers configured differently are rebuilt.
+	if prev != nil && prev.breaker == ps.breaker {
+		prev.mu.RLock()
+		ps.prev = make(map[string]*member, len(prev.members))
+		for _, m := range prev.members {
+			ps.prev[m.name] = m
+		}
+		prev.mu.RUnlock()
+	}
+	defer func() { ps.prev = nil }()
+
+	addNamed := func(name string, p proxy.Proxy) error {
+		if name == "" {
+			return errors.New("empty proxy name")
+		}
+		if _, ok := ps.named[name]; ok {
+			return fmt.Errorf("duplicate proxy name: %s", name)
+		}
+		ps.named[name] = p
+		return nil
+	}
+
+	if !k.Proxy.IsEmpty() {
+		urls := k.Proxy.GetProxies()
+		var list []proxy.Proxy
+		for i, s := range urls {
+			name := defaultProxyName
+			if len(urls) > 1 {
+				name = fmt.Sprintf("%s-%d", defaultProxyName, i+1)
+			}
+			m := ps.reuse(name, s, 0)
+			if m == nil {
+				p, err := parseProxy(s)
+				if err != nil {
+					return nil, err
+				}
+				m = ps.newMember(name, s, p)
+			}
+			ps.members = append(ps.members, m)
+			list = append(list, m)
+		}
+
+		if len(list) == 1 {
+			// Single proxy mode
+			ps.defaultProxy = list[0]
+		} else {
+			// Multiple proxy mode - use round-robin proxy
+			for _, p := range list {
+				if err := addNamed(p.(*member).Name(), p); err != nil {
+					return nil, err
+				}
+			}
+			strategy, err := balancer.New(balancer.RoundRobin)
+			if err != nil {
+				return nil, err
+			}
+			g := balancer.NewGroup(defaultProxyName, strategy, list)
+			ps.groups = append(ps.groups, g)
+			ps.defaultProxy = g
+		}
+		if err := addNamed(defaultProxyName, ps.defaultProxy); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, e := range k.Proxies {
+		m := ps.reuse(e.Name, e.URL, e.Weight)
+		if m == nil {
+			p, err := parseProxy(e.URL)
+			if err != nil {
+				return nil, fmt.Errorf("proxy %s: %w", e.Name, err)
+			}
+			m = ps.newMember(e.Name, e.URL, p)
+			m.weight = e.Weight
+		}
+		if err := addNamed(e.Name, m); err != nil {
+			return nil, err
+		}
+		ps.members = append(ps.members, m)
+	}
+
+	for _, g := range k.ProxyGroups {
+		strategy, err := balancer.New(g.Type)
+		if err != nil {
+			return nil, fmt.Errorf("proxy group %s: %w", g.Name, err)
+		}
+		affinity, err := balancer.ParseAffinity(g.Affinity)
+		if err != nil {
+			return nil, fmt.Errorf("proxy group %s: %w", g.Name, err)
+		}
+		if len(g.Proxies) == 0 {
+			return nil, fmt.Errorf("proxy group %s: empty proxies", g.Name)
+		}
+
+		var list []proxy.Proxy
+		for _, name := range g.Proxies {
+			p, ok := ps.named[name]
+			if !ok {
+				return nil, fmt.Errorf("proxy group %s: proxy %q not found", g.Name, name)
+			}
+			if _, isGroup := p.(*balancer.Group); isGroup {
+				return nil, fmt.Errorf("proxy group %s: nested group %q is not supported", g.Name, name)
+			}
+			list = append(list, p)
+		}
+
+		opts := []balancer.Option{balancer.WithAffinity(affinity, g.AffinityTTL)}
+		if g.Retry || strategy.Name() == balancer.Failover {
+			opts = append(opts, balancer.WithRetry())
+		}
+		bg := balancer.NewGroup(g.Name, strategy, list, opts...)
+		if err := addNamed(g.Name, bg); err != nil {
+			return nil, err
+		}
+		ps.groups = append(ps.groups, bg)
+	}
+
+	if ps.defaultProxy == nil && len(k.Rules) == 0 {
+		return nil, errors.New("empty proxy")
+	}
+	if prev != nil {
+		ps.carryAdded(prev)
+	}
+	return ps, nil
+}
+
+// reuse returns the member of prev named name, if it's unchanged and
+// not reused yet, or nil.
+func (ps *proxySet) reuse(name, rawURL string, weight int) *member {
+	m, ok := ps.prev[name]
+	if !ok || m.rawURL != rawURL || m.weight != weight {
+		return nil
+	}
+	delete(ps.prev, name)
+	return m
+}
+
+// carryAdded adds the members added at runtime to prev, to the groups
+// of the same names which they were in.
+func (ps *proxySet) carryAdded(prev *proxySet) {
+	prev.mu.RLock()
+	defer prev.mu.RUnlock()
+
+	for _, pm := range prev.members {
+		if !pm.added {
+			continue
+		}
+		if p, ok := ps.named[pm.name]; ok {
+			if p != proxy.Proxy(pm) {
+				log.Warnf("[ENGINE] proxy %s added at runtime is replaced by config", pm.name)
+			}
+			continue
+		}
+		m := ps.reuse(pm.name, pm.rawURL, pm.weight)
+		if m == nil {
+			p, err := parseProxy(pm.rawURL)
+			if err != nil {
+				log.Warnf("[ENGINE] proxy %s added at runtime: %v", pm.name, err)
+				continue
+			}
+			m = ps.newMember(pm.name, pm.rawURL, p)
+			m.added = true
+		}
+		ps.named[m.name] = m
+		ps.members = append(ps.members, m)
+		for _, g := range prev.groups {
+			if !slices.Contains(g.Members(), proxy.Proxy(pm)) {
+				continue
+			}
+			if ng, ok := ps.named[g.Name()].(*balancer.Group); ok {
+				ng.AddMember(m)
+			}
+		}
+	}
+}
+
+// newMember creates a configured member, with circuit breaker if
+// enabled, which refreshes the groups on state changes like the
+// health checker does.
+func (ps *proxySet) newMember(name, rawURL string, p proxy.Proxy) *member {
+	m := newMember(name, rawURL, p)
+	if ps.breaker.Enable {
+		m.breaker = newBreaker(name, ps.breaker, func() { ps.updateHealthy(nil) })
+	}
+	return m
+}
+
+// stopBreakers stops the circuit breakers of members, which are no
+// longer in use, except those carried over to next if not nil.
+func (ps *proxySet) stopBreakers(next *proxySet) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	for _, m := range ps.members {
+		if m.breaker != nil && (next == nil || !slices.Contains(next.members, m)) {
+			m.breaker.stop()
+		}
+	}
+}
+
+// dialer returns the proxy.Dialer used by tunnel, which is a rule
+// router if any rule is configured, or the default proxy otherwise.
+func (ps *proxySet) dialer(k *Key) (proxy.Dialer, error) {
+	if len(k.Rules) == 0 {
+		ps.targets[defaultProxyName] = struct{}{}
+		return ps.defaultProxy, nil
+	}
+
+	rules, err := rule.ParseRules(k.Rules)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rules {
+		ps.targets[r.Target()] = struct{}{}
+	}
+	// Router gets its own copy, as proxies may be added at runtime.
+	return rule.NewRouter(rules, maps.Clone(ps.named))
+}
+
+// leaves returns members as a list of proxy.Proxy.
+func (ps *proxySet) leaves() []proxy.Proxy {
+	list := make([]proxy.Proxy, 0, len(ps.members))
+	for _, m := range ps.members {
+		list = append(list, m)
+	}
+	return list
+}
+
+// retainTraffic drops the traffic totals of the proxies other than
+// members, which are gone for good.
+func (ps *proxySet) retainTraffic() {
+	ps.mu.RLock()
+	names := make([]string, 0, len(ps.members))
+	for _, m := range ps.members {
+		names = append(names, m.name)
+	}
+	ps.mu.RUnlock()
+	statistic.DefaultManager.RetainProxies(names)
+}
+
+// updateServers replaces the proxy servers denied by acl with those
+// of members, if enabled. It must be called without ps.mu held.
+func (ps *proxySet) updateServers() {
+	if ps.acl == nil {
+		return
+	}
+	ps.serversMu.Lock()
+	defer ps.serversMu.Unlock()
+
+	var servers []netip.AddrPort
+	if ps.denyServers {
+		servers = ps.servers()
+	}
+	ps.acl.SetProxyServers(servers)
+}
+
+// servers returns the resolved addresses of the proxy servers of
+// members, which are resolved concurrently. Names which fail to
+// resolve are logged and skipped.
+func (ps *proxySet) servers() []netip.AddrPort {
+	ps.mu.RLock()
+	addrs := make([]string, 0, len(ps.members))
+	for _, m := range ps.members {
+		addrs = append(addrs, m.Addr())
+	}
+	ps.mu.RUnlock()
+
+	resolved := make([][]netip.AddrPort, len(addrs))
+	var wg sync.WaitGroup
+	for i, addr := range addrs {
+		host, portStr, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ips, err := resolveHost(host)
+			if err != nil {
+				log.Warnf("[ACL] resolve proxy server %s: %v", host, err)
+				return
+			}
+			for _, ip := range ips {
+				resolved[i] = append(resolved[i], netip.AddrPortFrom(ip, uint16(port)))
+			}
+		}()
+	}
+	wg.Wait()
+	return slices.Concat(resolved...)
+}
+
+func resolveHost(host string) ([]netip.Addr, error) {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{ip}, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+}
+
+// updateHealthy is called by the health checker after each round,
+// of which the results have been recorded by members.
+func (ps *proxySet) updateHealthy([]proxy.Proxy) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	ps.refresh()
+}
+
+// refresh updates all proxy groups with their available members,
+// which are enabled and healthy, for TCP and UDP respectively. It
+// must be called with ps.mu held.
+func (ps *proxySet) refresh() {
+	for _, g := range ps.groups {
+		var enabled, healthy, healthyUDP []proxy.Proxy
+		for _, p := range g.Members() {
+			m := p.(*member)
+			if m.disabled.Load() {
+				continue
+			}
+			enabled = append(enabled, m)
+			if !m.Allow() {
+				continue
+			}
+			if m.Healthy() {
+				healthy = append(healthy, m)
+			}
+			if m.HealthyUDP() {
+				healthyUDP = append(healthyUDP, m)
+			}
+		}
+		// 组内所有代理都不健康时，按故障策略保留全部启用的代理以防止断线
+		if len(healthy) == 0 && !ps.failClosed {
+			healthy = enabled
+		}
+		if len(healthyUDP) == 0 && !ps.failClosed {
+			healthyUDP = enabled
+		}
+		g.Update(healthy)
+		g.UpdateUDP(healthyUDP)
+		log.Infof("[ENGINE] 更新代理组 %s 健康代理列表，当前健康代理数量: TCP %d, UDP %d",
+			g.Name(), len(healthy), len(healthyUDP))
+	}
+}
+
+func (ps *proxySet) member(name string) (*member, error) {
+	p, ok := ps.named[name]
+	if !ok {
+		return nil, fmt.Errorf("proxy %q not found", name)
+	}
+	m, ok := p.(*member)
+	if !ok || !slices.Contains(ps.members, m) {
+		return nil, fmt.Errorf("proxy %q is not a configured proxy", name)
+	}
+	return m, nil
+}
+
+func (ps *proxySet) group(name string) (*balancer.Group, error) {
+	for _, g := range ps.groups {
+		if g.Name() == name {
+			return g, nil
+		}
+	}
+	return nil, fmt.Errorf("proxy group %q not found", name)
+}
+
+// Proxies implements restapi.ProxyManager.
+func (ps *proxySet) Proxies() []restapi.ProxyInfo {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	infos := make([]restapi.ProxyInfo, 0, len(ps.members))
+	for _, m := range ps.members {
+		info := restapi.ProxyInfo{
+			Name:     m.Name(),
+			Proto:    m.Proto().String(),
+			Address:  m.url,
+			Groups:   []string{},
+			Disabled: m.disabled.Load(),
+			Active:   m.Active(),
+		}
+		if m.breaker != nil {
+			info.Circuit = m.breaker.State().String()
+		}
+		m.mu.RLock()
+		info.Healthy = m.healthy
+		info.LastCheck = m.lastCheck
+		info.LastDelay = m.lastDelay.Milliseconds()
+		if m.lastError != nil {
+			info.LastError = m.lastError.Error()
+		}
+		info.UDPHealthy = m.udpHealthy
+		info.UDPLastDelay = m.udpLastDelay.Milliseconds()
+		if m.udpLastError != nil {
+			info.UDPLastError = m.udpLastError.Error()
+		}
+		m.mu.RUnlock()
+
+		for _, g := range ps.groups {
+			if slices.Contains(g.Members(), proxy.Proxy(m)) {
+				info.Groups = append(info.Groups, g.Name())
+			}
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// ProxyGroups implements restapi.ProxyManager.
+func (ps *proxySet) ProxyGroups() []restapi.ProxyGroupInfo {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	names := func(list []proxy.Proxy) []string {
+		s := make([]string, 0, len(list))
+		for _, p := range list {
+			s = append(s, p.(*member).Name())
+		}
+		return s
+	}
+
+	infos := make([]restapi.ProxyGroupInfo, 0, len(ps.groups))
+	for _, g := range ps.groups {
+		infos = append(infos, restapi.ProxyGroupInfo{
+			Name:         g.Name(),
+			Type:         g.Strategy().Name(),
+			Affinity:     g.Affinity().String(),
+			Retry:        g.Retry(),
+			Members:      names(g.Members()),
+			Available:    names(g.Available()),
+			AvailableUDP: names(g.AvailableUDP()),
+		})
+	}
+	return infos
+}
+
+// AddProxy implements restapi.ProxyManager. The proxy is added to
+// the given groups, and can't be referenced by rules until reload.
+func (ps *proxySet) AddProxy(name, url string, groups []string) error {
+	if err := ps.addProxy(name, url, groups); err != nil {
+		return err
+	}
+	ps.updateServers()
+	return nil
+}
+
+func (ps *proxySet) addProxy(name, url string, groups []string) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if name == "" {
+		return errors.New("empty proxy name")
+	}
+	if _, ok := ps.named[name]; ok {
+		return fmt.Errorf("duplicate proxy name: %s", name)
+	}
+	var gs []*balancer.Group
+	for _, gn := range groups {
+		g, err := ps.group(gn)
+		if err != nil {
+			return err
+		}
+		gs = append(gs, g)
+	}
+
+	p, err := parseProxy(url)
+	if err != nil {
+		return fmt.Errorf("proxy %s: %w", name, err)
+	}
+
+	m := ps.newMember(name, url, p)
+	m.added = true
+	ps.named[name] = m
+	ps.members = append(ps.members, m)
+	for _, g := range gs {
+		g.AddMember(m)
+	}
+	if ps.hc != nil {
+		ps.hc.AddProxy(m)
+	}
+	ps.refresh()
+
+	log.Infof("[ENGINE] add proxy %s: %s", name, m.url)
+	return nil
+}
+
+// RemoveProxy implements restapi.ProxyManager. A proxy referenced by
+// rules or being the last member of a group can't be removed.
+func (ps *proxySet) RemoveProxy(name string) error {
+	if err := ps.removeProxy(name); err != nil {
+		return err
+	}
+	ps.updateServers()
+	ps.retainTraffic()
+	return nil
+}
+
+func (ps *proxySet) removeProxy(name string) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	m, err := ps.member(name)
+	if err != nil {
+		return err
+	}
+	if _, ok := ps.targets[name]; ok || ps.defaultProxy == proxy.Proxy(m) {
+		return fmt.Errorf("proxy %q is in use by rules", name)
+	}
+	for _, g := range ps.groups {
+		if members := g.Members(); len(members) == 1 && members[0] == proxy.Proxy(m) {
+			return fmt.Errorf("proxy %q is the last member of group %s", name, g.Name())
+		}
+	}
+
+	for _, g := range ps.groups {
+		g.RemoveMember(m)
+	}
+	delete(ps.named, name)
+	ps.members = slices.DeleteFunc(ps.members, func(x *member) bool { return x == m })
+	if ps.hc != nil {
+		ps.hc.RemoveProxy(m)
+	}
+	if m.breaker != nil {
+		m.breaker.stop()
+	}
+	ps.refresh()
+
+	log.Infof("[ENGINE] remove proxy %s", name)
+	return nil
+}
+
+// SetProxyDisabled implements restapi.ProxyManager.
+func (ps *proxySet) SetProxyDisabled(name string, disabled bool) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	m, err := ps.member(name)
+	if err != nil {
+		return err
+	}
+	m.disabled.Store(disabled)
+	ps.refresh()
+
+	log.Infof("[ENGINE] set proxy %s disabled: %t", name, disabled)
+	return nil
+}
@@ -0,0 +1,122 @@
+package engine
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+
+	"github.com/xjasonlyu/tun2socks/v2/dns/fakeip"
+	"github.com/xjasonlyu/tun2socks/v2/flowlog"
+	"github.com/xjasonlyu/tun2socks/v2/log"
+)
+
+// Reload applies *Key to the running default engine without tearing
+// down the device and netstack. The new key is fully validated before
+// anything is applied, so a bad key leaves the running one untouched.
+// Changed options which can't be applied live are reported and kept
+// as they are until restart. Unchanged proxies and those added at
+// runtime are carried over with their health and circuit breaker
+// state, and so is the fake IP pool if its range is unchanged.
+func Reload(k *Key) error {
+	_engineMu.Lock()
+	defer _engineMu.Unlock()
+
+	if _defaultKey == nil {
+		return errors.New("engine not started")
+	}
+	old := _defaultKey
+
+	// Build everything first.
+	ps, err := rebuildProxySet(k, _proxySet)
+	if err != nil {
+		return err
+	}
+	d, err := ps.dialer(k)
+	if err != nil {
+		return err
+	}
+	dnsChanged := !reflect.DeepEqual(old.DNS, k.DNS)
+	var pool *fakeip.Pool
+	if _dnsServer != nil && sameFakeIPPool(old.DNS, k.DNS) {
+		pool = _dnsServer.FakeIP()
+	}
+	server, err := buildDNSServer(k, pool)
+	if err != nil {
+		return err
+	}
+	flowLogChanged := !reflect.DeepEqual(old.AccessLog, k.AccessLog) ||
+		!reflect.DeepEqual(old.IPFIX, k.IPFIX)
+	var exporters []*flowlog.Exporter
+	if flowLogChanged {
+		if exporters, err = buildExporters(k); err != nil {
+			return err
+		}
+	}
+	if err = general(k); err != nil {
+		closeExporters(exporters)
+		return err
+	}
+
+	applyProxySet(k, ps, d)
+	if dnsChanged {
+		applyDNSServer(k, server)
+	}
+	if flowLogChanged {
+		applyExporters(exporters)
+	}
+
+	if fields := restartRequired(old, k); len(fields) > 0 {
+		log.Warnf("[ENGINE] restart required to apply: %s", strings.Join(fields, ", "))
+		keepRestartRequired(old, k)
+	}
+	_defaultKey = k
+
+	log.Infof("[ENGINE] config reloaded")
+	return nil
+}
+
+// sameFakeIPPool reports whether the fake IP pools configured by a and
+// b are the same, so that the mappings handed out can be kept.
+func sameFakeIPPool(a, b DNSConfig) bool {
+	a, b = dnsDefaults(a), dnsDefaults(b)
+	return a.Enable && b.Enable && a.Mode == "fake-ip" && b.Mode == "fake-ip" &&
+		a.FakeIPRange == b.FakeIPRange && a.FakeIPRange6 == b.FakeIPRange6 && a.FakeIPSize == b.FakeIPSize
+}
+
+// restartRequired returns the yaml names of options which differ
+// between old and k but require a new device or netstack to apply.
+func restartRequired(old, k *Key) []string {
+	var fields []string
+	check := func(name string, changed bool) {
+		if changed {
+			fields = append(fields, name)
+		}
+	}
+	check("device", old.Device != k.Device)
+	check("mtu", old.MTU != k.MTU)
+	check("restapi", old.RestAPI != k.RestAPI)
+	check("metrics", old.Metrics != k.Metrics)
+	check("tcp-moderate-receive-buffer", old.TCPModerateReceiveBuffer != k.TCPModerateReceiveBuffer)
+	check("tcp-send-buffer-size", old.TCPSendBufferSize != k.TCPSendBufferSize)
+	check("tcp-receive-buffer-size", old.TCPReceiveBufferSize != k.TCPReceiveBufferSize)
+	check("multicast-groups", old.MulticastGroups != k.MulticastGroups)
+	check("tun-pre-up", old.TUNPreUp != k.TUNPreUp)
+	check("tun-post-up", old.TUNPostUp != k.TUNPostUp)
+	return fields
+}
+
+// keepRestartRequired copies the running values of options reported
+// by restartRequired into k, so that they are reported again against
+// the next reload until restart.
+func keepRestartRequired(old, k *Key) {
+	k.Device = old.Device
+	k.MTU = old.MTU
+	k.RestAPI = old.RestAPI
+	k.Metrics = old.Metrics
+	k.TCPModerateReceiveBuffer = old.TCPModerateReceiveBuffer
+	k.TCPSendBufferSize = old.TCPSendBufferSize
+	k.TCPReceiveBufferSize = old.TCPReceiveBufferSize
+	k.MulticastGroups = old.MulticastGroups
+	k.TUNPreUp = old.TUNPreUp
+	k.TUNPostUp = old.TUNPostUp
+}
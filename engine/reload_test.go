@@ -0,0 +1,100 @@
+package engine
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/proxy"
+	"github.com/xjasonlyu/tun2socks/v2/rule"
+	"github.com/xjasonlyu/tun2socks/v2/tunnel"
+	"github.com/xjasonlyu/tun2socks/v2/tunnel/statistic"
+)
+
+func TestRestartRequired(t *testing.T) {
+	old := &Key{Device: "tun0", MTU: 1500, LogLevel: "info"}
+
+	k := &Key{Device: "tun0", MTU: 1500, LogLevel: "debug", UDPTimeout: time.Minute}
+	assert.Empty(t, restartRequired(old, k))
+
+	k = &Key{Device: "tun1", MTU: 9000, TCPSendBufferSize: "1m"}
+	assert.Equal(t, []string{"device", "mtu", "tcp-send-buffer-size"}, restartRequired(old, k))
+
+	keepRestartRequired(old, k)
+	assert.Empty(t, restartRequired(old, k))
+}
+
+func TestReload(t *testing.T) {
+	t.Cleanup(tunnel.ReplaceGlobal(tunnel.New(&proxy.Base{}, statistic.DefaultManager)))
+	t.Cleanup(func() {
+		_proxySet.stopBreakers(nil)
+		_proxySet, _dnsServer, _defaultKey = nil, nil, nil
+	})
+
+	k := &Key{
+		Proxies: []ProxyEntry{
+			{Name: "a", URL: "socks5://127.0.0.1:1080"},
+			{Name: "b", URL: "socks5://127.0.0.1:1081"},
+		},
+		ProxyGroups: []ProxyGroupConfig{
+			{Name: "group", Proxies: []string{"a", "b"}},
+		},
+		CircuitBreaker: CircuitBreakerConfig{Enable: true},
+		DNS:            DNSConfig{Enable: true},
+		Rules:          []string{"MATCH,group"},
+	}
+	require.NoError(t, proxies(k))
+	require.NoError(t, dnsHijack(k))
+	_defaultKey = k
+
+	old := _proxySet
+	require.NoError(t, old.AddProxy("c", "socks5://127.0.0.1:1082", []string{"group"}))
+	require.NoError(t, old.SetProxyDisabled("a", true))
+	oldDNS := _dnsServer
+	fakeIP := oldDNS.FakeIP().IPv4("example.com")
+	conn, _ := net.Pipe()
+	statistic.NewTCPTracker(conn, &M.Metadata{Proxy: "gone"}, statistic.DefaultManager).Close()
+
+	k2 := *k
+	k2.Proxies = []ProxyEntry{
+		{Name: "a", URL: "socks5://127.0.0.1:1080"},
+		{Name: "b", URL: "socks5://127.0.0.1:2081"},
+	}
+	k2.DNS.Hosts = map[string]string{"example.org": "1.2.3.4"}
+	k2.Rules = []string{"DOMAIN,example.org,b", "MATCH,group"}
+	require.NoError(t, Reload(&k2))
+
+	// Proxies are swapped, with the unchanged and runtime-added ones
+	// carried over.
+	ps := _proxySet
+	require.NotSame(t, old, ps)
+	assert.Same(t, old.named["a"], ps.named["a"])
+	assert.NotSame(t, old.named["b"], ps.named["b"])
+	assert.Same(t, old.named["c"], ps.named["c"])
+	assert.Equal(t, "socks5://127.0.0.1:2081", ps.Proxies()[1].Address)
+	assert.Equal(t, []string{"b", "c"}, ps.ProxyGroups()[0].Available)
+	// Traffic totals of the proxies gone are dropped.
+	assert.NotContains(t, statistic.DefaultManager.Snapshot().Proxies, "gone")
+
+	// Rules are swapped.
+	router, ok := tunnel.T().Dialer().(*rule.Router)
+	require.True(t, ok)
+	assert.Len(t, router.Rules(), 2)
+
+	// DNS is swapped, keeping the fake IP pool.
+	require.NotSame(t, oldDNS, _dnsServer)
+	assert.Equal(t, _dnsServer, tunnel.T().DNSHandler())
+	host, err := _dnsServer.LookupHost(fakeIP)
+	require.NoError(t, err)
+	assert.Equal(t, "example.com", host)
+
+	// The pool is rebuilt once its range changes.
+	k3 := k2
+	k3.DNS.FakeIPRange = "198.19.0.0/16"
+	require.NoError(t, Reload(&k3))
+	assert.NotSame(t, oldDNS.FakeIP(), _dnsServer.FakeIP())
+}
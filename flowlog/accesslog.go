@@ -0,0 +1,184 @@
+package flowlog
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/xjasonlyu/tun2socks/v2/tunnel/statistic"
+)
+
+const (
+	defaultMaxSize    = 100 << 20 // 100 MiB
+	defaultMaxBackups = 5
+)
+
+// accessRecord is a line of the access log.
+type accessRecord struct {
+	Time         time.Time `json:"time"`
+	ID           string    `json:"id"`
+	Network      string    `json:"network"`
+	Source       string    `json:"source"`
+	Destination  string    `json:"destination"`
+	Host         string    `json:"host,omitempty"`
+	Dialer       string    `json:"dialer,omitempty"`
+	Proxy        string    `json:"proxy,omitempty"`
+	ProxyAddress string    `json:"proxyAddress,omitempty"`
+	Group        string    `json:"group,omitempty"`
+	Rule         string    `json:"rule,omitempty"`
+	Upload       int64     `json:"upload"`
+	Download     int64     `json:"download"`
+	Start        time.Time `json:"start"`
+	Duration     int64     `json:"duration"` // in milliseconds
+	Result       string    `json:"result"`
+}
+
+func newAccessRecord(c *statistic.ClosedConnection) *accessRecord {
+	m := c.Metadata
+	r := &accessRecord{
+		Time:         c.End,
+		ID:           c.ID.String(),
+		Network:      m.Network.String(),
+		Source:       m.SourceAddress(),
+		Destination:  m.DestinationAddress(),
+		Host:         m.Host,
+		Proxy:        m.Proxy,
+		ProxyAddress: m.ProxyAddress,
+		Group:        m.Group,
+		Rule:         m.Rule,
+		Upload:       c.Upload,
+		Download:     c.Download,
+		Start:        c.Start,
+		Duration:     c.Duration,
+		Result:       c.Reason,
+	}
+	if m.MidIP.IsValid() {
+		r.Dialer = netip.AddrPortFrom(m.MidIP, m.MidPort).String()
+	}
+	return r
+}
+
+// accessLog writes a JSON line per connection to a rotating file.
+type accessLog struct {
+	w *rotateWriter
+}
+
+// NewAccessLog creates an Exporter writing JSON lines to the file at
+// path, which is rotated once larger than maxSize bytes, keeping at
+// most maxBackups old files as path.1, path.2 and so on. Zero values
+// select the defaults, and a negative maxBackups keeps no old files.
+func NewAccessLog(path string, maxSize int64, maxBackups int) (*Exporter, error) {
+	if maxSize <= 0 {
+		maxSize = defaultMaxSize
+	}
+	if maxBackups == 0 {
+		maxBackups = defaultMaxBackups
+	}
+	maxBackups = max(maxBackups, 0)
+	w := &rotateWriter{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return newExporter("ACCESS_LOG", &accessLog{w: w}), nil
+}
+
+func (l *accessLog) encode(c *statistic.ClosedConnection) error {
+	b, err := json.Marshal(newAccessRecord(c))
+	if err != nil {
+		return err
+	}
+	return l.w.writeLine(append(b, '\n'))
+}
+
+func (l *accessLog) flush() error {
+	return l.w.flush()
+}
+
+func (l *accessLog) close() error {
+	return l.w.close()
+}
+
+// rotateWriter is a buffered file writer rotated by size, which
+// never splits a line across files.
+type rotateWriter struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	f    *os.File
+	w    *bufio.Writer
+	size int64
+}
+
+func (w *rotateWriter) open() error {
+	if err := os.MkdirAll(filepath.Dir(w.path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f, w.size = f, fi.Size()
+	if w.w == nil {
+		w.w = bufio.NewWriter(f)
+	} else {
+		w.w.Reset(f)
+	}
+	return nil
+}
+
+func (w *rotateWriter) writeLine(p []byte) error {
+	if w.size > 0 && w.size+int64(len(p)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := w.w.Write(p)
+	w.size += int64(n)
+	return err
+}
+
+// rotate moves the current file to path.1, shifting the older ones,
+// and opens a new file at path.
+func (w *rotateWriter) rotate() error {
+	if err := w.close(); err != nil {
+		return err
+	}
+	if w.maxBackups == 0 {
+		if err := os.Remove(w.path); err != nil {
+			return err
+		}
+		return w.open()
+	}
+	backup := func(i int) string { return fmt.Sprintf("%s.%d", w.path, i) }
+	for i := w.maxBackups - 1; i > 0; i-- {
+		if err := os.Rename(backup(i), backup(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(w.path, backup(1)); err != nil {
+		return err
+	}
+	return w.open()
+}
+
+func (w *rotateWriter) flush() error {
+	return w.w.Flush()
+}
+
+func (w *rotateWriter) close() error {
+	if err := w.w.Flush(); err != nil {
+		w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
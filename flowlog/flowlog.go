@@ -0,0 +1,124 @@
+// Package flowlog exports the finished connections tracked by
+// statistic.Manager, as access log lines or IPFIX flow records.
+package flowlog
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xjasonlyu/tun2socks/v2/log"
+	"github.com/xjasonlyu/tun2socks/v2/tunnel/statistic"
+)
+
+const (
+	// queueSize is the number of connections buffered for export,
+	// beyond which they are dropped.
+	queueSize = 4096
+
+	// flushInterval is the interval to flush the buffered output.
+	flushInterval = time.Second
+)
+
+var _ statistic.Sink = (*Exporter)(nil)
+
+// encoder writes the connections to the destination of Exporter.
+type encoder interface {
+	encode(c *statistic.ClosedConnection) error
+	flush() error
+	close() error
+}
+
+// Exporter is a statistic.Sink which hands the connections over to
+// a background encoder, so that recording never blocks the tunnel.
+type Exporter struct {
+	name    string
+	encoder encoder
+
+	queue   chan *statistic.ClosedConnection
+	dropped atomic.Uint64
+
+	closeOnce sync.Once
+	done      chan struct{}
+	stopped   chan struct{}
+}
+
+func newExporter(name string, e encoder) *Exporter {
+	x := &Exporter{
+		name:    name,
+		encoder: e,
+		queue:   make(chan *statistic.ClosedConnection, queueSize),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go x.run()
+	return x
+}
+
+// Record implements statistic.Sink.
+func (x *Exporter) Record(c *statistic.ClosedConnection) {
+	select {
+	case x.queue <- c:
+	default:
+		x.dropped.Add(1)
+	}
+}
+
+// Close flushes the queued connections and closes Exporter.
+func (x *Exporter) Close() error {
+	x.closeOnce.Do(func() {
+		close(x.done)
+	})
+	<-x.stopped
+	return nil
+}
+
+func (x *Exporter) run() {
+	defer close(x.stopped)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case c := <-x.queue:
+			x.encode(c)
+		case <-ticker.C:
+			x.flush()
+		case <-x.done:
+			x.drain()
+			x.flush()
+			if err := x.encoder.close(); err != nil {
+				log.Warnf("[%s] close: %v", x.name, err)
+			}
+			return
+		}
+	}
+}
+
+// drain encodes the connections left in queue.
+func (x *Exporter) drain() {
+	for {
+		select {
+		case c := <-x.queue:
+			x.encode(c)
+		default:
+			return
+		}
+	}
+}
+
+func (x *Exporter) encode(c *statistic.ClosedConnection) {
+	if err := x.encoder.encode(c); err != nil {
+		log.Warnf("[%s] export %s: %v", x.name, c.ID, err)
+	}
+}
+
+func (x *Exporter) flush() {
+	if err := x.encoder.flush(); err != nil {
+		log.Warnf("[%s] flush: %v", x.name, err)
+	}
+	if n := x.dropped.Swap(0); n > 0 {
+		log.Warnf("[%s] dropped %d connections due to full queue", x.name, n)
+	}
+}
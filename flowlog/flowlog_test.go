@@ -0,0 +1,146 @@
+package flowlog
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/tunnel/statistic"
+)
+
+func newClosed(src, dst string, reason string) *statistic.ClosedConnection {
+	start := time.UnixMilli(1700000000000)
+	return &statistic.ClosedConnection{
+		ID: uuid.New(),
+		Metadata: &M.Metadata{
+			Network:      M.TCP,
+			SrcIP:        netip.MustParseAddr(src),
+			SrcPort:      40000,
+			DstIP:        netip.MustParseAddr(dst),
+			DstPort:      443,
+			MidIP:        netip.MustParseAddr("192.168.1.2"),
+			MidPort:      50000,
+			Proxy:        "hk",
+			ProxyAddress: "10.0.0.2:1080",
+			Rule:         "MATCH",
+		},
+		Start:    start,
+		End:      start.Add(1500 * time.Millisecond),
+		Duration: 1500,
+		Upload:   100,
+		Download: 2000,
+		Reason:   reason,
+	}
+}
+
+func readLines(t *testing.T, path string) []accessRecord {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var records []accessRecord
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var r accessRecord
+		require.NoError(t, json.Unmarshal(s.Bytes(), &r))
+		records = append(records, r)
+	}
+	require.NoError(t, s.Err())
+	return records
+}
+
+func TestAccessLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log", "access.log")
+	line, err := json.Marshal(newAccessRecord(newClosed("10.0.0.1", "1.1.1.1", statistic.ReasonEOF)))
+	require.NoError(t, err)
+
+	// Two lines fit in each file.
+	x, err := NewAccessLog(path, int64(len(line)+1)*2, 1)
+	require.NoError(t, err)
+	for range 5 {
+		x.Record(newClosed("10.0.0.1", "1.1.1.1", statistic.ReasonEOF))
+	}
+	require.NoError(t, x.Close())
+
+	records := readLines(t, path)
+	require.Len(t, records, 1)
+	r := records[0]
+	assert.Equal(t, "tcp", r.Network)
+	assert.Equal(t, "10.0.0.1:40000", r.Source)
+	assert.Equal(t, "1.1.1.1:443", r.Destination)
+	assert.Equal(t, "192.168.1.2:50000", r.Dialer)
+	assert.Equal(t, "hk", r.Proxy)
+	assert.Equal(t, int64(100), r.Upload)
+	assert.Equal(t, int64(2000), r.Download)
+	assert.Equal(t, int64(1500), r.Duration)
+	assert.Equal(t, statistic.ReasonEOF, r.Result)
+
+	assert.Len(t, readLines(t, path+".1"), 2)
+	assert.NoFileExists(t, path+".2")
+}
+
+func TestIPFIX(t *testing.T) {
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer collector.Close()
+
+	x, err := NewIPFIX(collector.LocalAddr().String(), 7)
+	require.NoError(t, err)
+	x.Record(newClosed("10.0.0.1", "1.1.1.1", statistic.ReasonTimeout))
+	x.Record(newClosed("fd00::1", "2001:db8::1", "dial: refused"))
+	require.NoError(t, x.Close())
+
+	require.NoError(t, collector.SetReadDeadline(time.Now().Add(5*time.Second)))
+	buf := make([]byte, 65535)
+	n, _, err := collector.ReadFrom(buf)
+	require.NoError(t, err)
+	msg := buf[:n]
+
+	require.GreaterOrEqual(t, len(msg), ipfixHeaderLen)
+	assert.Equal(t, uint16(ipfixVersion), binary.BigEndian.Uint16(msg[0:]))
+	assert.Equal(t, uint16(n), binary.BigEndian.Uint16(msg[2:]))
+	assert.Equal(t, uint32(0), binary.BigEndian.Uint32(msg[8:]))
+	assert.Equal(t, uint32(7), binary.BigEndian.Uint32(msg[12:]))
+
+	sets := make(map[uint16][]byte)
+	for b := msg[ipfixHeaderLen:]; len(b) > 0; {
+		require.GreaterOrEqual(t, len(b), ipfixSetHeaderLen)
+		id, length := binary.BigEndian.Uint16(b[0:]), int(binary.BigEndian.Uint16(b[2:]))
+		require.LessOrEqual(t, length, len(b))
+		sets[id] = b[ipfixSetHeaderLen:length]
+		b = b[length:]
+	}
+	require.Contains(t, sets, uint16(ipfixTemplateSetID))
+	assert.Equal(t, uint16(ipfixTemplateIPv4), binary.BigEndian.Uint16(sets[ipfixTemplateSetID]))
+
+	v4 := sets[ipfixTemplateIPv4]
+	require.Len(t, v4, fieldsLen(ipfixFieldsIPv4))
+	assert.Equal(t, []byte{10, 0, 0, 1}, v4[0:4])
+	assert.Equal(t, []byte{1, 1, 1, 1}, v4[4:8])
+	assert.Equal(t, uint16(40000), binary.BigEndian.Uint16(v4[8:]))
+	assert.Equal(t, uint16(443), binary.BigEndian.Uint16(v4[10:]))
+	assert.Equal(t, byte(6), v4[12])
+	assert.Equal(t, []byte{192, 168, 1, 2}, v4[13:17])
+	assert.Equal(t, uint64(100), binary.BigEndian.Uint64(v4[19:]))
+	assert.Equal(t, uint64(2000), binary.BigEndian.Uint64(v4[27:]))
+	assert.Equal(t, uint64(1700000000000), binary.BigEndian.Uint64(v4[35:]))
+	assert.Equal(t, byte(ipfixEndIdleTimeout), v4[len(v4)-1])
+
+	v6 := sets[ipfixTemplateIPv6]
+	require.Len(t, v6, fieldsLen(ipfixFieldsIPv6))
+	assert.Equal(t, netip.MustParseAddr("fd00::1").AsSlice(), v6[0:16])
+	// MidIP is mapped into IPv6 for the IPv6 template.
+	assert.Equal(t, netip.MustParseAddr("::ffff:192.168.1.2").AsSlice(), v6[37:53])
+	assert.Equal(t, byte(ipfixEndForced), v6[len(v6)-1])
+}
@@ -0,0 +1,264 @@
+package flowlog
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"time"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/tunnel/statistic"
+)
+
+// IPFIX (RFC 7011) constants.
+const (
+	ipfixVersion       = 10
+	ipfixHeaderLen     = 16
+	ipfixSetHeaderLen  = 4
+	ipfixTemplateSetID = 2
+
+	// Template IDs of flow records, which must be at least 256.
+	ipfixTemplateIPv4 = 256
+	ipfixTemplateIPv6 = 257
+
+	// ipfixMaxMessage keeps messages within a common path MTU.
+	ipfixMaxMessage = 1400
+
+	// ipfixTemplateInterval is the interval to resend templates, as
+	// collectors may start or restart at any time over UDP.
+	ipfixTemplateInterval = time.Minute
+)
+
+// Values of flowEndReason (IE 136).
+const (
+	ipfixEndIdleTimeout = 1
+	ipfixEndOfFlow      = 3
+	ipfixEndForced      = 4
+)
+
+// ipfixField is an information element of template.
+type ipfixField struct {
+	id, length uint16
+}
+
+var (
+	ipfixFieldsIPv4 = []ipfixField{
+		{8, 4},   // sourceIPv4Address
+		{12, 4},  // destinationIPv4Address
+		{7, 2},   // sourceTransportPort
+		{11, 2},  // destinationTransportPort
+		{4, 1},   // protocolIdentifier
+		{225, 4}, // postNATSourceIPv4Address
+		{227, 2}, // postNAPTSourceTransportPort
+		{231, 8}, // initiatorOctets
+		{232, 8}, // responderOctets
+		{152, 8}, // flowStartMilliseconds
+		{153, 8}, // flowEndMilliseconds
+		{136, 1}, // flowEndReason
+	}
+	ipfixFieldsIPv6 = []ipfixField{
+		{27, 16},  // sourceIPv6Address
+		{28, 16},  // destinationIPv6Address
+		{7, 2},    // sourceTransportPort
+		{11, 2},   // destinationTransportPort
+		{4, 1},    // protocolIdentifier
+		{281, 16}, // postNATSourceIPv6Address
+		{227, 2},  // postNAPTSourceTransportPort
+		{231, 8},  // initiatorOctets
+		{232, 8},  // responderOctets
+		{152, 8},  // flowStartMilliseconds
+		{153, 8},  // flowEndMilliseconds
+		{136, 1},  // flowEndReason
+	}
+)
+
+var (
+	_ipfixTemplateSetLen = len(appendTemplateSet(nil))
+	_ipfixMaxRecordLen   = max(fieldsLen(ipfixFieldsIPv4), fieldsLen(ipfixFieldsIPv6))
+)
+
+func fieldsLen(fields []ipfixField) int {
+	n := 0
+	for _, f := range fields {
+		n += int(f.length)
+	}
+	return n
+}
+
+// ipfix sends flow records to a collector over UDP.
+type ipfix struct {
+	conn   net.Conn
+	domain uint32
+
+	// seq is the number of data records sent, as required by the
+	// sequence number of message header.
+	seq          uint32
+	lastTemplate time.Time
+
+	// v4 and v6 hold the pending data records of each template.
+	v4, v6 []byte
+	count  uint32
+}
+
+// NewIPFIX creates an Exporter sending IPFIX flow records to the
+// collector at addr over UDP, with the observation domain ID.
+func NewIPFIX(addr string, domain uint32) (*Exporter, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return newExporter("IPFIX", &ipfix{conn: conn, domain: domain}), nil
+}
+
+func (x *ipfix) encode(c *statistic.ClosedConnection) error {
+	m := c.Metadata
+	src, dst := m.SrcIP.Unmap(), m.DstIP.Unmap()
+
+	var b []byte
+	v4 := src.Is4() && dst.Is4()
+	if v4 {
+		b = append(x.v4, src.AsSlice()...)
+		b = append(b, dst.AsSlice()...)
+	} else {
+		b = append(x.v6, as16(src)...)
+		b = append(b, as16(dst)...)
+	}
+
+	b = binary.BigEndian.AppendUint16(b, m.SrcPort)
+	b = binary.BigEndian.AppendUint16(b, m.DstPort)
+	b = append(b, protocolOf(m.Network))
+
+	mid := m.MidIP.Unmap()
+	switch {
+	case v4 && mid.Is4():
+		b = append(b, mid.AsSlice()...)
+	case v4:
+		b = append(b, make([]byte, 4)...)
+	default:
+		b = append(b, as16(mid)...)
+	}
+	b = binary.BigEndian.AppendUint16(b, m.MidPort)
+
+	b = binary.BigEndian.AppendUint64(b, uint64(max(c.Upload, 0)))
+	b = binary.BigEndian.AppendUint64(b, uint64(max(c.Download, 0)))
+	b = binary.BigEndian.AppendUint64(b, uint64(c.Start.UnixMilli()))
+	b = binary.BigEndian.AppendUint64(b, uint64(c.End.UnixMilli()))
+	b = append(b, endReasonOf(c))
+
+	if v4 {
+		x.v4 = b
+	} else {
+		x.v6 = b
+	}
+	x.count++
+
+	// Flush before the next record could overflow the message.
+	if x.size()+_ipfixTemplateSetLen+_ipfixMaxRecordLen > ipfixMaxMessage {
+		return x.flush()
+	}
+	return nil
+}
+
+// size returns the size of message with the pending records.
+func (x *ipfix) size() int {
+	n := ipfixHeaderLen
+	if len(x.v4) > 0 {
+		n += ipfixSetHeaderLen + len(x.v4)
+	}
+	if len(x.v6) > 0 {
+		n += ipfixSetHeaderLen + len(x.v6)
+	}
+	return n
+}
+
+func (x *ipfix) flush() error {
+	now := time.Now()
+	withTemplates := now.Sub(x.lastTemplate) >= ipfixTemplateInterval
+	if x.count == 0 && !withTemplates {
+		return nil
+	}
+
+	msg := make([]byte, ipfixHeaderLen, x.size()+_ipfixTemplateSetLen)
+	if withTemplates {
+		msg = appendTemplateSet(msg)
+	}
+	msg = appendSet(msg, ipfixTemplateIPv4, x.v4)
+	msg = appendSet(msg, ipfixTemplateIPv6, x.v6)
+
+	binary.BigEndian.PutUint16(msg[0:], ipfixVersion)
+	binary.BigEndian.PutUint16(msg[2:], uint16(len(msg)))
+	binary.BigEndian.PutUint32(msg[4:], uint32(now.Unix()))
+	binary.BigEndian.PutUint32(msg[8:], x.seq)
+	binary.BigEndian.PutUint32(msg[12:], x.domain)
+
+	x.seq += x.count
+	x.v4, x.v6, x.count = x.v4[:0], x.v6[:0], 0
+	if withTemplates {
+		x.lastTemplate = now
+	}
+
+	_, err := x.conn.Write(msg)
+	return err
+}
+
+func (x *ipfix) close() error {
+	return x.conn.Close()
+}
+
+func appendTemplateSet(b []byte) []byte {
+	start := len(b)
+	b = binary.BigEndian.AppendUint16(b, ipfixTemplateSetID)
+	b = binary.BigEndian.AppendUint16(b, 0) // length
+	for _, t := range []struct {
+		id     uint16
+		fields []ipfixField
+	}{
+		{ipfixTemplateIPv4, ipfixFieldsIPv4},
+		{ipfixTemplateIPv6, ipfixFieldsIPv6},
+	} {
+		id, fields := t.id, t.fields
+		b = binary.BigEndian.AppendUint16(b, id)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(fields)))
+		for _, f := range fields {
+			b = binary.BigEndian.AppendUint16(b, f.id)
+			b = binary.BigEndian.AppendUint16(b, f.length)
+		}
+	}
+	binary.BigEndian.PutUint16(b[start+2:], uint16(len(b)-start))
+	return b
+}
+
+func appendSet(b []byte, id uint16, records []byte) []byte {
+	if len(records) == 0 {
+		return b
+	}
+	b = binary.BigEndian.AppendUint16(b, id)
+	b = binary.BigEndian.AppendUint16(b, uint16(ipfixSetHeaderLen+len(records)))
+	return append(b, records...)
+}
+
+func as16(ip netip.Addr) []byte {
+	if !ip.IsValid() {
+		return make([]byte, 16)
+	}
+	a := ip.As16()
+	return a[:]
+}
+
+func protocolOf(network M.Network) byte {
+	if network == M.UDP {
+		return 17
+	}
+	return 6
+}
+
+func endReasonOf(c *statistic.ClosedConnection) byte {
+	switch {
+	case c.Reason == statistic.ReasonTimeout:
+		return ipfixEndIdleTimeout
+	case c.DialFailed(), c.Reason == statistic.ReasonClosed:
+		return ipfixEndForced
+	default:
+		return ipfixEndOfFlow
+	}
+}
@@ -21,6 +21,7 @@ var (
 	key = new(engine.Key)
 
 	configFile          string
+	watchConfig         bool
 	versionFlag         bool
 	proxyFlag           string
 	healthCheckEnable   bool
@@ -33,12 +34,15 @@ func init() {
 	flag.IntVar(&key.Mark, "fwmark", 0, "Set firewall MARK (Linux only)")
 	flag.IntVar(&key.MTU, "mtu", 0, "Set device maximum transmission unit (MTU)")
 	flag.DurationVar(&key.UDPTimeout, "udp-timeout", 0, "Set timeout for each UDP session")
+	flag.StringVar(&key.UDPNAT, "udp-nat", "", "UDP NAT behavior [symmetric|full-cone|restricted|port-restricted]")
 	flag.StringVar(&configFile, "config", "", "YAML format configuration file")
+	flag.BoolVar(&watchConfig, "watch", false, "Reload the configuration file on change")
 	flag.StringVar(&key.Device, "device", "", "Use this device [driver://]name")
 	flag.StringVar(&key.Interface, "interface", "", "Use network INTERFACE (Linux/MacOS only)")
 	flag.StringVar(&key.LogLevel, "loglevel", "info", "Log level [debug|info|warn|error|silent]")
 	flag.StringVar(&proxyFlag, "proxy", "", "Use this proxy [protocol://]host[:port]")
 	flag.StringVar(&key.RestAPI, "restapi", "", "HTTP statistic server listen address")
+	flag.StringVar(&key.Metrics, "metrics", "", "Prometheus metrics listen address without authentication")
 	flag.StringVar(&key.TCPSendBufferSize, "tcp-sndbuf", "", "Set TCP send buffer size for netstack")
 	flag.StringVar(&key.TCPReceiveBufferSize, "tcp-rcvbuf", "", "Set TCP receive buffer size for netstack")
 	flag.BoolVar(&key.TCPModerateReceiveBuffer, "tcp-auto-tuning", false, "Enable TCP receive buffer auto-tuning")
@@ -62,43 +66,109 @@ func main() {
 		os.Exit(0)
 	}
 
+	// Flags are kept as the base of each (re)load of config file.
+	base := *key
+	k, err := loadKey(base)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	engine.Insert(k)
+
+	engine.Start()
+	defer engine.Stop()
+
+	reloadCh := make(chan struct{}, 1)
+	if watchConfig && configFile != "" {
+		go watchFile(configFile, reloadCh)
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for {
+		select {
+		case sig := <-sigCh:
+			if sig != syscall.SIGHUP {
+				return
+			}
+		case <-reloadCh:
+		}
+		reload(base)
+	}
+}
+
+// loadKey returns a new *engine.Key from base, which holds the
+// command line flags, and the config file.
+func loadKey(base engine.Key) (*engine.Key, error) {
+	k := &base
+
 	if configFile != "" {
 		data, err := os.ReadFile(configFile)
 		if err != nil {
-			log.Fatalf("Failed to read config file '%s': %v", configFile, err)
+			return nil, fmt.Errorf("failed to read config file '%s': %w", configFile, err)
 		}
-		if err = yaml.Unmarshal(data, key); err != nil {
-			log.Fatalf("Failed to unmarshal config file '%s': %v", configFile, err)
+		if err = yaml.Unmarshal(data, k); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal config file '%s': %w", configFile, err)
 		}
 	}
 
 	// Handle command line proxy flag
 	if proxyFlag != "" {
-		if err := key.Proxy.UnmarshalYAML(&yaml.Node{Kind: yaml.ScalarNode, Value: proxyFlag}); err != nil {
-			log.Fatalf("Failed to parse proxy flag: %v", err)
+		if err := k.Proxy.UnmarshalYAML(&yaml.Node{Kind: yaml.ScalarNode, Value: proxyFlag}); err != nil {
+			return nil, fmt.Errorf("failed to parse proxy flag: %w", err)
 		}
 	}
 
 	// Handle command line health check flags
 	if healthCheckEnable {
-		key.HealthCheck.Enable = healthCheckEnable
+		k.HealthCheck.Enable = healthCheckEnable
 	}
 	if healthCheckInterval > 0 {
-		key.HealthCheck.Interval = healthCheckInterval
+		k.HealthCheck.Interval = healthCheckInterval
 	}
 	if healthCheckTimeout > 0 {
-		key.HealthCheck.Timeout = healthCheckTimeout
+		k.HealthCheck.Timeout = healthCheckTimeout
 	}
 	if healthCheckURL != "" {
-		key.HealthCheck.URL = healthCheckURL
+		k.HealthCheck.URL = healthCheckURL
 	}
+	return k, nil
+}
 
-	engine.Insert(key)
+func reload(base engine.Key) {
+	k, err := loadKey(base)
+	if err == nil {
+		err = engine.Reload(k)
+	}
+	if err != nil {
+		log.Errorf("[ENGINE] failed to reload, keep running config: %v", err)
+	}
+}
 
-	engine.Start()
-	defer engine.Stop()
+// watchFile notifies ch when the modification time or size of file
+// changes. Polling is used so that editors replacing the file by
+// rename are handled as well.
+func watchFile(file string, ch chan<- struct{}) {
+	const interval = 2 * time.Second
 
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-	<-sigCh
+	stat := func() (time.Time, int64) {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, -1
+		}
+		return fi.ModTime(), fi.Size()
+	}
+
+	lastMod, lastSize := stat()
+	for range time.Tick(interval) {
+		mod, size := stat()
+		if size < 0 || (mod.Equal(lastMod) && size == lastSize) {
+			continue
+		}
+		lastMod, lastSize = mod, size
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
 }
@@ -3,6 +3,7 @@ package metadata
 import (
 	"net"
 	"net/netip"
+	"strconv"
 )
 
 // Metadata contains metadata of transport protocol sessions.
@@ -14,6 +15,34 @@ type Metadata struct {
 	SrcPort uint16     `json:"sourcePort"`
 	MidPort uint16     `json:"dialerPort"`
 	DstPort uint16     `json:"destinationPort"`
+
+	// Host is the hostname of destination, which is preferred over
+	// DstIP by proxies if set.
+	Host string `json:"host,omitempty"`
+
+	// Protocol is the application protocol detected by sniffing.
+	Protocol string `json:"protocol,omitempty"`
+
+	// Rule and Target are filled by rule.Router with the
+	// matched rule and the proxy that the flow is routed to.
+	Rule   string `json:"rule,omitempty"`
+	Target string `json:"target,omitempty"`
+
+	// Proxy is the name of the proxy that the flow is dialed through,
+	// with its protocol and address, and Group is the proxy group
+	// which picked it, if any.
+	Proxy        string `json:"proxy,omitempty"`
+	ProxyProto   string `json:"proxyProto,omitempty"`
+	ProxyAddress string `json:"proxyAddress,omitempty"`
+	Group        string `json:"group,omitempty"`
+
+	// Attempts is the number of proxies tried by a proxy group with
+	// retry until success.
+	Attempts int `json:"attempts,omitempty"`
+
+	// Probe marks the dials only probing whether the destination is
+	// reachable, which are left out of the dial statistics of proxies.
+	Probe bool `json:"-"`
 }
 
 func (m *Metadata) DestinationAddrPort() netip.AddrPort {
@@ -24,6 +53,15 @@ func (m *Metadata) DestinationAddress() string {
 	return m.DestinationAddrPort().String()
 }
 
+// RemoteAddress returns the destination address to be dialed, which
+// is "host:port" if Host is set, or the same as DestinationAddress.
+func (m *Metadata) RemoteAddress() string {
+	if m.Host != "" {
+		return net.JoinHostPort(m.Host, strconv.FormatUint(uint64(m.DstPort), 10))
+	}
+	return m.DestinationAddress()
+}
+
 func (m *Metadata) SourceAddrPort() netip.AddrPort {
 	return netip.AddrPortFrom(m.SrcIP, m.SrcPort)
 }
@@ -0,0 +1,322 @@
+// Package metrics implements the counters and histograms exported in
+// the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Metric types of the text exposition format.
+const (
+	TypeCounter   = "counter"
+	TypeGauge     = "gauge"
+	TypeHistogram = "histogram"
+)
+
+// Label is a name-value pair of a sample.
+type Label struct {
+	Name, Value string
+}
+
+// Sample is a single value of a metric family.
+type Sample struct {
+	// Name is the full name of sample, which differs from the family
+	// name for the _bucket, _sum and _count series of histograms.
+	Name   string
+	Labels []Label
+	Value  float64
+}
+
+// Family is a group of samples sharing the same name, type and help.
+type Family struct {
+	Name    string
+	Type    string
+	Help    string
+	Samples []Sample
+}
+
+// collector produces a metric family on each gathering.
+type collector interface {
+	collect() Family
+}
+
+// Registry holds the collectors to gather.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+// Default is the registry used by the package level constructors.
+var Default = &Registry{}
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	r.collectors = append(r.collectors, c)
+	r.mu.Unlock()
+}
+
+// Gather returns the current metric families in registration order.
+func (r *Registry) Gather() []Family {
+	r.mu.Lock()
+	collectors := slices.Clone(r.collectors)
+	r.mu.Unlock()
+
+	families := make([]Family, 0, len(collectors))
+	for _, c := range collectors {
+		families = append(families, c.collect())
+	}
+	return families
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	v atomic.Uint64
+}
+
+// Add adds n to Counter.
+func (c *Counter) Add(n uint64) {
+	c.v.Add(n)
+}
+
+// Inc increments Counter by one.
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+// Value returns the current value of Counter.
+func (c *Counter) Value() uint64 {
+	return c.v.Load()
+}
+
+// vec holds the children of a labeled metric keyed by label values.
+type vec[T any] struct {
+	name, help string
+	labels     []string
+	newChild   func() T
+
+	mu       sync.RWMutex
+	children map[string]T
+	values   map[string][]string
+}
+
+func newVec[T any](name, help string, labels []string, newChild func() T) *vec[T] {
+	return &vec[T]{
+		name:     name,
+		help:     help,
+		labels:   labels,
+		newChild: newChild,
+		children: make(map[string]T),
+		values:   make(map[string][]string),
+	}
+}
+
+// with returns the child of the given label values, creating it if
+// absent. It panics if the number of values mismatches the labels.
+func (v *vec[T]) with(values ...string) T {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s: expected %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+
+	v.mu.RLock()
+	c, ok := v.children[key]
+	v.mu.RUnlock()
+	if ok {
+		return c
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if c, ok = v.children[key]; !ok {
+		c = v.newChild()
+		v.children[key] = c
+		v.values[key] = slices.Clone(values)
+	}
+	return c
+}
+
+// each calls fn with the children sorted by label values.
+func (v *vec[T]) each(fn func(labels []Label, child T)) {
+	v.mu.RLock()
+	keys := make([]string, 0, len(v.children))
+	for key := range v.children {
+		keys = append(keys, key)
+	}
+	v.mu.RUnlock()
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		v.mu.RLock()
+		child, values := v.children[key], v.values[key]
+		v.mu.RUnlock()
+
+		labels := make([]Label, len(values))
+		for i, value := range values {
+			labels[i] = Label{v.labels[i], value}
+		}
+		fn(labels, child)
+	}
+}
+
+// CounterVec is a set of counters partitioned by labels.
+type CounterVec struct {
+	*vec[*Counter]
+}
+
+// NewCounterVec creates a CounterVec registered to Default.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{newVec(name, help, labels, func() *Counter { return &Counter{} })}
+	Default.register(c)
+	return c
+}
+
+// With returns the counter of the given label values.
+func (c *CounterVec) With(values ...string) *Counter {
+	return c.with(values...)
+}
+
+func (c *CounterVec) collect() Family {
+	f := Family{Name: c.name, Type: TypeCounter, Help: c.help}
+	c.each(func(labels []Label, child *Counter) {
+		f.Samples = append(f.Samples, Sample{Name: c.name, Labels: labels, Value: float64(child.Value())})
+	})
+	return f
+}
+
+// DefBuckets are the default histogram buckets in seconds, suited
+// for dial and round-trip latencies.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Histogram counts observations in configurable buckets.
+type Histogram struct {
+	buckets []float64
+	counts  []atomic.Uint64 // non-cumulative, the last for +Inf
+	sum     atomic.Uint64   // float64 bits
+	count   atomic.Uint64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		buckets: buckets,
+		counts:  make([]atomic.Uint64, len(buckets)+1),
+	}
+}
+
+// Observe adds a single observation to Histogram.
+func (h *Histogram) Observe(v float64) {
+	i, _ := slices.BinarySearch(h.buckets, v)
+	h.counts[i].Add(1)
+	for {
+		old := h.sum.Load()
+		if h.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			break
+		}
+	}
+	h.count.Add(1)
+}
+
+func (h *Histogram) samples(name string, labels []Label) []Sample {
+	samples := make([]Sample, 0, len(h.buckets)+3)
+	var cumulative uint64
+	for i, upper := range h.buckets {
+		cumulative += h.counts[i].Load()
+		samples = append(samples, Sample{
+			Name:   name + "_bucket",
+			Labels: append(slices.Clip(labels), Label{"le", formatFloat(upper)}),
+			Value:  float64(cumulative),
+		})
+	}
+	cumulative += h.counts[len(h.buckets)].Load()
+	samples = append(samples,
+		Sample{Name: name + "_bucket", Labels: append(slices.Clip(labels), Label{"le", "+Inf"}), Value: float64(cumulative)},
+		Sample{Name: name + "_sum", Labels: labels, Value: math.Float64frombits(h.sum.Load())},
+		Sample{Name: name + "_count", Labels: labels, Value: float64(h.count.Load())},
+	)
+	return samples
+}
+
+// HistogramVec is a set of histograms partitioned by labels.
+type HistogramVec struct {
+	*vec[*Histogram]
+}
+
+// NewHistogramVec creates a HistogramVec registered to Default, with
+// buckets sorted in increasing order.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	buckets = slices.Sorted(slices.Values(buckets))
+	h := &HistogramVec{newVec(name, help, labels, func() *Histogram { return newHistogram(buckets) })}
+	Default.register(h)
+	return h
+}
+
+// With returns the histogram of the given label values.
+func (h *HistogramVec) With(values ...string) *Histogram {
+	return h.with(values...)
+}
+
+func (h *HistogramVec) collect() Family {
+	f := Family{Name: h.name, Type: TypeHistogram, Help: h.help}
+	h.each(func(labels []Label, child *Histogram) {
+		f.Samples = append(f.Samples, child.samples(h.name, labels)...)
+	})
+	return f
+}
+
+// WriteText writes families in the Prometheus text exposition format.
+func WriteText(w io.Writer, families []Family) error {
+	var b strings.Builder
+	for _, f := range families {
+		fmt.Fprintf(&b, "# HELP %s %s\n", f.Name, escapeHelp(f.Help))
+		fmt.Fprintf(&b, "# TYPE %s %s\n", f.Name, f.Type)
+		for _, s := range f.Samples {
+			b.WriteString(s.Name)
+			if len(s.Labels) > 0 {
+				b.WriteByte('{')
+				for i, l := range s.Labels {
+					if i > 0 {
+						b.WriteByte(',')
+					}
+					fmt.Fprintf(&b, "%s=\"%s\"", l.Name, escapeLabel(l.Value))
+				}
+				b.WriteByte('}')
+			}
+			b.WriteByte(' ')
+			b.WriteString(formatFloat(s.Value))
+			b.WriteByte('\n')
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, +1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	_helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	_labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return _helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return _labelEscaper.Replace(s)
+}
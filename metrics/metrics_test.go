@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteText(t *testing.T) {
+	r := &Registry{}
+	c := &CounterVec{newVec("test_total", "Test \\ counter.", []string{"proxy"}, func() *Counter { return &Counter{} })}
+	h := &HistogramVec{newVec("test_seconds", "Test histogram.", []string{"proxy"}, func() *Histogram { return newHistogram([]float64{0.1, 1}) })}
+	r.register(c)
+	r.register(h)
+
+	c.With(`b"`).Add(2)
+	c.With("a").Inc()
+	h.With("a").Observe(0.1)
+	h.With("a").Observe(0.5)
+	h.With("a").Observe(3)
+
+	b := &strings.Builder{}
+	require.NoError(t, WriteText(b, r.Gather()))
+	assert.Equal(t, `# HELP test_total Test \\ counter.
+# TYPE test_total counter
+test_total{proxy="a"} 1
+test_total{proxy="b\""} 2
+# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{proxy="a",le="0.1"} 1
+test_seconds_bucket{proxy="a",le="1"} 2
+test_seconds_bucket{proxy="a",le="+Inf"} 3
+test_seconds_sum{proxy="a"} 3.6
+test_seconds_count{proxy="a"} 3
+`, b.String())
+
+	assert.Panics(t, func() { c.With("a", "b") })
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestErrorClass(t *testing.T) {
+	for _, tt := range []struct {
+		err   error
+		class string
+	}{
+		{context.Canceled, "canceled"},
+		{fmt.Errorf("dial: %w", context.DeadlineExceeded), "timeout"},
+		{&net.OpError{Op: "dial", Err: timeoutError{}}, "timeout"},
+		{&net.DNSError{Err: "no such host"}, "dns"},
+		{&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, "refused"},
+		{syscall.ECONNRESET, "reset"},
+		{syscall.EHOSTUNREACH, "unreachable"},
+		{errors.New("socks5 handshake failed"), "other"},
+	} {
+		assert.Equal(t, tt.class, ErrorClass(tt.err), tt.err.Error())
+	}
+}
@@ -0,0 +1,74 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Metrics of the proxies, shared by the engine and the REST API.
+var (
+	DialAttempts = NewCounterVec("tun2socks_dial_attempts_total",
+		"Dial attempts through the proxy.", "proxy", "network")
+	DialFailures = NewCounterVec("tun2socks_dial_failures_total",
+		"Failed dial attempts through the proxy by error class.", "proxy", "network", "class")
+	DialDuration = NewHistogramVec("tun2socks_dial_duration_seconds",
+		"Duration of successful dials through the proxy.", DefBuckets, "proxy", "network")
+
+	HealthChecks = NewCounterVec("tun2socks_health_checks_total",
+		"Health checks of the proxy by kind and result.", "proxy", "kind", "result")
+	HealthCheckDuration = NewHistogramVec("tun2socks_health_check_duration_seconds",
+		"Round-trip time of passed health checks of the proxy.", DefBuckets, "proxy", "kind")
+)
+
+// ObserveDial records a dial through proxy over network, which took
+// d and failed with err if not nil.
+func ObserveDial(proxy, network string, d time.Duration, err error) {
+	DialAttempts.With(proxy, network).Inc()
+	if err != nil {
+		DialFailures.With(proxy, network, ErrorClass(err)).Inc()
+		return
+	}
+	DialDuration.With(proxy, network).Observe(d.Seconds())
+}
+
+// ObserveHealthCheck records a health check of kind (tcp or udp) of
+// proxy, which took d and failed with err if not nil.
+func ObserveHealthCheck(proxy, kind string, d time.Duration, err error) {
+	if err != nil {
+		HealthChecks.With(proxy, kind, "failure").Inc()
+		return
+	}
+	HealthChecks.With(proxy, kind, "success").Inc()
+	HealthCheckDuration.With(proxy, kind).Observe(d.Seconds())
+}
+
+// ErrorClass classifies err into a coarse label value, which keeps
+// the cardinality of failure metrics bounded.
+func ErrorClass(err error) string {
+	var dnsErr *net.DNSError
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return "timeout"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return "reset"
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return "unreachable"
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+	return "other"
+}
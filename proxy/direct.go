@@ -3,6 +3,7 @@ package proxy
 import (
 	"context"
 	"net"
+	"sync"
 
 	"github.com/xjasonlyu/tun2socks/v2/dialer"
 	M "github.com/xjasonlyu/tun2socks/v2/metadata"
@@ -23,8 +24,11 @@ func NewDirect() *Direct {
 	}
 }
 
+// DialContext dials the destination directly. If metadata carries a
+// hostname, it is resolved locally and both A and AAAA records are
+// raced by happy eyeballs (RFC 6555) of net.Dialer.
 func (d *Direct) DialContext(ctx context.Context, metadata *M.Metadata) (net.Conn, error) {
-	c, err := dialer.DialContext(ctx, "tcp", metadata.DestinationAddress())
+	c, err := dialer.DialContext(ctx, "tcp", metadata.RemoteAddress())
 	if err != nil {
 		return nil, err
 	}
@@ -42,6 +46,12 @@ func (d *Direct) DialUDP(*M.Metadata) (net.PacketConn, error) {
 
 type directPacketConn struct {
 	net.PacketConn
+
+	// resolved caches the last resolved hostname address, so that
+	// packets of the same session are not resolved one by one.
+	mu       sync.Mutex
+	host     string
+	resolved *net.UDPAddr
 }
 
 func (pc *directPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
@@ -49,9 +59,30 @@ func (pc *directPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
 		return pc.PacketConn.WriteTo(b, udpAddr)
 	}
 
-	udpAddr, err := net.ResolveUDPAddr("udp", addr.String())
+	target := addr.String()
+	if ma, ok := addr.(*M.Addr); ok {
+		target = ma.Metadata().RemoteAddress()
+	}
+
+	udpAddr, err := pc.resolve(target)
 	if err != nil {
 		return 0, err
 	}
 	return pc.PacketConn.WriteTo(b, udpAddr)
 }
+
+func (pc *directPacketConn) resolve(address string) (*net.UDPAddr, error) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if pc.resolved != nil && pc.host == address {
+		return pc.resolved, nil
+	}
+
+	udpAddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	pc.host, pc.resolved = address, udpAddr
+	return udpAddr, nil
+}
@@ -0,0 +1,16 @@
+package proxy
+
+// DestinationError is the error of a proxy server which failed to reach
+// the destination, e.g. refused by the destination, which doesn't imply
+// the proxy itself failing.
+type DestinationError struct {
+	Err error
+}
+
+func (e *DestinationError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *DestinationError) Unwrap() error {
+	return e.Err
+}
@@ -50,7 +50,7 @@ func (h *HTTP) DialContext(ctx context.Context, metadata *M.Metadata) (c net.Con
 }
 
 func (h *HTTP) shakeHand(metadata *M.Metadata, rw io.ReadWriter) error {
-	addr := metadata.DestinationAddress()
+	addr := metadata.RemoteAddress()
 	req := &http.Request{
 		Method: http.MethodConnect,
 		URL: &url.URL{
@@ -82,6 +82,8 @@ func (h *HTTP) shakeHand(metadata *M.Metadata, rw io.ReadWriter) error {
 		return errors.New("HTTP auth required by proxy")
 	case http.StatusMethodNotAllowed:
 		return errors.New("CONNECT method not allowed by proxy")
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return &DestinationError{Err: fmt.Errorf("HTTP connect status: %s", resp.Status)}
 	default:
 		return fmt.Errorf("HTTP connect status: %s", resp.Status)
 	}
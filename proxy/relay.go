@@ -239,6 +239,13 @@ func readRelayResponse(r io.Reader) error {
 }
 
 func serializeRelayAddr(m *M.Metadata) *relay.AddrFeature {
+	if m.Host != "" {
+		return &relay.AddrFeature{
+			AType: relay.AddrDomain,
+			Host:  m.Host,
+			Port:  m.DstPort,
+		}
+	}
 	af := &relay.AddrFeature{
 		Host: m.DstIP.String(),
 		Port: m.DstPort,
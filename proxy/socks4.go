@@ -40,6 +40,6 @@ func (ss *Socks4) DialContext(ctx context.Context, metadata *M.Metadata) (c net.
 		safeConnClose(c, err)
 	}(c)
 
-	err = socks4.ClientHandshake(c, metadata.DestinationAddress(), socks4.CmdConnect, ss.userID)
+	err = socks4.ClientHandshake(c, metadata.RemoteAddress(), socks4.CmdConnect, ss.userID)
 	return
 }
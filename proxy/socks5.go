@@ -69,6 +69,10 @@ func (ss *Socks5) DialContext(ctx context.Context, metadata *M.Metadata) (c net.
 	}
 
 	_, err = socks5.ClientHandshake(c, serializeSocksAddr(metadata), socks5.CmdConnect, user)
+	var rep socks5.Reply
+	if errors.As(err, &rep) && rep.Unreachable() {
+		err = &DestinationError{Err: err}
+	}
 	return
 }
 
@@ -193,5 +197,5 @@ func (pc *socksPacketConn) Close() error {
 }
 
 func serializeSocksAddr(m *M.Metadata) socks5.Addr {
-	return socks5.SerializeAddr("", m.DstIP, m.DstPort)
+	return socks5.SerializeAddr(m.Host, m.DstIP, m.DstPort)
 }
@@ -0,0 +1,218 @@
+package restapi
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+
+	"github.com/xjasonlyu/tun2socks/v2/core/capture"
+)
+
+var (
+	_captureEndpoint atomic.Pointer[capture.Endpoint]
+
+	// _fileCapture is the running capture to file, at most one at a
+	// time, which is controlled by POST and DELETE.
+	_fileCapture struct {
+		sync.Mutex
+		session *capture.Session
+		path    string
+	}
+)
+
+func SetCaptureEndpoint(e *capture.Endpoint) {
+	_captureEndpoint.Store(e)
+}
+
+func init() {
+	registerEndpoint("/capture", captureRouter())
+}
+
+func captureRouter() http.Handler {
+	r := chi.NewRouter()
+	r.Get("/", getCapture)
+	r.Post("/", startFileCapture)
+	r.Delete("/", stopFileCapture)
+	r.Get("/stream", streamCapture)
+	return r
+}
+
+// fileCaptureInfo returns the state of the running capture to file.
+func fileCaptureInfo() render.M {
+	s := _fileCapture.session
+	if s == nil {
+		return nil
+	}
+	return render.M{
+		"file":    _fileCapture.path,
+		"options": s.Options(),
+		"stats":   s.Stats(),
+	}
+}
+
+func getCapture(w http.ResponseWriter, r *http.Request) {
+	e := _captureEndpoint.Load()
+	if e == nil {
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, ErrUninitialized)
+		return
+	}
+
+	_fileCapture.Lock()
+	defer _fileCapture.Unlock()
+	render.JSON(w, r, render.M{
+		"sessions": len(e.Sessions()),
+		"file":     fileCaptureInfo(),
+	})
+}
+
+// startFileCapture starts capturing to the file given by query, with
+// the options of parseCaptureOptions.
+func startFileCapture(w http.ResponseWriter, r *http.Request) {
+	e := _captureEndpoint.Load()
+	if e == nil {
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, ErrUninitialized)
+		return
+	}
+
+	path := r.URL.Query().Get("file")
+	opts, err := parseCaptureOptions(r.URL.Query())
+	if err == nil && path == "" {
+		err = errors.New("empty file")
+	}
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, newError(err.Error()))
+		return
+	}
+
+	_fileCapture.Lock()
+	defer _fileCapture.Unlock()
+	if _fileCapture.session != nil {
+		render.Status(r, http.StatusConflict)
+		render.JSON(w, r, newError("capture already running"))
+		return
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, newError(err.Error()))
+		return
+	}
+	s, err := e.Start(f, opts)
+	if err != nil {
+		f.Close()
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, newError(err.Error()))
+		return
+	}
+	_fileCapture.session, _fileCapture.path = s, path
+
+	go func() {
+		_ = s.Wait()
+		f.Close()
+		_fileCapture.Lock()
+		if _fileCapture.session == s {
+			_fileCapture.session = nil
+		}
+		_fileCapture.Unlock()
+	}()
+
+	render.JSON(w, r, fileCaptureInfo())
+}
+
+func stopFileCapture(w http.ResponseWriter, r *http.Request) {
+	_fileCapture.Lock()
+	s, info := _fileCapture.session, fileCaptureInfo()
+	_fileCapture.Unlock()
+	if s == nil {
+		render.NoContent(w, r)
+		return
+	}
+
+	s.Stop()
+	err := s.Wait()
+	info["stats"] = s.Stats()
+	if err != nil {
+		info["error"] = err.Error()
+	}
+	render.JSON(w, r, info)
+}
+
+// streamCapture streams pcapng of the captured packets, until the
+// client goes away or a limit is reached.
+func streamCapture(w http.ResponseWriter, r *http.Request) {
+	e := _captureEndpoint.Load()
+	if e == nil {
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, ErrUninitialized)
+		return
+	}
+
+	opts, err := parseCaptureOptions(r.URL.Query())
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, newError(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-pcapng")
+	w.Header().Set("Content-Disposition", `attachment; filename="capture.pcapng"`)
+	s, err := e.Start(w, opts)
+	if err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, newError(err.Error()))
+		return
+	}
+
+	select {
+	case <-s.Done():
+	case <-r.Context().Done():
+		s.Stop()
+		<-s.Done()
+	}
+}
+
+// parseCaptureOptions parses snaplen, count, duration, and the filter
+// of host (IP or CIDR), port and proto (tcp, udp or icmp).
+func parseCaptureOptions(query url.Values) (opts capture.Options, err error) {
+	if s := query.Get("snaplen"); s != "" {
+		if opts.SnapLen, err = strconv.Atoi(s); err != nil {
+			return
+		}
+	}
+	if s := query.Get("count"); s != "" {
+		if opts.Count, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return
+		}
+	}
+	if s := query.Get("duration"); s != "" {
+		if opts.Duration, err = time.ParseDuration(s); err != nil {
+			return
+		}
+	}
+	if s := query.Get("host"); s != "" {
+		if opts.Filter.Host, err = parsePrefix(s); err != nil {
+			return
+		}
+	}
+	if s := query.Get("port"); s != "" {
+		var port uint64
+		if port, err = strconv.ParseUint(s, 10, 16); err != nil {
+			return
+		}
+		opts.Filter.Port = uint16(port)
+	}
+	opts.Filter.Protocol = query.Get("proto")
+	return
+}
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"encoding/json"
 	"net/http"
+	"net/netip"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -23,6 +25,7 @@ func init() {
 func connectionRouter() http.Handler {
 	r := chi.NewRouter()
 	r.Get("/", getConnections)
+	r.Get("/closed", getClosedConnections)
 	r.Delete("/", closeAllConnections)
 	r.Delete("/{id}", closeConnection)
 	return r
@@ -75,6 +78,66 @@ func getConnections(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// getClosedConnections returns the recently closed connections,
+// filtered by source and destination IP or CIDR (or domain for the
+// destination), and the time window of since and until, each being
+// either a RFC 3339 time or a duration before now.
+func getClosedConnections(w http.ResponseWriter, r *http.Request) {
+	var (
+		filter statistic.ClosedFilter
+		err    error
+		query  = r.URL.Query()
+		now    = time.Now()
+	)
+
+	if s := query.Get("source"); s != "" {
+		if filter.Source, err = parsePrefix(s); err != nil {
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, newError(err.Error()))
+			return
+		}
+	}
+	if s := query.Get("destination"); s != "" {
+		if filter.Destination, err = parsePrefix(s); err != nil {
+			filter.Host = strings.ToLower(strings.TrimSuffix(s, "."))
+		}
+	}
+	for key, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if s := query.Get(key); s != "" {
+			if *t, err = parseTime(s, now); err != nil {
+				render.Status(r, http.StatusBadRequest)
+				render.JSON(w, r, newError(err.Error()))
+				return
+			}
+		}
+	}
+
+	render.JSON(w, r, render.M{
+		"connections": statistic.DefaultManager.Closed(filter),
+	})
+}
+
+// parsePrefix parses s as a CIDR, or an IP as a single address prefix.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		return netip.ParsePrefix(s)
+	}
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	ip = ip.Unmap()
+	return netip.PrefixFrom(ip, ip.BitLen()), nil
+}
+
+// parseTime parses s as a RFC 3339 time, or a duration before now.
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
 func closeConnection(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
 	snapshot := statistic.DefaultManager.Snapshot()
@@ -0,0 +1,73 @@
+package restapi
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+
+	"github.com/xjasonlyu/tun2socks/v2/dns"
+)
+
+// _dnsServer may be swapped at runtime by config reload.
+var _dnsServer atomic.Pointer[dns.Server]
+
+func SetDNSServer(s *dns.Server) {
+	_dnsServer.Store(s)
+}
+
+func init() {
+	registerEndpoint("/dns", dnsRouter())
+}
+
+func dnsRouter() http.Handler {
+	r := chi.NewRouter()
+	r.Get("/cache", getDNSCache)
+	r.Delete("/cache", flushDNSCache)
+	r.Get("/fakeip", getFakeIPMappings)
+	r.Delete("/fakeip", flushFakeIPMappings)
+	return r
+}
+
+func getDNSCache(w http.ResponseWriter, r *http.Request) {
+	server := _dnsServer.Load()
+	if server == nil {
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, ErrUninitialized)
+		return
+	}
+	render.JSON(w, r, render.M{"size": server.CacheLen()})
+}
+
+func flushDNSCache(w http.ResponseWriter, r *http.Request) {
+	server := _dnsServer.Load()
+	if server == nil {
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, ErrUninitialized)
+		return
+	}
+	server.FlushCache()
+	render.NoContent(w, r)
+}
+
+func getFakeIPMappings(w http.ResponseWriter, r *http.Request) {
+	server := _dnsServer.Load()
+	if server == nil || server.FakeIP() == nil {
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, ErrUninitialized)
+		return
+	}
+	render.JSON(w, r, render.M{"mappings": server.FakeIP().Mappings()})
+}
+
+func flushFakeIPMappings(w http.ResponseWriter, r *http.Request) {
+	server := _dnsServer.Load()
+	if server == nil || server.FakeIP() == nil {
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, ErrUninitialized)
+		return
+	}
+	server.FakeIP().Flush()
+	render.NoContent(w, r)
+}
@@ -0,0 +1,47 @@
+package restapi
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+
+	"github.com/xjasonlyu/tun2socks/v2/tunnel/ping"
+)
+
+var _pinger atomic.Pointer[ping.Handler]
+
+func SetPinger(h *ping.Handler) {
+	_pinger.Store(h)
+}
+
+func init() {
+	registerEndpoint("/icmp", icmpRouter())
+}
+
+func icmpRouter() http.Handler {
+	r := chi.NewRouter()
+	r.Get("/", getICMP)
+	return r
+}
+
+// getICMP returns the config and statistics of ICMP echo requests.
+func getICMP(w http.ResponseWriter, r *http.Request) {
+	h := _pinger.Load()
+	if h == nil {
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, ErrUninitialized)
+		return
+	}
+
+	config := h.Config()
+	render.JSON(w, r, render.M{
+		"config": render.M{
+			"mode":       config.Mode,
+			"timeout":    config.Timeout.String(),
+			"probePorts": config.ProbePorts,
+		},
+		"stats": h.Stats(),
+	})
+}
@@ -0,0 +1,175 @@
+package restapi
+
+import (
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+
+	"github.com/xjasonlyu/tun2socks/v2/metrics"
+	"github.com/xjasonlyu/tun2socks/v2/tunnel/statistic"
+)
+
+func init() {
+	registerEndpoint("/metrics", http.HandlerFunc(getMetrics))
+}
+
+// StartMetrics serves /metrics alone on a separate listener without
+// authentication, so that it can be scraped by Prometheus.
+func StartMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", getMetrics)
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return http.Serve(listener, mux)
+}
+
+func getMetrics(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.WriteText(w, gatherMetrics())
+}
+
+func gatherMetrics() []metrics.Family {
+	up, down := statistic.DefaultManager.Total()
+	tcp, udp := statistic.DefaultManager.Count()
+
+	families := []metrics.Family{
+		counter("tun2socks_upload_bytes_total", "Total bytes sent through the tunnel.", float64(up)),
+		counter("tun2socks_download_bytes_total", "Total bytes received through the tunnel.", float64(down)),
+		{
+			Name: "tun2socks_active_connections",
+			Type: metrics.TypeGauge,
+			Help: "Active TCP connections and UDP sessions.",
+			Samples: []metrics.Sample{
+				{Name: "tun2socks_active_connections", Labels: []metrics.Label{{Name: "network", Value: "tcp"}}, Value: float64(tcp)},
+				{Name: "tun2socks_active_connections", Labels: []metrics.Label{{Name: "network", Value: "udp"}}, Value: float64(udp)},
+			},
+		},
+	}
+	families = append(families, metrics.Default.Gather()...)
+	families = append(families, proxyTrafficMetrics()...)
+	families = append(families, proxyMetrics()...)
+	families = append(families, stackMetrics()...)
+	return families
+}
+
+// proxyMetrics returns the state of proxies held by ProxyManager.
+func proxyMetrics() []metrics.Family {
+	m := proxyManager()
+	if m == nil {
+		return nil
+	}
+
+	healthy := metrics.Family{
+		Name: "tun2socks_proxy_healthy",
+		Type: metrics.TypeGauge,
+		Help: "Whether the proxy is healthy by kind of health check.",
+	}
+	disabled := metrics.Family{
+		Name: "tun2socks_proxy_disabled",
+		Type: metrics.TypeGauge,
+		Help: "Whether the proxy is disabled.",
+	}
+	active := metrics.Family{
+		Name: "tun2socks_proxy_active_connections",
+		Type: metrics.TypeGauge,
+		Help: "Active connections through the proxy.",
+	}
+	for _, p := range m.Proxies() {
+		name := metrics.Label{Name: "proxy", Value: p.Name}
+		healthy.Samples = append(healthy.Samples,
+			metrics.Sample{Name: healthy.Name, Labels: []metrics.Label{name, {Name: "kind", Value: "tcp"}}, Value: boolValue(p.Healthy)},
+			metrics.Sample{Name: healthy.Name, Labels: []metrics.Label{name, {Name: "kind", Value: "udp"}}, Value: boolValue(p.UDPHealthy)},
+		)
+		disabled.Samples = append(disabled.Samples,
+			metrics.Sample{Name: disabled.Name, Labels: []metrics.Label{name}, Value: boolValue(p.Disabled)})
+		active.Samples = append(active.Samples,
+			metrics.Sample{Name: active.Name, Labels: []metrics.Label{name}, Value: float64(p.Active)})
+	}
+	return []metrics.Family{healthy, disabled, active}
+}
+
+// proxyTrafficMetrics returns the bytes carried by each proxy, as
+// accounted by statistic.Manager.
+func proxyTrafficMetrics() []metrics.Family {
+	upload := metrics.Family{
+		Name: "tun2socks_proxy_upload_bytes_total",
+		Type: metrics.TypeCounter,
+		Help: "Bytes sent through the proxy.",
+	}
+	download := metrics.Family{
+		Name: "tun2socks_proxy_download_bytes_total",
+		Type: metrics.TypeCounter,
+		Help: "Bytes received through the proxy.",
+	}
+	proxies := statistic.DefaultManager.Snapshot().Proxies
+	for _, name := range slices.Sorted(maps.Keys(proxies)) {
+		p, label := proxies[name], []metrics.Label{{Name: "proxy", Value: name}}
+		upload.Samples = append(upload.Samples,
+			metrics.Sample{Name: upload.Name, Labels: label, Value: float64(p.Upload.Load())})
+		download.Samples = append(download.Samples,
+			metrics.Sample{Name: download.Name, Labels: label, Value: float64(p.Download.Load())})
+	}
+	return []metrics.Family{upload, download}
+}
+
+// stackMetrics returns the selected counters of netstack.
+func stackMetrics() []metrics.Family {
+	if _stackStatsFunc == nil {
+		return nil
+	}
+	s := _stackStatsFunc()
+	if s.TCP.CurrentEstablished == nil /* stack is not initialized */ {
+		return nil
+	}
+
+	stat := func(name, help string, c *tcpip.StatCounter) metrics.Family {
+		return counter("tun2socks_netstack_"+name, help, float64(c.Value()))
+	}
+	return []metrics.Family{
+		stat("dropped_packets_total", "Packets dropped by netstack.", s.DroppedPackets),
+		stat("ip_packets_received_total", "IP packets received from the link layer.", s.IP.PacketsReceived),
+		stat("ip_packets_delivered_total", "IP packets delivered to the transport layer.", s.IP.PacketsDelivered),
+		stat("ip_packets_sent_total", "IP packets sent to the link layer.", s.IP.PacketsSent),
+		stat("ip_invalid_destination_addresses_total", "IP packets received with an unknown or invalid destination address.", s.IP.InvalidDestinationAddressesReceived),
+		stat("tcp_passive_connection_openings_total", "TCP connections accepted from the TUN device.", s.TCP.PassiveConnectionOpenings),
+		stat("tcp_established_resets_total", "TCP connections reset from the established or close-wait state.", s.TCP.EstablishedResets),
+		stat("tcp_failed_connection_attempts_total", "TCP connections failed to be established.", s.TCP.FailedConnectionAttempts),
+		stat("tcp_segments_received_total", "TCP segments received.", s.TCP.ValidSegmentsReceived),
+		stat("tcp_segments_sent_total", "TCP segments sent.", s.TCP.SegmentsSent),
+		stat("tcp_retransmits_total", "TCP segments retransmitted.", s.TCP.Retransmits),
+		stat("udp_packets_received_total", "UDP packets received.", s.UDP.PacketsReceived),
+		stat("udp_packets_sent_total", "UDP packets sent.", s.UDP.PacketsSent),
+		stat("udp_receive_buffer_errors_total", "UDP packets dropped due to a full receive buffer.", s.UDP.ReceiveBufferErrors),
+		{
+			Name: "tun2socks_netstack_tcp_current_established",
+			Type: metrics.TypeGauge,
+			Help: "TCP connections in the established or close-wait state.",
+			Samples: []metrics.Sample{
+				{Name: "tun2socks_netstack_tcp_current_established", Value: float64(s.TCP.CurrentEstablished.Value())},
+			},
+		},
+	}
+}
+
+func counter(name, help string, value float64) metrics.Family {
+	return metrics.Family{
+		Name:    name,
+		Type:    metrics.TypeCounter,
+		Help:    help,
+		Samples: []metrics.Sample{{Name: name, Value: value}},
+	}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
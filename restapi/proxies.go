@@ -0,0 +1,154 @@
+package restapi
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+)
+
+// ProxyInfo is the runtime state of a configured proxy.
+type ProxyInfo struct {
+	Name      string    `json:"name"`
+	Proto     string    `json:"proto"`
+	Address   string    `json:"address"`
+	Groups    []string  `json:"groups"`
+	Healthy   bool      `json:"healthy"`
+	Disabled  bool      `json:"disabled"`
+	LastCheck time.Time `json:"lastCheck"`
+	LastDelay int64     `json:"lastDelay"` // in milliseconds
+	LastError string    `json:"lastError,omitempty"`
+	Active    int64     `json:"active"`
+	// Circuit is the state of circuit breaker, if enabled.
+	Circuit string `json:"circuit,omitempty"`
+
+	// UDP health, which is checked separately if configured.
+	UDPHealthy   bool   `json:"udpHealthy"`
+	UDPLastDelay int64  `json:"udpLastDelay"` // in milliseconds
+	UDPLastError string `json:"udpLastError,omitempty"`
+}
+
+// ProxyGroupInfo is the runtime state of a proxy group.
+type ProxyGroupInfo struct {
+	Name      string   `json:"name"`
+	Type      string   `json:"type"`
+	Affinity  string   `json:"affinity"`
+	Retry     bool     `json:"retry"`
+	Members   []string `json:"members"`
+	Available []string `json:"available"`
+	// AvailableUDP lists the members in rotation for UDP.
+	AvailableUDP []string `json:"availableUDP"`
+}
+
+// ProxyManager manages the proxies of the running engine.
+type ProxyManager interface {
+	Proxies() []ProxyInfo
+	ProxyGroups() []ProxyGroupInfo
+	AddProxy(name, url string, groups []string) error
+	RemoveProxy(name string) error
+	SetProxyDisabled(name string, disabled bool) error
+}
+
+// _proxyManager may be swapped at runtime by config reload.
+var _proxyManager atomic.Value
+
+type proxyManagerHolder struct{ ProxyManager }
+
+func SetProxyManager(m ProxyManager) {
+	_proxyManager.Store(proxyManagerHolder{m})
+}
+
+func proxyManager() ProxyManager {
+	h, _ := _proxyManager.Load().(proxyManagerHolder)
+	return h.ProxyManager
+}
+
+func init() {
+	registerEndpoint("/proxies", proxyRouter())
+}
+
+func proxyRouter() http.Handler {
+	r := chi.NewRouter()
+	r.Get("/", getProxies)
+	r.Post("/", addProxy)
+	r.Delete("/{name}", removeProxy)
+	r.Put("/{name}/enable", setProxyDisabled(false))
+	r.Put("/{name}/disable", setProxyDisabled(true))
+	return r
+}
+
+func getProxies(w http.ResponseWriter, r *http.Request) {
+	m := proxyManager()
+	if m == nil {
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, ErrUninitialized)
+		return
+	}
+	render.JSON(w, r, render.M{
+		"proxies": m.Proxies(),
+		"groups":  m.ProxyGroups(),
+	})
+}
+
+func addProxy(w http.ResponseWriter, r *http.Request) {
+	m := proxyManager()
+	if m == nil {
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, ErrUninitialized)
+		return
+	}
+
+	req := struct {
+		Name   string   `json:"name"`
+		URL    string   `json:"url"`
+		Groups []string `json:"groups"`
+	}{}
+	if err := render.DecodeJSON(r.Body, &req); err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, ErrBadRequest)
+		return
+	}
+
+	if err := m.AddProxy(req.Name, req.URL, req.Groups); err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, newError(err.Error()))
+		return
+	}
+	render.NoContent(w, r)
+}
+
+func removeProxy(w http.ResponseWriter, r *http.Request) {
+	m := proxyManager()
+	if m == nil {
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, ErrUninitialized)
+		return
+	}
+
+	if err := m.RemoveProxy(chi.URLParam(r, "name")); err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, newError(err.Error()))
+		return
+	}
+	render.NoContent(w, r)
+}
+
+func setProxyDisabled(disabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m := proxyManager()
+		if m == nil {
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, ErrUninitialized)
+			return
+		}
+
+		if err := m.SetProxyDisabled(chi.URLParam(r, "name"), disabled); err != nil {
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, newError(err.Error()))
+			return
+		}
+		render.NoContent(w, r)
+	}
+}
@@ -0,0 +1,102 @@
+package restapi
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+
+	"github.com/xjasonlyu/tun2socks/v2/tunnel/ratelimit"
+)
+
+var _rateLimiter atomic.Pointer[ratelimit.Limiter]
+
+func SetRateLimiter(l *ratelimit.Limiter) {
+	_rateLimiter.Store(l)
+}
+
+func init() {
+	registerEndpoint("/ratelimit", rateLimitRouter())
+}
+
+func rateLimitRouter() http.Handler {
+	r := chi.NewRouter()
+	r.Get("/", getRateLimit)
+	r.Put("/", updateRateLimit)
+	r.Put("/connections/{id}", setConnRateLimit)
+	r.Delete("/connections/{id}", deleteConnRateLimit)
+	return r
+}
+
+func getRateLimit(w http.ResponseWriter, r *http.Request) {
+	l := _rateLimiter.Load()
+	if l == nil {
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, ErrUninitialized)
+		return
+	}
+	render.JSON(w, r, render.M{
+		"config":      l.Config(),
+		"connections": l.ConnLimits(),
+	})
+}
+
+// updateRateLimit replaces the limits in bytes per second, until the
+// config is reloaded.
+func updateRateLimit(w http.ResponseWriter, r *http.Request) {
+	l := _rateLimiter.Load()
+	if l == nil {
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, ErrUninitialized)
+		return
+	}
+
+	var config ratelimit.Config
+	if err := render.DecodeJSON(r.Body, &config); err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, ErrBadRequest)
+		return
+	}
+	if err := l.Update(config); err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, newError(err.Error()))
+		return
+	}
+	render.NoContent(w, r)
+}
+
+func setConnRateLimit(w http.ResponseWriter, r *http.Request) {
+	var limit ratelimit.Limit
+	if err := render.DecodeJSON(r.Body, &limit); err != nil {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, ErrBadRequest)
+		return
+	}
+	setConnLimit(w, r, limit)
+}
+
+func deleteConnRateLimit(w http.ResponseWriter, r *http.Request) {
+	setConnLimit(w, r, ratelimit.Limit{})
+}
+
+func setConnLimit(w http.ResponseWriter, r *http.Request, limit ratelimit.Limit) {
+	l := _rateLimiter.Load()
+	if l == nil {
+		render.Status(r, http.StatusInternalServerError)
+		render.JSON(w, r, ErrUninitialized)
+		return
+	}
+
+	if err := l.SetConnLimit(chi.URLParam(r, "id"), limit); err != nil {
+		if errors.Is(err, ratelimit.ErrNotFound) {
+			render.Status(r, http.StatusNotFound)
+		} else {
+			render.Status(r, http.StatusBadRequest)
+		}
+		render.JSON(w, r, newError(err.Error()))
+		return
+	}
+	render.NoContent(w, r)
+}
@@ -0,0 +1,70 @@
+package rule
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Parse parses rule from a line in the form of "TYPE,PAYLOAD,TARGET",
+// or "MATCH,TARGET" for the final rule.
+func Parse(line string) (Rule, error) {
+	var fields []string
+	for _, f := range strings.Split(line, ",") {
+		fields = append(fields, strings.TrimSpace(f))
+	}
+
+	typ := strings.ToUpper(fields[0])
+	if typ == Match.String() {
+		if len(fields) != 2 || fields[1] == "" {
+			return nil, fmt.Errorf("invalid rule: %s", line)
+		}
+		return &matchRule{base: &base{target: fields[1]}}, nil
+	}
+
+	if len(fields) != 3 || fields[1] == "" || fields[2] == "" {
+		return nil, fmt.Errorf("invalid rule: %s", line)
+	}
+	payload, target := fields[1], fields[2]
+
+	var (
+		r   Rule
+		err error
+	)
+	switch typ {
+	case Network.String():
+		r, err = newNetworkRule(payload, target)
+	case SrcCIDR.String():
+		r, err = newCIDRRule(payload, target, true)
+	case DstCIDR.String():
+		r, err = newCIDRRule(payload, target, false)
+	case DstPort.String():
+		r, err = newPortRule(payload, target)
+	case Domain.String():
+		r = newDomainRule(payload, target, Domain)
+	case DomainSuffix.String():
+		r = newDomainRule(payload, target, DomainSuffix)
+	case DomainKeyword.String():
+		r = newDomainRule(payload, target, DomainKeyword)
+	case Protocol.String():
+		r = &protocolRule{base: &base{payload: payload, target: target}, protocol: payload}
+	default:
+		return nil, fmt.Errorf("unsupported rule type: %s", fields[0])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse rule %s: %w", line, err)
+	}
+	return r, nil
+}
+
+// ParseRules parses rules from lines and keeps their order.
+func ParseRules(lines []string) ([]Rule, error) {
+	rules := make([]Rule, 0, len(lines))
+	for _, line := range lines {
+		r, err := Parse(line)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
@@ -0,0 +1,75 @@
+package rule
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/proxy"
+)
+
+var _ proxy.Dialer = (*Router)(nil)
+
+// ErrNoRuleMatched is returned when no rule matches the flow.
+var ErrNoRuleMatched = errors.New("no rule matched")
+
+// Router routes each flow to the target of the first matched
+// rule, and implements proxy.Dialer so that it can be used by
+// tunnel directly.
+type Router struct {
+	rules   []Rule
+	proxies map[string]proxy.Proxy
+}
+
+// NewRouter creates a Router with ordered rules. The targets of
+// rules must be found in proxies, which is keyed by proxy name.
+func NewRouter(rules []Rule, proxies map[string]proxy.Proxy) (*Router, error) {
+	for i, r := range rules {
+		if _, ok := proxies[r.Target()]; !ok {
+			return nil, fmt.Errorf("rule %s: proxy %q not found", Name(r), r.Target())
+		}
+		if r.Type() == Match && i != len(rules)-1 {
+			return nil, fmt.Errorf("rule %s: must be the last rule", Name(r))
+		}
+	}
+	return &Router{
+		rules:   rules,
+		proxies: proxies,
+	}, nil
+}
+
+// Rules returns the ordered rules of Router.
+func (r *Router) Rules() []Rule {
+	return r.rules
+}
+
+// Route finds the proxy of the first matched rule, and records the
+// rule on metadata.
+func (r *Router) Route(metadata *M.Metadata) (proxy.Proxy, error) {
+	for _, rule := range r.rules {
+		if rule.Match(metadata) {
+			metadata.Rule = Name(rule)
+			metadata.Target = rule.Target()
+			return r.proxies[rule.Target()], nil
+		}
+	}
+	return nil, ErrNoRuleMatched
+}
+
+func (r *Router) DialContext(ctx context.Context, metadata *M.Metadata) (net.Conn, error) {
+	p, err := r.Route(metadata)
+	if err != nil {
+		return nil, err
+	}
+	return p.DialContext(ctx, metadata)
+}
+
+func (r *Router) DialUDP(metadata *M.Metadata) (net.PacketConn, error) {
+	p, err := r.Route(metadata)
+	if err != nil {
+		return nil, err
+	}
+	return p.DialUDP(metadata)
+}
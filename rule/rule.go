@@ -0,0 +1,269 @@
+// Package rule provides rule-based routing for tunnel flows.
+package rule
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+)
+
+// Type is the type of rule.
+type Type uint8
+
+const (
+	Network Type = iota
+	SrcCIDR
+	DstCIDR
+	DstPort
+	Domain
+	DomainSuffix
+	DomainKeyword
+	Protocol
+	Match
+)
+
+func (t Type) String() string {
+	switch t {
+	case Network:
+		return "NETWORK"
+	case SrcCIDR:
+		return "SRC-CIDR"
+	case DstCIDR:
+		return "DST-CIDR"
+	case DstPort:
+		return "DST-PORT"
+	case Domain:
+		return "DOMAIN"
+	case DomainSuffix:
+		return "DOMAIN-SUFFIX"
+	case DomainKeyword:
+		return "DOMAIN-KEYWORD"
+	case Protocol:
+		return "PROTOCOL"
+	case Match:
+		return "MATCH"
+	default:
+		return fmt.Sprintf("type(%d)", t)
+	}
+}
+
+// Rule matches flows by their metadata and routes the matched
+// flows to its target.
+type Rule interface {
+	// Type returns the type of rule.
+	Type() Type
+	// Payload returns the raw payload of rule.
+	Payload() string
+	// Target returns the name of proxy or proxy group
+	// that matched flows are routed to.
+	Target() string
+	// Match reports whether the metadata matches rule.
+	Match(*M.Metadata) bool
+}
+
+// Name returns the human-readable name of rule, e.g. "DST-CIDR,10.0.0.0/8".
+func Name(r Rule) string {
+	if r.Payload() == "" {
+		return r.Type().String()
+	}
+	return r.Type().String() + "," + r.Payload()
+}
+
+type base struct {
+	payload string
+	target  string
+}
+
+func (b *base) Payload() string {
+	return b.payload
+}
+
+func (b *base) Target() string {
+	return b.target
+}
+
+type networkRule struct {
+	*base
+	network M.Network
+}
+
+func newNetworkRule(payload, target string) (*networkRule, error) {
+	var network M.Network
+	switch strings.ToLower(payload) {
+	case M.TCP.String():
+		network = M.TCP
+	case M.UDP.String():
+		network = M.UDP
+	default:
+		return nil, fmt.Errorf("invalid network: %s", payload)
+	}
+	return &networkRule{
+		base:    &base{payload: payload, target: target},
+		network: network,
+	}, nil
+}
+
+func (r *networkRule) Type() Type {
+	return Network
+}
+
+func (r *networkRule) Match(metadata *M.Metadata) bool {
+	return metadata.Network == r.network
+}
+
+type cidrRule struct {
+	*base
+	prefix netip.Prefix
+	source bool
+}
+
+func newCIDRRule(payload, target string, source bool) (*cidrRule, error) {
+	prefix, err := netip.ParsePrefix(payload)
+	if err != nil {
+		return nil, err
+	}
+	return &cidrRule{
+		base:   &base{payload: payload, target: target},
+		prefix: prefix.Masked(),
+		source: source,
+	}, nil
+}
+
+func (r *cidrRule) Type() Type {
+	if r.source {
+		return SrcCIDR
+	}
+	return DstCIDR
+}
+
+func (r *cidrRule) Match(metadata *M.Metadata) bool {
+	ip := metadata.DstIP
+	if r.source {
+		ip = metadata.SrcIP
+	}
+	return ip.IsValid() && r.prefix.Contains(ip.Unmap())
+}
+
+// portRange is an inclusive range of ports.
+type portRange struct {
+	start, end uint16
+}
+
+type portRule struct {
+	*base
+	ranges []portRange
+}
+
+// newPortRule parses payload in the form of "80/443/8000-9000".
+func newPortRule(payload, target string) (*portRule, error) {
+	var ranges []portRange
+	for _, s := range strings.Split(payload, "/") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		lo, hi, found := strings.Cut(s, "-")
+		start, err := strconv.ParseUint(lo, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port: %s", s)
+		}
+		end := start
+		if found {
+			if end, err = strconv.ParseUint(hi, 10, 16); err != nil {
+				return nil, fmt.Errorf("invalid port: %s", s)
+			}
+		}
+		if start > end {
+			return nil, fmt.Errorf("invalid port range: %s", s)
+		}
+		ranges = append(ranges, portRange{start: uint16(start), end: uint16(end)})
+	}
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("empty port payload")
+	}
+	return &portRule{
+		base:   &base{payload: payload, target: target},
+		ranges: ranges,
+	}, nil
+}
+
+func (r *portRule) Type() Type {
+	return DstPort
+}
+
+func (r *portRule) Match(metadata *M.Metadata) bool {
+	for _, pr := range r.ranges {
+		if metadata.DstPort >= pr.start && metadata.DstPort <= pr.end {
+			return true
+		}
+	}
+	return false
+}
+
+type domainRule struct {
+	*base
+	typ    Type
+	domain string
+}
+
+func newDomainRule(payload, target string, typ Type) *domainRule {
+	return &domainRule{
+		base:   &base{payload: payload, target: target},
+		typ:    typ,
+		domain: strings.ToLower(strings.TrimSuffix(payload, ".")),
+	}
+}
+
+func (r *domainRule) Type() Type {
+	return r.typ
+}
+
+// Match matches the hostname of metadata, which is restored from
+// fake IPs or sniffed from the first client bytes.
+func (r *domainRule) Match(metadata *M.Metadata) bool {
+	host := strings.ToLower(metadata.Host)
+	if host == "" {
+		return false
+	}
+
+	switch r.typ {
+	case Domain:
+		return host == r.domain
+	case DomainSuffix:
+		return host == r.domain || strings.HasSuffix(host, "."+r.domain)
+	case DomainKeyword:
+		return strings.Contains(host, r.domain)
+	default:
+		return false
+	}
+}
+
+type protocolRule struct {
+	*base
+	protocol string
+}
+
+func (r *protocolRule) Type() Type {
+	return Protocol
+}
+
+// Match matches the application protocol detected by sniffing.
+func (r *protocolRule) Match(metadata *M.Metadata) bool {
+	return strings.EqualFold(metadata.Protocol, r.protocol)
+}
+
+type matchRule struct {
+	*base
+}
+
+func (r *matchRule) Type() Type {
+	return Match
+}
+
+func (r *matchRule) Match(*M.Metadata) bool {
+	return true
+}
@@ -0,0 +1,109 @@
+package rule
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/proxy"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		line    string
+		typ     Type
+		payload string
+		target  string
+		err     bool
+	}{
+		{"NETWORK,udp,DIRECT", Network, "udp", "DIRECT", false},
+		{"SRC-CIDR,192.168.1.0/24,PROXY", SrcCIDR, "192.168.1.0/24", "PROXY", false},
+		{"dst-cidr, 10.0.0.0/8 , DIRECT", DstCIDR, "10.0.0.0/8", "DIRECT", false},
+		{"DST-PORT,25/8000-9000,REJECT", DstPort, "25/8000-9000", "REJECT", false},
+		{"MATCH,PROXY", Match, "", "PROXY", false},
+		{"MATCH", 0, "", "", true},
+		{"NETWORK,icmp,DIRECT", 0, "", "", true},
+		{"DST-CIDR,10.0.0.0,DIRECT", 0, "", "", true},
+		{"DST-PORT,9000-8000,DIRECT", 0, "", "", true},
+		{"DST-PORT,65536,DIRECT", 0, "", "", true},
+		{"DOMAIN-SUFFIX,example.com,DIRECT", DomainSuffix, "example.com", "DIRECT", false},
+		{"PROTOCOL,quic,REJECT", Protocol, "quic", "REJECT", false},
+		{"GEOIP,CN,DIRECT", 0, "", "", true},
+		{"DST-CIDR,10.0.0.0/8", 0, "", "", true},
+	}
+	for _, tt := range tests {
+		r, err := Parse(tt.line)
+		if tt.err {
+			assert.Error(t, err, tt.line)
+			continue
+		}
+		require.NoError(t, err, tt.line)
+		assert.Equal(t, tt.typ, r.Type())
+		assert.Equal(t, tt.payload, r.Payload())
+		assert.Equal(t, tt.target, r.Target())
+	}
+}
+
+func TestMatch(t *testing.T) {
+	metadata := &M.Metadata{
+		Network:  M.TCP,
+		SrcIP:    netip.MustParseAddr("192.168.1.10"),
+		SrcPort:  50000,
+		DstIP:    netip.MustParseAddr("10.1.2.3"),
+		DstPort:  8080,
+		Host:     "www.Example.com",
+		Protocol: "tls",
+	}
+
+	tests := []struct {
+		line  string
+		match bool
+	}{
+		{"NETWORK,tcp,DIRECT", true},
+		{"NETWORK,udp,DIRECT", false},
+		{"SRC-CIDR,192.168.1.0/24,DIRECT", true},
+		{"SRC-CIDR,192.168.2.0/24,DIRECT", false},
+		{"DST-CIDR,10.0.0.0/8,DIRECT", true},
+		{"DST-CIDR,::ffff:10.0.0.0/104,DIRECT", false},
+		{"DST-PORT,80/443,DIRECT", false},
+		{"DST-PORT,8000-9000,DIRECT", true},
+		{"DST-PORT,8080,DIRECT", true},
+		{"DOMAIN,www.example.com,DIRECT", true},
+		{"DOMAIN,example.com,DIRECT", false},
+		{"DOMAIN-SUFFIX,example.com,DIRECT", true},
+		{"DOMAIN-SUFFIX,ample.com,DIRECT", false},
+		{"DOMAIN-KEYWORD,exam,DIRECT", true},
+		{"PROTOCOL,TLS,DIRECT", true},
+		{"PROTOCOL,quic,DIRECT", false},
+		{"MATCH,DIRECT", true},
+	}
+	for _, tt := range tests {
+		r, err := Parse(tt.line)
+		require.NoError(t, err, tt.line)
+		assert.Equal(t, tt.match, r.Match(metadata), tt.line)
+	}
+}
+
+func TestNewRouter(t *testing.T) {
+	proxies := map[string]proxy.Proxy{"DIRECT": proxy.NewDirect()}
+
+	rules, err := ParseRules([]string{"NETWORK,udp,DIRECT", "MATCH,DIRECT"})
+	require.NoError(t, err)
+	_, err = NewRouter(rules, proxies)
+	assert.NoError(t, err)
+
+	// MATCH must be the last rule.
+	rules, err = ParseRules([]string{"MATCH,DIRECT", "NETWORK,udp,DIRECT"})
+	require.NoError(t, err)
+	_, err = NewRouter(rules, proxies)
+	assert.Error(t, err)
+
+	// Target must be found in proxies.
+	rules, err = ParseRules([]string{"MATCH,PROXY"})
+	require.NoError(t, err)
+	_, err = NewRouter(rules, proxies)
+	assert.Error(t, err)
+}
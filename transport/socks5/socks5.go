@@ -58,9 +58,20 @@ const (
 	AtypIPv6       Atyp = 0x04
 )
 
-// Reply field as defined in RFC 1928 section 6.
+// Reply field as defined in RFC 1928 section 6, which is returned as
+// the error of a failed request.
 type Reply uint8
 
+func (r Reply) Error() string {
+	return r.String()
+}
+
+// Unreachable reports whether r is about the destination being
+// unreachable or refusing the connection, rather than the server.
+func (r Reply) Unreachable() bool {
+	return r >= 0x03 /* network unreachable */ && r <= 0x06 /* TTL expired */
+}
+
 func (r Reply) String() string {
 	switch r {
 	case 0x00:
@@ -252,7 +263,7 @@ func ClientHandshake(rw io.ReadWriter, addr Addr, command Command, user *User) (
 	}
 
 	if rep := Reply(buf[1]); rep != 0x00 /* SUCCEEDED */ {
-		return nil, fmt.Errorf("%s: %s", command, rep)
+		return nil, fmt.Errorf("%s: %w", command, rep)
 	}
 
 	return ReadAddr(rw, buf)
@@ -0,0 +1,56 @@
+package tunnel
+
+import (
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+
+	"github.com/xjasonlyu/tun2socks/v2/core/adapter"
+	"github.com/xjasonlyu/tun2socks/v2/log"
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/tunnel/acl"
+)
+
+var _ adapter.TransportFilter = (*Tunnel)(nil)
+
+// FilterTCP checks the destination of a new TCP connection against
+// the ACL before its handshake, and defers the handshake if enabled.
+func (t *Tunnel) FilterTCP(id *stack.TransportEndpointID) adapter.Action {
+	return t.filter(M.TCP, id)
+}
+
+// FilterUDP checks the destination of a new UDP session against the
+// ACL before its endpoint is created.
+func (t *Tunnel) FilterUDP(id *stack.TransportEndpointID) adapter.Action {
+	return t.filter(M.UDP, id)
+}
+
+func (t *Tunnel) filter(network M.Network, id *stack.TransportEndpointID) adapter.Action {
+	metadata := &M.Metadata{
+		Network: network,
+		SrcIP:   parseTCPIPAddress(id.RemoteAddress),
+		SrcPort: id.RemotePort,
+		DstIP:   parseTCPIPAddress(id.LocalAddress),
+		DstPort: id.LocalPort,
+	}
+	// Fake IPs are checked by their hostnames, or left to the
+	// handlers to drop if not mapped.
+	_ = t.restoreHost(metadata)
+
+	d := t.acl.Check(metadata)
+	if !d.Deny {
+		if network == M.TCP && t.deferReject.Load() != uint32(adapter.ActionAccept) && t.sniffTimeout.Load() == 0 {
+			return adapter.ActionDefer
+		}
+		return adapter.ActionAccept
+	}
+	log.Infof("[ACL] deny %s %s -> %s by %s: %s", network,
+		metadata.SourceAddress(), metadata.RemoteAddress(), d.Reason, d.Action)
+
+	switch d.Action {
+	case acl.Unreachable:
+		return adapter.ActionUnreachable
+	case acl.Drop:
+		return adapter.ActionDrop
+	default:
+		return adapter.ActionReset
+	}
+}
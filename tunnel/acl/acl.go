@@ -0,0 +1,260 @@
+// Package acl decides on which destinations tunneled flows may reach,
+// before they're established and dialed.
+package acl
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/metrics"
+)
+
+var denied = metrics.NewCounterVec("tun2socks_acl_denied_total",
+	"Flows denied by ACL by network and action.", "network", "action")
+
+// Action is how a denied flow is refused.
+type Action uint8
+
+const (
+	// Reset replies TCP RST, or ICMP port unreachable for UDP.
+	Reset Action = iota + 1
+	// Unreachable replies ICMP communication administratively prohibited.
+	Unreachable
+	// Drop silently drops the flow.
+	Drop
+)
+
+// ParseAction parses the name of Action.
+func ParseAction(s string) (Action, error) {
+	switch strings.ToLower(s) {
+	case "reset":
+		return Reset, nil
+	case "unreachable":
+		return Unreachable, nil
+	case "drop":
+		return Drop, nil
+	default:
+		return 0, fmt.Errorf("invalid acl action: %q", s)
+	}
+}
+
+func (a Action) String() string {
+	switch a {
+	case Reset:
+		return "reset"
+	case Unreachable:
+		return "unreachable"
+	case Drop:
+		return "drop"
+	default:
+		return fmt.Sprintf("action(%d)", a)
+	}
+}
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	From, To uint16
+}
+
+// ParsePortRange parses a port "25" or a range "8000-9000".
+func ParsePortRange(s string) (PortRange, error) {
+	from, to, found := strings.Cut(s, "-")
+	if !found {
+		to = from
+	}
+	a, err := strconv.ParseUint(strings.TrimSpace(from), 10, 16)
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port range: %q", s)
+	}
+	b, err := strconv.ParseUint(strings.TrimSpace(to), 10, 16)
+	if err != nil || b < a {
+		return PortRange{}, fmt.Errorf("invalid port range: %q", s)
+	}
+	return PortRange{From: uint16(a), To: uint16(b)}, nil
+}
+
+func (r PortRange) contains(port uint16) bool {
+	return port >= r.From && port <= r.To
+}
+
+// Rule matches destinations by all of its non-empty conditions.
+type Rule struct {
+	// Deny denies the matched destinations, or allows them if false.
+	Deny bool
+	// Action overrides Config.Action for the denied flows if non-zero.
+	Action Action
+
+	Prefixes []netip.Prefix
+	Ports    []PortRange
+	Networks []M.Network
+	// IPVersion is 4 or 6, or zero for both.
+	IPVersion int
+}
+
+func (r *Rule) match(network M.Network, ip netip.Addr, port uint16) bool {
+	switch r.IPVersion {
+	case 4:
+		if !ip.Is4() {
+			return false
+		}
+	case 6:
+		if !ip.Is6() {
+			return false
+		}
+	}
+	if len(r.Networks) > 0 && !contains(r.Networks, func(n M.Network) bool { return n == network }) {
+		return false
+	}
+	if len(r.Ports) > 0 && !contains(r.Ports, func(pr PortRange) bool { return pr.contains(port) }) {
+		return false
+	}
+	if len(r.Prefixes) > 0 && !contains(r.Prefixes, func(p netip.Prefix) bool { return p.Contains(ip) }) {
+		return false
+	}
+	return true
+}
+
+func contains[T any](s []T, f func(T) bool) bool {
+	for _, v := range s {
+		if f(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// Config is the ACL, of which the first matched rule applies.
+type Config struct {
+	Rules []Rule
+	// DefaultDeny denies the destinations matched by no rule.
+	DefaultDeny bool
+	// Action is how denied flows are refused, Reset if zero.
+	Action Action
+}
+
+// Validate checks c as ACL.SetConfig does, so that it can be checked
+// ahead of applying along with other settings.
+func (c *Config) Validate() error {
+	if c.Action > Drop {
+		return errors.New("invalid acl action")
+	}
+	for i, r := range c.Rules {
+		if r.Action > Drop {
+			return fmt.Errorf("rule %d: invalid acl action", i)
+		}
+		if r.IPVersion != 0 && r.IPVersion != 4 && r.IPVersion != 6 {
+			return fmt.Errorf("rule %d: invalid ip version: %d", i, r.IPVersion)
+		}
+		for _, p := range r.Prefixes {
+			if !p.IsValid() {
+				return fmt.Errorf("rule %d: invalid prefix", i)
+			}
+		}
+	}
+	return nil
+}
+
+// Decision is the result of ACL.Check.
+type Decision struct {
+	Deny   bool
+	Action Action
+	// Reason is what the decision is made by, i.e. "rule N" with the
+	// index of the rule, "proxy server" or "default".
+	Reason string
+}
+
+// ACL checks the destinations of flows against its Config, and denies
+// those to the proxy servers to avoid loops.
+type ACL struct {
+	config  atomic.Pointer[Config]
+	servers atomic.Pointer[[]netip.AddrPort]
+}
+
+// New creates an ACL allowing everything.
+func New() *ACL {
+	a := &ACL{}
+	a.config.Store(&Config{Action: Reset})
+	a.servers.Store(&[]netip.AddrPort{})
+	return a
+}
+
+// Config returns the current Config.
+func (a *ACL) Config() Config {
+	return *a.config.Load()
+}
+
+// SetConfig replaces the Config, which applies to new flows only.
+func (a *ACL) SetConfig(config Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	if config.Action == 0 {
+		config.Action = Reset
+	}
+	a.config.Store(&config)
+	return nil
+}
+
+// SetProxyServers replaces the addresses of proxy servers to deny, for
+// which flows would be dialed through the proxies themselves.
+func (a *ACL) SetProxyServers(servers []netip.AddrPort) {
+	s := make([]netip.AddrPort, 0, len(servers))
+	for _, ap := range servers {
+		s = append(s, netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()))
+	}
+	a.servers.Store(&s)
+}
+
+// ProxyServers returns the addresses of proxy servers denied.
+func (a *ACL) ProxyServers() []netip.AddrPort {
+	return *a.servers.Load()
+}
+
+// Check decides on the destination of metadata, and counts denials.
+// Destinations with Host, e.g. restored from fake IPs, are matched by
+// the rules without address conditions only, as their addresses are
+// resolved by proxies.
+func (a *ACL) Check(metadata *M.Metadata) Decision {
+	d := a.check(metadata)
+	if d.Deny {
+		denied.With(metadata.Network.String(), d.Action.String()).Inc()
+	}
+	return d
+}
+
+func (a *ACL) check(metadata *M.Metadata) Decision {
+	c := a.config.Load()
+	ip, port := metadata.DstIP.Unmap(), metadata.DstPort
+
+	for _, ap := range *a.servers.Load() {
+		if ap.Addr() == ip && ap.Port() == port {
+			return Decision{Deny: true, Action: c.Action, Reason: "proxy server"}
+		}
+	}
+	for i := range c.Rules {
+		r := &c.Rules[i]
+		if metadata.Host != "" && (len(r.Prefixes) > 0 || r.IPVersion != 0) {
+			continue
+		}
+		if !r.match(metadata.Network, ip, port) {
+			continue
+		}
+		d := Decision{Deny: r.Deny, Reason: "rule " + strconv.Itoa(i)}
+		if d.Deny {
+			d.Action = r.Action
+			if d.Action == 0 {
+				d.Action = c.Action
+			}
+		}
+		return d
+	}
+	if c.DefaultDeny {
+		return Decision{Deny: true, Action: c.Action, Reason: "default"}
+	}
+	return Decision{Reason: "default"}
+}
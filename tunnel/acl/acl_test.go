@@ -0,0 +1,80 @@
+package acl
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+)
+
+func newMetadata(network M.Network, dst string) *M.Metadata {
+	ap := netip.MustParseAddrPort(dst)
+	return &M.Metadata{Network: network, DstIP: ap.Addr(), DstPort: ap.Port()}
+}
+
+func withHost(metadata *M.Metadata, host string) *M.Metadata {
+	metadata.Host = host
+	return metadata
+}
+
+func TestParsePortRange(t *testing.T) {
+	r, err := ParsePortRange("25")
+	require.NoError(t, err)
+	assert.Equal(t, PortRange{From: 25, To: 25}, r)
+	r, err = ParsePortRange("8000-9000")
+	require.NoError(t, err)
+	assert.Equal(t, PortRange{From: 8000, To: 9000}, r)
+
+	for _, s := range []string{"", "a", "9000-8000", "1-65536"} {
+		_, err = ParsePortRange(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestACLCheck(t *testing.T) {
+	a := New()
+	assert.False(t, a.Check(newMetadata(M.TCP, "1.1.1.1:25")).Deny)
+
+	require.NoError(t, a.SetConfig(Config{
+		Action: Drop,
+		Rules: []Rule{
+			{Prefixes: []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")}},
+			{Deny: true, Prefixes: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}},
+			{Deny: true, Action: Reset, Networks: []M.Network{M.TCP}, Ports: []PortRange{{From: 25, To: 25}}},
+			{Deny: true, Action: Unreachable, IPVersion: 6, Ports: []PortRange{{From: 8000, To: 9000}}},
+		},
+	}))
+	a.SetProxyServers([]netip.AddrPort{netip.MustParseAddrPort("1.2.3.4:1080")})
+
+	for _, tt := range []struct {
+		metadata *M.Metadata
+		expected Decision
+	}{
+		{newMetadata(M.TCP, "10.1.2.3:80"), Decision{Reason: "rule 0"}},
+		{newMetadata(M.UDP, "10.2.3.4:53"), Decision{Deny: true, Action: Drop, Reason: "rule 1"}},
+		{newMetadata(M.TCP, "[::ffff:10.2.3.4]:53"), Decision{Deny: true, Action: Drop, Reason: "rule 1"}},
+		{newMetadata(M.TCP, "8.8.8.8:25"), Decision{Deny: true, Action: Reset, Reason: "rule 2"}},
+		{newMetadata(M.UDP, "8.8.8.8:25"), Decision{Reason: "default"}},
+		{newMetadata(M.UDP, "[2001:db8::1]:8080"), Decision{Deny: true, Action: Unreachable, Reason: "rule 3"}},
+		{newMetadata(M.UDP, "8.8.8.8:8080"), Decision{Reason: "default"}},
+		{newMetadata(M.TCP, "1.2.3.4:1080"), Decision{Deny: true, Action: Drop, Reason: "proxy server"}},
+		{newMetadata(M.TCP, "1.2.3.4:443"), Decision{Reason: "default"}},
+		// Hostnames are matched by ports only.
+		{withHost(newMetadata(M.TCP, "10.2.3.4:25"), "example.com"), Decision{Deny: true, Action: Reset, Reason: "rule 2"}},
+		{withHost(newMetadata(M.UDP, "10.2.3.4:8080"), "example.com"), Decision{Reason: "default"}},
+	} {
+		assert.Equal(t, tt.expected, a.Check(tt.metadata), tt.metadata.DestinationAddress())
+	}
+
+	before := denied.With("tcp", "reset").Value()
+	require.NoError(t, a.SetConfig(Config{DefaultDeny: true}))
+	assert.Equal(t, Decision{Deny: true, Action: Reset, Reason: "default"}, a.Check(newMetadata(M.TCP, "8.8.8.8:443")))
+	assert.Equal(t, before+1, denied.With("tcp", "reset").Value())
+
+	assert.Error(t, a.SetConfig(Config{Rules: []Rule{{IPVersion: 5}}}))
+	assert.Error(t, a.SetConfig(Config{Rules: []Rule{{Prefixes: []netip.Prefix{{}}}}}))
+	assert.Error(t, a.SetConfig(Config{Action: Drop + 1}))
+}
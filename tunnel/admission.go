@@ -0,0 +1,83 @@
+package tunnel
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+
+	"github.com/xjasonlyu/tun2socks/v2/core/adapter"
+	"github.com/xjasonlyu/tun2socks/v2/log"
+	"github.com/xjasonlyu/tun2socks/v2/tunnel/admission"
+)
+
+// admitTCPConn handles conn if admitted, or closes it right away
+// without spawning a goroutine.
+func (t *Tunnel) admitTCPConn(conn adapter.TCPConn) {
+	id := conn.ID()
+	release, err := t.admission.AdmitTCP(parseTCPIPAddress(id.RemoteAddress))
+	if err != nil {
+		log.Debugf("[TCP] refuse %s:%d: %v", id.RemoteAddress, id.RemotePort, err)
+		conn.Close()
+		return
+	}
+	go func() {
+		defer release()
+		t.handleTCPConn(conn)
+	}()
+}
+
+// admitUDPConn handles conn if admitted, which may evict the least
+// recently active session, or closes it right away.
+func (t *Tunnel) admitUDPConn(conn adapter.UDPConn) {
+	id := conn.ID()
+	s, err := t.admission.AdmitUDP(parseTCPIPAddress(id.RemoteAddress), conn)
+	if err != nil {
+		log.Debugf("[UDP] refuse %s:%d: %v", id.RemoteAddress, id.RemotePort, err)
+		conn.Close()
+		return
+	}
+	go func() {
+		defer s.Release()
+		t.handleUDPConn(&admittedUDPConn{UDPConn: conn, session: s})
+	}()
+}
+
+// admittedUDPConn marks its session active on each datagram.
+type admittedUDPConn struct {
+	adapter.UDPConn
+	session *admission.Session
+}
+
+// DialFrom implements adapter.ConeUDPConn if the admitted conn does.
+func (c *admittedUDPConn) DialFrom(from netip.AddrPort) (adapter.UDPConn, error) {
+	if cc, ok := c.UDPConn.(adapter.ConeUDPConn); ok {
+		return cc.DialFrom(from)
+	}
+	return nil, errors.ErrUnsupported
+}
+
+func (c *admittedUDPConn) Read(b []byte) (int, error) {
+	n, err := c.UDPConn.Read(b)
+	if n > 0 {
+		c.session.Touch()
+	}
+	return n, err
+}
+
+func (c *admittedUDPConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.UDPConn.ReadFrom(b)
+	if n > 0 {
+		c.session.Touch()
+	}
+	return n, addr, err
+}
+
+func (c *admittedUDPConn) Write(b []byte) (int, error) {
+	c.session.Touch()
+	return c.UDPConn.Write(b)
+}
+
+func (c *admittedUDPConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.session.Touch()
+	return c.UDPConn.WriteTo(b, addr)
+}
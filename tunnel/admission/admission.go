@@ -0,0 +1,205 @@
+// Package admission bounds the number of tunneled TCP connections and
+// UDP sessions, in total and per source IP.
+package admission
+
+import (
+	"io"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xjasonlyu/tun2socks/v2/metrics"
+)
+
+// Scopes of caps, as reported by refusals and evictions.
+const (
+	ScopeTotal  = "total"
+	ScopeSource = "source"
+)
+
+var (
+	refused = metrics.NewCounterVec("tun2socks_admission_refused_total",
+		"Flows refused by admission control by network and scope of cap.", "network", "scope")
+	evicted = metrics.NewCounterVec("tun2socks_udp_sessions_evicted_total",
+		"UDP sessions evicted by admission control by scope of cap.", "scope")
+)
+
+// Config is the caps of flows, where zero means unlimited.
+type Config struct {
+	MaxTCP          int
+	MaxUDP          int
+	MaxTCPPerSource int
+	MaxUDPPerSource int
+}
+
+// RefusedError is returned when a flow is refused.
+type RefusedError struct {
+	Network string
+	Scope   string
+}
+
+func (e *RefusedError) Error() string {
+	return e.Network + " " + e.Scope + " limit reached"
+}
+
+// Controller admits flows within the caps. UDP sessions at a cap
+// evict the least recently active session of the same scope instead
+// of being refused.
+type Controller struct {
+	mu     sync.Mutex
+	config Config
+
+	tcp         int
+	tcpBySource map[netip.Addr]int
+
+	udp         map[*Session]struct{}
+	udpBySource map[netip.Addr]int
+}
+
+// New creates an unlimited Controller.
+func New() *Controller {
+	return &Controller{
+		tcpBySource: make(map[netip.Addr]int),
+		udp:         make(map[*Session]struct{}),
+		udpBySource: make(map[netip.Addr]int),
+	}
+}
+
+// SetConfig replaces the caps, which apply to new flows only.
+func (c *Controller) SetConfig(config Config) {
+	c.mu.Lock()
+	c.config = config
+	c.mu.Unlock()
+}
+
+// Count returns the numbers of admitted TCP connections and UDP
+// sessions.
+func (c *Controller) Count() (tcp, udp int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tcp, len(c.udp)
+}
+
+// AdmitTCP admits a TCP connection from src, returning the function
+// to call once it's closed.
+func (c *Controller) AdmitTCP(src netip.Addr) (release func(), err error) {
+	src = src.Unmap()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n := c.config.MaxTCP; n > 0 && c.tcp >= n {
+		return nil, c.refuse("tcp", ScopeTotal)
+	}
+	if n := c.config.MaxTCPPerSource; n > 0 && c.tcpBySource[src] >= n {
+		return nil, c.refuse("tcp", ScopeSource)
+	}
+	c.tcp++
+	c.tcpBySource[src]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.tcp--
+			if c.tcpBySource[src]--; c.tcpBySource[src] <= 0 {
+				delete(c.tcpBySource, src)
+			}
+		})
+	}, nil
+}
+
+// AdmitUDP admits a UDP session from src, which is closed by closer
+// if evicted for a newer session.
+func (c *Controller) AdmitUDP(src netip.Addr, closer io.Closer) (*Session, error) {
+	src = src.Unmap()
+	s := &Session{c: c, src: src, closer: closer}
+	s.Touch()
+
+	var victims []*Session
+	c.mu.Lock()
+	if n := c.config.MaxUDPPerSource; n > 0 && c.udpBySource[src] >= n {
+		victim := c.lruLocked(func(v *Session) bool { return v.src == src })
+		if victim == nil {
+			c.mu.Unlock()
+			return nil, c.refuse("udp", ScopeSource)
+		}
+		c.removeLocked(victim)
+		victims = append(victims, victim)
+		evicted.With(ScopeSource).Inc()
+	}
+	if n := c.config.MaxUDP; n > 0 && len(c.udp) >= n {
+		victim := c.lruLocked(func(*Session) bool { return true })
+		if victim == nil {
+			c.mu.Unlock()
+			return nil, c.refuse("udp", ScopeTotal)
+		}
+		c.removeLocked(victim)
+		victims = append(victims, victim)
+		evicted.With(ScopeTotal).Inc()
+	}
+	c.udp[s] = struct{}{}
+	c.udpBySource[src]++
+	c.mu.Unlock()
+
+	// Close outside of lock, as closing may release the session.
+	for _, v := range victims {
+		v.evict()
+	}
+	return s, nil
+}
+
+func (c *Controller) refuse(network, scope string) error {
+	refused.With(network, scope).Inc()
+	return &RefusedError{Network: network, Scope: scope}
+}
+
+// lruLocked returns the least recently active session matched.
+func (c *Controller) lruLocked(match func(*Session) bool) *Session {
+	var lru *Session
+	for s := range c.udp {
+		if match(s) && (lru == nil || s.active.Load() < lru.active.Load()) {
+			lru = s
+		}
+	}
+	return lru
+}
+
+func (c *Controller) removeLocked(s *Session) {
+	if _, ok := c.udp[s]; !ok {
+		return
+	}
+	delete(c.udp, s)
+	if c.udpBySource[s.src]--; c.udpBySource[s.src] <= 0 {
+		delete(c.udpBySource, s.src)
+	}
+}
+
+// Session is an admitted UDP session.
+type Session struct {
+	c      *Controller
+	src    netip.Addr
+	closer io.Closer
+
+	// active is the last time of activity in Unix nanoseconds.
+	active atomic.Int64
+}
+
+// Touch marks s active, delaying its eviction.
+func (s *Session) Touch() {
+	s.active.Store(time.Now().UnixNano())
+}
+
+// Release releases s once it's closed.
+func (s *Session) Release() {
+	s.c.mu.Lock()
+	s.c.removeLocked(s)
+	s.c.mu.Unlock()
+}
+
+func (s *Session) evict() {
+	if s.closer != nil {
+		_ = s.closer.Close()
+	}
+}
@@ -0,0 +1,94 @@
+package admission
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type closer struct {
+	closed bool
+}
+
+func (c *closer) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestAdmitTCP(t *testing.T) {
+	c := New()
+	c.SetConfig(Config{MaxTCP: 3, MaxTCPPerSource: 2})
+	refusedBefore := refused.With("tcp", ScopeSource).Value() + refused.With("tcp", ScopeTotal).Value()
+	a, b := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")
+
+	r1, err := c.AdmitTCP(a)
+	require.NoError(t, err)
+	_, err = c.AdmitTCP(netip.AddrFrom16(a.As16())) // IPv4-mapped
+	require.NoError(t, err)
+
+	_, err = c.AdmitTCP(a)
+	var re *RefusedError
+	require.ErrorAs(t, err, &re)
+	assert.Equal(t, ScopeSource, re.Scope)
+
+	_, err = c.AdmitTCP(b)
+	require.NoError(t, err)
+	_, err = c.AdmitTCP(b)
+	require.ErrorAs(t, err, &re)
+	assert.Equal(t, ScopeTotal, re.Scope)
+
+	r1()
+	r1() // released once
+	tcp, _ := c.Count()
+	assert.Equal(t, 2, tcp)
+	_, err = c.AdmitTCP(a)
+	require.NoError(t, err)
+	assert.Equal(t, refusedBefore+2, refused.With("tcp", ScopeSource).Value()+refused.With("tcp", ScopeTotal).Value())
+}
+
+func TestAdmitUDP(t *testing.T) {
+	c := New()
+	c.SetConfig(Config{MaxUDP: 3, MaxUDPPerSource: 2})
+	sourceBefore, totalBefore := evicted.With(ScopeSource).Value(), evicted.With(ScopeTotal).Value()
+	a, b := netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")
+
+	admit := func(src netip.Addr) (*Session, *closer) {
+		cl := &closer{}
+		s, err := c.AdmitUDP(src, cl)
+		require.NoError(t, err)
+		time.Sleep(time.Millisecond) // order by activity
+		return s, cl
+	}
+
+	a1, a1c := admit(a)
+	_, a2c := admit(a)
+	a1.Touch()
+
+	// The least recently active session of the source is evicted.
+	_, a3c := admit(a)
+	assert.False(t, a1c.closed)
+	assert.True(t, a2c.closed)
+	_, udp := c.Count()
+	assert.Equal(t, 2, udp)
+
+	_, b1c := admit(b)
+	assert.False(t, a1c.closed)
+
+	// The least recently active session of all is evicted.
+	admit(b)
+	assert.True(t, a1c.closed)
+	assert.False(t, a3c.closed)
+	assert.False(t, b1c.closed)
+	_, udp = c.Count()
+	assert.Equal(t, 3, udp)
+
+	// Releasing an evicted session is a no-op.
+	a1.Release()
+	_, udp = c.Count()
+	assert.Equal(t, 3, udp)
+	assert.Equal(t, sourceBefore+1, evicted.With(ScopeSource).Value())
+	assert.Equal(t, totalBefore+1, evicted.With(ScopeTotal).Value())
+}
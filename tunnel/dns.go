@@ -0,0 +1,95 @@
+package tunnel
+
+import (
+	"io"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/xjasonlyu/tun2socks/v2/buffer"
+	"github.com/xjasonlyu/tun2socks/v2/core/adapter"
+	"github.com/xjasonlyu/tun2socks/v2/log"
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+)
+
+const (
+	// dnsPort is the port of DNS queries hijacked by Tunnel.
+	dnsPort = 53
+
+	// maxDNSPending is the maximum number of hijacked DNS queries being
+	// served, beyond which they are dropped.
+	maxDNSPending = 1024
+)
+
+// DNSHandler handles DNS queries hijacked from the netstack.
+type DNSHandler interface {
+	// ServeDNS answers the DNS query message.
+	ServeDNS([]byte) ([]byte, error)
+
+	// LookupHost returns the hostname that ip is mapped to, or an
+	// empty hostname if ip has never been handed out by the handler.
+	LookupHost(netip.Addr) (string, error)
+}
+
+// restoreHost fills the hostname of metadata with the mapping held
+// by DNSHandler, if any.
+func (t *Tunnel) restoreHost(metadata *M.Metadata) error {
+	h := t.DNSHandler()
+	if h == nil {
+		return nil
+	}
+	host, err := h.LookupHost(metadata.DstIP)
+	if err != nil {
+		return err
+	}
+	if host != "" {
+		metadata.Host = host
+	}
+	return nil
+}
+
+// handleDNS answers DNS queries of uc with h until the session times out.
+// Queries are served concurrently, as some of them may be resolved by
+// upstream servers, and dropped once pending, shared by all sessions,
+// is full.
+func handleDNS(uc adapter.UDPConn, h DNSHandler, metadata *M.Metadata, timeout time.Duration, pending chan struct{}) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	log.Debugf("[DNS] hijack %s <-> %s", metadata.SourceAddress(), metadata.DestinationAddress())
+	for {
+		buf := buffer.Get(buffer.MaxSegmentSize)
+		uc.SetReadDeadline(time.Now().Add(timeout))
+		n, err := uc.Read(buf)
+		if err != nil {
+			buffer.Put(buf)
+			if err != io.EOF {
+				log.Debugf("[DNS] read from %s: %v", metadata.SourceAddress(), err)
+			}
+			return
+		}
+
+		select {
+		case pending <- struct{}{}:
+		default:
+			buffer.Put(buf)
+			log.Debugf("[DNS] drop query from %s: too many pending", metadata.SourceAddress())
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-pending }()
+			defer buffer.Put(buf)
+
+			resp, err := h.ServeDNS(buf[:n])
+			if err != nil {
+				log.Debugf("[DNS] serve %s: %v", metadata.SourceAddress(), err)
+				return
+			}
+			if _, err = uc.Write(resp); err != nil {
+				log.Debugf("[DNS] write to %s: %v", metadata.SourceAddress(), err)
+			}
+		}()
+	}
+}
@@ -0,0 +1,75 @@
+package tunnel
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+)
+
+// queryConn reads the queries in order, then EOF.
+type queryConn struct {
+	net.PacketConn
+	queries chan []byte
+}
+
+func (c *queryConn) Read(b []byte) (int, error) {
+	q, ok := <-c.queries
+	if !ok {
+		return 0, io.EOF
+	}
+	return copy(b, q), nil
+}
+
+func (c *queryConn) Write(b []byte) (int, error)      { return len(b), nil }
+func (c *queryConn) Close() error                     { return nil }
+func (c *queryConn) LocalAddr() net.Addr              { return nil }
+func (c *queryConn) RemoteAddr() net.Addr             { return nil }
+func (c *queryConn) SetDeadline(time.Time) error      { return nil }
+func (c *queryConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *queryConn) SetWriteDeadline(time.Time) error { return nil }
+func (c *queryConn) ID() *stack.TransportEndpointID   { return &stack.TransportEndpointID{} }
+
+// blockingDNS serves queries once release is closed.
+type blockingDNS struct {
+	served  atomic.Int32
+	release chan struct{}
+}
+
+func (h *blockingDNS) ServeDNS(b []byte) ([]byte, error) {
+	h.served.Add(1)
+	<-h.release
+	return b, nil
+}
+
+func (h *blockingDNS) LookupHost(netip.Addr) (string, error) { return "", nil }
+
+func TestHandleDNSPending(t *testing.T) {
+	uc := &queryConn{queries: make(chan []byte, 3)}
+	for i := 0; i < 3; i++ {
+		uc.queries <- []byte("query")
+	}
+	close(uc.queries)
+
+	h := &blockingDNS{release: make(chan struct{})}
+	pending := make(chan struct{}, 1)
+	done := make(chan struct{})
+	go func() {
+		handleDNS(uc, h, &M.Metadata{}, time.Minute, pending)
+		close(done)
+	}()
+
+	// The queries beyond the pending one are dropped.
+	assert.Eventually(t, func() bool { return len(uc.queries) == 0 }, time.Second, 10*time.Millisecond)
+	close(h.release)
+	<-done
+	assert.Equal(t, int32(1), h.served.Load())
+	assert.Len(t, pending, 0)
+}
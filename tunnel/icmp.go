@@ -0,0 +1,13 @@
+package tunnel
+
+import (
+	"github.com/xjasonlyu/tun2socks/v2/core/adapter"
+)
+
+var _ adapter.EchoHandler = (*Tunnel)(nil)
+
+// HandleEcho answers the ICMP echo request by the mode of ping.Handler,
+// or leaves it to the stack if the mode is off.
+func (t *Tunnel) HandleEcho(req adapter.EchoRequest) bool {
+	return t.ping.Handle(req)
+}
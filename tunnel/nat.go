@@ -0,0 +1,543 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+
+	"github.com/xjasonlyu/tun2socks/v2/buffer"
+	"github.com/xjasonlyu/tun2socks/v2/core/adapter"
+	"github.com/xjasonlyu/tun2socks/v2/log"
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/tunnel/statistic"
+)
+
+// UDPNAT is the mapping and filtering behavior of UDP sessions, named
+// after the NAT types of RFC 3489.
+type UDPNAT uint8
+
+const (
+	// NATSymmetric dials a remote conn per destination of a source,
+	// which passes the datagrams from that destination only.
+	NATSymmetric UDPNAT = iota
+	// NATFullCone shares a remote conn among all destinations of a
+	// source, which passes the datagrams from any remote.
+	NATFullCone
+	// NATRestricted is NATFullCone passing the datagrams from the
+	// addresses which the source has sent to only, on any port.
+	NATRestricted
+	// NATPortRestricted is NATFullCone passing the datagrams from the
+	// addresses and ports which the source has sent to only.
+	NATPortRestricted
+)
+
+// ParseUDPNAT parses the name of UDPNAT.
+func ParseUDPNAT(s string) (UDPNAT, error) {
+	switch strings.ToLower(s) {
+	case "", "symmetric":
+		return NATSymmetric, nil
+	case "full-cone":
+		return NATFullCone, nil
+	case "restricted":
+		return NATRestricted, nil
+	case "port-restricted":
+		return NATPortRestricted, nil
+	default:
+		return NATSymmetric, fmt.Errorf("invalid udp nat: %s", s)
+	}
+}
+
+func (n UDPNAT) String() string {
+	switch n {
+	case NATSymmetric:
+		return "symmetric"
+	case NATFullCone:
+		return "full-cone"
+	case NATRestricted:
+		return "restricted"
+	case NATPortRestricted:
+		return "port-restricted"
+	default:
+		return fmt.Sprintf("nat(%d)", n)
+	}
+}
+
+// natTable holds the mappings of sources in cone NAT modes.
+type natTable struct {
+	mu sync.Mutex
+	m  map[netip.AddrPort]*natMapping
+}
+
+func newNATTable() *natTable {
+	return &natTable{m: make(map[netip.AddrPort]*natMapping)}
+}
+
+// errNATRoute is returned for the sessions routed to another proxy
+// than the mapping of their source, which are dialed on their own.
+var errNATRoute = errors.New("routed apart from nat mapping")
+
+// mapping returns the mapping of the source of metadata, or creates one
+// with the remote conn dialed by dial, which is reported by created.
+// Concurrent sessions of the source wait for the first one to dial.
+func (nt *natTable) mapping(metadata *M.Metadata, nat UDPNAT, dial func() (net.PacketConn, error)) (m *natMapping, created bool, err error) {
+	src := metadata.SourceAddrPort()
+
+	nt.mu.Lock()
+	m, ok := nt.m[src]
+	if ok && m.route != metadata.Target {
+		nt.mu.Unlock()
+		return nil, false, errNATRoute
+	}
+	if !ok {
+		m = &natMapping{
+			table:     nt,
+			src:       src,
+			nat:       nat,
+			route:     metadata.Target,
+			metadata:  metadata,
+			ready:     make(chan struct{}),
+			legs:      make(map[netip.AddrPort]*natLeg),
+			hostLegs:  make(map[netip.AddrPort]*natLeg),
+			peers:     make(map[netip.AddrPort]struct{}),
+			hostPorts: make(map[uint16]struct{}),
+		}
+		nt.m[src] = m
+	}
+	nt.mu.Unlock()
+
+	if ok {
+		<-m.ready
+		if m.err != nil {
+			return nil, false, m.err
+		}
+		return m, false, nil
+	}
+
+	m.pc, m.err = dial()
+	close(m.ready)
+	if m.err != nil {
+		nt.remove(m)
+		return nil, false, m.err
+	}
+	return m, true, nil
+}
+
+func (nt *natTable) remove(m *natMapping) {
+	nt.mu.Lock()
+	if nt.m[m.src] == m {
+		delete(nt.m, m.src)
+	}
+	nt.mu.Unlock()
+}
+
+// natMapping is the remote conn of a source shared by its sessions to
+// all destinations, i.e. the legs. The datagrams from the remotes which
+// have no legs are sent to the source through new legs opened from the
+// remote addresses, if passed by the filtering of nat.
+type natMapping struct {
+	table *natTable
+	src   netip.AddrPort
+	nat   UDPNAT
+
+	// route is the proxy that the sessions of the mapping are routed
+	// to, and metadata is of the session which dialed the remote conn.
+	route    string
+	metadata *M.Metadata
+
+	// pc is the remote conn, valid once ready is closed without err.
+	ready chan struct{}
+	pc    net.PacketConn
+	err   error
+
+	// lastActive is the time of the last datagram in either direction,
+	// in nanoseconds since the Unix epoch.
+	lastActive atomic.Int64
+
+	mu     sync.Mutex
+	closed bool
+	// dialFrom opens the legs from the remotes, if supported.
+	dialFrom func(netip.AddrPort) (adapter.UDPConn, error)
+	// The legs by the destination address, of which those to hostnames
+	// are kept apart, as their replies are from unknown addresses.
+	legs     map[netip.AddrPort]*natLeg
+	hostLegs map[netip.AddrPort]*natLeg
+	// The destinations sent to by the source, kept for filtering until
+	// the mapping is closed.
+	peers     map[netip.AddrPort]struct{}
+	hostPorts map[uint16]struct{}
+}
+
+// natLeg is a session of a source to a destination in a natMapping.
+type natLeg struct {
+	uc     adapter.UDPConn
+	dst    netip.AddrPort
+	remote net.Addr
+	host   bool
+
+	// pc is the remote conn of the leg over conn, which is tracked
+	// and limited on its own.
+	conn *natLegConn
+	pc   net.PacketConn
+}
+
+// deliver sends the datagram b from the remote conn of the mapping to
+// the source through the leg.
+func (l *natLeg) deliver(b []byte, from net.Addr) error {
+	l.conn.pending, l.conn.from = b, from
+	n, _, err := l.pc.ReadFrom(b)
+	if err != nil {
+		return err
+	}
+	_, err = l.uc.Write(b[:n])
+	return err
+}
+
+// natLegConn writes through the remote conn of a mapping, and reads
+// the datagram handed over by natLeg.deliver, as all the replies are
+// read from the remote conn by serveNATMapping.
+type natLegConn struct {
+	net.PacketConn
+
+	pending []byte
+	from    net.Addr
+}
+
+func (c *natLegConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n := copy(b, c.pending)
+	c.pending = nil
+	return n, c.from, nil
+}
+
+// Close and the deadlines are left to the mapping, as the remote conn
+// is shared by the other legs.
+func (c *natLegConn) Close() error                     { return nil }
+func (c *natLegConn) SetDeadline(time.Time) error      { return nil }
+func (c *natLegConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *natLegConn) SetWriteDeadline(time.Time) error { return nil }
+
+// openLeg sets up the remote conn of l for the session of metadata,
+// which takes the proxy of the mapping.
+func (t *Tunnel) openLeg(m *natMapping, l *natLeg, metadata *M.Metadata) {
+	if metadata != m.metadata {
+		metadata.MidIP, metadata.MidPort = m.metadata.MidIP, m.metadata.MidPort
+		metadata.Proxy = m.metadata.Proxy
+		metadata.ProxyProto = m.metadata.ProxyProto
+		metadata.ProxyAddress = m.metadata.ProxyAddress
+		metadata.Group = m.metadata.Group
+	}
+	l.conn = &natLegConn{PacketConn: m.pc}
+	pc := statistic.NewUDPTracker(l.conn, metadata, t.manager)
+	l.pc = t.limiter.PacketConn(pc, trackerID(pc), metadata)
+}
+
+func (m *natMapping) touch() {
+	m.lastActive.Store(time.Now().UnixNano())
+}
+
+// add adds l to the mapping, or returns false if it's closed.
+func (m *natMapping) add(l *natLeg) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return false
+	}
+	if m.dialFrom == nil {
+		if cc, ok := l.uc.(adapter.ConeUDPConn); ok {
+			m.dialFrom = cc.DialFrom
+		}
+	}
+	if l.host {
+		m.hostLegs[l.dst] = l
+		m.hostPorts[l.dst.Port()] = struct{}{}
+	} else {
+		m.legs[l.dst] = l
+		m.peers[l.dst] = struct{}{}
+	}
+	return true
+}
+
+func (m *natMapping) remove(l *natLeg) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if l.host {
+		if m.hostLegs[l.dst] == l {
+			delete(m.hostLegs, l.dst)
+		}
+	} else if m.legs[l.dst] == l {
+		delete(m.legs, l.dst)
+	}
+}
+
+// lookup returns the leg to send the datagram from addr through, and
+// whether a new leg may be opened from addr if there is none.
+func (m *natMapping) lookup(addr netip.AddrPort) (*natLeg, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if l := m.legs[addr]; l != nil {
+		return l, true
+	}
+
+	// The replies of hostnames are told apart by their ports only, so
+	// they are dropped if there are several legs on the port, rather
+	// than sent from the fake address of another hostname.
+	var (
+		hl *natLeg
+		n  int
+	)
+	for dst, l := range m.hostLegs {
+		if dst.Port() == addr.Port() {
+			hl = l
+			n++
+		}
+	}
+	if n == 1 {
+		return hl, true
+	} else if n > 1 {
+		return nil, false
+	}
+
+	switch m.nat {
+	case NATFullCone:
+		return nil, true
+	case NATRestricted:
+		for peer := range m.peers {
+			if peer.Addr() == addr.Addr() {
+				return nil, true
+			}
+		}
+	case NATPortRestricted:
+		if _, ok := m.peers[addr]; ok {
+			return nil, true
+		}
+	}
+	// Hostnames are resolved by the proxy, so their addresses are
+	// unknown and only their ports are checked.
+	_, ok := m.hostPorts[addr.Port()]
+	return nil, ok
+}
+
+// close closes the remote conn, and stops all the legs.
+func (m *natMapping) close() {
+	m.table.remove(m)
+
+	m.mu.Lock()
+	m.closed = true
+	for _, l := range m.legs {
+		l.uc.SetReadDeadline(time.Now())
+	}
+	for _, l := range m.hostLegs {
+		l.uc.SetReadDeadline(time.Now())
+	}
+	m.mu.Unlock()
+
+	m.pc.Close()
+}
+
+// handleConeUDPConn handles uc as a leg of the mapping of its source,
+// which is created with the remote conn dialed for uc if there is none.
+// The sessions routed to another proxy than the mapping are handled in
+// symmetric NAT instead.
+func (t *Tunnel) handleConeUDPConn(uc adapter.UDPConn, metadata *M.Metadata, peeked [][]byte, nat UDPNAT) {
+	d := t.Dialer()
+	if r, ok := d.(router); ok {
+		p, err := r.Route(metadata)
+		if err != nil {
+			log.Warnf("[UDP] dial %s: %v", metadata.DestinationAddress(), err)
+			t.manager.Failed(metadata, time.Now(), err)
+			return
+		}
+		d = p
+	}
+
+	timeout := t.udpTimeout.Load()
+	l := &natLeg{
+		uc:     uc,
+		dst:    metadata.DestinationAddrPort(),
+		remote: udpRemote(metadata),
+		host:   metadata.Host != "",
+	}
+
+	for {
+		m, created, err := t.nat.mapping(metadata, nat, func() (net.PacketConn, error) {
+			start := time.Now()
+			pc, err := d.DialUDP(metadata)
+			if err != nil {
+				log.Warnf("[UDP] dial %s: %v", metadata.DestinationAddress(), err)
+				t.manager.Failed(metadata, start, err)
+				return nil, err
+			}
+			metadata.MidIP, metadata.MidPort = parseNetAddr(pc.LocalAddr())
+			log.Debugf("[UDP] %s NAT map %s", nat, metadata.SourceAddress())
+			return pc, nil
+		})
+		if errors.Is(err, errNATRoute) {
+			t.handleSymmetricUDPConn(uc, metadata, peeked, d)
+			return
+		} else if err != nil {
+			return
+		}
+		t.openLeg(m, l, metadata)
+		if !m.add(l) {
+			// The mapping has just been closed, so retry with a new one.
+			l.pc.Close()
+			continue
+		}
+		defer l.pc.Close()
+		defer m.remove(l)
+		if created {
+			// Serve the remote conn once the first leg is added, so
+			// that its replies are filtered through.
+			m.touch()
+			go t.serveNATMapping(m, timeout)
+		}
+
+		// Replay the sniffed datagrams to remote.
+		for _, b := range peeked {
+			if _, err = l.pc.WriteTo(b, l.remote); err != nil {
+				log.Warnf("[UDP] write to %s: %v", metadata.DestinationAddress(), err)
+				return
+			}
+		}
+
+		log.Infof("[UDP] %s <-> %s", metadata.SourceAddress(), metadata.DestinationAddress())
+		serveNATLeg(m, l, timeout)
+		return
+	}
+}
+
+// serveNATLeg sends the datagrams of l to its destination through the
+// remote conn, until l times out or the mapping is closed.
+func serveNATLeg(m *natMapping, l *natLeg, timeout time.Duration) {
+	buf := buffer.Get(buffer.MaxSegmentSize)
+	defer buffer.Put(buf)
+
+	for {
+		l.uc.SetReadDeadline(time.Now().Add(timeout))
+		n, err := l.uc.Read(buf)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return /* ignore I/O timeout */
+		} else if err == io.EOF {
+			return /* ignore EOF */
+		} else if err != nil {
+			log.Debugf("[UDP] read from %s: %v", m.src, err)
+			return
+		}
+
+		if _, err = l.pc.WriteTo(buf[:n], l.remote); err != nil {
+			log.Debugf("[UDP] write to %s: %v", l.remote, err)
+			return
+		}
+		m.touch()
+	}
+}
+
+// serveNATMapping sends the datagrams from the remote conn of m to the
+// source, until there are none in either direction within timeout.
+func (t *Tunnel) serveNATMapping(m *natMapping, timeout time.Duration) {
+	defer m.close()
+
+	buf := buffer.Get(buffer.MaxSegmentSize)
+	defer buffer.Put(buf)
+
+	for {
+		m.pc.SetReadDeadline(time.Now().Add(timeout))
+		n, from, err := m.pc.ReadFrom(buf)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			if time.Since(time.Unix(0, m.lastActive.Load())) < timeout {
+				continue
+			}
+			return
+		} else if err == io.EOF || errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			log.Debugf("[UDP] read from remote of %s: %v", m.src, err)
+			return
+		}
+		m.touch()
+
+		ip, port := parseNetAddr(from)
+		addr := netip.AddrPortFrom(ip.Unmap(), port)
+		l, ok := m.lookup(addr)
+		if l == nil && ok && ip.IsValid() {
+			l = t.openNATLeg(m, addr, timeout)
+		}
+		if l == nil {
+			log.Debugf("[UDP] %s NAT %s: drop packet from %s", m.nat, m.src, from)
+			continue
+		}
+		if err = l.deliver(buf[:n], from); err != nil {
+			log.Debugf("[UDP] write to %s: %v", m.src, err)
+			continue
+		}
+		l.uc.SetReadDeadline(time.Now().Add(timeout))
+	}
+}
+
+// openNATLeg opens a leg of m from addr, if it's allowed by ACL and
+// admitted, which is then served like the others.
+func (t *Tunnel) openNATLeg(m *natMapping, addr netip.AddrPort, timeout time.Duration) *natLeg {
+	m.mu.Lock()
+	dialFrom := m.dialFrom
+	m.mu.Unlock()
+	if dialFrom == nil {
+		return nil
+	}
+
+	id := &stack.TransportEndpointID{
+		LocalPort:     addr.Port(),
+		LocalAddress:  tcpip.AddrFromSlice(addr.Addr().AsSlice()),
+		RemotePort:    m.src.Port(),
+		RemoteAddress: tcpip.AddrFromSlice(m.src.Addr().AsSlice()),
+	}
+	if action := t.filter(M.UDP, id); action != adapter.ActionAccept && action != adapter.ActionDefer {
+		return nil
+	}
+
+	uc, err := dialFrom(addr)
+	if err != nil {
+		log.Debugf("[UDP] %s NAT %s: open from %s: %v", m.nat, m.src, addr, err)
+		return nil
+	}
+	s, err := t.admission.AdmitUDP(m.src.Addr(), uc)
+	if err != nil {
+		log.Debugf("[UDP] refuse %s from %s: %v", m.src, addr, err)
+		uc.Close()
+		return nil
+	}
+
+	// The leg is of the same route as the mapping, from addr.
+	metadata := *m.metadata
+	metadata.DstIP, metadata.DstPort = addr.Addr(), addr.Port()
+	metadata.Host, metadata.Protocol = "", ""
+	l := &natLeg{
+		uc:     &admittedUDPConn{UDPConn: uc, session: s},
+		dst:    addr,
+		remote: net.UDPAddrFromAddrPort(addr),
+	}
+	t.openLeg(m, l, &metadata)
+	if !m.add(l) {
+		l.pc.Close()
+		s.Release()
+		uc.Close()
+		return nil
+	}
+	go func() {
+		defer s.Release()
+		defer uc.Close()
+		defer l.pc.Close()
+		defer m.remove(l)
+
+		log.Infof("[UDP] %s <-> %s", m.src, addr)
+		serveNATLeg(m, l, timeout)
+	}()
+	return l
+}
@@ -0,0 +1,158 @@
+package tunnel
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/tunnel/statistic"
+)
+
+func TestParseUDPNAT(t *testing.T) {
+	for _, n := range []UDPNAT{NATSymmetric, NATFullCone, NATRestricted, NATPortRestricted} {
+		got, err := ParseUDPNAT(n.String())
+		require.NoError(t, err)
+		assert.Equal(t, n, got)
+	}
+	_, err := ParseUDPNAT("cone")
+	assert.Error(t, err)
+}
+
+func TestNATFiltering(t *testing.T) {
+	var (
+		src      = netip.MustParseAddrPort("10.0.0.1:12345")
+		peer     = netip.MustParseAddrPort("192.0.2.1:3478")
+		peerPort = netip.MustParseAddrPort("192.0.2.1:5000")
+		other    = netip.MustParseAddrPort("198.51.100.1:3478")
+		// The fake IP of a hostname, and one of its real addresses.
+		fakeIP  = netip.MustParseAddrPort("198.18.0.1:443")
+		fakeIP2 = netip.MustParseAddrPort("198.18.0.2:443")
+		realIP  = netip.MustParseAddrPort("203.0.113.1:443")
+	)
+
+	for _, tt := range []struct {
+		nat             UDPNAT
+		peerPort, other bool
+	}{
+		{NATFullCone, true, true},
+		{NATRestricted, true, false},
+		{NATPortRestricted, false, false},
+	} {
+		t.Run(tt.nat.String(), func(t *testing.T) {
+			nt := newNATTable()
+			m, created, err := nt.mapping(&M.Metadata{SrcIP: src.Addr(), SrcPort: src.Port()}, tt.nat, func() (net.PacketConn, error) { return nil, nil })
+			require.NoError(t, err)
+			assert.True(t, created)
+
+			// Sessions of src share the mapping.
+			m2, created, err := nt.mapping(&M.Metadata{SrcIP: src.Addr(), SrcPort: src.Port()}, NATSymmetric, nil)
+			require.NoError(t, err)
+			assert.False(t, created)
+			assert.Same(t, m, m2)
+
+			l := &natLeg{dst: peer}
+			hl := &natLeg{dst: fakeIP, host: true}
+			require.True(t, m.add(l))
+			require.True(t, m.add(hl))
+
+			got, ok := m.lookup(peer)
+			assert.Same(t, l, got)
+			assert.True(t, ok)
+
+			got, ok = m.lookup(peerPort)
+			assert.Nil(t, got)
+			assert.Equal(t, tt.peerPort, ok)
+
+			got, ok = m.lookup(other)
+			assert.Nil(t, got)
+			assert.Equal(t, tt.other, ok)
+
+			// Replies from a hostname are sent through its leg.
+			got, ok = m.lookup(realIP)
+			assert.Same(t, hl, got)
+			assert.True(t, ok)
+
+			// Replies from a hostname on a port shared by another one
+			// can't be told apart.
+			hl2 := &natLeg{dst: fakeIP2, host: true}
+			require.True(t, m.add(hl2))
+			got, ok = m.lookup(realIP)
+			assert.Nil(t, got)
+			assert.False(t, ok)
+			m.remove(hl)
+			got, ok = m.lookup(realIP)
+			assert.Same(t, hl2, got)
+			assert.True(t, ok)
+
+			// The destinations sent to are still passed after their
+			// legs are removed.
+			m.remove(l)
+			m.remove(hl2)
+			got, ok = m.lookup(peer)
+			assert.Nil(t, got)
+			assert.True(t, ok)
+			_, ok = m.lookup(realIP)
+			assert.True(t, ok)
+		})
+	}
+}
+
+func TestNATRoute(t *testing.T) {
+	src := netip.MustParseAddrPort("10.0.0.1:12345")
+	metadata := func(target string) *M.Metadata {
+		return &M.Metadata{SrcIP: src.Addr(), SrcPort: src.Port(), Target: target}
+	}
+
+	nt := newNATTable()
+	m, created, err := nt.mapping(metadata("a"), NATFullCone, func() (net.PacketConn, error) { return nil, nil })
+	require.NoError(t, err)
+	assert.True(t, created)
+
+	got, _, err := nt.mapping(metadata("a"), NATFullCone, nil)
+	require.NoError(t, err)
+	assert.Same(t, m, got)
+
+	// Sessions routed to another proxy are not mapped.
+	_, _, err = nt.mapping(metadata("b"), NATFullCone, nil)
+	assert.ErrorIs(t, err, errNATRoute)
+}
+
+func TestNATLegTracking(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer peer.Close()
+
+	tun := New(nil, statistic.DefaultManager)
+	first := &M.Metadata{Network: M.UDP, Rule: "nat-leg-a", Target: "p", Proxy: "nat-leg-p", ProxyProto: "socks5"}
+	nt := newNATTable()
+	m, _, err := nt.mapping(first, NATFullCone, func() (net.PacketConn, error) { return pc, nil })
+	require.NoError(t, err)
+
+	second := &M.Metadata{Network: M.UDP, Rule: "nat-leg-b", Target: "p"}
+	la, lb := &natLeg{}, &natLeg{}
+	tun.openLeg(m, la, first)
+	tun.openLeg(m, lb, second)
+	defer la.pc.Close()
+	defer lb.pc.Close()
+	// The legs joining the mapping take its proxy.
+	assert.Equal(t, "nat-leg-p", second.Proxy)
+
+	_, err = lb.pc.WriteTo([]byte("hello"), peer.LocalAddr())
+	require.NoError(t, err)
+	buf := make([]byte, 16)
+	n, _, err := peer.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf[:n]))
+
+	snapshot := statistic.DefaultManager.Snapshot()
+	assert.Zero(t, snapshot.Rules["nat-leg-a"].Upload.Load())
+	assert.EqualValues(t, 5, snapshot.Rules["nat-leg-b"].Upload.Load())
+	assert.EqualValues(t, 5, snapshot.Proxies["nat-leg-p"].Upload.Load())
+}
@@ -0,0 +1,400 @@
+// Package ping answers ICMP echo requests to tunneled destinations,
+// which proxies can't carry.
+package ping
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip"
+
+	"github.com/xjasonlyu/tun2socks/v2/core/adapter"
+	"github.com/xjasonlyu/tun2socks/v2/log"
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/metrics"
+	"github.com/xjasonlyu/tun2socks/v2/proxy"
+	"github.com/xjasonlyu/tun2socks/v2/tunnel/acl"
+)
+
+const (
+	// DefaultTimeout is the default timeout of forwarded echoes and
+	// TCP probes.
+	DefaultTimeout = 3 * time.Second
+
+	// maxPending is the maximum number of echo requests waiting for
+	// replies, beyond which they are dropped.
+	maxPending = 1024
+
+	// probeCacheTTL is how long the result of a TCP probe is reused
+	// for the echo requests to the same destination.
+	probeCacheTTL = 10 * time.Second
+
+	// maxProbeCache is the maximum number of cached probe results.
+	maxProbeCache = 4096
+)
+
+// DefaultProbePorts are the default ports of TCP probes.
+var DefaultProbePorts = []uint16{443, 80}
+
+var echoes = metrics.NewCounterVec("tun2socks_icmp_echo_total",
+	"ICMP echo requests handled by mode and result.", "mode", "result")
+
+// Results of echo requests.
+const (
+	resultReply   = "reply"
+	resultTimeout = "timeout"
+	resultDropped = "dropped"
+	resultDenied  = "denied"
+)
+
+// Mode is how echo requests are answered.
+type Mode uint8
+
+const (
+	// Off leaves echo requests to the stack.
+	Off Mode = iota
+	// Local replies to every echo request locally.
+	Local
+	// Forward forwards echo requests through unprivileged ICMP
+	// datagram sockets bound like the direct dialer.
+	Forward
+	// Probe replies if the destination accepts TCP connections
+	// through the proxy.
+	Probe
+)
+
+// ParseMode parses the name of Mode.
+func ParseMode(s string) (Mode, error) {
+	switch strings.ToLower(s) {
+	case "", "off":
+		return Off, nil
+	case "local":
+		return Local, nil
+	case "forward":
+		return Forward, nil
+	case "probe":
+		return Probe, nil
+	default:
+		return Off, fmt.Errorf("invalid icmp mode: %s", s)
+	}
+}
+
+func (m Mode) String() string {
+	switch m {
+	case Off:
+		return "off"
+	case Local:
+		return "local"
+	case Forward:
+		return "forward"
+	case Probe:
+		return "probe"
+	default:
+		return fmt.Sprintf("mode(%d)", m)
+	}
+}
+
+func (m Mode) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// Config configures Handler.
+type Config struct {
+	Mode Mode
+	// Timeout of forwarded echoes and TCP probes, DefaultTimeout if zero.
+	Timeout time.Duration
+	// ProbePorts are tried in order by TCP probes, DefaultProbePorts
+	// if empty.
+	ProbePorts []uint16
+}
+
+// Stats are the counters of echo requests since start.
+type Stats struct {
+	Requests uint64 `json:"requests"`
+	Replies  uint64 `json:"replies"`
+	Timeouts uint64 `json:"timeouts"`
+	Dropped  uint64 `json:"dropped"`
+	Denied   uint64 `json:"denied"`
+	// AverageRTT is the average round-trip time of the forwarded
+	// echoes and TCP probes replied, in milliseconds.
+	AverageRTT float64 `json:"averageRTT"`
+}
+
+// Handler answers echo requests by Config.
+type Handler struct {
+	config atomic.Pointer[Config]
+
+	// dialer returns the dialer of TCP probes, listen opens the ICMP
+	// datagram sockets to forward echoes, and check decides on the
+	// destinations of echoes and probes by the ACL.
+	dialer func() proxy.Dialer
+	listen func(network string) (net.PacketConn, error)
+	check  func(*M.Metadata) acl.Decision
+
+	pending chan struct{}
+
+	requests, replies, timeouts, dropped, denied atomic.Uint64
+	rttCount, rttSum                             atomic.Uint64
+
+	mu     sync.Mutex
+	probes map[netip.Addr]probeResult
+}
+
+type probeResult struct {
+	ok      bool
+	expires time.Time
+}
+
+// New creates a Handler in Off mode, which probes through the dialer
+// returned by dialer, forwards echoes through the sockets opened by
+// listen, and answers only the echoes allowed by check.
+func New(dialer func() proxy.Dialer, listen func(string) (net.PacketConn, error), check func(*M.Metadata) acl.Decision) *Handler {
+	h := &Handler{
+		dialer:  dialer,
+		listen:  listen,
+		check:   check,
+		pending: make(chan struct{}, maxPending),
+		probes:  make(map[netip.Addr]probeResult),
+	}
+	h.config.Store(&Config{})
+	return h
+}
+
+// Config returns the current Config.
+func (h *Handler) Config() Config {
+	return *h.config.Load()
+}
+
+// SetConfig replaces the Config, which applies to new requests only.
+func (h *Handler) SetConfig(config Config) {
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeout
+	}
+	if len(config.ProbePorts) == 0 {
+		config.ProbePorts = DefaultProbePorts
+	}
+	h.config.Store(&config)
+
+	h.mu.Lock()
+	clear(h.probes)
+	h.mu.Unlock()
+}
+
+// Stats returns the counters of echo requests.
+func (h *Handler) Stats() Stats {
+	s := Stats{
+		Requests: h.requests.Load(),
+		Replies:  h.replies.Load(),
+		Timeouts: h.timeouts.Load(),
+		Dropped:  h.dropped.Load(),
+		Denied:   h.denied.Load(),
+	}
+	if n := h.rttCount.Load(); n > 0 {
+		s.AverageRTT = float64(time.Duration(h.rttSum.Load()/n)) / float64(time.Millisecond)
+	}
+	return s
+}
+
+// Handle answers req without blocking, or returns false to leave it
+// to the stack in Off mode.
+func (h *Handler) Handle(req adapter.EchoRequest) bool {
+	config := h.config.Load()
+	switch config.Mode {
+	case Local, Forward, Probe:
+		h.requests.Add(1)
+	default:
+		return false
+	}
+
+	id := req.ID()
+	metadata := &M.Metadata{
+		Network: M.ICMP,
+		SrcIP:   parseAddress(id.RemoteAddress),
+		DstIP:   parseAddress(id.LocalAddress),
+	}
+	if d := h.check(metadata); d.Deny {
+		h.deny(config.Mode, req, metadata, d)
+		return true
+	}
+	if config.Mode == Local {
+		h.reply(config.Mode, req, 0)
+		return true
+	}
+
+	select {
+	case h.pending <- struct{}{}:
+	default:
+		h.dropped.Add(1)
+		echoes.With(config.Mode.String(), resultDropped).Inc()
+		return true
+	}
+	go func() {
+		defer func() { <-h.pending }()
+
+		var (
+			rtt time.Duration
+			err error
+		)
+		if config.Mode == Forward {
+			rtt, err = h.forward(config, req)
+		} else {
+			rtt, err = h.probe(config, req)
+		}
+		if err != nil {
+			h.timeouts.Add(1)
+			echoes.With(config.Mode.String(), resultTimeout).Inc()
+			id := req.ID()
+			log.Debugf("[ICMP] %s echo %s -> %s: %v", config.Mode, id.RemoteAddress, id.LocalAddress, err)
+			return
+		}
+		h.reply(config.Mode, req, rtt)
+	}()
+	return true
+}
+
+// deny refuses req denied by the ACL, replying ICMP unreachable unless
+// the action is to drop.
+func (h *Handler) deny(mode Mode, req adapter.EchoRequest, metadata *M.Metadata, d acl.Decision) {
+	log.Infof("[ACL] deny %s %s -> %s by %s: %s", metadata.Network,
+		metadata.SrcIP, metadata.DstIP, d.Reason, d.Action)
+	h.denied.Add(1)
+	echoes.With(mode.String(), resultDenied).Inc()
+
+	if d.Action == acl.Drop {
+		return
+	}
+	if err := req.Unreachable(); err != nil {
+		log.Debugf("[ICMP] unreachable %s -> %s: %v", metadata.DstIP, metadata.SrcIP, err)
+	}
+}
+
+func (h *Handler) reply(mode Mode, req adapter.EchoRequest, rtt time.Duration) {
+	if err := req.Reply(); err != nil {
+		id := req.ID()
+		log.Debugf("[ICMP] reply %s -> %s: %v", id.LocalAddress, id.RemoteAddress, err)
+		return
+	}
+	h.replies.Add(1)
+	if rtt > 0 {
+		h.rttCount.Add(1)
+		h.rttSum.Add(uint64(rtt))
+	}
+	echoes.With(mode.String(), resultReply).Inc()
+}
+
+// forward sends req to its destination through an ICMP datagram socket,
+// and waits for the reply.
+func (h *Handler) forward(config *Config, req adapter.EchoRequest) (time.Duration, error) {
+	dst := parseAddress(req.ID().LocalAddress)
+
+	var (
+		network = "udp4"
+		proto   = 1 // ICMPv4
+		msg     = icmp.Message{Type: ipv4.ICMPTypeEcho}
+	)
+	if dst.Is6() {
+		network, proto = "udp6", 58 // ICMPv6
+		msg.Type = ipv6.ICMPTypeEchoRequest
+	}
+	msg.Body = &icmp.Echo{ID: int(req.Ident()), Seq: int(req.Seq()), Data: req.Payload()}
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+
+	pc, err := h.listen(network)
+	if err != nil {
+		return 0, err
+	}
+	defer pc.Close()
+
+	start := time.Now()
+	pc.SetDeadline(start.Add(config.Timeout))
+	if _, err = pc.WriteTo(b, &net.UDPAddr{IP: dst.AsSlice()}); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, len(b)+512)
+	for {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			return 0, err
+		}
+		reply, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil {
+			continue
+		}
+		if echo, ok := reply.Body.(*icmp.Echo); ok && echo.Seq == int(req.Seq()) &&
+			(reply.Type == ipv4.ICMPTypeEchoReply || reply.Type == ipv6.ICMPTypeEchoReply) {
+			return time.Since(start), nil
+		}
+	}
+}
+
+// probe dials the destination of req through the proxy on the probe
+// ports in order, replying if any of them succeeds. The results are
+// cached for a while for the following requests.
+func (h *Handler) probe(config *Config, req adapter.EchoRequest) (time.Duration, error) {
+	id := req.ID()
+	src, dst := parseAddress(id.RemoteAddress), parseAddress(id.LocalAddress)
+
+	now := time.Now()
+	h.mu.Lock()
+	r, ok := h.probes[dst]
+	h.mu.Unlock()
+	if ok && now.Before(r.expires) {
+		if !r.ok {
+			return 0, errors.New("probe failed")
+		}
+		return 0, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.Timeout)
+	defer cancel()
+
+	var err error
+	for _, port := range config.ProbePorts {
+		metadata := &M.Metadata{
+			Network: M.TCP,
+			SrcIP:   src,
+			DstIP:   dst,
+			DstPort: port,
+			Probe:   true,
+		}
+		if d := h.check(metadata); d.Deny {
+			err = fmt.Errorf("port %d denied by %s", port, d.Reason)
+			continue
+		}
+
+		var c net.Conn
+		c, err = h.dialer().DialContext(ctx, metadata)
+		if err == nil {
+			c.Close()
+			break
+		}
+	}
+	rtt := time.Since(now)
+
+	h.mu.Lock()
+	if len(h.probes) >= maxProbeCache {
+		clear(h.probes)
+	}
+	h.probes[dst] = probeResult{ok: err == nil, expires: now.Add(probeCacheTTL)}
+	h.mu.Unlock()
+	return rtt, err
+}
+
+func parseAddress(addr tcpip.Address) netip.Addr {
+	ip, _ := netip.AddrFromSlice(addr.AsSlice())
+	return ip
+}
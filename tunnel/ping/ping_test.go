@@ -0,0 +1,171 @@
+package ping
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/proxy"
+	"github.com/xjasonlyu/tun2socks/v2/tunnel/acl"
+)
+
+type fakeRequest struct {
+	id          stack.TransportEndpointID
+	replied     chan struct{}
+	unreachable chan struct{}
+}
+
+func newRequest() *fakeRequest {
+	return &fakeRequest{
+		id: stack.TransportEndpointID{
+			LocalAddress:  tcpip.AddrFrom4([4]byte{1, 1, 1, 1}),
+			RemoteAddress: tcpip.AddrFrom4([4]byte{10, 0, 0, 1}),
+		},
+		replied:     make(chan struct{}, 1),
+		unreachable: make(chan struct{}, 1),
+	}
+}
+
+func (r *fakeRequest) ID() *stack.TransportEndpointID { return &r.id }
+func (r *fakeRequest) Ident() uint16                  { return 1 }
+func (r *fakeRequest) Seq() uint16                    { return 1 }
+func (r *fakeRequest) Payload() []byte                { return nil }
+func (r *fakeRequest) Reply() error                   { r.replied <- struct{}{}; return nil }
+func (r *fakeRequest) Unreachable() error             { r.unreachable <- struct{}{}; return nil }
+
+func (r *fakeRequest) wait() bool {
+	select {
+	case <-r.replied:
+		return true
+	case <-time.After(time.Second):
+		return false
+	}
+}
+
+type fakeDialer struct {
+	open  map[uint16]bool
+	dials chan *M.Metadata
+}
+
+func (d *fakeDialer) DialContext(_ context.Context, metadata *M.Metadata) (net.Conn, error) {
+	d.dials <- metadata
+	if !d.open[metadata.DstPort] {
+		return nil, errors.New("refused")
+	}
+	c, _ := net.Pipe()
+	return c, nil
+}
+
+func (d *fakeDialer) DialUDP(*M.Metadata) (net.PacketConn, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func newHandler(d *fakeDialer, config Config) *Handler {
+	return newHandlerACL(d, config, acl.New())
+}
+
+func newHandlerACL(d *fakeDialer, config Config, a *acl.ACL) *Handler {
+	h := New(func() proxy.Dialer { return d }, func(string) (net.PacketConn, error) {
+		return nil, errors.ErrUnsupported
+	}, a.Check)
+	h.SetConfig(config)
+	return h
+}
+
+func TestParseMode(t *testing.T) {
+	for _, m := range []Mode{Off, Local, Forward, Probe} {
+		got, err := ParseMode(m.String())
+		require.NoError(t, err)
+		assert.Equal(t, m, got)
+	}
+	_, err := ParseMode("bogus")
+	assert.Error(t, err)
+}
+
+func TestOffAndLocal(t *testing.T) {
+	h := newHandler(nil, Config{})
+	assert.False(t, h.Handle(newRequest()))
+	assert.Equal(t, uint64(0), h.Stats().Requests)
+
+	h.SetConfig(Config{Mode: Local})
+	r := newRequest()
+	assert.True(t, h.Handle(r))
+	assert.True(t, r.wait())
+	assert.Equal(t, Stats{Requests: 1, Replies: 1}, h.Stats())
+}
+
+func TestProbe(t *testing.T) {
+	d := &fakeDialer{open: map[uint16]bool{80: true}, dials: make(chan *M.Metadata, 8)}
+	h := newHandler(d, Config{Mode: Probe, ProbePorts: []uint16{443, 80}})
+
+	r := newRequest()
+	assert.True(t, h.Handle(r))
+	assert.True(t, r.wait())
+	assert.Equal(t, uint16(443), (<-d.dials).DstPort)
+	m := <-d.dials
+	assert.Equal(t, M.TCP, m.Network)
+	assert.True(t, m.Probe)
+	assert.Equal(t, "1.1.1.1:80", m.DestinationAddress())
+
+	// The result is cached.
+	r = newRequest()
+	assert.True(t, h.Handle(r))
+	assert.True(t, r.wait())
+	assert.Len(t, d.dials, 0)
+
+	d.open = nil
+	h.SetConfig(Config{Mode: Probe})
+	r = newRequest()
+	assert.True(t, h.Handle(r))
+	assert.False(t, r.wait())
+	assert.Equal(t, uint64(3), h.Stats().Requests)
+	assert.Equal(t, uint64(2), h.Stats().Replies)
+	assert.Equal(t, uint64(1), h.Stats().Timeouts)
+}
+
+func TestDeny(t *testing.T) {
+	a := acl.New()
+	require.NoError(t, a.SetConfig(acl.Config{
+		Rules: []acl.Rule{
+			{Deny: true, Action: acl.Unreachable, Networks: []M.Network{M.ICMP},
+				Prefixes: []netip.Prefix{netip.MustParsePrefix("1.1.1.1/32")}},
+			{Deny: true, Networks: []M.Network{M.TCP}, Ports: []acl.PortRange{{From: 443, To: 443}}},
+		},
+	}))
+	d := &fakeDialer{open: map[uint16]bool{443: true, 80: true}, dials: make(chan *M.Metadata, 8)}
+	h := newHandlerACL(d, Config{Mode: Local}, a)
+
+	r := newRequest()
+	assert.True(t, h.Handle(r))
+	assert.False(t, r.wait())
+	assert.Len(t, r.unreachable, 1)
+	assert.Equal(t, Stats{Requests: 1, Denied: 1}, h.Stats())
+
+	// Denied echoes are dropped silently by Drop.
+	cfg := a.Config()
+	cfg.Rules[0].Action = acl.Drop
+	require.NoError(t, a.SetConfig(cfg))
+	r = newRequest()
+	assert.True(t, h.Handle(r))
+	assert.False(t, r.wait())
+	assert.Len(t, r.unreachable, 0)
+
+	// Probes skip the denied ports.
+	cfg.Rules = cfg.Rules[1:]
+	require.NoError(t, a.SetConfig(cfg))
+	h.SetConfig(Config{Mode: Probe, ProbePorts: []uint16{443, 80}})
+	r = newRequest()
+	assert.True(t, h.Handle(r))
+	assert.True(t, r.wait())
+	assert.Equal(t, uint16(80), (<-d.dials).DstPort)
+	assert.Len(t, d.dials, 0)
+}
@@ -0,0 +1,91 @@
+package ratelimit
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+)
+
+// Conn wraps the remote conn of a tunneled connection of id, so that
+// writes are limited as upload and reads as download.
+func (l *Limiter) Conn(c net.Conn, id string, metadata *M.Metadata) net.Conn {
+	return &conn{Conn: c, flow: l.open(id, metadata)}
+}
+
+// PacketConn wraps the remote packet conn of a tunneled session of
+// id, so that writes are limited as upload and reads as download.
+func (l *Limiter) PacketConn(pc net.PacketConn, id string, metadata *M.Metadata) net.PacketConn {
+	return &packetConn{PacketConn: pc, flow: l.open(id, metadata)}
+}
+
+type conn struct {
+	net.Conn
+	flow *flow
+	once sync.Once
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		if werr := c.flow.waitDown(n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	if err := c.flow.waitUp(len(b)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *conn) Close() error {
+	c.once.Do(c.flow.close)
+	return c.Conn.Close()
+}
+
+func (c *conn) CloseRead() error {
+	if cr, ok := c.Conn.(interface{ CloseRead() error }); ok {
+		return cr.CloseRead()
+	}
+	return errors.New("CloseRead is not implemented")
+}
+
+func (c *conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("CloseWrite is not implemented")
+}
+
+type packetConn struct {
+	net.PacketConn
+	flow *flow
+	once sync.Once
+}
+
+func (pc *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := pc.PacketConn.ReadFrom(b)
+	if n > 0 {
+		if werr := pc.flow.waitDown(n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, addr, err
+}
+
+func (pc *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if err := pc.flow.waitUp(len(b)); err != nil {
+		return 0, err
+	}
+	return pc.PacketConn.WriteTo(b, addr)
+}
+
+func (pc *packetConn) Close() error {
+	pc.once.Do(pc.flow.close)
+	return pc.PacketConn.Close()
+}
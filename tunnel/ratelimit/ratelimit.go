@@ -0,0 +1,298 @@
+// Package ratelimit shapes the bandwidth of tunneled connections with
+// token buckets at global, per source IP, per proxy and per connection
+// scopes, which can be changed while connections are running.
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/time/rate"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+)
+
+// minBurst is the minimum burst of buckets, which must hold the
+// largest UDP datagram.
+const minBurst = 64 << 10
+
+// ErrNotFound is returned when a connection is not found.
+var ErrNotFound = errors.New("connection not found")
+
+// Limit is a pair of bandwidth limits in bytes per second, where zero
+// means unlimited.
+type Limit struct {
+	Up   int64 `json:"up"`
+	Down int64 `json:"down"`
+}
+
+// IsZero reports whether l is unlimited in both directions.
+func (l Limit) IsZero() bool {
+	return l.Up <= 0 && l.Down <= 0
+}
+
+// SourceLimit overrides PerSource of Config for the sources within
+// Prefix, each of which still has its own buckets.
+type SourceLimit struct {
+	Prefix netip.Prefix `json:"prefix"`
+	Limit
+}
+
+// Config is the bandwidth limits of each scope.
+type Config struct {
+	// Global limits all connections together.
+	Global Limit `json:"global"`
+	// PerSource limits the connections of each source IP together.
+	PerSource Limit `json:"perSource"`
+	// Sources override PerSource by the longest matching prefix.
+	Sources []SourceLimit `json:"sources,omitempty"`
+	// Proxies limit the connections of each proxy together.
+	Proxies map[string]Limit `json:"proxies,omitempty"`
+}
+
+// sourceLimit returns the limit of ip.
+func (c *Config) sourceLimit(ip netip.Addr) Limit {
+	best := -1
+	limit := c.PerSource
+	for _, s := range c.Sources {
+		if s.Prefix.Bits() > best && s.Prefix.Contains(ip) {
+			best, limit = s.Prefix.Bits(), s.Limit
+		}
+	}
+	return limit
+}
+
+// Validate checks c as Limiter.Update does, so that it can be checked
+// ahead of applying along with other settings.
+func (c *Config) Validate() error {
+	for _, s := range c.Sources {
+		if !s.Prefix.IsValid() {
+			return fmt.Errorf("invalid source prefix: %s", s.Prefix)
+		}
+	}
+	return nil
+}
+
+// bucket is a pair of token buckets of both directions.
+type bucket struct {
+	up, down *rate.Limiter
+	// refs counts the flows using bucket, guarded by Limiter.mu.
+	refs int
+}
+
+func newBucket(l Limit) *bucket {
+	b := &bucket{
+		up:   rate.NewLimiter(rate.Inf, minBurst),
+		down: rate.NewLimiter(rate.Inf, minBurst),
+	}
+	b.set(l)
+	return b
+}
+
+func (b *bucket) set(l Limit) {
+	setLimit(b.up, l.Up)
+	setLimit(b.down, l.Down)
+}
+
+func (b *bucket) limit() Limit {
+	return Limit{Up: limitOf(b.up), Down: limitOf(b.down)}
+}
+
+func setLimit(r *rate.Limiter, n int64) {
+	if n <= 0 {
+		r.SetLimit(rate.Inf)
+		return
+	}
+	r.SetBurst(int(max(n, minBurst)))
+	r.SetLimit(rate.Limit(n))
+}
+
+func limitOf(r *rate.Limiter) int64 {
+	if r.Limit() == rate.Inf {
+		return 0
+	}
+	return int64(r.Limit())
+}
+
+// Limiter holds the buckets of running connections.
+type Limiter struct {
+	mu      sync.Mutex
+	config  Config
+	global  *bucket
+	sources map[netip.Addr]*bucket
+	proxies map[string]*bucket
+	flows   map[string]*flow
+}
+
+// New creates an unlimited Limiter.
+func New() *Limiter {
+	return &Limiter{
+		global:  newBucket(Limit{}),
+		sources: make(map[netip.Addr]*bucket),
+		proxies: make(map[string]*bucket),
+		flows:   make(map[string]*flow),
+	}
+}
+
+// Config returns the current limits.
+func (l *Limiter) Config() Config {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.config
+}
+
+// Update replaces the limits, which applies to the running
+// connections as well.
+func (l *Limiter) Update(config Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	config.Sources = slices.Clone(config.Sources)
+	if config.Proxies != nil {
+		proxies := make(map[string]Limit, len(config.Proxies))
+		for name, limit := range config.Proxies {
+			proxies[name] = limit
+		}
+		config.Proxies = proxies
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.config = config
+	l.global.set(config.Global)
+	for ip, b := range l.sources {
+		b.set(config.sourceLimit(ip))
+	}
+	for name, b := range l.proxies {
+		b.set(config.Proxies[name])
+	}
+	return nil
+}
+
+// SetConnLimit overrides the limits of source and proxy for the
+// running connection of id, which is still limited globally. A zero
+// limit removes the override.
+func (l *Limiter) SetConnLimit(id string, limit Limit) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, ok := l.flows[id]
+	if !ok {
+		return ErrNotFound
+	}
+	f.own.set(limit)
+	f.override.Store(!limit.IsZero())
+	return nil
+}
+
+// ConnLimits returns the overridden limits of running connections by
+// their IDs.
+func (l *Limiter) ConnLimits() map[string]Limit {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limits := make(map[string]Limit)
+	for id, f := range l.flows {
+		if f.override.Load() {
+			limits[id] = f.own.limit()
+		}
+	}
+	return limits
+}
+
+// flow is the buckets a connection draws from.
+type flow struct {
+	l        *Limiter
+	id       string
+	src      netip.Addr
+	proxy    string
+	source   *bucket
+	via      *bucket
+	own      *bucket
+	override atomic.Bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (l *Limiter) open(id string, metadata *M.Metadata) *flow {
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &flow{
+		l:      l,
+		id:     id,
+		src:    metadata.SrcIP.Unmap(),
+		proxy:  metadata.Proxy,
+		own:    newBucket(Limit{}),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if f.source = l.sources[f.src]; f.source == nil {
+		f.source = newBucket(l.config.sourceLimit(f.src))
+		l.sources[f.src] = f.source
+	}
+	f.source.refs++
+	if f.via = l.proxies[f.proxy]; f.via == nil {
+		f.via = newBucket(l.config.Proxies[f.proxy])
+		l.proxies[f.proxy] = f.via
+	}
+	f.via.refs++
+	if id != "" {
+		l.flows[id] = f
+	}
+	return f
+}
+
+func (f *flow) close() {
+	f.cancel()
+
+	l := f.l
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if f.source.refs--; f.source.refs == 0 {
+		delete(l.sources, f.src)
+	}
+	if f.via.refs--; f.via.refs == 0 {
+		delete(l.proxies, f.proxy)
+	}
+	if l.flows[f.id] == f {
+		delete(l.flows, f.id)
+	}
+}
+
+func (f *flow) waitUp(n int) error {
+	if f.override.Load() {
+		return f.wait(n, f.l.global.up, f.own.up)
+	}
+	return f.wait(n, f.l.global.up, f.source.up, f.via.up)
+}
+
+func (f *flow) waitDown(n int) error {
+	if f.override.Load() {
+		return f.wait(n, f.l.global.down, f.own.down)
+	}
+	return f.wait(n, f.l.global.down, f.source.down, f.via.down)
+}
+
+// wait waits for n tokens from each of limiters, in chunks no larger
+// than minBurst, as bursts may change meanwhile.
+func (f *flow) wait(n int, limiters ...*rate.Limiter) error {
+	for _, r := range limiters {
+		if r.Limit() == rate.Inf {
+			continue
+		}
+		for left := n; left > 0; {
+			chunk := min(left, minBurst)
+			if err := r.WaitN(f.ctx, chunk); err != nil {
+				return err
+			}
+			left -= chunk
+		}
+	}
+	return nil
+}
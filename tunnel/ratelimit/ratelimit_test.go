@@ -0,0 +1,137 @@
+package ratelimit
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+)
+
+func newMetadata(src, proxy string) *M.Metadata {
+	return &M.Metadata{SrcIP: netip.MustParseAddr(src), Proxy: proxy}
+}
+
+func TestLimiterBuckets(t *testing.T) {
+	l := New()
+	require.NoError(t, l.Update(Config{
+		PerSource: Limit{Up: 1 << 20},
+		Sources: []SourceLimit{
+			{Prefix: netip.MustParsePrefix("10.0.0.0/8"), Limit: Limit{Up: 2 << 20}},
+			{Prefix: netip.MustParsePrefix("10.0.0.1/32"), Limit: Limit{Down: 3 << 20}},
+		},
+		Proxies: map[string]Limit{"hk": {Down: 4 << 20}},
+	}))
+
+	f1 := l.open("1", newMetadata("10.0.0.1", "hk"))
+	f2 := l.open("2", newMetadata("10.0.0.1", "jp"))
+	f3 := l.open("3", newMetadata("10.0.0.2", "hk"))
+	f4 := l.open("4", newMetadata("192.168.0.1", "hk"))
+
+	// Flows of the same source or proxy share the buckets.
+	assert.Same(t, f1.source, f2.source)
+	assert.Same(t, f1.via, f3.via)
+	assert.NotSame(t, f1.source, f3.source)
+	assert.Equal(t, Limit{Down: 3 << 20}, f1.source.limit())
+	assert.Equal(t, Limit{Up: 2 << 20}, f3.source.limit())
+	assert.Equal(t, Limit{Up: 1 << 20}, f4.source.limit())
+	assert.Equal(t, Limit{Down: 4 << 20}, f1.via.limit())
+	assert.Equal(t, Limit{}, f2.via.limit())
+
+	// Updates apply to the running flows.
+	require.NoError(t, l.Update(Config{
+		Global:  Limit{Up: 5 << 20, Down: 5 << 20},
+		Proxies: map[string]Limit{"jp": {Up: 6 << 20}},
+	}))
+	assert.Equal(t, Limit{Up: 5 << 20, Down: 5 << 20}, l.global.limit())
+	assert.Equal(t, Limit{}, f1.source.limit())
+	assert.Equal(t, Limit{}, f1.via.limit())
+	assert.Equal(t, Limit{Up: 6 << 20}, f2.via.limit())
+
+	assert.ErrorIs(t, l.SetConnLimit("5", Limit{Up: 1}), ErrNotFound)
+	require.NoError(t, l.SetConnLimit("1", Limit{Up: 7 << 20}))
+	assert.True(t, f1.override.Load())
+	assert.Equal(t, map[string]Limit{"1": {Up: 7 << 20}}, l.ConnLimits())
+	require.NoError(t, l.SetConnLimit("1", Limit{}))
+	assert.False(t, f1.override.Load())
+	assert.Empty(t, l.ConnLimits())
+
+	for _, f := range []*flow{f1, f2, f3, f4} {
+		f.close()
+	}
+	assert.Empty(t, l.sources)
+	assert.Empty(t, l.proxies)
+	assert.Empty(t, l.flows)
+
+	assert.Error(t, l.Update(Config{Sources: []SourceLimit{{}}}))
+}
+
+func TestLimiterConn(t *testing.T) {
+	const limit = 1 << 20
+
+	l := New()
+	require.NoError(t, l.Update(Config{PerSource: Limit{Up: limit}}))
+
+	transfer := func(src string) time.Duration {
+		c1, c2 := net.Pipe()
+		go io.Copy(io.Discard, c2)
+		c := l.Conn(c1, src, newMetadata(src, "hk"))
+		defer c.Close()
+
+		// A burst plus a quarter second of tokens.
+		start := time.Now()
+		_, err := c.Write(make([]byte, limit+limit/4))
+		require.NoError(t, err)
+		return time.Since(start)
+	}
+
+	assert.GreaterOrEqual(t, transfer("10.0.0.1"), 200*time.Millisecond)
+
+	// The override replaces the limit of source.
+	require.NoError(t, l.Update(Config{PerSource: Limit{Up: 1}}))
+	c1, c2 := net.Pipe()
+	go io.Copy(io.Discard, c2)
+	c := l.Conn(c1, "override", newMetadata("10.0.0.2", "hk"))
+	defer c.Close()
+	require.NoError(t, l.SetConnLimit("override", Limit{Up: 1 << 30}))
+	start := time.Now()
+	_, err := c.Write(make([]byte, limit))
+	require.NoError(t, err)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestLimiterClose(t *testing.T) {
+	l := New()
+	require.NoError(t, l.Update(Config{Global: Limit{Down: 1}}))
+
+	c1, c2 := net.Pipe()
+	c := l.Conn(c1, "", newMetadata("10.0.0.1", ""))
+	go c2.Write(make([]byte, minBurst))
+
+	// Waiting for tokens is interrupted by close.
+	done := make(chan error)
+	go func() {
+		b := make([]byte, minBurst)
+		_, err := io.ReadFull(c, b)
+		if err == nil {
+			_, err = c.Read(b)
+		}
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	go c2.Write([]byte{1})
+	time.Sleep(50 * time.Millisecond)
+	c.Close()
+
+	select {
+	case err := <-done:
+		assert.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait not interrupted by close")
+	}
+}
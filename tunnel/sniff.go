@@ -0,0 +1,91 @@
+package tunnel
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/xjasonlyu/tun2socks/v2/buffer"
+	"github.com/xjasonlyu/tun2socks/v2/log"
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/tunnel/sniffer"
+)
+
+const (
+	// sniffBufferSize is the maximum number of bytes peeked from
+	// TCP clients, which should fit a large TLS ClientHello.
+	sniffBufferSize = 8 << 10
+
+	// sniffMaxDatagrams is the maximum number of datagrams peeked
+	// from UDP clients, as a QUIC ClientHello may span several ones.
+	sniffMaxDatagrams = 3
+
+	// quicPort is the port of UDP flows sniffed for QUIC.
+	quicPort = 443
+)
+
+// applySniffed records the sniffed result on metadata. The hostname
+// restored from fake IPs, if any, takes precedence.
+func applySniffed(metadata *M.Metadata, r *sniffer.Result) {
+	if metadata.Host == "" {
+		metadata.Host = r.Host
+	}
+	metadata.Protocol = r.Protocol
+}
+
+// sniffTCP peeks the first bytes sent by the client within timeout,
+// and returns them so that they can be replayed to the remote.
+func sniffTCP(c net.Conn, metadata *M.Metadata, timeout time.Duration) []byte {
+	buf := make([]byte, 0, sniffBufferSize)
+
+	c.SetReadDeadline(time.Now().Add(timeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	for len(buf) < cap(buf) {
+		n, err := c.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+
+		r, sErr := sniffer.SniffStream(buf)
+		if sErr == nil {
+			applySniffed(metadata, r)
+			log.Debugf("[SNIFF] %s %s -> %s", r.Protocol, metadata.DestinationAddress(), r.Host)
+			return buf
+		}
+		if !errors.Is(sErr, sniffer.ErrNeedMore) || err != nil {
+			return buf
+		}
+	}
+	return buf
+}
+
+// sniffUDP peeks the first datagrams sent by the client within timeout,
+// and returns them so that they can be replayed to the remote.
+func sniffUDP(c net.Conn, metadata *M.Metadata, timeout time.Duration) [][]byte {
+	var datagrams [][]byte
+
+	c.SetReadDeadline(time.Now().Add(timeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	buf := buffer.Get(buffer.MaxSegmentSize)
+	defer buffer.Put(buf)
+
+	for len(datagrams) < sniffMaxDatagrams {
+		n, err := c.Read(buf)
+		if err != nil {
+			return datagrams
+		}
+		datagrams = append(datagrams, slices.Clone(buf[:n]))
+
+		host, sErr := sniffer.SniffQUIC(datagrams...)
+		if sErr == nil {
+			applySniffed(metadata, &sniffer.Result{Host: host, Protocol: sniffer.ProtocolQUIC})
+			log.Debugf("[SNIFF] %s %s -> %s", sniffer.ProtocolQUIC, metadata.DestinationAddress(), host)
+			return datagrams
+		}
+		if !errors.Is(sErr, sniffer.ErrNeedMore) {
+			return datagrams
+		}
+	}
+	return datagrams
+}
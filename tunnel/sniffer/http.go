@@ -0,0 +1,72 @@
+package sniffer
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+var httpMethods = [...]string{
+	"GET", "POST", "HEAD", "PUT", "DELETE", "OPTIONS", "PATCH", "CONNECT", "TRACE",
+}
+
+// SniffHTTP returns the Host header of HTTP/1 request at the head of b.
+func SniffHTTP(b []byte) (string, error) {
+	if !hasMethod(b) {
+		return "", ErrNoClue
+	}
+
+	// Skip the request line.
+	i := bytes.Index(b, []byte("\r\n"))
+	if i < 0 {
+		return "", ErrNeedMore
+	}
+	b = b[i+2:]
+
+	for {
+		i = bytes.Index(b, []byte("\r\n"))
+		if i < 0 {
+			return "", ErrNeedMore
+		}
+		if i == 0 /* end of header */ {
+			return "", ErrNoClue
+		}
+
+		line := b[:i]
+		b = b[i+2:]
+
+		key, value, ok := bytes.Cut(line, []byte(":"))
+		if !ok || !strings.EqualFold(string(bytes.TrimSpace(key)), "host") {
+			continue
+		}
+
+		host := strings.TrimSpace(string(value))
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+		if _, err := netip.ParseAddr(host); err == nil || host == "" {
+			// IP literals are no better than the destination address.
+			return "", ErrNoClue
+		}
+		return strings.ToLower(host), nil
+	}
+}
+
+// hasMethod reports whether b starts with an HTTP method followed by
+// a space, or might do so once more data arrives.
+func hasMethod(b []byte) bool {
+	for _, m := range httpMethods {
+		if len(b) <= len(m) {
+			if strings.HasPrefix(m, string(b)) {
+				return true
+			}
+			continue
+		}
+		if string(b[:len(m)]) == m && b[len(m)] == ' ' {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,264 @@
+package sniffer
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	quicVersion1 = 0x00000001
+
+	// Frame types carried by Initial packets.
+	quicFramePadding = 0x00
+	quicFramePing    = 0x01
+	quicFrameACK     = 0x02
+	quicFrameACKECN  = 0x03
+	quicFrameCrypto  = 0x06
+	quicFrameClose   = 0x1c
+
+	quicSampleLen = 16
+)
+
+// quicSaltV1 is the salt to derive Initial secrets as defined in
+// RFC 9001 section 5.2.
+var quicSaltV1 = []byte{
+	0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17,
+	0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a,
+}
+
+var errQUICMalformed = errors.New("malformed QUIC packet")
+
+// SniffQUIC returns the SNI of TLS ClientHello carried by the client
+// Initial packets, which may be split across multiple datagrams.
+func SniffQUIC(datagrams ...[]byte) (string, error) {
+	var frags []cryptoFragment
+	for _, b := range datagrams {
+		f, err := decryptInitial(b)
+		if err != nil {
+			return "", ErrNoClue
+		}
+		frags = append(frags, f...)
+	}
+
+	hs := assembleCrypto(frags)
+	if len(hs) < handshakeHeaderLen {
+		return "", ErrNeedMore
+	}
+	if hs[0] != handshakeTypeClientHello {
+		return "", ErrNoClue
+	}
+	msgLen := int(hs[1])<<16 | int(hs[2])<<8 | int(hs[3])
+	if len(hs) < handshakeHeaderLen+msgLen {
+		return "", ErrNeedMore
+	}
+	return parseClientHello(hs[:handshakeHeaderLen+msgLen])
+}
+
+// cryptoFragment is the data of a CRYPTO frame at offset.
+type cryptoFragment struct {
+	offset uint64
+	data   []byte
+}
+
+// assembleCrypto returns the contiguous crypto stream from offset 0.
+func assembleCrypto(frags []cryptoFragment) []byte {
+	sort.Slice(frags, func(i, j int) bool {
+		return frags[i].offset < frags[j].offset
+	})
+
+	var stream []byte
+	for _, f := range frags {
+		end := f.offset + uint64(len(f.data))
+		if f.offset > uint64(len(stream)) {
+			break
+		}
+		if end > uint64(len(stream)) {
+			stream = append(stream, f.data[uint64(len(stream))-f.offset:]...)
+		}
+	}
+	return stream
+}
+
+// decryptInitial removes protection of the client Initial packet at
+// the head of b as defined in RFC 9001 section 5, and returns the
+// CRYPTO frames it carries.
+func decryptInitial(b []byte) ([]cryptoFragment, error) {
+	// Long header with fixed bit set, and packet type Initial.
+	if len(b) < 7 || b[0]&0xc0 != 0xc0 || b[0]&0x30 != 0x00 {
+		return nil, errQUICMalformed
+	}
+	if binary.BigEndian.Uint32(b[1:5]) != quicVersion1 {
+		return nil, errQUICMalformed
+	}
+
+	r := reader(b[5:])
+	dcid, ok := r.vector(1)
+	if !ok || len(dcid) > 20 {
+		return nil, errQUICMalformed
+	}
+	if _, ok = r.vector(1); !ok /* scid */ {
+		return nil, errQUICMalformed
+	}
+	// Compare as uint64 first, as the 62-bit length overflows int on
+	// 32-bit platforms.
+	tokenLen, ok := r.varint()
+	if !ok || uint64(len(r)) < tokenLen || !r.skip(int(tokenLen)) {
+		return nil, errQUICMalformed
+	}
+	length, ok := r.varint()
+	if !ok || uint64(len(r)) < length || length < 4+quicSampleLen {
+		return nil, errQUICMalformed
+	}
+	pnOffset := len(b) - len(r)
+
+	key, iv, hp, err := quicClientInitialKeys(dcid)
+	if err != nil {
+		return nil, err
+	}
+
+	// Remove header protection.
+	block, err := aes.NewCipher(hp)
+	if err != nil {
+		return nil, err
+	}
+	mask := make([]byte, aes.BlockSize)
+	block.Encrypt(mask, b[pnOffset+4:pnOffset+4+quicSampleLen])
+
+	header := make([]byte, pnOffset+4)
+	copy(header, b)
+	header[0] ^= mask[0] & 0x0f
+	pnLen := int(header[0]&0x03) + 1
+	var pn uint64
+	for i := 0; i < pnLen; i++ {
+		header[pnOffset+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(header[pnOffset+i])
+	}
+	header = header[:pnOffset+pnLen]
+
+	// Decrypt payload.
+	block, err = aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, len(iv))
+	copy(nonce, iv)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	ciphertext := b[pnOffset+pnLen : pnOffset+int(length)]
+	payload, err := aead.Open(nil, nonce, ciphertext, header)
+	if err != nil {
+		return nil, err
+	}
+	return parseCryptoFrames(payload)
+}
+
+// parseCryptoFrames returns the CRYPTO frames of Initial payload.
+func parseCryptoFrames(payload []byte) ([]cryptoFragment, error) {
+	var frags []cryptoFragment
+	r := reader(payload)
+	for len(r) > 0 {
+		typ, _ := r.varint()
+		switch typ {
+		case quicFramePadding, quicFramePing:
+		case quicFrameCrypto:
+			offset, ok1 := r.varint()
+			n, ok2 := r.varint()
+			if !ok1 || !ok2 || uint64(len(r)) < n {
+				return nil, errQUICMalformed
+			}
+			frags = append(frags, cryptoFragment{offset: offset, data: r[:n]})
+			r = r[n:]
+		case quicFrameACK, quicFrameACKECN:
+			// Largest Acknowledged, ACK Delay, ACK Range Count, First ACK Range.
+			var rangeCount uint64
+			for i := 0; i < 4; i++ {
+				v, ok := r.varint()
+				if !ok {
+					return nil, errQUICMalformed
+				}
+				if i == 2 {
+					rangeCount = v
+				}
+			}
+			// Gap and ACK Range Length of each range, and ECN counts.
+			count := 2 * rangeCount
+			if typ == quicFrameACKECN {
+				count += 3
+			}
+			for i := uint64(0); i < count; i++ {
+				if _, ok := r.varint(); !ok {
+					return nil, errQUICMalformed
+				}
+			}
+		case quicFrameClose:
+			return frags, nil
+		default:
+			return nil, errQUICMalformed
+		}
+	}
+	return frags, nil
+}
+
+// quicClientInitialKeys derives client Initial keys from the
+// destination connection ID.
+func quicClientInitialKeys(dcid []byte) (key, iv, hp []byte, err error) {
+	initial := hkdf.Extract(sha256.New, dcid, quicSaltV1)
+	client, err := hkdfExpandLabel(initial, "client in", sha256.Size)
+	if err != nil {
+		return
+	}
+	if key, err = hkdfExpandLabel(client, "quic key", 16); err != nil {
+		return
+	}
+	if iv, err = hkdfExpandLabel(client, "quic iv", 12); err != nil {
+		return
+	}
+	hp, err = hkdfExpandLabel(client, "quic hp", 16)
+	return
+}
+
+// hkdfExpandLabel implements HKDF-Expand-Label of TLS 1.3 with an
+// empty context.
+func hkdfExpandLabel(secret []byte, label string, length int) ([]byte, error) {
+	label = "tls13 " + label
+	info := make([]byte, 0, 2+1+len(label)+1)
+	info = binary.BigEndian.AppendUint16(info, uint16(length))
+	info = append(info, byte(len(label)))
+	info = append(info, label...)
+	info = append(info, 0)
+
+	out := make([]byte, length)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, secret, info), out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// varint reads a QUIC variable-length integer.
+func (r *reader) varint() (uint64, bool) {
+	if len(*r) < 1 {
+		return 0, false
+	}
+	n := 1 << ((*r)[0] >> 6)
+	if len(*r) < n {
+		return 0, false
+	}
+	v := uint64((*r)[0] & 0x3f)
+	for _, c := range (*r)[1:n] {
+		v = v<<8 | uint64(c)
+	}
+	*r = (*r)[n:]
+	return v, true
+}
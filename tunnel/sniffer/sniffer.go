@@ -0,0 +1,47 @@
+// Package sniffer recovers destination hostnames from the first
+// bytes sent by clients.
+package sniffer
+
+import (
+	"errors"
+)
+
+// Application protocols detected by sniffer.
+const (
+	ProtocolHTTP = "http"
+	ProtocolTLS  = "tls"
+	ProtocolQUIC = "quic"
+)
+
+var (
+	// ErrNeedMore is returned if more data is required to sniff.
+	ErrNeedMore = errors.New("need more data")
+
+	// ErrNoClue is returned if the data is not recognized.
+	ErrNoClue = errors.New("no clue")
+)
+
+// Result is the result of sniffing.
+type Result struct {
+	Host     string
+	Protocol string
+}
+
+// SniffStream sniffs the first bytes of a stream, e.g. TCP, for a TLS
+// ClientHello or an HTTP/1 request. It returns ErrNeedMore if b might
+// be recognized once more data arrives.
+func SniffStream(b []byte) (*Result, error) {
+	host, err := SniffTLS(b)
+	if err == nil {
+		return &Result{Host: host, Protocol: ProtocolTLS}, nil
+	}
+	if errors.Is(err, ErrNeedMore) {
+		return nil, err
+	}
+
+	host, err = SniffHTTP(b)
+	if err == nil {
+		return &Result{Host: host, Protocol: ProtocolHTTP}, nil
+	}
+	return nil, err
+}
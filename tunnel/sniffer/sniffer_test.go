@@ -0,0 +1,168 @@
+package sniffer
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// clientHelloRecord returns the first TLS record sent by a client
+// connecting to serverName.
+func clientHelloRecord(t *testing.T, serverName string) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		tc := tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		_ = tc.Handshake()
+		client.Close()
+	}()
+
+	header := make([]byte, recordHeaderLen)
+	_, err := io.ReadFull(server, header)
+	require.NoError(t, err)
+	body := make([]byte, binary.BigEndian.Uint16(header[3:]))
+	_, err = io.ReadFull(server, body)
+	require.NoError(t, err)
+	return append(header, body...)
+}
+
+func TestSniffTLS(t *testing.T) {
+	record := clientHelloRecord(t, "Example.COM")
+
+	host, err := SniffTLS(record)
+	require.NoError(t, err)
+	assert.Equal(t, "example.com", host)
+
+	_, err = SniffTLS(record[:len(record)/2])
+	assert.ErrorIs(t, err, ErrNeedMore)
+
+	_, err = SniffTLS([]byte("GET / HTTP/1.1\r\n"))
+	assert.ErrorIs(t, err, ErrNoClue)
+
+	r, err := SniffStream(record)
+	require.NoError(t, err)
+	assert.Equal(t, &Result{Host: "example.com", Protocol: ProtocolTLS}, r)
+}
+
+func TestSniffHTTP(t *testing.T) {
+	tests := []struct {
+		data string
+		host string
+		err  error
+	}{
+		{"GET / HTTP/1.1\r\nHost: Example.com:8080\r\nAccept: */*\r\n\r\n", "example.com", nil},
+		{"POST /a HTTP/1.1\r\nUser-Agent: x\r\nhost: [::1]:80\r\n", "", ErrNoClue},
+		{"GET / HTTP/1.1\r\nHost: [::1]\r\n", "", ErrNoClue},
+		{"GET / HTTP/1.1\r\nHost: 192.0.2.1\r\n", "", ErrNoClue},
+		{"GET / HTTP/1.1\r\nHost: 192.0.2.1:8080\r\n", "", ErrNoClue},
+		{"GET / HTTP/1.1\r\nUser-Agent: x\r\n", "", ErrNeedMore},
+		{"GE", "", ErrNeedMore},
+		{"GET / HTTP/1.0\r\n\r\n", "", ErrNoClue},
+		{"SSH-2.0-OpenSSH_9.0\r\n", "", ErrNoClue},
+	}
+	for _, tt := range tests {
+		host, err := SniffHTTP([]byte(tt.data))
+		if tt.err != nil {
+			assert.ErrorIs(t, err, tt.err, tt.data)
+			continue
+		}
+		require.NoError(t, err, tt.data)
+		assert.Equal(t, tt.host, host)
+	}
+}
+
+func TestQUICClientInitialKeys(t *testing.T) {
+	// RFC 9001 appendix A.1.
+	dcid, _ := hex.DecodeString("8394c8f03e515708")
+	key, iv, hp, err := quicClientInitialKeys(dcid)
+	require.NoError(t, err)
+	assert.Equal(t, "1f369613dd76d5467730efcbe3b1a22d", hex.EncodeToString(key))
+	assert.Equal(t, "fa044b2f42a3fd3b46fb255c", hex.EncodeToString(iv))
+	assert.Equal(t, "9f50449e04a0e810283a1e9933adedd2", hex.EncodeToString(hp))
+}
+
+// sealInitial builds a protected client Initial packet carrying
+// CRYPTO data at offset, with a 2-byte packet number.
+func sealInitial(t *testing.T, dcid []byte, pn uint16, offset int, data []byte) []byte {
+	var frame []byte
+	frame = append(frame, quicFrameCrypto)
+	frame = append(frame, 0x80, 0, byte(offset>>8), byte(offset)) /* 4-byte varint */
+	frame = append(frame, 0x40|byte(len(data)>>8), byte(len(data)))
+	frame = append(frame, data...)
+	frame = append(frame, make([]byte, 32)...) /* PADDING */
+
+	key, iv, hp, err := quicClientInitialKeys(dcid)
+	require.NoError(t, err)
+
+	length := 2 + len(frame) + 16
+	header := []byte{0xc1, 0, 0, 0, 1, byte(len(dcid))}
+	header = append(header, dcid...)
+	header = append(header, 0 /* scid */, 0 /* token */)
+	header = append(header, 0x40|byte(length>>8), byte(length))
+	pnOffset := len(header)
+	header = binary.BigEndian.AppendUint16(header, pn)
+
+	block, _ := aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+	nonce := make([]byte, len(iv))
+	copy(nonce, iv)
+	nonce[len(nonce)-1] ^= byte(pn)
+	nonce[len(nonce)-2] ^= byte(pn >> 8)
+	packet := aead.Seal(append([]byte{}, header...), nonce, frame, header)
+
+	block, _ = aes.NewCipher(hp)
+	mask := make([]byte, aes.BlockSize)
+	block.Encrypt(mask, packet[pnOffset+4:pnOffset+4+quicSampleLen])
+	packet[0] ^= mask[0] & 0x0f
+	packet[pnOffset] ^= mask[1]
+	packet[pnOffset+1] ^= mask[2]
+	return packet
+}
+
+func TestSniffQUIC(t *testing.T) {
+	record := clientHelloRecord(t, "quic.example.com")
+	hs := record[recordHeaderLen:]
+	dcid := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	host, err := SniffQUIC(sealInitial(t, dcid, 0, 0, hs))
+	require.NoError(t, err)
+	assert.Equal(t, "quic.example.com", host)
+
+	// ClientHello split across two datagrams, received out of order.
+	half := len(hs) / 2
+	first := sealInitial(t, dcid, 0, 0, hs[:half])
+	second := sealInitial(t, dcid, 1, half, hs[half:])
+
+	_, err = SniffQUIC(first)
+	assert.ErrorIs(t, err, ErrNeedMore)
+
+	host, err = SniffQUIC(second, first)
+	require.NoError(t, err)
+	assert.Equal(t, "quic.example.com", host)
+
+	_, err = SniffQUIC([]byte("not a quic packet"))
+	assert.ErrorIs(t, err, ErrNoClue)
+}
+
+func TestQUICTokenLength(t *testing.T) {
+	// Initial packet with a token length of 2^62-1, which would be
+	// negative as int on 32-bit platforms.
+	packet := []byte{0xc0, 0, 0, 0, 1, 8, 1, 2, 3, 4, 5, 6, 7, 8, 0}
+	packet = append(packet, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	packet = append(packet, make([]byte, 64)...)
+
+	_, err := decryptInitial(packet)
+	assert.ErrorIs(t, err, errQUICMalformed)
+
+	r := reader(packet)
+	assert.False(t, r.skip(-1))
+}
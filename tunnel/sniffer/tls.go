@@ -0,0 +1,157 @@
+package sniffer
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+const (
+	recordTypeHandshake      = 0x16
+	handshakeTypeClientHello = 0x01
+	extensionServerName      = 0x0000
+	serverNameTypeHostName   = 0x00
+
+	recordHeaderLen    = 5
+	handshakeHeaderLen = 4
+)
+
+// SniffTLS returns the SNI of TLS ClientHello at the head of b, which
+// may span multiple TLS records.
+func SniffTLS(b []byte) (string, error) {
+	if len(b) > 0 && b[0] != recordTypeHandshake {
+		return "", ErrNoClue
+	}
+	if len(b) > recordHeaderLen && b[recordHeaderLen] != handshakeTypeClientHello {
+		return "", ErrNoClue
+	}
+
+	var hs []byte
+	for {
+		if len(b) < recordHeaderLen {
+			return "", ErrNeedMore
+		}
+		if b[0] != recordTypeHandshake || b[1] != 0x03 {
+			return "", ErrNoClue
+		}
+		length := int(binary.BigEndian.Uint16(b[3:5]))
+		if len(b) < recordHeaderLen+length {
+			return "", ErrNeedMore
+		}
+		hs = append(hs, b[recordHeaderLen:recordHeaderLen+length]...)
+		b = b[recordHeaderLen+length:]
+
+		if len(hs) >= handshakeHeaderLen {
+			msgLen := int(hs[1])<<16 | int(hs[2])<<8 | int(hs[3])
+			if len(hs) >= handshakeHeaderLen+msgLen {
+				return parseClientHello(hs[:handshakeHeaderLen+msgLen])
+			}
+		}
+	}
+}
+
+// parseClientHello returns the SNI of handshake message ClientHello.
+func parseClientHello(b []byte) (string, error) {
+	if len(b) < handshakeHeaderLen || b[0] != handshakeTypeClientHello {
+		return "", ErrNoClue
+	}
+	r := reader(b[handshakeHeaderLen:])
+
+	// legacy_version, random
+	if !r.skip(2 + 32) {
+		return "", ErrNoClue
+	}
+	// legacy_session_id, cipher_suites, legacy_compression_methods
+	if _, ok := r.vector(1); !ok {
+		return "", ErrNoClue
+	}
+	if _, ok := r.vector(2); !ok {
+		return "", ErrNoClue
+	}
+	if _, ok := r.vector(1); !ok {
+		return "", ErrNoClue
+	}
+
+	extensions, ok := r.vector(2)
+	if !ok {
+		return "", ErrNoClue
+	}
+	for len(extensions) > 0 {
+		typ, ok := extensions.uint16()
+		if !ok {
+			return "", ErrNoClue
+		}
+		data, ok := extensions.vector(2)
+		if !ok {
+			return "", ErrNoClue
+		}
+		if typ != extensionServerName {
+			continue
+		}
+
+		list, ok := data.vector(2)
+		if !ok {
+			return "", ErrNoClue
+		}
+		for len(list) > 0 {
+			nameType, ok := list.uint8()
+			if !ok {
+				return "", ErrNoClue
+			}
+			name, ok := list.vector(2)
+			if !ok {
+				return "", ErrNoClue
+			}
+			if nameType == serverNameTypeHostName && len(name) > 0 {
+				return strings.ToLower(strings.TrimSuffix(string(name), ".")), nil
+			}
+		}
+	}
+	return "", ErrNoClue
+}
+
+// reader is a minimal parser of TLS presentation language.
+type reader []byte
+
+func (r *reader) skip(n int) bool {
+	if n < 0 || len(*r) < n {
+		return false
+	}
+	*r = (*r)[n:]
+	return true
+}
+
+func (r *reader) uint8() (uint8, bool) {
+	if len(*r) < 1 {
+		return 0, false
+	}
+	v := (*r)[0]
+	*r = (*r)[1:]
+	return v, true
+}
+
+func (r *reader) uint16() (uint16, bool) {
+	if len(*r) < 2 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint16(*r)
+	*r = (*r)[2:]
+	return v, true
+}
+
+// vector reads a variable-length vector with a lenBytes length prefix.
+func (r *reader) vector(lenBytes int) (reader, bool) {
+	if len(*r) < lenBytes {
+		return nil, false
+	}
+	var n int
+	for _, c := range (*r)[:lenBytes] {
+		n = n<<8 | int(c)
+	}
+	*r = (*r)[lenBytes:]
+	if len(*r) < n {
+		return nil, false
+	}
+	v := (*r)[:n]
+	*r = (*r)[n:]
+	return v, true
+}
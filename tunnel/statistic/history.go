@@ -0,0 +1,161 @@
+package statistic
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+)
+
+// DefaultHistorySize is the default number of closed connections kept.
+const DefaultHistorySize = 1024
+
+// Reasons of closed connections other than errors.
+const (
+	ReasonEOF     = "eof"     // closed by remote
+	ReasonClosed  = "closed"  // closed locally
+	ReasonTimeout = "timeout" // closed after idle timeout
+
+	// reasonDialPrefix prefixes the dial error of failed connections.
+	reasonDialPrefix = "dial: "
+)
+
+// ClosedConnection is a connection which has been closed or failed
+// to dial.
+type ClosedConnection struct {
+	ID       uuid.UUID   `json:"id"`
+	Metadata *M.Metadata `json:"metadata"`
+	Start    time.Time   `json:"start"`
+	End      time.Time   `json:"end"`
+	Duration int64       `json:"duration"` // in milliseconds
+	Upload   int64       `json:"upload"`
+	Download int64       `json:"download"`
+	Reason   string      `json:"reason"`
+}
+
+// DialFailed reports whether c failed to dial.
+func (c *ClosedConnection) DialFailed() bool {
+	return strings.HasPrefix(c.Reason, reasonDialPrefix)
+}
+
+// ClosedFilter selects closed connections, where the zero value of
+// each field matches any.
+type ClosedFilter struct {
+	Source      netip.Prefix
+	Destination netip.Prefix
+	// Host matches the domain of destination and its subdomains.
+	Host string
+	// Since and Until match the connections alive within the window.
+	Since, Until time.Time
+}
+
+// Match reports whether c is selected by f.
+func (f *ClosedFilter) Match(c *ClosedConnection) bool {
+	if f.Source.IsValid() && !f.Source.Contains(c.Metadata.SrcIP.Unmap()) {
+		return false
+	}
+	if f.Destination.IsValid() && !f.Destination.Contains(c.Metadata.DstIP.Unmap()) {
+		return false
+	}
+	if f.Host != "" {
+		host := strings.ToLower(c.Metadata.Host)
+		if host != f.Host && !strings.HasSuffix(host, "."+f.Host) {
+			return false
+		}
+	}
+	if !f.Since.IsZero() && c.End.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && c.Start.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+// history is a ring buffer of the recently closed connections.
+type history struct {
+	mu   sync.Mutex
+	buf  []*ClosedConnection
+	next int
+	full bool
+}
+
+func newHistory(size int) *history {
+	return &history{buf: make([]*ClosedConnection, size)}
+}
+
+func (h *history) push(c *ClosedConnection) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.buf) == 0 {
+		return
+	}
+	h.buf[h.next] = c
+	h.next = (h.next + 1) % len(h.buf)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// list returns the closed connections from the newest to the oldest.
+func (h *history) list() []*ClosedConnection {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.listLocked()
+}
+
+func (h *history) listLocked() []*ClosedConnection {
+	n := h.next
+	if h.full {
+		n = len(h.buf)
+	}
+	list := make([]*ClosedConnection, 0, n)
+	for i := 1; i <= n; i++ {
+		list = append(list, h.buf[(h.next-i+len(h.buf))%len(h.buf)])
+	}
+	return list
+}
+
+// resize changes the capacity of history, keeping the newest ones.
+func (h *history) resize(size int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if size == len(h.buf) {
+		return
+	}
+	list := h.listLocked()
+	h.buf = make([]*ClosedConnection, size)
+	h.next, h.full = 0, false
+	for i := min(len(list), size) - 1; i >= 0; i-- {
+		h.buf[h.next] = list[i]
+		h.next = (h.next + 1) % size
+		if h.next == 0 {
+			h.full = true
+		}
+	}
+}
+
+// reasonOf returns the close reason of a connection by the first
+// error seen on it.
+func reasonOf(err error) string {
+	switch {
+	case err == nil:
+		return ReasonClosed
+	case errors.Is(err, io.EOF):
+		return ReasonEOF
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return ReasonTimeout
+	case errors.Is(err, net.ErrClosed):
+		return ReasonClosed
+	default:
+		return err.Error()
+	}
+}
@@ -1,24 +1,33 @@
 package statistic
 
 import (
+	"slices"
 	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"go.uber.org/atomic"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
 )
 
 var DefaultManager *Manager
 
 func init() {
-	DefaultManager = &Manager{
+	DefaultManager = newManager()
+	go DefaultManager.handle()
+}
+
+func newManager() *Manager {
+	return &Manager{
 		uploadTemp:    atomic.NewInt64(0),
 		downloadTemp:  atomic.NewInt64(0),
 		uploadBlip:    atomic.NewInt64(0),
 		downloadBlip:  atomic.NewInt64(0),
 		uploadTotal:   atomic.NewInt64(0),
 		downloadTotal: atomic.NewInt64(0),
+		history:       newHistory(DefaultHistorySize),
 	}
-	go DefaultManager.handle()
 }
 
 type Manager struct {
@@ -29,6 +38,97 @@ type Manager struct {
 	downloadBlip  *atomic.Int64
 	uploadTotal   *atomic.Int64
 	downloadTotal *atomic.Int64
+
+	// proxies and rules hold the running totals keyed by the name
+	// of proxy and the matched rule of flows.
+	proxies sync.Map
+	rules   sync.Map
+
+	// history keeps the recently closed connections.
+	history *history
+
+	// sinks receive the closed connections as well.
+	sinks atomic.Pointer[[]Sink]
+}
+
+// Sink receives the connections once closed or failed to dial. Record
+// is called on the path of closing, so it must not block.
+type Sink interface {
+	Record(c *ClosedConnection)
+}
+
+// SetSinks replaces the sinks of closed connections.
+func (m *Manager) SetSinks(sinks ...Sink) {
+	m.sinks.Store(&sinks)
+}
+
+func (m *Manager) record(c *ClosedConnection) {
+	m.history.push(c)
+	if sinks := m.sinks.Load(); sinks != nil {
+		for _, s := range *sinks {
+			s.Record(c)
+		}
+	}
+}
+
+// Traffic is the running upload and download totals.
+type Traffic struct {
+	Upload   *atomic.Int64 `json:"upload"`
+	Download *atomic.Int64 `json:"download"`
+}
+
+func newTraffic() Traffic {
+	return Traffic{
+		Upload:   atomic.NewInt64(0),
+		Download: atomic.NewInt64(0),
+	}
+}
+
+// ProxyTraffic is the running totals of a proxy. It's replaced with the
+// same totals once the proxy changes its protocol or address.
+type ProxyTraffic struct {
+	Proto   string `json:"proto"`
+	Address string `json:"address"`
+	Traffic
+}
+
+// counters returns the running totals to be updated by the tracker
+// of metadata, which are nil if the flow has no proxy or rule.
+func (m *Manager) counters(metadata *M.Metadata) (proxy *ProxyTraffic, rule *Traffic) {
+	if metadata.Proxy != "" {
+		v, loaded := m.proxies.LoadOrStore(metadata.Proxy, &ProxyTraffic{
+			Proto:   metadata.ProxyProto,
+			Address: metadata.ProxyAddress,
+			Traffic: newTraffic(),
+		})
+		proxy = v.(*ProxyTraffic)
+		if loaded && (proxy.Proto != metadata.ProxyProto || proxy.Address != metadata.ProxyAddress) {
+			next := &ProxyTraffic{
+				Proto:   metadata.ProxyProto,
+				Address: metadata.ProxyAddress,
+				Traffic: proxy.Traffic,
+			}
+			m.proxies.CompareAndSwap(metadata.Proxy, proxy, next)
+			proxy = next
+		}
+	}
+	if metadata.Rule != "" {
+		t := newTraffic()
+		v, _ := m.rules.LoadOrStore(metadata.Rule, &t)
+		rule = v.(*Traffic)
+	}
+	return
+}
+
+// RetainProxies drops the running totals of the proxies other than
+// names, e.g. those removed on reload.
+func (m *Manager) RetainProxies(names []string) {
+	m.proxies.Range(func(key, _ any) bool {
+		if !slices.Contains(names, key.(string)) {
+			m.proxies.Delete(key)
+		}
+		return true
+	})
 }
 
 func (m *Manager) Join(c tracker) {
@@ -36,7 +136,42 @@ func (m *Manager) Join(c tracker) {
 }
 
 func (m *Manager) Leave(c tracker) {
-	m.connections.Delete(c.ID())
+	if _, loaded := m.connections.LoadAndDelete(c.ID()); loaded {
+		m.record(c.closed())
+	}
+}
+
+// Failed records a connection which failed to dial since start.
+func (m *Manager) Failed(metadata *M.Metadata, start time.Time, err error) {
+	id, _ := uuid.NewRandom()
+	end := time.Now()
+	m.record(&ClosedConnection{
+		ID:       id,
+		Metadata: metadata,
+		Start:    start,
+		End:      end,
+		Duration: end.Sub(start).Milliseconds(),
+		Reason:   reasonDialPrefix + err.Error(),
+	})
+}
+
+// Closed returns the recently closed connections selected by filter,
+// from the newest to the oldest.
+func (m *Manager) Closed(filter ClosedFilter) []*ClosedConnection {
+	list := m.history.list()
+	selected := list[:0]
+	for _, c := range list {
+		if filter.Match(c) {
+			selected = append(selected, c)
+		}
+	}
+	return selected
+}
+
+// SetHistorySize sets the number of closed connections kept, where
+// zero disables the history.
+func (m *Manager) SetHistorySize(size int) {
+	m.history.resize(max(size, 0))
 }
 
 func (m *Manager) PushUploaded(size int64) {
@@ -53,6 +188,24 @@ func (m *Manager) Now() (up int64, down int64) {
 	return m.uploadBlip.Load(), m.downloadBlip.Load()
 }
 
+func (m *Manager) Total() (up int64, down int64) {
+	return m.uploadTotal.Load(), m.downloadTotal.Load()
+}
+
+// Count returns the number of active TCP connections and UDP sessions.
+func (m *Manager) Count() (tcp int, udp int) {
+	m.connections.Range(func(_, value any) bool {
+		switch value.(type) {
+		case *tcpTracker:
+			tcp++
+		case *udpTracker:
+			udp++
+		}
+		return true
+	})
+	return
+}
+
 func (m *Manager) Snapshot() *Snapshot {
 	var connections []tracker
 	m.connections.Range(func(key, value any) bool {
@@ -60,10 +213,24 @@ func (m *Manager) Snapshot() *Snapshot {
 		return true
 	})
 
+	proxies := make(map[string]*ProxyTraffic)
+	m.proxies.Range(func(key, value any) bool {
+		proxies[key.(string)] = value.(*ProxyTraffic)
+		return true
+	})
+
+	rules := make(map[string]*Traffic)
+	m.rules.Range(func(key, value any) bool {
+		rules[key.(string)] = value.(*Traffic)
+		return true
+	})
+
 	return &Snapshot{
 		UploadTotal:   m.uploadTotal.Load(),
 		DownloadTotal: m.downloadTotal.Load(),
 		Connections:   connections,
+		Proxies:       proxies,
+		Rules:         rules,
 	}
 }
 
@@ -74,6 +241,17 @@ func (m *Manager) ResetStatistic() {
 	m.downloadTemp.Store(0)
 	m.downloadBlip.Store(0)
 	m.downloadTotal.Store(0)
+	// Trackers keep updating the same totals, so reset them in place.
+	m.proxies.Range(func(_, value any) bool {
+		value.(*ProxyTraffic).Upload.Store(0)
+		value.(*ProxyTraffic).Download.Store(0)
+		return true
+	})
+	m.rules.Range(func(_, value any) bool {
+		value.(*Traffic).Upload.Store(0)
+		value.(*Traffic).Download.Store(0)
+		return true
+	})
 }
 
 func (m *Manager) handle() {
@@ -88,7 +266,9 @@ func (m *Manager) handle() {
 }
 
 type Snapshot struct {
-	DownloadTotal int64     `json:"downloadTotal"`
-	UploadTotal   int64     `json:"uploadTotal"`
-	Connections   []tracker `json:"connections"`
+	DownloadTotal int64                    `json:"downloadTotal"`
+	UploadTotal   int64                    `json:"uploadTotal"`
+	Connections   []tracker                `json:"connections"`
+	Proxies       map[string]*ProxyTraffic `json:"proxies"`
+	Rules         map[string]*Traffic      `json:"rules"`
 }
@@ -0,0 +1,135 @@
+package statistic
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+)
+
+func TestManagerTraffic(t *testing.T) {
+	m := newManager()
+
+	newConn := func(metadata *M.Metadata) net.Conn {
+		c1, c2 := net.Pipe()
+		go func() {
+			buf := make([]byte, 16)
+			n, _ := c2.Read(buf)
+			c2.Write(buf[:n*2])
+			c2.Close()
+		}()
+		return NewTCPTracker(c1, metadata, m)
+	}
+
+	for _, metadata := range []*M.Metadata{
+		{Network: M.TCP, Proxy: "hk", ProxyProto: "socks5", ProxyAddress: "10.0.0.2:1080", Rule: "MATCH"},
+		{Network: M.TCP, Proxy: "hk", ProxyProto: "socks5", ProxyAddress: "10.0.0.2:1080", Rule: "DOMAIN-SUFFIX,lan"},
+		{Network: M.TCP, Proxy: "DIRECT"},
+	} {
+		c := newConn(metadata)
+		_, err := c.Write([]byte("ping"))
+		require.NoError(t, err)
+		_, err = c.Read(make([]byte, 16))
+		require.NoError(t, err)
+		c.Close()
+	}
+
+	s := m.Snapshot()
+	require.Len(t, s.Proxies, 2)
+	hk := s.Proxies["hk"]
+	assert.Equal(t, "socks5", hk.Proto)
+	assert.Equal(t, "10.0.0.2:1080", hk.Address)
+	assert.Equal(t, int64(8), hk.Upload.Load())
+	assert.Equal(t, int64(16), hk.Download.Load())
+	assert.Equal(t, int64(4), s.Proxies["DIRECT"].Upload.Load())
+	require.Len(t, s.Rules, 2)
+	assert.Equal(t, int64(8), s.Rules["MATCH"].Download.Load())
+	assert.Empty(t, s.Connections)
+
+	b, err := json.Marshal(s)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), `"hk":{"proto":"socks5","address":"10.0.0.2:1080","upload":8,"download":16}`)
+
+	// The proxy replaced with the same name keeps its totals.
+	c := newConn(&M.Metadata{Network: M.TCP, Proxy: "hk", ProxyProto: "http", ProxyAddress: "10.0.0.3:8080"})
+	_, err = c.Write([]byte("ping"))
+	require.NoError(t, err)
+	c.Close()
+	hk = m.Snapshot().Proxies["hk"]
+	assert.Equal(t, "http", hk.Proto)
+	assert.Equal(t, "10.0.0.3:8080", hk.Address)
+	assert.Equal(t, int64(12), hk.Upload.Load())
+
+	m.RetainProxies([]string{"hk"})
+	assert.Len(t, m.Snapshot().Proxies, 1)
+
+	m.ResetStatistic()
+	assert.Zero(t, m.Snapshot().Proxies["hk"].Upload.Load())
+}
+
+func TestManagerHistory(t *testing.T) {
+	m := newManager()
+	m.SetHistorySize(2)
+
+	start := time.Now()
+	m.Failed(&M.Metadata{
+		SrcIP: netip.MustParseAddr("10.0.0.1"),
+		DstIP: netip.MustParseAddr("1.1.1.1"),
+	}, start, errors.New("refused"))
+
+	c1, c2 := net.Pipe()
+	c := NewTCPTracker(c1, &M.Metadata{
+		SrcIP: netip.MustParseAddr("10.0.0.2"),
+		DstIP: netip.MustParseAddr("8.8.8.8"),
+		Host:  "dns.google",
+	}, m)
+	c2.Close()
+	_, err := c.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+	c.Close()
+	c.Close()
+
+	closed := m.Closed(ClosedFilter{})
+	require.Len(t, closed, 2)
+	assert.Equal(t, ReasonEOF, closed[0].Reason)
+	assert.Equal(t, "dial: refused", closed[1].Reason)
+
+	for _, tt := range []struct {
+		filter ClosedFilter
+		want   int
+	}{
+		{ClosedFilter{Source: netip.MustParsePrefix("10.0.0.0/24")}, 2},
+		{ClosedFilter{Source: netip.MustParsePrefix("10.0.0.1/32")}, 1},
+		{ClosedFilter{Destination: netip.MustParsePrefix("8.8.0.0/16")}, 1},
+		{ClosedFilter{Host: "google"}, 1},
+		{ClosedFilter{Host: "oogle"}, 0},
+		{ClosedFilter{Since: time.Now().Add(time.Minute)}, 0},
+		{ClosedFilter{Until: start.Add(-time.Minute)}, 0},
+		{ClosedFilter{Since: start, Until: time.Now()}, 2},
+	} {
+		assert.Len(t, m.Closed(tt.filter), tt.want, "%+v", tt.filter)
+	}
+
+	m.Failed(&M.Metadata{}, start, errors.New("third"))
+	closed = m.Closed(ClosedFilter{})
+	require.Len(t, closed, 2)
+	assert.Equal(t, "dial: third", closed[0].Reason)
+	assert.Equal(t, ReasonEOF, closed[1].Reason)
+
+	m.SetHistorySize(1)
+	closed = m.Closed(ClosedFilter{})
+	require.Len(t, closed, 1)
+	assert.Equal(t, "dial: third", closed[0].Reason)
+
+	m.SetHistorySize(0)
+	m.Failed(&M.Metadata{}, start, errors.New("dropped"))
+	assert.Empty(t, m.Closed(ClosedFilter{}))
+}
@@ -3,6 +3,7 @@ package statistic
 import (
 	"errors"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -14,6 +15,8 @@ import (
 type tracker interface {
 	ID() string
 	Close() error
+
+	closed() *ClosedConnection
 }
 
 type trackerInfo struct {
@@ -22,6 +25,79 @@ type trackerInfo struct {
 	Metadata      *M.Metadata   `json:"metadata"`
 	UploadTotal   *atomic.Int64 `json:"upload"`
 	DownloadTotal *atomic.Int64 `json:"download"`
+
+	// proxy and rule are the running totals shared by the flows of
+	// the same proxy and rule.
+	proxy *ProxyTraffic
+	rule  *Traffic
+
+	// err is the first error seen on the connection.
+	mu  sync.Mutex
+	err error
+}
+
+func newTrackerInfo(metadata *M.Metadata, manager *Manager) *trackerInfo {
+	id, _ := uuid.NewRandom()
+	proxy, rule := manager.counters(metadata)
+	return &trackerInfo{
+		UUID:          id,
+		Start:         time.Now(),
+		Metadata:      metadata,
+		UploadTotal:   atomic.NewInt64(0),
+		DownloadTotal: atomic.NewInt64(0),
+		proxy:         proxy,
+		rule:          rule,
+	}
+}
+
+// fail records err as the close reason if it's the first error.
+func (ti *trackerInfo) fail(err error) {
+	if err == nil {
+		return
+	}
+	ti.mu.Lock()
+	if ti.err == nil {
+		ti.err = err
+	}
+	ti.mu.Unlock()
+}
+
+func (ti *trackerInfo) closed() *ClosedConnection {
+	ti.mu.Lock()
+	err := ti.err
+	ti.mu.Unlock()
+
+	end := time.Now()
+	return &ClosedConnection{
+		ID:       ti.UUID,
+		Metadata: ti.Metadata,
+		Start:    ti.Start,
+		End:      end,
+		Duration: end.Sub(ti.Start).Milliseconds(),
+		Upload:   ti.UploadTotal.Load(),
+		Download: ti.DownloadTotal.Load(),
+		Reason:   reasonOf(err),
+	}
+}
+
+func (ti *trackerInfo) addUpload(n int64) {
+	ti.UploadTotal.Add(n)
+	if ti.proxy != nil {
+		ti.proxy.Upload.Add(n)
+	}
+	if ti.rule != nil {
+		ti.rule.Upload.Add(n)
+	}
+}
+
+func (ti *trackerInfo) addDownload(n int64) {
+	ti.DownloadTotal.Add(n)
+	if ti.proxy != nil {
+		ti.proxy.Download.Add(n)
+	}
+	if ti.rule != nil {
+		ti.rule.Download.Add(n)
+	}
 }
 
 type tcpTracker struct {
@@ -32,18 +108,10 @@ type tcpTracker struct {
 }
 
 func NewTCPTracker(conn net.Conn, metadata *M.Metadata, manager *Manager) net.Conn {
-	id, _ := uuid.NewRandom()
-
 	tt := &tcpTracker{
-		Conn:    conn,
-		manager: manager,
-		trackerInfo: &trackerInfo{
-			UUID:          id,
-			Start:         time.Now(),
-			Metadata:      metadata,
-			UploadTotal:   atomic.NewInt64(0),
-			DownloadTotal: atomic.NewInt64(0),
-		},
+		Conn:        conn,
+		manager:     manager,
+		trackerInfo: newTrackerInfo(metadata, manager),
 	}
 
 	manager.Join(tt)
@@ -56,17 +124,19 @@ func (tt *tcpTracker) ID() string {
 
 func (tt *tcpTracker) Read(b []byte) (int, error) {
 	n, err := tt.Conn.Read(b)
+	tt.fail(err)
 	download := int64(n)
 	tt.manager.PushDownloaded(download)
-	tt.DownloadTotal.Add(download)
+	tt.addDownload(download)
 	return n, err
 }
 
 func (tt *tcpTracker) Write(b []byte) (int, error) {
 	n, err := tt.Conn.Write(b)
+	tt.fail(err)
 	upload := int64(n)
 	tt.manager.PushUploaded(upload)
-	tt.UploadTotal.Add(upload)
+	tt.addUpload(upload)
 	return n, err
 }
 
@@ -97,18 +167,10 @@ type udpTracker struct {
 }
 
 func NewUDPTracker(conn net.PacketConn, metadata *M.Metadata, manager *Manager) net.PacketConn {
-	id, _ := uuid.NewRandom()
-
 	ut := &udpTracker{
-		PacketConn: conn,
-		manager:    manager,
-		trackerInfo: &trackerInfo{
-			UUID:          id,
-			Start:         time.Now(),
-			Metadata:      metadata,
-			UploadTotal:   atomic.NewInt64(0),
-			DownloadTotal: atomic.NewInt64(0),
-		},
+		PacketConn:  conn,
+		manager:     manager,
+		trackerInfo: newTrackerInfo(metadata, manager),
 	}
 
 	manager.Join(ut)
@@ -121,17 +183,19 @@ func (ut *udpTracker) ID() string {
 
 func (ut *udpTracker) ReadFrom(b []byte) (int, net.Addr, error) {
 	n, addr, err := ut.PacketConn.ReadFrom(b)
+	ut.fail(err)
 	download := int64(n)
 	ut.manager.PushDownloaded(download)
-	ut.DownloadTotal.Add(download)
+	ut.addDownload(download)
 	return n, addr, err
 }
 
 func (ut *udpTracker) WriteTo(b []byte, addr net.Addr) (int, error) {
 	n, err := ut.PacketConn.WriteTo(b, addr)
+	ut.fail(err)
 	upload := int64(n)
 	ut.manager.PushUploaded(upload)
-	ut.UploadTotal.Add(upload)
+	ut.addUpload(upload)
 	return n, err
 }
 
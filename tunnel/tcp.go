@@ -26,19 +26,60 @@ func (t *Tunnel) handleTCPConn(originConn adapter.TCPConn) {
 		DstPort: id.LocalPort,
 	}
 
+	if err := t.restoreHost(metadata); err != nil {
+		log.Warnf("[TCP] restore host %s: %v", metadata.DestinationAddress(), err)
+		return
+	}
+
+	// The handshake of pending conn is completed once dialed.
+	pending, _ := originConn.(adapter.PendingTCPConn)
+
+	var peeked []byte
+	if timeout := t.sniffTimeout.Load(); timeout > 0 {
+		if pending != nil {
+			if err := pending.Accept(); err != nil {
+				log.Debugf("[TCP] accept %s: %v", metadata.SourceAddress(), err)
+				return
+			}
+			pending = nil
+		}
+		peeked = sniffTCP(originConn, metadata, timeout)
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), tcpConnectTimeout)
 	defer cancel()
 
+	start := time.Now()
 	remoteConn, err := t.Dialer().DialContext(ctx, metadata)
 	if err != nil {
 		log.Warnf("[TCP] dial %s: %v", metadata.DestinationAddress(), err)
+		t.manager.Failed(metadata, start, err)
+		if pending != nil {
+			pending.Reject(adapter.Action(t.deferReject.Load()))
+		}
 		return
 	}
+	if pending != nil {
+		if err = pending.Accept(); err != nil {
+			log.Debugf("[TCP] accept %s: %v", metadata.SourceAddress(), err)
+			remoteConn.Close()
+			return
+		}
+	}
 	metadata.MidIP, metadata.MidPort = parseNetAddr(remoteConn.LocalAddr())
 
 	remoteConn = statistic.NewTCPTracker(remoteConn, metadata, t.manager)
+	remoteConn = t.limiter.Conn(remoteConn, trackerID(remoteConn), metadata)
 	defer remoteConn.Close()
 
+	// Replay the sniffed bytes to remote.
+	if len(peeked) > 0 {
+		if _, err = remoteConn.Write(peeked); err != nil {
+			log.Warnf("[TCP] write to %s: %v", metadata.DestinationAddress(), err)
+			return
+		}
+	}
+
 	log.Infof("[TCP] %s <-> %s", metadata.SourceAddress(), metadata.DestinationAddress())
 	pipe(originConn, remoteConn)
 }
@@ -8,7 +8,12 @@ import (
 	"go.uber.org/atomic"
 
 	"github.com/xjasonlyu/tun2socks/v2/core/adapter"
+	D "github.com/xjasonlyu/tun2socks/v2/dialer"
 	"github.com/xjasonlyu/tun2socks/v2/proxy"
+	"github.com/xjasonlyu/tun2socks/v2/tunnel/acl"
+	"github.com/xjasonlyu/tun2socks/v2/tunnel/admission"
+	"github.com/xjasonlyu/tun2socks/v2/tunnel/ping"
+	"github.com/xjasonlyu/tun2socks/v2/tunnel/ratelimit"
 	"github.com/xjasonlyu/tun2socks/v2/tunnel/statistic"
 )
 
@@ -31,26 +36,66 @@ type Tunnel struct {
 	// UDP session timeout.
 	udpTimeout *atomic.Duration
 
+	// Timeout of sniffing the first client bytes, or
+	// zero if sniffing is disabled.
+	sniffTimeout *atomic.Duration
+
+	// Action to reject TCP connections failed to dial with, if their
+	// handshakes are deferred until dialed, or ActionAccept if not.
+	deferReject *atomic.Uint32
+
+	// UDPNAT behavior of new UDP sessions, and the mappings of
+	// sources in cone NAT modes.
+	udpNAT *atomic.Uint32
+	nat    *natTable
+
 	// Internal proxy.Dialer for Tunnel.
 	dialerMu sync.RWMutex
 	dialer   proxy.Dialer
 
+	// Optional DNSHandler for hijacked DNS queries.
+	dnsMu      sync.RWMutex
+	dnsHandler DNSHandler
+	dnsPending chan struct{}
+
 	// Where the Tunnel statistics are sent to.
 	manager *statistic.Manager
 
+	// Bandwidth limits of tunneled connections.
+	limiter *ratelimit.Limiter
+
+	// Caps of concurrent connections and sessions.
+	admission *admission.Controller
+
+	// Destinations allowed for new connections and sessions.
+	acl *acl.ACL
+
+	// Handler of ICMP echo requests.
+	ping *ping.Handler
+
 	procOnce   sync.Once
 	procCancel context.CancelFunc
 }
 
 func New(dialer proxy.Dialer, manager *statistic.Manager) *Tunnel {
-	return &Tunnel{
-		tcpQueue:   make(chan adapter.TCPConn),
-		udpQueue:   make(chan adapter.UDPConn),
-		udpTimeout: atomic.NewDuration(udpSessionTimeout),
-		dialer:     dialer,
-		manager:    manager,
-		procCancel: func() { /* nop */ },
+	t := &Tunnel{
+		tcpQueue:     make(chan adapter.TCPConn),
+		udpQueue:     make(chan adapter.UDPConn),
+		udpTimeout:   atomic.NewDuration(udpSessionTimeout),
+		sniffTimeout: atomic.NewDuration(0),
+		deferReject:  atomic.NewUint32(uint32(adapter.ActionAccept)),
+		udpNAT:       atomic.NewUint32(uint32(NATSymmetric)),
+		nat:          newNATTable(),
+		dialer:       dialer,
+		dnsPending:   make(chan struct{}, maxDNSPending),
+		manager:      manager,
+		limiter:      ratelimit.New(),
+		admission:    admission.New(),
+		acl:          acl.New(),
+		procCancel:   func() { /* nop */ },
 	}
+	t.ping = ping.New(t.Dialer, D.DefaultDialer.ListenICMP, t.acl.Check)
+	return t
 }
 
 // TCPIn return fan-in TCP queue.
@@ -75,9 +120,9 @@ func (t *Tunnel) process(ctx context.Context) {
 	for {
 		select {
 		case conn := <-t.tcpQueue:
-			go t.handleTCPConn(conn)
+			t.admitTCPConn(conn)
 		case conn := <-t.udpQueue:
-			go t.handleUDPConn(conn)
+			t.admitUDPConn(conn)
 		case <-ctx.Done():
 			return
 		}
@@ -111,6 +156,78 @@ func (t *Tunnel) SetDialer(dialer proxy.Dialer) {
 	t.dialerMu.Unlock()
 }
 
+func (t *Tunnel) DNSHandler() DNSHandler {
+	t.dnsMu.RLock()
+	h := t.dnsHandler
+	t.dnsMu.RUnlock()
+	return h
+}
+
+// SetDNSHandler sets the DNSHandler to hijack DNS queries, or
+// disables hijacking if h is nil.
+func (t *Tunnel) SetDNSHandler(h DNSHandler) {
+	t.dnsMu.Lock()
+	t.dnsHandler = h
+	t.dnsMu.Unlock()
+}
+
+// SetUDPTimeout sets the UDP session timeout, or restores the
+// default timeout if timeout is zero.
 func (t *Tunnel) SetUDPTimeout(timeout time.Duration) {
+	if timeout == 0 {
+		timeout = udpSessionTimeout
+	}
 	t.udpTimeout.Store(timeout)
 }
+
+// SetSniffTimeout enables sniffing hostnames from the first client
+// bytes within timeout, or disables sniffing if timeout is zero.
+func (t *Tunnel) SetSniffTimeout(timeout time.Duration) {
+	t.sniffTimeout.Store(timeout)
+}
+
+// SetDeferredHandshake defers the handshakes of TCP connections until
+// their remote conns are dialed if enable, and rejects those failed to
+// dial with reject, i.e. adapter.ActionReset or ActionUnreachable.
+// Connections are not deferred while sniffing is enabled, as it needs
+// the first client bytes before dialing.
+func (t *Tunnel) SetDeferredHandshake(enable bool, reject adapter.Action) {
+	if !enable {
+		reject = adapter.ActionAccept
+	}
+	t.deferReject.Store(uint32(reject))
+}
+
+// SetUDPNAT sets the UDPNAT behavior of new UDP sessions. The sessions
+// of existing mappings keep the behavior they're created with.
+func (t *Tunnel) SetUDPNAT(nat UDPNAT) {
+	t.udpNAT.Store(uint32(nat))
+}
+
+// RateLimiter returns the bandwidth limiter of tunneled connections.
+func (t *Tunnel) RateLimiter() *ratelimit.Limiter {
+	return t.limiter
+}
+
+// Admission returns the admission control of tunneled connections.
+func (t *Tunnel) Admission() *admission.Controller {
+	return t.admission
+}
+
+// ACL returns the access control list of tunneled destinations.
+func (t *Tunnel) ACL() *acl.ACL {
+	return t.acl
+}
+
+// Ping returns the handler of ICMP echo requests.
+func (t *Tunnel) Ping() *ping.Handler {
+	return t.ping
+}
+
+// trackerID returns the ID of conn tracked by statistic.Manager.
+func trackerID(conn any) string {
+	if t, ok := conn.(interface{ ID() string }); ok {
+		return t.ID()
+	}
+	return ""
+}
@@ -10,10 +10,10 @@ import (
 	"github.com/xjasonlyu/tun2socks/v2/core/adapter"
 	"github.com/xjasonlyu/tun2socks/v2/log"
 	M "github.com/xjasonlyu/tun2socks/v2/metadata"
+	"github.com/xjasonlyu/tun2socks/v2/proxy"
 	"github.com/xjasonlyu/tun2socks/v2/tunnel/statistic"
 )
 
-// TODO: Port Restricted NAT support.
 func (t *Tunnel) handleUDPConn(uc adapter.UDPConn) {
 	defer uc.Close()
 
@@ -26,28 +26,74 @@ func (t *Tunnel) handleUDPConn(uc adapter.UDPConn) {
 		DstPort: id.LocalPort,
 	}
 
-	pc, err := t.Dialer().DialUDP(metadata)
+	if h := t.DNSHandler(); h != nil && metadata.DstPort == dnsPort {
+		handleDNS(uc, h, metadata, t.udpTimeout.Load(), t.dnsPending)
+		return
+	}
+
+	if err := t.restoreHost(metadata); err != nil {
+		log.Warnf("[UDP] restore host %s: %v", metadata.DestinationAddress(), err)
+		return
+	}
+
+	var peeked [][]byte
+	if timeout := t.sniffTimeout.Load(); timeout > 0 && metadata.DstPort == quicPort {
+		peeked = sniffUDP(uc, metadata, timeout)
+	}
+
+	if nat := UDPNAT(t.udpNAT.Load()); nat != NATSymmetric {
+		t.handleConeUDPConn(uc, metadata, peeked, nat)
+		return
+	}
+	t.handleSymmetricUDPConn(uc, metadata, peeked, t.Dialer())
+}
+
+// router is implemented by the dialers routing the sessions to proxies
+// by rules, i.e. rule.Router.
+type router interface {
+	Route(*M.Metadata) (proxy.Proxy, error)
+}
+
+// handleSymmetricUDPConn relays uc through a remote conn of its own,
+// which is dialed by d.
+func (t *Tunnel) handleSymmetricUDPConn(uc adapter.UDPConn, metadata *M.Metadata, peeked [][]byte, d proxy.Dialer) {
+	start := time.Now()
+	pc, err := d.DialUDP(metadata)
 	if err != nil {
 		log.Warnf("[UDP] dial %s: %v", metadata.DestinationAddress(), err)
+		t.manager.Failed(metadata, start, err)
 		return
 	}
 	metadata.MidIP, metadata.MidPort = parseNetAddr(pc.LocalAddr())
 
 	pc = statistic.NewUDPTracker(pc, metadata, t.manager)
+	pc = t.limiter.PacketConn(pc, trackerID(pc), metadata)
 	defer pc.Close()
 
-	var remote net.Addr
-	if udpAddr := metadata.UDPAddr(); udpAddr != nil {
-		remote = udpAddr
-	} else {
-		remote = metadata.Addr()
-	}
+	remote := udpRemote(metadata)
 	pc = newSymmetricNATPacketConn(pc, metadata)
 
+	// Replay the sniffed datagrams to remote.
+	for _, b := range peeked {
+		if _, err = pc.WriteTo(b, remote); err != nil {
+			log.Warnf("[UDP] write to %s: %v", metadata.DestinationAddress(), err)
+			return
+		}
+	}
+
 	log.Infof("[UDP] %s <-> %s", metadata.SourceAddress(), metadata.DestinationAddress())
 	pipePacket(uc, pc, remote, t.udpTimeout.Load())
 }
 
+// udpRemote returns the address to send the datagrams of metadata to,
+// which is the hostname if any.
+func udpRemote(metadata *M.Metadata) net.Addr {
+	if udpAddr := metadata.UDPAddr(); udpAddr != nil && metadata.Host == "" {
+		return udpAddr
+	}
+	return metadata.Addr()
+}
+
 func pipePacket(origin, remote net.PacketConn, to net.Addr, timeout time.Duration) {
 	wg := sync.WaitGroup{}
 	wg.Add(2)
@@ -62,6 +108,9 @@ func unidirectionalPacketStream(dst, src net.PacketConn, to net.Addr, dir string
 	defer wg.Done()
 	if err := copyPacketData(dst, src, to, timeout); err != nil {
 		log.Debugf("[UDP] copy data for %s: %v", dir, err)
+		// Stop the other direction as well, e.g. once the session
+		// is closed by eviction.
+		dst.SetReadDeadline(time.Now())
 	}
 }
 
@@ -91,6 +140,11 @@ type symmetricNATPacketConn struct {
 	net.PacketConn
 	src string
 	dst string
+
+	// host is set if the destination is a hostname, of which the
+	// resolved address is unknown, so only the port is checked.
+	host    bool
+	dstPort uint16
 }
 
 func newSymmetricNATPacketConn(pc net.PacketConn, metadata *M.Metadata) *symmetricNATPacketConn {
@@ -98,6 +152,8 @@ func newSymmetricNATPacketConn(pc net.PacketConn, metadata *M.Metadata) *symmetr
 		PacketConn: pc,
 		src:        metadata.SourceAddress(),
 		dst:        metadata.DestinationAddress(),
+		host:       metadata.Host != "",
+		dstPort:    metadata.DstPort,
 	}
 }
 
@@ -105,7 +161,12 @@ func (pc *symmetricNATPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
 	for {
 		n, from, err := pc.PacketConn.ReadFrom(p)
 
-		if from != nil && from.String() != pc.dst {
+		if from != nil && pc.host {
+			if _, port := parseNetAddr(from); port != pc.dstPort {
+				log.Warnf("[UDP] symmetric NAT %s->%s: drop packet from %s", pc.src, pc.dst, from)
+				continue
+			}
+		} else if from != nil && from.String() != pc.dst {
 			log.Warnf("[UDP] symmetric NAT %s->%s: drop packet from %s", pc.src, pc.dst, from)
 			continue
 		}